@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/osbuild/images/pkg/cloud"
+	"github.com/osbuild/images/pkg/platform"
+)
+
+// awsEC2Client is the subset of the EC2 API that is needed to find,
+// copy, share, list and delete the AMIs that image-builder registered
+type awsEC2Client interface {
+	ec2.DescribeImagesAPIClient
+	CopyImage(ctx context.Context, params *ec2.CopyImageInput, optFns ...func(*ec2.Options)) (*ec2.CopyImageOutput, error)
+	ModifyImageAttribute(ctx context.Context, params *ec2.ModifyImageAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifyImageAttributeOutput, error)
+	DeregisterImage(ctx context.Context, params *ec2.DeregisterImageInput, optFns ...func(*ec2.Options)) (*ec2.DeregisterImageOutput, error)
+	DeleteSnapshot(ctx context.Context, params *ec2.DeleteSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSnapshotOutput, error)
+	DescribeSnapshots(ctx context.Context, params *ec2.DescribeSnapshotsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSnapshotsOutput, error)
+}
+
+// awsImageWaitDelay is the minimum delay between two checks if an AMI
+// is available, mocked in tests
+var awsImageWaitDelay = 15 * time.Second
+
+// awsImageWaitTimeout is how long to wait for an AMI (or a copy) to
+// become available, copies of big images can take a while
+const awsImageWaitTimeout = 90 * time.Minute
+
+var awsAccountIDRe = regexp.MustCompile(`^[0-9]{12}$`)
+
+// awsBootModeFromString parses the EC2 names of the boot modes
+func awsBootModeFromString(s string) (platform.BootMode, error) {
+	switch s {
+	case "legacy-bios":
+		return platform.BOOT_LEGACY, nil
+	case "uefi":
+		return platform.BOOT_UEFI, nil
+	case "uefi-preferred":
+		return platform.BOOT_HYBRID, nil
+	default:
+		return platform.BOOT_NONE, fmt.Errorf("unsupported boot mode %q, use legacy-bios, uefi or uefi-preferred", s)
+	}
+}
+
+// awsNewEC2Client is mocked in tests
+var awsNewEC2Client = func(region, profile string) (awsEC2Client, error) {
+	loadOpts := []func(*config.LoadOptions) error{
+		config.WithRegion(region),
+	}
+	if profile != "" {
+		loadOpts = append(loadOpts, config.WithSharedConfigProfile(profile))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load aws configuration: %w", err)
+	}
+	return ec2.NewFromConfig(cfg), nil
+}
+
+// awsImageManager implements "cloud list" and "cloud delete" for AMIs,
+// the EBS snapshots of an AMI are deleted together with it
+type awsImageManager struct {
+	client awsEC2Client
+}
+
+func (am *awsImageManager) listImages(ctx context.Context) ([]cloudImage, error) {
+	var result []cloudImage
+	paginator := ec2.NewDescribeImagesPaginator(am.client, &ec2.DescribeImagesInput{
+		Owners: []string{"self"},
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("tag:" + cloudTagCreatedBy),
+				Values: []string{cloudCreatedByValue},
+			},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("cannot list images: %w", err)
+		}
+		for _, img := range page.Images {
+			result = append(result, cloudImageFromAMI(&img))
+		}
+	}
+	return result, nil
+}
+
+func cloudImageFromAMI(img *types.Image) cloudImage {
+	ci := cloudImage{
+		ID:   aws.ToString(img.ImageId),
+		Name: aws.ToString(img.Name),
+		Arch: string(img.Architecture),
+	}
+	// an unparsable date sorts as the oldest image
+	ci.Created, _ = time.Parse(time.RFC3339, aws.ToString(img.CreationDate))
+	for _, tag := range img.Tags {
+		switch aws.ToString(tag.Key) {
+		case cloudTagDistro:
+			ci.Distro = aws.ToString(tag.Value)
+		case cloudTagArch:
+			ci.Arch = aws.ToString(tag.Value)
+		case cloudTagImageType:
+			ci.ImageType = aws.ToString(tag.Value)
+		}
+	}
+	for _, bdm := range img.BlockDeviceMappings {
+		if bdm.Ebs != nil && bdm.Ebs.SnapshotId != nil {
+			ci.Snapshots = append(ci.Snapshots, *bdm.Ebs.SnapshotId)
+		}
+	}
+	return ci
+}
+
+// awsFindImageByName returns the AMI with the given name that is owned
+// by the account or nil if there is none
+func awsFindImageByName(ctx context.Context, client awsEC2Client, name string) (*types.Image, error) {
+	out, err := client.DescribeImages(ctx, &ec2.DescribeImagesInput{
+		Owners: []string{"self"},
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("name"),
+				Values: []string{name},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot look up AMI %q: %w", name, err)
+	}
+	if len(out.Images) == 0 {
+		return nil, nil
+	}
+	return &out.Images[0], nil
+}
+
+func (am *awsImageManager) deleteImage(ctx context.Context, img *cloudImage, status io.Writer) error {
+	if _, err := am.client.DeregisterImage(ctx, &ec2.DeregisterImageInput{
+		ImageId: aws.String(img.ID),
+	}); err != nil {
+		return fmt.Errorf("cannot deregister image: %w", err)
+	}
+	// the image is gone, try to delete all of its snapshots so that
+	// none of them is left behind unnoticed
+	var errs []error
+	for _, snapshotID := range img.Snapshots {
+		if _, err := am.client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{
+			SnapshotId: aws.String(snapshotID),
+		}); err != nil {
+			errs = append(errs, fmt.Errorf("cannot delete snapshot %s: %w", snapshotID, err))
+			continue
+		}
+		fmt.Fprintf(status, "Deleted snapshot %s\n", snapshotID)
+	}
+	return errors.Join(errs...)
+}
+
+// awsAMIUploader registers the AMI with the uploader of the images
+// library and then copies it into further regions and shares the AMI
+// and its copies with other accounts
+type awsAMIUploader struct {
+	cloud.Uploader
+	amiName       string
+	region        string
+	profile       string
+	copyToRegions []string
+	shareWith     []string
+
+	// amiIDs are the ids of the AMI and its copies by region
+	amiIDs map[string]string
+}
+
+func (au *awsAMIUploader) UploadAndRegister(r io.Reader, uploadSize uint64, status io.Writer) error {
+	au.amiIDs = nil
+	started := time.Now()
+	uploadErr := au.Uploader.UploadAndRegister(r, uploadSize, status)
+
+	ctx := context.Background()
+	client, err := awsNewEC2Client(au.region, au.profile)
+	if err != nil {
+		if uploadErr != nil {
+			return uploadErr
+		}
+		return registeredUploadError(err)
+	}
+	// AMI names are unique in a region, the name finds the AMI that
+	// the upload registered
+	img, err := awsFindImageByName(ctx, client, au.amiName)
+	if uploadErr != nil {
+		if err == nil && img != nil {
+			// the AMI is registered, e.g. only deleting the S3
+			// object failed
+			au.amiIDs = map[string]string{au.region: aws.ToString(img.ImageId)}
+			return registeredUploadError(uploadErr)
+		}
+		au.deleteImportedSnapshots(ctx, client, started, status)
+		return uploadErr
+	}
+	if err != nil {
+		return registeredUploadError(err)
+	}
+	if img == nil {
+		return registeredUploadError(fmt.Errorf("cannot find the registered AMI %q", au.amiName))
+	}
+	amiID := aws.ToString(img.ImageId)
+	au.amiIDs = map[string]string{au.region: amiID}
+	if len(au.copyToRegions) == 0 && len(au.shareWith) == 0 {
+		return nil
+	}
+	return registeredUploadError(au.distribute(ctx, client, amiID, status))
+}
+
+// deleteImportedSnapshots deletes the snapshots that a failed upload
+// imported for the AMI, the images library tags them with the name
+// of the AMI
+func (au *awsAMIUploader) deleteImportedSnapshots(ctx context.Context, client awsEC2Client, since time.Time, status io.Writer) {
+	out, err := client.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{
+		OwnerIds: []string{"self"},
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("tag:Name"),
+				Values: []string{au.amiName},
+			},
+		},
+	})
+	if err != nil {
+		fmt.Fprintf(status, "WARNING: cannot look for the snapshots of the failed upload: %v\n", err)
+		return
+	}
+	for _, snapshot := range out.Snapshots {
+		// older snapshots with the same name are not from this upload
+		if snapshot.StartTime == nil || snapshot.StartTime.Before(since) {
+			continue
+		}
+		snapshotID := aws.ToString(snapshot.SnapshotId)
+		if _, err := client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{
+			SnapshotId: aws.String(snapshotID),
+		}); err != nil {
+			fmt.Fprintf(status, "WARNING: cannot delete snapshot %s of the failed upload: %v\n", snapshotID, err)
+			continue
+		}
+		fmt.Fprintf(status, "Deleted snapshot %s of the failed upload\n", snapshotID)
+	}
+}
+
+// remoteID implements remoteIDUploader
+func (au *awsAMIUploader) remoteID() string {
+	return au.amiIDs[au.region]
+}
+
+// regionalIDs implements regionalIDUploader, the copies are included
+// as soon as they are created
+func (au *awsAMIUploader) regionalIDs() map[string]string {
+	return maps.Clone(au.amiIDs)
+}
+
+// acceptsImageFormat implements imageFormatUploader, the AMI is
+// registered from a snapshot that is imported from a raw disk
+func (au *awsAMIUploader) acceptsImageFormat(f imageFormat) bool {
+	return f == imageFormatRaw
+}
+
+// distribute copies the AMI into all regions, waits for the copies and
+// then shares all of them, a copy keeps the tags but not the launch
+// permissions of the source AMI
+func (au *awsAMIUploader) distribute(ctx context.Context, client awsEC2Client, amiID string, status io.Writer) error {
+	// an AMI can only be copied once it is available
+	if err := awsWaitForImage(ctx, client, au.region, amiID, status); err != nil {
+		return err
+	}
+
+	type regionalAMI struct {
+		region string
+		id     string
+		client awsEC2Client
+	}
+	amis := []regionalAMI{{au.region, amiID, client}}
+	for _, region := range au.copyToRegions {
+		regionClient, err := awsNewEC2Client(region, au.profile)
+		if err != nil {
+			return err
+		}
+		out, err := regionClient.CopyImage(ctx, &ec2.CopyImageInput{
+			Name:          aws.String(au.amiName),
+			SourceImageId: aws.String(amiID),
+			SourceRegion:  aws.String(au.region),
+			CopyImageTags: aws.Bool(true),
+		})
+		if err != nil {
+			return fmt.Errorf("cannot copy AMI %s to %s: %w", amiID, region, err)
+		}
+		copyID := aws.ToString(out.ImageId)
+		au.amiIDs[region] = copyID
+		fmt.Fprintf(status, "Copying AMI %s to %s as %s\n", amiID, region, copyID)
+		amis = append(amis, regionalAMI{region, copyID, regionClient})
+	}
+	for _, ami := range amis[1:] {
+		if err := awsWaitForImage(ctx, ami.client, ami.region, ami.id, status); err != nil {
+			return err
+		}
+	}
+
+	if len(au.shareWith) == 0 {
+		return nil
+	}
+	var permissions []types.LaunchPermission
+	for _, account := range au.shareWith {
+		permissions = append(permissions, types.LaunchPermission{UserId: aws.String(account)})
+	}
+	for _, ami := range amis {
+		if _, err := ami.client.ModifyImageAttribute(ctx, &ec2.ModifyImageAttributeInput{
+			ImageId: aws.String(ami.id),
+			LaunchPermission: &types.LaunchPermissionModifications{
+				Add: permissions,
+			},
+		}); err != nil {
+			return fmt.Errorf("cannot share AMI %s in %s: %w", ami.id, ami.region, err)
+		}
+		fmt.Fprintf(status, "Shared AMI %s in %s with %s\n", ami.id, ami.region, strings.Join(au.shareWith, ", "))
+	}
+	return nil
+}
+
+func awsWaitForImage(ctx context.Context, client awsEC2Client, region, amiID string, status io.Writer) error {
+	fmt.Fprintf(status, "Waiting for AMI %s in %s to become available\n", amiID, region)
+	waiter := ec2.NewImageAvailableWaiter(client, func(o *ec2.ImageAvailableWaiterOptions) {
+		o.MinDelay = awsImageWaitDelay
+		o.MaxDelay = 8 * awsImageWaitDelay
+	})
+	if err := waiter.Wait(ctx, &ec2.DescribeImagesInput{ImageIds: []string{amiID}}, awsImageWaitTimeout); err != nil {
+		return fmt.Errorf("AMI %s in %s did not become available: %w", amiID, region, err)
+	}
+	return nil
+}
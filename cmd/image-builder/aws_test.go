@@ -0,0 +1,435 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/osbuild/images/pkg/cloud"
+	"github.com/osbuild/images/pkg/cloud/awscloud"
+	"github.com/osbuild/images/pkg/platform"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+)
+
+type fakeEC2Image struct {
+	region string
+	name   string
+	// pendingPolls is the number of DescribeImages calls that still
+	// report the image as pending
+	pendingPolls      int
+	copiedTags        bool
+	launchPermissions []string
+}
+
+// fakeEC2Endpoint is a minimal stand-in for the EC2 query API, the
+// region of a request is taken from the signature
+type fakeEC2Endpoint struct {
+	mu       sync.Mutex
+	images   map[string]*fakeEC2Image
+	nextCopy int
+	// failAction is an action that always fails
+	failAction string
+}
+
+var ec2RegionRe = regexp.MustCompile(`Credential=[^/]+/[^/]+/([^/]+)/ec2/`)
+
+func (fe *fakeEC2Endpoint) reply(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "text/xml")
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		panic(err)
+	}
+}
+
+func (fe *fakeEC2Endpoint) fail(w http.ResponseWriter, code, msg string) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, `<Response><Errors><Error><Code>%s</Code><Message>%s</Message></Error></Errors><RequestID>1</RequestID></Response>`, code, msg)
+}
+
+// lookup returns the image with the given id in the given region
+func (fe *fakeEC2Endpoint) lookup(w http.ResponseWriter, region, id string) *fakeEC2Image {
+	img := fe.images[id]
+	if img == nil || img.region != region {
+		fe.fail(w, "InvalidAMIID.NotFound", fmt.Sprintf("The image id '[%s]' does not exist", id))
+		return nil
+	}
+	return img
+}
+
+func (fe *fakeEC2Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	if err := r.ParseForm(); err != nil {
+		panic(err)
+	}
+	m := ec2RegionRe.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		fe.fail(w, "AuthFailure", "missing signature")
+		return
+	}
+	region := m[1]
+	if r.Form.Get("Action") == fe.failAction {
+		fe.fail(w, "UnauthorizedOperation", "not allowed")
+		return
+	}
+
+	type imageItem struct {
+		ImageID    string `xml:"imageId"`
+		Name       string `xml:"name"`
+		ImageState string `xml:"imageState"`
+	}
+	type describeImagesResponse struct {
+		XMLName   xml.Name    `xml:"DescribeImagesResponse"`
+		RequestID string      `xml:"requestId"`
+		Images    []imageItem `xml:"imagesSet>item"`
+	}
+	switch r.Form.Get("Action") {
+	case "DescribeImages":
+		if r.Form.Get("Filter.1.Name") == "name" {
+			resp := describeImagesResponse{RequestID: "1"}
+			for id, img := range fe.images {
+				if img.region == region && img.name == r.Form.Get("Filter.1.Value.1") {
+					resp.Images = append(resp.Images, imageItem{id, img.name, "pending"})
+				}
+			}
+			fe.reply(w, resp)
+			return
+		}
+		id := r.Form.Get("ImageId.1")
+		img := fe.lookup(w, region, id)
+		if img == nil {
+			return
+		}
+		state := "available"
+		if img.pendingPolls > 0 {
+			img.pendingPolls--
+			state = "pending"
+		}
+		fe.reply(w, describeImagesResponse{RequestID: "1", Images: []imageItem{{id, img.name, state}}})
+	case "CopyImage":
+		src := fe.images[r.Form.Get("SourceImageId")]
+		if src == nil || src.region != r.Form.Get("SourceRegion") || src.pendingPolls > 0 {
+			fe.fail(w, "InvalidAMIID.Unavailable", "source not available")
+			return
+		}
+		fe.nextCopy++
+		id := fmt.Sprintf("ami-copy-%d", fe.nextCopy)
+		fe.images[id] = &fakeEC2Image{
+			region:       region,
+			name:         r.Form.Get("Name"),
+			pendingPolls: 2,
+			copiedTags:   r.Form.Get("CopyImageTags") == "true",
+		}
+		fe.reply(w, struct {
+			XMLName   xml.Name `xml:"CopyImageResponse"`
+			RequestID string   `xml:"requestId"`
+			ImageID   string   `xml:"imageId"`
+		}{RequestID: "1", ImageID: id})
+	case "ModifyImageAttribute":
+		img := fe.lookup(w, region, r.Form.Get("ImageId"))
+		if img == nil {
+			return
+		}
+		for i := 1; r.Form.Has(fmt.Sprintf("LaunchPermission.Add.%d.UserId", i)); i++ {
+			img.launchPermissions = append(img.launchPermissions, r.Form.Get(fmt.Sprintf("LaunchPermission.Add.%d.UserId", i)))
+		}
+		fe.reply(w, struct {
+			XMLName   xml.Name `xml:"ModifyImageAttributeResponse"`
+			RequestID string   `xml:"requestId"`
+			Return    bool     `xml:"return"`
+		}{RequestID: "1", Return: true})
+	default:
+		fe.fail(w, "InvalidAction", r.Form.Get("Action"))
+	}
+}
+
+// mockEC2Endpoint points the EC2 client of "upload" to a fake EC2 API
+// that knows the given (pending) source AMI
+func mockEC2Endpoint(t *testing.T, region, amiName, amiID string) *fakeEC2Endpoint {
+	fe := &fakeEC2Endpoint{
+		images: map[string]*fakeEC2Image{
+			amiID: {region: region, name: amiName, pendingPolls: 1},
+		},
+	}
+	srv := httptest.NewServer(fe)
+	t.Cleanup(srv.Close)
+
+	t.Setenv("AWS_ENDPOINT_URL_EC2", srv.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "no-config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "no-credentials"))
+	restore := main.MockAwsImageWaitDelay(time.Millisecond)
+	t.Cleanup(restore)
+	return fe
+}
+
+// mockAWSUploads mocks the uploader of the images library with the
+// given fake and the EC2 API with a fake that finds the AMIs that the
+// fake uploader registers
+func mockAWSUploads(t *testing.T, fa *fakeAwsUploader) *fakeEC2 {
+	fe := &fakeEC2{}
+	fa.ec2 = fe
+	restore := main.MockAwscloudNewUploader(func(region string, bucket string, ami string, opts *awscloud.UploaderOptions) (cloud.Uploader, error) {
+		fa.region = region
+		fa.bucket = bucket
+		fa.ami = ami
+		fa.opts = opts
+		return fa, nil
+	})
+	t.Cleanup(restore)
+	restore = main.MockAwsNewEC2Client(func(region, profile string) (main.AwsEC2Client, error) {
+		return fe, nil
+	})
+	t.Cleanup(restore)
+	return fe
+}
+
+func TestUploadAWSCopyAndShare(t *testing.T) {
+	fe := mockEC2Endpoint(t, "eu-west-1", "my-ami", "ami-src")
+
+	imagePath := filepath.Join(t.TempDir(), "disk.raw")
+	require.NoError(t, os.WriteFile(imagePath, []byte("fake-raw-img"), 0644))
+	var uploadOpts *awscloud.UploaderOptions
+	fa := &fakeAwsUploader{amiID: "ami-src"}
+	restore := main.MockAwscloudNewUploader(func(region string, bucket string, ami string, opts *awscloud.UploaderOptions) (cloud.Uploader, error) {
+		uploadOpts = opts
+		return fa, nil
+	})
+	defer restore()
+	var fakeStderr bytes.Buffer
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(&fakeStderr)
+	defer restore()
+	resultPath := filepath.Join(t.TempDir(), "result.json")
+	restore = main.MockOsArgs([]string{
+		"upload",
+		"--to=aws",
+		"--arch=x86_64",
+		"--aws-region=eu-west-1",
+		"--aws-bucket=my-bucket",
+		"--aws-ami-name=my-ami",
+		"--aws-copy-to-region=us-east-1",
+		"--aws-copy-to-region=ap-south-1",
+		"--aws-share-with-account=123456789012",
+		"--aws-share-with-account=210987654321",
+		"--aws-boot-mode=uefi",
+		"--upload-result", resultPath,
+		imagePath,
+	})
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	expectedBootMode := platform.BOOT_UEFI
+	assert.Equal(t, &expectedBootMode, uploadOpts.BootMode)
+
+	accounts := []string{"123456789012", "210987654321"}
+	assert.Equal(t, map[string]*fakeEC2Image{
+		"ami-src":    {region: "eu-west-1", name: "my-ami", launchPermissions: accounts},
+		"ami-copy-1": {region: "us-east-1", name: "my-ami", copiedTags: true, launchPermissions: accounts},
+		"ami-copy-2": {region: "ap-south-1", name: "my-ami", copiedTags: true, launchPermissions: accounts},
+	}, fe.images)
+	assert.Contains(t, fakeStderr.String(), `Waiting for AMI ami-src in eu-west-1 to become available
+Copying AMI ami-src to us-east-1 as ami-copy-1
+Copying AMI ami-src to ap-south-1 as ami-copy-2
+Waiting for AMI ami-copy-1 in us-east-1 to become available
+Waiting for AMI ami-copy-2 in ap-south-1 to become available
+Shared AMI ami-src in eu-west-1 with 123456789012, 210987654321
+Shared AMI ami-copy-1 in us-east-1 with 123456789012, 210987654321
+Shared AMI ami-copy-2 in ap-south-1 with 123456789012, 210987654321
+`)
+	var results []map[string]any
+	content, err := os.ReadFile(resultPath)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(content, &results))
+	require.Len(t, results, 1)
+	assert.Equal(t, "ami-src", results[0]["remote_id"])
+	assert.Equal(t, map[string]any{
+		"eu-west-1":  "ami-src",
+		"us-east-1":  "ami-copy-1",
+		"ap-south-1": "ami-copy-2",
+	}, results[0]["regional_ids"])
+}
+
+func TestUploadAWSShareFailsIsNotRetried(t *testing.T) {
+	fe := mockEC2Endpoint(t, "eu-west-1", "my-ami", "ami-src")
+	fe.failAction = "ModifyImageAttribute"
+
+	imagePath := filepath.Join(t.TempDir(), "disk.raw")
+	require.NoError(t, os.WriteFile(imagePath, []byte("fake-raw-img"), 0644))
+	fa := &fakeAwsUploader{amiID: "ami-src"}
+	restore := main.MockAwscloudNewUploader(func(region string, bucket string, ami string, opts *awscloud.UploaderOptions) (cloud.Uploader, error) {
+		return fa, nil
+	})
+	defer restore()
+	var sleeps []time.Duration
+	restore = main.MockUploadRetrySleep(func(d time.Duration) { sleeps = append(sleeps, d) })
+	defer restore()
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+	resultPath := filepath.Join(t.TempDir(), "result.json")
+	restore = main.MockOsArgs([]string{
+		"upload",
+		"--to=aws",
+		"--arch=x86_64",
+		"--aws-region=eu-west-1",
+		"--aws-bucket=my-bucket",
+		"--aws-ami-name=my-ami",
+		"--aws-share-with-account=123456789012",
+		"--upload-result", resultPath,
+		imagePath,
+	})
+	defer restore()
+
+	err := main.Run()
+	assert.ErrorContains(t, err, "cannot share AMI ami-src in eu-west-1: ")
+	// the AMI is registered, a retry would register another one
+	assert.Equal(t, 1, fa.uploadAndRegisterCalls)
+	assert.Empty(t, sleeps)
+
+	var results []map[string]any
+	content, err := os.ReadFile(resultPath)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(content, &results))
+	require.Len(t, results, 1)
+	assert.Equal(t, "ami-src", results[0]["remote_id"])
+	assert.Equal(t, float64(1), results[0]["attempts"])
+	assert.Contains(t, results[0]["error"], "cannot share AMI ami-src in eu-west-1: ")
+}
+
+func TestUploadAWSCopyErrors(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "disk.raw")
+	require.NoError(t, os.WriteFile(imagePath, []byte("fake-raw-img"), 0644))
+	mockAWSUploads(t, &fakeAwsUploader{})
+	restore := main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+
+	for _, tc := range []struct {
+		extraArgs   []string
+		expectedErr string
+	}{
+		{
+			[]string{"--aws-copy-to-region=eu-west-1"},
+			"cannot copy the AMI into the region it is registered in (eu-west-1)",
+		},
+		{
+			[]string{"--aws-copy-to-region=us-east-1", "--aws-copy-to-region=us-east-1"},
+			"cannot use --aws-copy-to-region=us-east-1 more than once",
+		},
+		{
+			[]string{"--aws-share-with-account=1234"},
+			`invalid AWS account id "1234" (expected 12 digits)`,
+		},
+		{
+			[]string{"--aws-boot-mode=bios"},
+			`unsupported boot mode "bios", use legacy-bios, uefi or uefi-preferred`,
+		},
+		{
+			// the fake uploader does not register an AMI
+			[]string{"--aws-share-with-account=123456789012"},
+			`cannot find the registered AMI "my-ami"`,
+		},
+	} {
+		restore = main.MockOsArgs(append([]string{
+			"upload",
+			"--to=aws",
+			"--arch=x86_64",
+			"--aws-region=eu-west-1",
+			"--aws-bucket=my-bucket",
+			"--aws-ami-name=my-ami",
+			imagePath,
+		}, tc.extraArgs...))
+		defer restore()
+		err := main.Run()
+		assert.EqualError(t, err, tc.expectedErr)
+	}
+}
+
+func TestUploadAWSFailureCleansUp(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "disk.raw")
+	require.NoError(t, os.WriteFile(imagePath, []byte("fake-raw-img"), 0644))
+	fa := &fakeAwsUploader{uploadAndRegisterErr: fmt.Errorf("injected register error")}
+	fe := mockAWSUploads(t, fa)
+	fe.snapshots = []types.Snapshot{
+		{
+			SnapshotId: aws.String("snap-old"),
+			StartTime:  aws.Time(time.Now().Add(-24 * time.Hour)),
+			Tags:       []types.Tag{{Key: aws.String("Name"), Value: aws.String("my-ami")}},
+		},
+		{
+			SnapshotId: aws.String("snap-new"),
+			StartTime:  aws.Time(time.Now().Add(time.Minute)),
+			Tags:       []types.Tag{{Key: aws.String("Name"), Value: aws.String("my-ami")}},
+		},
+		{
+			SnapshotId: aws.String("snap-other"),
+			StartTime:  aws.Time(time.Now().Add(time.Minute)),
+			Tags:       []types.Tag{{Key: aws.String("Name"), Value: aws.String("other-ami")}},
+		},
+	}
+	var sleeps []time.Duration
+	restore := main.MockUploadRetrySleep(func(d time.Duration) { sleeps = append(sleeps, d) })
+	defer restore()
+	var fakeStderr bytes.Buffer
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(&fakeStderr)
+	defer restore()
+	resultPath := filepath.Join(t.TempDir(), "result.json")
+	restore = main.MockOsArgs([]string{
+		"upload",
+		"--to=aws",
+		"--arch=x86_64",
+		"--aws-region=eu-west-1",
+		"--aws-bucket=my-bucket",
+		"--aws-ami-name=my-ami",
+		"--upload-result", resultPath,
+		imagePath,
+	})
+	defer restore()
+
+	// the snapshot that the failed upload imported is deleted
+	err := main.Run()
+	assert.EqualError(t, err, "injected register error")
+	assert.Equal(t, 1, fa.uploadAndRegisterCalls)
+	assert.Empty(t, sleeps)
+	assert.Equal(t, []string{"snap-new"}, fe.deletedSnapshots)
+	assert.Contains(t, fakeStderr.String(), "Deleted snapshot snap-new of the failed upload\n")
+
+	// an AMI that got registered nevertheless is reported
+	fe.deletedSnapshots = nil
+	fe.images = []types.Image{{ImageId: aws.String("ami-registered"), Name: aws.String("my-ami")}}
+	err = main.Run()
+	assert.EqualError(t, err, "injected register error")
+	assert.Empty(t, fe.deletedSnapshots)
+	var results []map[string]any
+	content, err := os.ReadFile(resultPath)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(content, &results))
+	require.Len(t, results, 1)
+	assert.Equal(t, "ami-registered", results[0]["remote_id"])
+	assert.Equal(t, "injected register error", results[0]["error"])
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/pageblob"
+
+	"github.com/osbuild/images/pkg/cloud/azure"
+)
+
+// azureClient is the part of the Azure resource manager API that is
+// needed to register an image
+type azureClient interface {
+	GetResourceGroupLocation(ctx context.Context, resourceGroup string) (string, error)
+	GetStorageAccountKey(ctx context.Context, resourceGroup string, storageAccount string) (string, error)
+	RegisterImage(ctx context.Context, resourceGroup, storageAccount, storageContainer, blobName, imageName, location string, hyperVGen azure.HyperVGenerationType) error
+}
+
+// azureNewClient is mocked in tests
+var azureNewClient = func(credentials azure.Credentials, tenantID, subscriptionID string) (azureClient, error) {
+	return azure.NewClient(credentials, tenantID, subscriptionID)
+}
+
+type azureUploaderOptions struct {
+	// StorageEndpoint is the URL of the blob service of the storage
+	// account, e.g. "http://127.0.0.1:10000/devstoreaccount1" for
+	// Azurite. Defaults to https://<account>.blob.core.windows.net
+	StorageEndpoint  string
+	StorageAccount   string
+	StorageContainer string
+	ResourceGroup    string
+	ImageName        string
+	// Location is optional, the location of the resource group is
+	// used if unset
+	Location  string
+	HyperVGen azure.HyperVGenerationType
+	// SubscriptionID is only used for the id of the managed image
+	SubscriptionID string
+	// StorageKey is the access key of the storage account, it is
+	// looked up via the resource manager API if unset
+	StorageKey string
+}
+
+// azureUploader uploads a VHD as a page blob and registers a managed
+// image from it
+type azureUploader struct {
+	client azureClient
+	opts   azureUploaderOptions
+
+	blobClient *pageblob.Client
+}
+
+func newAzureUploader(client azureClient, opts *azureUploaderOptions) *azureUploader {
+	au := &azureUploader{client: client, opts: *opts}
+	if au.opts.StorageEndpoint == "" {
+		au.opts.StorageEndpoint = fmt.Sprintf("https://%s.blob.core.windows.net", opts.StorageAccount)
+	}
+	au.opts.StorageEndpoint = strings.TrimSuffix(au.opts.StorageEndpoint, "/")
+	return au
+}
+
+func (au *azureUploader) blobName() string {
+	return azure.EnsureVHDExtension(au.opts.ImageName)
+}
+
+// storageKey returns the access key of the storage account, it can
+// be set via $AZURE_STORAGE_KEY (e.g. for Azurite)
+func (au *azureUploader) storageKey(ctx context.Context) (string, error) {
+	if au.opts.StorageKey != "" {
+		return au.opts.StorageKey, nil
+	}
+	return au.client.GetStorageAccountKey(ctx, au.opts.ResourceGroup, au.opts.StorageAccount)
+}
+
+func (au *azureUploader) Check(status io.Writer) error {
+	ctx := context.Background()
+	fmt.Fprintf(status, "Checking Azure resource group %q\n", au.opts.ResourceGroup)
+	if _, err := au.client.GetResourceGroupLocation(ctx, au.opts.ResourceGroup); err != nil {
+		return fmt.Errorf("cannot access resource group %q: %w", au.opts.ResourceGroup, err)
+	}
+	fmt.Fprintf(status, "Checking Azure storage account %q\n", au.opts.StorageAccount)
+	if _, err := au.storageKey(ctx); err != nil {
+		return fmt.Errorf("cannot access storage account %q: %w", au.opts.StorageAccount, err)
+	}
+	return nil
+}
+
+func (au *azureUploader) UploadAndRegister(r io.Reader, uploadSize uint64, status io.Writer) error {
+	ctx := context.Background()
+	if uploadSize < vhdFooterSize || (uploadSize-vhdFooterSize)%vhdSizeAlignment != 0 {
+		return permanentUploadErrorf("the virtual size of a VHD for azure must be a multiple of 1 MiB, got %d bytes with the footer", uploadSize)
+	}
+	key, err := au.storageKey(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get the key of storage account %q: %w", au.opts.StorageAccount, err)
+	}
+	cred, err := azblob.NewSharedKeyCredential(au.opts.StorageAccount, key)
+	if err != nil {
+		return fmt.Errorf("cannot create shared key credential: %w", err)
+	}
+
+	containerURL := fmt.Sprintf("%s/%s", au.opts.StorageEndpoint, au.opts.StorageContainer)
+	containerClient, err := container.NewClientWithSharedKeyCredential(containerURL, cred, nil)
+	if err != nil {
+		return fmt.Errorf("cannot create a container client: %w", err)
+	}
+	if _, err := containerClient.Create(ctx, nil); err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		return fmt.Errorf("cannot create storage container %q: %w", au.opts.StorageContainer, err)
+	}
+
+	fmt.Fprintf(status, "Uploading %s to Azure\n", au.blobName())
+	blobURL := fmt.Sprintf("%s/%s", containerURL, au.blobName())
+	client, err := pageblob.NewClientWithSharedKeyCredential(blobURL, cred, nil)
+	if err != nil {
+		return fmt.Errorf("cannot create a pageblob client: %w", err)
+	}
+	if _, err := client.Create(ctx, int64(uploadSize), nil); err != nil {
+		return fmt.Errorf("cannot create a new page blob: %w", err)
+	}
+	if err := uploadPages(ctx, client, r, uploadSize); err != nil {
+		return err
+	}
+	au.blobClient = client
+
+	fmt.Fprintf(status, "Registering image %q in resource group %q\n", au.opts.ImageName, au.opts.ResourceGroup)
+	if err := au.client.RegisterImage(ctx, au.opts.ResourceGroup, au.opts.StorageAccount, au.opts.StorageContainer, au.blobName(), au.opts.ImageName, au.opts.Location, au.opts.HyperVGen); err != nil {
+		return fmt.Errorf("cannot register image %q: %w", au.opts.ImageName, err)
+	}
+	return nil
+}
+
+// acceptsImageFormat implements imageFormatUploader, the page blob
+// must be a fixed VHD, other images are converted to one
+func (au *azureUploader) acceptsImageFormat(f imageFormat) bool {
+	return f == imageFormatVHD
+}
+
+// retryable implements retryableUploader, a retry creates the page
+// blob again and registering the image replaces an existing one
+func (au *azureUploader) retryable() bool {
+	return true
+}
+
+func (au *azureUploader) verifyUpload(size uint64, sums *uploadChecksums, status io.Writer) error {
+	fmt.Fprintf(status, "Verifying %s\n", au.blobName())
+	props, err := au.blobClient.GetProperties(context.Background(), nil)
+	if err != nil {
+		return fmt.Errorf("cannot get the properties of %s: %w", au.blobName(), err)
+	}
+	if props.ContentLength == nil || *props.ContentLength != int64(size) {
+		return fmt.Errorf("page blob %s does not have %d bytes", au.blobName(), size)
+	}
+	return nil
+}
+
+func (au *azureUploader) remoteID() string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/images/%s", au.opts.SubscriptionID, au.opts.ResourceGroup, au.opts.ImageName)
+}
+
+// uploadPages writes the content of r into the page blob, pages that
+// only contain zeros are skipped as a new page blob reads as zeros
+func uploadPages(ctx context.Context, client *pageblob.Client, r io.Reader, size uint64) error {
+	buf := make([]byte, azure.PageBlobMaxUploadPagesBytes)
+	var offset uint64
+	for offset < size {
+		n, err := io.ReadFull(r, buf[:min(uint64(len(buf)), size-offset)])
+		if err != nil {
+			return fmt.Errorf("cannot read the image: %w", err)
+		}
+		chunk := buf[:n]
+		if !isZero(chunk) {
+			rng := blob.HTTPRange{Offset: int64(offset), Count: int64(n)}
+			// the storage service checks the md5 of every page write
+			sum := md5.Sum(chunk)
+			opts := &pageblob.UploadPagesOptions{
+				TransactionalValidation: blob.TransferValidationTypeMD5(sum[:]),
+			}
+			if _, err := client.UploadPages(ctx, streaming.NopCloser(bytes.NewReader(chunk)), rng, opts); err != nil {
+				return fmt.Errorf("cannot upload pages at offset %d: %w", offset, err)
+			}
+		}
+		offset += uint64(n)
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
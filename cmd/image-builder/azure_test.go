@@ -0,0 +1,410 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/osbuild/images/pkg/cloud/azure"
+	testrepos "github.com/osbuild/images/test/data/repositories"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+	"github.com/osbuild/image-builder-cli/internal/testutil"
+)
+
+// the well-known Azurite account
+const (
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// fakeAzurite is a minimal stand-in for the Azurite blob service, it
+// supports creating containers and page blobs and writing pages
+type fakeAzurite struct {
+	mu         sync.Mutex
+	containers map[string]bool
+	blobs      map[string][]byte
+	pageWrites int
+}
+
+var azuriteRangeRe = regexp.MustCompile(`^bytes=(\d+)-(\d+)$`)
+
+func newFakeAzurite(t *testing.T) (*fakeAzurite, string) {
+	fa := &fakeAzurite{
+		containers: make(map[string]bool),
+		blobs:      make(map[string][]byte),
+	}
+	srv := httptest.NewServer(fa)
+	t.Cleanup(srv.Close)
+	return fa, srv.URL + "/" + azuriteAccount
+}
+
+func (fa *fakeAzurite) fail(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>%s</Code></Error>`, code)
+}
+
+func (fa *fakeAzurite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if parts[0] != azuriteAccount || !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey "+azuriteAccount+":") {
+		fa.fail(w, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+	if r.Method == http.MethodHead && len(parts) == 3 {
+		blob, ok := fa.blobs[parts[1]+"/"+parts[2]]
+		if !ok {
+			fa.fail(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		w.Header().Set("x-ms-blob-type", "PageBlob")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPut || len(parts) < 2 {
+		fa.fail(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+	containerName := parts[1]
+	switch {
+	case len(parts) == 2 && r.URL.Query().Get("restype") == "container":
+		if fa.containers[containerName] {
+			fa.fail(w, http.StatusConflict, "ContainerAlreadyExists")
+			return
+		}
+		fa.containers[containerName] = true
+	case len(parts) == 3 && r.URL.Query().Get("comp") == "page":
+		blob, ok := fa.blobs[containerName+"/"+parts[2]]
+		m := azuriteRangeRe.FindStringSubmatch(r.Header.Get("x-ms-range"))
+		if !ok || m == nil {
+			fa.fail(w, http.StatusBadRequest, "InvalidPageRange")
+			return
+		}
+		start, _ := strconv.Atoi(m[1])
+		end, _ := strconv.Atoi(m[2])
+		body, _ := io.ReadAll(r.Body)
+		sum := md5.Sum(body)
+		if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) {
+			fa.fail(w, http.StatusBadRequest, "Md5Mismatch")
+			return
+		}
+		if start%512 != 0 || len(body) != end-start+1 || end >= len(blob) {
+			fa.fail(w, http.StatusBadRequest, "InvalidPageRange")
+			return
+		}
+		copy(blob[start:], body)
+		fa.pageWrites++
+	case len(parts) == 3 && r.Header.Get("x-ms-blob-type") == "PageBlob":
+		if !fa.containers[containerName] {
+			fa.fail(w, http.StatusNotFound, "ContainerNotFound")
+			return
+		}
+		size, _ := strconv.Atoi(r.Header.Get("x-ms-blob-content-length"))
+		fa.blobs[containerName+"/"+parts[2]] = make([]byte, size)
+	default:
+		fa.fail(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+type fakeAzureClient struct {
+	location      string
+	checkCalls    int
+	registerCalls []string
+}
+
+func (fc *fakeAzureClient) GetResourceGroupLocation(ctx context.Context, resourceGroup string) (string, error) {
+	fc.checkCalls++
+	return fc.location, nil
+}
+
+func (fc *fakeAzureClient) GetStorageAccountKey(ctx context.Context, resourceGroup, storageAccount string) (string, error) {
+	return azuriteKey, nil
+}
+
+func (fc *fakeAzureClient) RegisterImage(ctx context.Context, resourceGroup, storageAccount, storageContainer, blobName, imageName, location string, hyperVGen azure.HyperVGenerationType) error {
+	fc.registerCalls = append(fc.registerCalls, strings.Join([]string{resourceGroup, storageAccount, storageContainer, blobName, imageName, location, string(hyperVGen)}, ","))
+	return nil
+}
+
+func mockAzure(t *testing.T) (*fakeAzurite, string, *fakeAzureClient) {
+	fakeStorage, endpoint := newFakeAzurite(t)
+	fc := &fakeAzureClient{location: "westeurope"}
+	restore := main.MockAzureNewClient(func(creds azure.Credentials, tenantID, subscriptionID string) (main.AzureClient, error) {
+		assert.Equal(t, azure.Credentials{ClientID: "client-id", ClientSecret: "client-secret"}, creds)
+		assert.Equal(t, "tenant", tenantID)
+		assert.Equal(t, "subscription", subscriptionID)
+		return fc, nil
+	})
+	t.Cleanup(restore)
+	t.Setenv("AZURE_CLIENT_ID", "client-id")
+	t.Setenv("AZURE_CLIENT_SECRET", "client-secret")
+	t.Setenv("AZURE_TENANT_ID", "tenant")
+	t.Setenv("AZURE_SUBSCRIPTION_ID", "subscription")
+	return fakeStorage, endpoint, fc
+}
+
+// assertVHDBlob checks that the blob is the given disk as a fixed VHD
+// with a virtual size that is aligned to 1 MiB
+func assertVHDBlob(t *testing.T, disk, blob []byte) {
+	t.Helper()
+	require.Greater(t, len(blob), 512)
+	footer := blob[len(blob)-512:]
+	virtualSize := len(blob) - 512
+	assert.Equal(t, 0, virtualSize%(1024*1024))
+	assert.Equal(t, disk, blob[:len(disk)])
+	assert.True(t, bytes.Equal(make([]byte, virtualSize-len(disk)), blob[len(disk):virtualSize]), "padding is not zero")
+	assert.Equal(t, "conectix", string(footer[:8]))
+	assert.Equal(t, uint64(virtualSize), binary.BigEndian.Uint64(footer[48:]))
+	// fixed disk
+	assert.Equal(t, uint32(2), binary.BigEndian.Uint32(footer[60:]))
+	var checksum uint32
+	for i, b := range footer {
+		if i < 64 || i >= 68 {
+			checksum += uint32(b)
+		}
+	}
+	assert.Equal(t, ^checksum, binary.BigEndian.Uint32(footer[64:]))
+}
+
+func TestUploadAzure(t *testing.T) {
+	fakeStorage, endpoint, fc := mockAzure(t)
+
+	// a sparse disk, only the second 4 MiB chunk has data
+	img := make([]byte, 9*1024*1024)
+	copy(img[4*1024*1024+17:], "some-data")
+	imagePath := filepath.Join(t.TempDir(), "disk.vhd")
+	require.NoError(t, os.WriteFile(imagePath, img, 0644))
+
+	var fakeStdout bytes.Buffer
+	restore := main.MockOsStdout(&fakeStdout)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+	restore = main.MockOsArgs([]string{
+		"upload",
+		"--to=azure",
+		"--arch=x86_64",
+		"--azure-storage-endpoint", endpoint,
+		"--azure-storage-account", azuriteAccount,
+		"--azure-storage-container", "images",
+		"--azure-resource-group", "my-group",
+		"--azure-image-name", "my-image",
+		imagePath,
+	})
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	assert.True(t, fakeStorage.containers["images"])
+	// the raw image gets a VHD footer
+	assertVHDBlob(t, img, fakeStorage.blobs["images/my-image.vhd"])
+	// the zero chunks are not uploaded, only the data and the footer
+	assert.Equal(t, 2, fakeStorage.pageWrites)
+	assert.Equal(t, []string{"my-group,devstoreaccount1,images,my-image.vhd,my-image,,V1"}, fc.registerCalls)
+	assert.Contains(t, fakeStdout.String(), "100.00%")
+
+	// uploading again works with the existing container
+	err = main.Run()
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(fc.registerCalls))
+}
+
+func TestUploadAzureConvertsImages(t *testing.T) {
+	fakeStorage, endpoint, _ := mockAzure(t)
+	disk := testRawDisk()
+
+	for _, tc := range []struct {
+		filename string
+		content  []byte
+	}{
+		{"disk.vhd.xz", compressTestData(t, "xz", disk)},
+		{"disk.qcow2", makeQcow2(t, disk)},
+		{"disk.vmdk", makeStreamOptimizedVMDK(t, disk)},
+	} {
+		t.Run(tc.filename, func(t *testing.T) {
+			imagePath := filepath.Join(t.TempDir(), tc.filename)
+			require.NoError(t, os.WriteFile(imagePath, tc.content, 0644))
+
+			restore := main.MockOsStdout(io.Discard)
+			defer restore()
+			restore = main.MockOsStderr(io.Discard)
+			defer restore()
+			restore = main.MockOsArgs([]string{
+				"upload",
+				"--to=azure",
+				"--arch=x86_64",
+				"--azure-storage-endpoint", endpoint,
+				"--azure-storage-account", azuriteAccount,
+				"--azure-storage-container", "images",
+				"--azure-resource-group", "my-group",
+				"--azure-image-name", "my-image",
+				imagePath,
+			})
+			defer restore()
+
+			err := main.Run()
+			require.NoError(t, err)
+			assertVHDBlob(t, disk, fakeStorage.blobs["images/my-image.vhd"])
+		})
+	}
+}
+
+func TestUploadAzureVHDAsIs(t *testing.T) {
+	fakeStorage, endpoint, _ := mockAzure(t)
+	vhd := make([]byte, 1024*1024+512)
+	copy(vhd, "some-data")
+	copy(vhd[1024*1024:], "conectix")
+
+	for _, tc := range []struct {
+		filename string
+		content  []byte
+	}{
+		{"disk.vhd", vhd},
+		{"disk.vhd.xz", compressTestData(t, "xz", vhd)},
+	} {
+		t.Run(tc.filename, func(t *testing.T) {
+			imagePath := filepath.Join(t.TempDir(), tc.filename)
+			require.NoError(t, os.WriteFile(imagePath, tc.content, 0644))
+
+			var fakeStderr bytes.Buffer
+			restore := main.MockOsStdout(io.Discard)
+			defer restore()
+			restore = main.MockOsStderr(&fakeStderr)
+			defer restore()
+			restore = main.MockOsArgs([]string{
+				"upload",
+				"--to=azure",
+				"--arch=x86_64",
+				"--azure-storage-endpoint", endpoint,
+				"--azure-storage-account", azuriteAccount,
+				"--azure-storage-container", "images",
+				"--azure-resource-group", "my-group",
+				"--azure-image-name", "my-image",
+				imagePath,
+			})
+			defer restore()
+
+			err := main.Run()
+			require.NoError(t, err)
+			assert.Equal(t, vhd, fakeStorage.blobs["images/my-image.vhd"])
+			assert.NotContains(t, fakeStderr.String(), "fixed VHD")
+		})
+	}
+}
+
+func TestUploadAzureErrors(t *testing.T) {
+	_, endpoint, _ := mockAzure(t)
+
+	imagePath := filepath.Join(t.TempDir(), "disk.vhd.xz")
+	// a VHD with a virtual size that is not aligned to 1 MiB
+	vhd := make([]byte, 1024)
+	copy(vhd[512:], "conectix")
+	require.NoError(t, os.WriteFile(imagePath, vhd, 0644))
+	restore := main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+
+	for _, tc := range []struct {
+		cmdline     []string
+		expectedErr string
+	}{
+		{
+			[]string{"--to=azure"},
+			`missing all upload configuration: ["--azure-storage-account" "--azure-storage-container" "--azure-resource-group" "--azure-image-name"]`,
+		}, {
+			[]string{"--to=azure", "--azure-image-name=img", "--azure-resource-group=rg"},
+			`missing upload configuration: ["--azure-storage-account" "--azure-storage-container"]`,
+		}, {
+			[]string{"--to=azure", "--azure-image-name=img", "--azure-resource-group=rg", "--azure-storage-account", azuriteAccount, "--azure-storage-container=c", "--azure-storage-endpoint", endpoint},
+			`the virtual size of a VHD for azure must be a multiple of 1 MiB, got 1024 bytes with the footer`,
+		},
+	} {
+		t.Run(strings.Join(tc.cmdline, ","), func(t *testing.T) {
+			restore := main.MockOsArgs(append(append([]string{"upload", "--arch=x86_64"}, tc.cmdline...), imagePath))
+			defer restore()
+
+			err := main.Run()
+			assert.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestBuildAndUploadVHDWithAzurite(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+	restore = main.MockOsbuildVersion(func() (string, error) { return "999", nil })
+	defer restore()
+	restore = main.MockManifestgenDepsolver(fakeDepsolve)
+	defer restore()
+	restore = main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+	testutil.MockCommand(t, "osbuild", makeFakeOsbuildScript())
+
+	for _, tc := range []struct {
+		imgType string
+		distro  string
+	}{
+		{"vhd", "centos-9"},
+		// compressed with xz by the (fake) osbuild
+		{"azure-rhui", "rhel-9.6"},
+	} {
+		t.Run(tc.imgType, func(t *testing.T) {
+			if tc.imgType != "vhd" {
+				if _, err := exec.LookPath("xz"); err != nil {
+					t.Skip("no xz binary found")
+				}
+			}
+			fakeStorage, endpoint, fc := mockAzure(t)
+
+			restore := main.MockOsArgs([]string{
+				"build",
+				"--output-dir", t.TempDir(),
+				"--cache", t.TempDir(),
+				"--azure-storage-endpoint", endpoint,
+				"--azure-storage-account", azuriteAccount,
+				"--azure-storage-container", "images",
+				"--azure-resource-group", "my-group",
+				"--azure-image-name", "my-image",
+				"--azure-location", "northeurope",
+				tc.imgType,
+				"--distro=" + tc.distro,
+				"--arch=x86_64",
+			})
+			defer restore()
+
+			err := main.Run()
+			require.NoError(t, err)
+			assert.Equal(t, 1, fc.checkCalls)
+			// the images boot with bios and uefi (hybrid)
+			assert.Equal(t, []string{"my-group,devstoreaccount1,images,my-image.vhd,my-image,northeurope,V2"}, fc.registerCalls)
+			// the fake osbuild writes a VHD without a footer
+			assertVHDBlob(t, make([]byte, 1024*1024), fakeStorage.blobs["images/my-image.vhd"])
+		})
+	}
+}
@@ -8,22 +8,24 @@ import (
 	"github.com/cheggaaa/pb/v3"
 	"github.com/spf13/pflag"
 
+	"github.com/osbuild/image-builder-cli/pkg/progress"
 	"github.com/osbuild/images/pkg/cloud"
 )
 
-func bibUpload(uploader cloud.Uploader, path string, flags *pflag.FlagSet) error {
-	progress, err := flags.GetString("progress")
+func bibUpload(progressBar progress.ProgressBar, uploader cloud.Uploader, path string, flags *pflag.FlagSet) error {
+	progressType, err := flags.GetString("progress")
 	if err != nil {
 		return err
 	}
 
 	// TODO: extract this as a helper once we add "uploadAzure" or
-	// similar. Eventually we may provide json progress here too.
+	// similar.
 	var pbar *pb.ProgressBar
-	switch progress {
+	switch progressType {
 	case "auto", "verbose", "term":
 		pbar = pb.New(0)
 	}
+	reporter, _ := progressBar.(progress.UploadProgressReporter)
 
 	file, err := os.Open(path)
 	if err != nil {
@@ -34,12 +36,17 @@ func bibUpload(uploader cloud.Uploader, path string, flags *pflag.FlagSet) error
 
 	var r io.Reader = file
 	var size int64
-	if pbar != nil {
+	if pbar != nil || reporter != nil {
 		st, err := file.Stat()
 		if err != nil {
 			return err
 		}
 		size = st.Size()
+	}
+	switch {
+	case reporter != nil:
+		r = newUploadProgressReader(file, uint64(size), reporter)
+	case pbar != nil:
 		pbar.SetTotal(size)
 		pbar.Set(pb.Bytes, true)
 		pbar.SetWriter(osStdout)
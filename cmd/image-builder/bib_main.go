@@ -292,6 +292,7 @@ func bibCmdBuild(cmd *cobra.Command, args []string) error {
 	outputDir, _ := cmd.Flags().GetString("output")
 	targetArch, _ := cmd.Flags().GetString("target-arch")
 	progressType, _ := cmd.Flags().GetString("progress")
+	progressFd, _ := cmd.Flags().GetInt("progress-fd")
 
 	logrus.Debug("Validating environment")
 	if err := setup.Validate(targetArch, false); err != nil {
@@ -324,7 +325,7 @@ func bibCmdBuild(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("chowning is not allowed in output directory")
 	}
 
-	pbar, err := progress.New(progressType)
+	pbar, err := newProgressBar(progressType, progressFd)
 	if err != nil {
 		return fmt.Errorf("cannto create progress bar: %w", err)
 	}
@@ -392,7 +393,7 @@ func bibCmdBuild(cmd *cobra.Command, args []string) error {
 			switch imgType {
 			case "ami":
 				diskpath := filepath.Join(outputDir, exports[idx], "disk.raw")
-				if err := bibUpload(uploader, diskpath, cmd.Flags()); err != nil {
+				if err := bibUpload(pbar, uploader, diskpath, cmd.Flags()); err != nil {
 					return fmt.Errorf("cannot upload AMI: %w", err)
 				}
 			default:
@@ -559,8 +560,8 @@ func bibBuildCobraCmdline() (*cobra.Command, error) {
 	buildCmd.Flags().String("chown", "", "chown the ouput directory to match the specified UID:GID")
 	buildCmd.Flags().String("output", ".", "artifact output directory")
 	buildCmd.Flags().String("store", "/store", "osbuild store for intermediate pipeline trees")
-	//TODO: add json progress for higher level tools like "podman bootc"
-	buildCmd.Flags().String("progress", "auto", "type of progress bar to use (e.g. verbose,term)")
+	buildCmd.Flags().String("progress", "auto", "type of progress bar to use (e.g. verbose,term,json)")
+	buildCmd.Flags().Int("progress-fd", 0, "write the json progress to the given file descriptor instead of stdout")
 	// flag rules
 	for _, dname := range []string{"output", "store", "rpmmd"} {
 		if err := buildCmd.MarkFlagDirname(dname); err != nil {
@@ -8,6 +8,8 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
@@ -173,8 +175,13 @@ type fakeAwsUploader struct {
 	opts                *awscloud.UploaderOptions
 
 	uploadAndRegisterRead  bytes.Buffer
+	uploadAndRegisterSize  uint64
 	uploadAndRegisterCalls int
 	uploadAndRegisterErr   error
+	// amiID is registered with the ami name in ec2 (if set) like the
+	// aws uploader does
+	amiID string
+	ec2   *fakeEC2
 }
 
 var _ = cloud.Uploader(&fakeAwsUploader{})
@@ -186,10 +193,14 @@ func (fa *fakeAwsUploader) Check(status io.Writer) error {
 
 func (fa *fakeAwsUploader) UploadAndRegister(r io.Reader, size uint64, status io.Writer) error {
 	fa.uploadAndRegisterCalls++
+	fa.uploadAndRegisterSize = size
 	_, err := io.Copy(&fa.uploadAndRegisterRead, r)
 	if err != nil {
 		panic(err)
 	}
+	if fa.amiID != "" && fa.ec2 != nil && fa.uploadAndRegisterErr == nil {
+		fa.ec2.images = append(fa.ec2.images, types.Image{ImageId: aws.String(fa.amiID), Name: aws.String(fa.ami)})
+	}
 	return fa.uploadAndRegisterErr
 }
 
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"github.com/osbuild/blueprint/pkg/blueprint"
+
+	"github.com/osbuild/image-builder-cli/internal/blueprintload"
+)
+
+// blueprintValue returns the blueprint as generic json value without
+// the lists and objects that are not set
+func blueprintValue(bp *blueprint.Blueprint) (any, error) {
+	b, err := json.Marshal(bp)
+	if err != nil {
+		return nil, err
+	}
+	var v map[string]any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	for key, value := range v {
+		if value == nil {
+			delete(v, key)
+		}
+	}
+	return v, nil
+}
+
+// writeBlueprint writes the blueprint in the given format (toml, json
+// or yaml), toml is the default
+func writeBlueprint(w io.Writer, bp *blueprint.Blueprint, format string) error {
+	switch format {
+	case "", "toml":
+		enc := toml.NewEncoder(w)
+		enc.Indent = ""
+		return enc.Encode(bp)
+	case "json":
+		v, err := blueprintValue(bp)
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	case "yaml":
+		// the blueprint types only have json and toml names
+		v, err := blueprintValue(bp)
+		if err != nil {
+			return err
+		}
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		return enc.Close()
+	default:
+		return fmt.Errorf("unsupported format %q, supported formats: toml, json, yaml", format)
+	}
+}
+
+// blueprintVarsFromCmd returns the variables for the blueprints, the
+// values of --blueprint-var override the ones from the files. Without
+// any of the variable flags or --blueprint-templating it returns nil,
+// the blueprints are then used as they are.
+func blueprintVarsFromCmd(cmd *cobra.Command) (*blueprintload.Vars, error) {
+	varsFiles, err := cmd.Flags().GetStringArray("blueprint-vars-file")
+	if err != nil {
+		return nil, err
+	}
+	assignments, err := cmd.Flags().GetStringArray("blueprint-var")
+	if err != nil {
+		return nil, err
+	}
+	templating, err := cmd.Flags().GetBool("blueprint-templating")
+	if err != nil {
+		return nil, err
+	}
+	if !templating && len(varsFiles) == 0 && len(assignments) == 0 {
+		return nil, nil
+	}
+
+	vars := &blueprintload.Vars{}
+	for _, path := range varsFiles {
+		if err := vars.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, assignment := range assignments {
+		if err := vars.Set(assignment); err != nil {
+			return nil, err
+		}
+	}
+	return vars, nil
+}
+
+func cmdBlueprintMerge(cmd *cobra.Command, args []string) error {
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+	if format != "" && format != "toml" && format != "json" && format != "yaml" {
+		return fmt.Errorf("unsupported format %q, supported formats: toml, json, yaml", format)
+	}
+
+	vars, err := blueprintVarsFromCmd(cmd)
+	if err != nil {
+		return err
+	}
+	// the merged blueprint is only shown, never show the secrets
+	if vars != nil {
+		vars.MaskSecrets = true
+	}
+
+	bp, err := blueprintload.LoadAll(args, vars)
+	if err != nil {
+		return err
+	}
+	return writeBlueprint(cmd.OutOrStdout(), bp, format)
+}
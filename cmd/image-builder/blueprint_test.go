@@ -0,0 +1,289 @@
+package main_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	testrepos "github.com/osbuild/images/test/data/repositories"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+)
+
+func writeBlueprintLayers(t *testing.T, layers map[string]string) []string {
+	tmpdir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"base.toml", "team.yaml", "conflict.json"} {
+		content, ok := layers[name]
+		if !ok {
+			continue
+		}
+		path := filepath.Join(tmpdir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+var testBlueprintLayers = map[string]string{
+	"base.toml": `
+name = "base"
+packages = [{ name = "vim" }]
+
+[customizations]
+hostname = "base.example.com"
+
+[[customizations.user]]
+name = "alice"
+groups = ["wheel"]
+`,
+	"team.yaml": `
+packages:
+  - name: vim
+  - name: nginx
+customizations:
+  hostname: team.example.com
+  user:
+    - name: bob
+`,
+}
+
+func TestBlueprintMerge(t *testing.T) {
+	paths := writeBlueprintLayers(t, testBlueprintLayers)
+
+	for _, tc := range []struct {
+		format   string
+		expected string
+	}{
+		{"", `name = "base"
+
+[[packages]]
+name = "vim"
+
+[[packages]]
+name = "nginx"
+
+[customizations]
+hostname = "team.example.com"
+
+[[customizations.user]]
+name = "alice"
+groups = ["wheel"]
+
+[[customizations.user]]
+name = "bob"
+`},
+		{"yaml", `customizations:
+  hostname: team.example.com
+  user:
+    - groups:
+        - wheel
+      name: alice
+    - name: bob
+name: base
+packages:
+  - name: vim
+  - name: nginx
+`},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			var fakeStdout bytes.Buffer
+			restore := main.MockOsStdout(&fakeStdout)
+			defer restore()
+			restore = main.MockOsArgs(append([]string{"blueprint", "merge", "--format=" + tc.format}, paths...))
+			defer restore()
+
+			err := main.Run()
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, fakeStdout.String())
+		})
+	}
+}
+
+func TestBlueprintMergeConflict(t *testing.T) {
+	paths := writeBlueprintLayers(t, map[string]string{
+		"base.toml":     testBlueprintLayers["base.toml"],
+		"conflict.json": `{"customizations": {"user": [{"name": "alice", "groups": ["users"]}]}}`,
+	})
+
+	for _, args := range [][]string{
+		{"blueprint", "merge"},
+		{"manifest", "qcow2", "--distro=centos-9", "--arch=x86_64"},
+	} {
+		for _, path := range paths {
+			if args[0] == "blueprint" {
+				args = append(args, path)
+			} else {
+				args = append(args, "--blueprint", path)
+			}
+		}
+		restore := main.MockOsArgs(args)
+		defer restore()
+
+		err := main.Run()
+		assert.EqualError(t, err, `cannot merge "`+paths[1]+`": customizations.user "alice" conflicts with an earlier blueprint`)
+	}
+}
+
+func TestBlueprintMergeRendersVars(t *testing.T) {
+	tmpdir := t.TempDir()
+	secretPath := filepath.Join(tmpdir, "password")
+	require.NoError(t, os.WriteFile(secretPath, []byte("s3cret\n"), 0600))
+	varsPath := filepath.Join(tmpdir, "dev.vars")
+	require.NoError(t, os.WriteFile(varsPath, []byte("HOSTNAME=dev.example.com\nUSER=alice\n"), 0644))
+	paths := writeBlueprintLayers(t, map[string]string{
+		"base.toml": `
+[customizations]
+hostname = "${HOSTNAME}"
+
+[[customizations.user]]
+name = "${USER}"
+password = "${file:` + secretPath + `}"
+`,
+	})
+
+	var fakeStdout bytes.Buffer
+	restore := main.MockOsStdout(&fakeStdout)
+	defer restore()
+	restore = main.MockOsArgs([]string{"blueprint", "merge", "--blueprint-vars-file", varsPath, "--blueprint-var", "USER=bob", paths[0]})
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	assert.Equal(t, `[customizations]
+hostname = "dev.example.com"
+
+[[customizations.user]]
+name = "bob"
+password = "********"
+`, fakeStdout.String())
+}
+
+func TestBlueprintMergeTemplatingOptIn(t *testing.T) {
+	t.Setenv("TEST_HOSTNAME", "dev.example.com")
+	paths := writeBlueprintLayers(t, map[string]string{
+		"base.toml": `
+[customizations]
+hostname = "${env:TEST_HOSTNAME}"
+`,
+	})
+
+	for _, tc := range []struct {
+		extraArgs []string
+		expected  string
+	}{
+		// blueprints without templating are used as they are
+		{nil, "${env:TEST_HOSTNAME}"},
+		{[]string{"--blueprint-templating"}, "dev.example.com"},
+		{[]string{"--blueprint-var=UNUSED=1"}, "dev.example.com"},
+	} {
+		t.Run(strings.Join(tc.extraArgs, ","), func(t *testing.T) {
+			var fakeStdout bytes.Buffer
+			restore := main.MockOsStdout(&fakeStdout)
+			defer restore()
+			restore = main.MockOsArgs(append(append([]string{"blueprint", "merge"}, tc.extraArgs...), paths[0]))
+			defer restore()
+
+			err := main.Run()
+			require.NoError(t, err)
+			assert.Equal(t, "[customizations]\nhostname = \""+tc.expected+"\"\n", fakeStdout.String())
+		})
+	}
+}
+
+func TestManifestUndefinedBlueprintVar(t *testing.T) {
+	paths := writeBlueprintLayers(t, map[string]string{
+		"base.toml": `
+[customizations]
+hostname = "${HOSTNAME}"
+`,
+	})
+
+	restore := main.MockOsArgs([]string{"manifest", "qcow2", "--distro=centos-9", "--arch=x86_64", "--blueprint", paths[0], "--blueprint-var", "HOST=dev"})
+	defer restore()
+
+	err := main.Run()
+	assert.EqualError(t, err, `cannot substitute the variables in "`+paths[0]+`": customizations.hostname: undefined variable "HOSTNAME"`)
+}
+
+func TestBlueprintValidate(t *testing.T) {
+	restore := main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+
+	paths := writeBlueprintLayers(t, map[string]string{
+		"base.toml": `
+[customizations]
+installation_device = "/dev/vda"
+
+[[customizations.filesystem]]
+mountpoint = "/etc"
+minsize = "1 GiB"
+
+[[customizations.directories]]
+path = "/usr/local/data"
+
+[customizations.fdo]
+diun_pub_key_hash = "sha256:abc"
+
+[customizations.installer]
+unattended = true
+`,
+	})
+
+	var fakeStdout bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+	restore = main.MockOsArgs([]string{"blueprint", "validate", "--distro=centos-9", "--arch=x86_64", "qcow2", paths[0]})
+	defer restore()
+
+	err := main.Run()
+	assert.EqualError(t, err, `blueprint is not valid for centos-9 qcow2 (x86_64): 5 problem(s) found`)
+	assert.Equal(t, `customizations.installation_device: not supported
+customizations.fdo: not supported
+customizations.installer: not supported
+customizations.filesystem: The following custom mountpoints are not supported ["/etc"]
+customizations.fdo.manufacturing_server_url: required when using fdo
+`, fakeStdout.String())
+}
+
+func TestBlueprintValidateRequired(t *testing.T) {
+	restore := main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+
+	paths := writeBlueprintLayers(t, map[string]string{
+		"base.toml": `
+[customizations]
+hostname = "${HOSTNAME}"
+`,
+	})
+
+	for _, tc := range []struct {
+		imgType        string
+		expectedOutput string
+		expectedError  string
+	}{
+		{"qcow2", "blueprint is valid for centos-9 qcow2 (x86_64)\n", ""},
+		{"edge-simplified-installer", "customizations.hostname: not supported\ncustomizations.installation_device: required\n", "blueprint is not valid for centos-9 edge-simplified-installer (x86_64): 2 problem(s) found"},
+	} {
+		t.Run(tc.imgType, func(t *testing.T) {
+			var fakeStdout bytes.Buffer
+			restore = main.MockOsStdout(&fakeStdout)
+			defer restore()
+			restore = main.MockOsArgs([]string{"blueprint", "validate", "--distro=centos-9", "--arch=x86_64", "--blueprint-var=HOSTNAME=dev", tc.imgType, paths[0]})
+			defer restore()
+
+			err := main.Run()
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedError)
+			}
+			assert.Equal(t, tc.expectedOutput, fakeStdout.String())
+		})
+	}
+}
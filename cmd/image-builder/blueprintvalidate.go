@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/osbuild/blueprint/pkg/blueprint"
+	"github.com/osbuild/images/pkg/arch"
+	"github.com/osbuild/images/pkg/distro"
+	"github.com/osbuild/images/pkg/ostree"
+
+	"github.com/osbuild/image-builder-cli/internal/blueprintload"
+)
+
+// the images library reports the (first) unsupported or missing
+// option as a warning with this prefix, these are checked here for
+// all options
+const blueprintValidationWarningPrefix = "blueprint validation failed for image type"
+
+// blueprintProblem is a problem of a blueprint, path is the key path
+// (e.g. "customizations.user[0].key") or empty if it is unknown
+type blueprintProblem struct {
+	path    string
+	message string
+}
+
+func (p blueprintProblem) String() string {
+	if p.path == "" {
+		return p.message
+	}
+	return fmt.Sprintf("%s: %s", p.path, p.message)
+}
+
+// splitOptions splits options like "customizations.kernel.name" into
+// the options that are complete on this level and the sub options
+// by their first component
+func splitOptions(options []string) (map[string]bool, map[string][]string) {
+	complete := make(map[string]bool)
+	sub := make(map[string][]string)
+	for _, option := range options {
+		if first, rest, ok := strings.Cut(option, "."); ok {
+			sub[first] = append(sub[first], rest)
+		} else {
+			complete[option] = true
+		}
+	}
+	return complete, sub
+}
+
+// checkSupportedOptions returns all set values that are not in the
+// supported options, it follows distro.ValidateConfig() but does not
+// stop at the first problem
+func checkSupportedOptions(supported []string, v reflect.Value, path string) []blueprintProblem {
+	supportedMap, subMap := splitOptions(supported)
+
+	var problems []blueprintProblem
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			problems = append(problems, checkSupportedOptions(supported, v.Field(i), path)...)
+			continue
+		}
+
+		tag := blueprintload.FieldName(f)
+		fieldPath := blueprintload.JoinPath(path, tag)
+		field := v.Field(i)
+		// non-nil empty slices are counted as empty
+		if field.IsZero() || (field.Kind() == reflect.Slice && field.Len() == 0) {
+			continue
+		}
+		subList, listed := subMap[tag]
+		if !listed {
+			if !supportedMap[tag] {
+				problems = append(problems, blueprintProblem{fieldPath, "not supported"})
+			}
+			continue
+		}
+
+		if field.Kind() == reflect.Pointer {
+			field = field.Elem()
+		}
+		switch field.Kind() {
+		case reflect.Slice:
+			for j := 0; j < field.Len(); j++ {
+				problems = append(problems, checkSupportedOptions(subList, field.Index(j), fmt.Sprintf("%s[%d]", fieldPath, j))...)
+			}
+		case reflect.Struct:
+			problems = append(problems, checkSupportedOptions(subList, field, fieldPath)...)
+		default:
+			problems = append(problems, blueprintProblem{fieldPath, fmt.Sprintf("internal error: cannot check the sub options of a %v", field.Kind())})
+		}
+	}
+	return problems
+}
+
+func fieldByJSONTag(v reflect.Value, tag string) (reflect.Value, bool) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.Anonymous {
+			if field, ok := fieldByJSONTag(v.Field(i), tag); ok {
+				return field, true
+			}
+			continue
+		}
+		if blueprintload.FieldName(f) == tag {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// checkRequiredOptions returns all required options that are not set,
+// like checkSupportedOptions it follows distro.ValidateConfig()
+func checkRequiredOptions(required []string, v reflect.Value, path string) []blueprintProblem {
+	requiredMap, subMap := splitOptions(required)
+	// if any sub option is required the option is required too
+	for key := range subMap {
+		requiredMap[key] = true
+	}
+
+	var problems []blueprintProblem
+	keys := make([]string, 0, len(requiredMap))
+	for key := range requiredMap {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		keyPath := blueprintload.JoinPath(path, key)
+		field, ok := fieldByJSONTag(v, key)
+		if !ok {
+			problems = append(problems, blueprintProblem{keyPath, "internal error: unknown option"})
+			continue
+		}
+		// the zero value of other kinds (e.g. false) can be valid
+		switch field.Kind() {
+		case reflect.Pointer, reflect.Struct, reflect.String, reflect.Slice:
+			if field.IsZero() {
+				problems = append(problems, blueprintProblem{keyPath, "required"})
+				continue
+			}
+		default:
+			problems = append(problems, blueprintProblem{keyPath, fmt.Sprintf("internal error: a %v cannot be required", field.Kind())})
+			continue
+		}
+
+		subList, ok := subMap[key]
+		if !ok {
+			continue
+		}
+		if field.Kind() == reflect.Pointer {
+			field = field.Elem()
+		}
+		switch field.Kind() {
+		case reflect.Struct:
+			problems = append(problems, checkRequiredOptions(subList, field, keyPath)...)
+		case reflect.Slice:
+			for j := 0; j < field.Len(); j++ {
+				problems = append(problems, checkRequiredOptions(subList, field.Index(j), fmt.Sprintf("%s[%d]", keyPath, j))...)
+			}
+		default:
+			problems = append(problems, blueprintProblem{keyPath, fmt.Sprintf("internal error: cannot check the sub options of a %v", field.Kind())})
+		}
+	}
+	return problems
+}
+
+// checkDistroLimits returns the error of the checks that the image
+// type does when the manifest is generated, e.g. for the mountpoints
+// that the distribution allows, and the warnings (that fail a build
+// too)
+func checkDistroLimits(bp *blueprint.Blueprint, imgType distro.ImageType) ([]string, error) {
+	var opts distro.ImageOptions
+	if imgType.OSTreeRef() != "" {
+		// ostree images need a url (e.g. from --ostree-url), without
+		// one the checks would stop before the blueprint is checked
+		opts.OSTree = &ostree.ImageOptions{URL: "https://ostree.example.com/repo"}
+	}
+	// no repositories are needed as nothing is depsolved
+	_, warnings, err := imgType.Manifest(bp, opts, nil, nil)
+	return warnings, err
+}
+
+// distroLimitProblem returns the problem for an error of
+// checkDistroLimits, the generic prefix of the error is removed
+func distroLimitProblem(path string, err error, imgType distro.ImageType) blueprintProblem {
+	msg := strings.TrimPrefix(err.Error(), fmt.Sprintf("%s %q: ", blueprintValidationWarningPrefix, imgType.Name()))
+	if strings.HasPrefix(msg, path) {
+		// e.g. "customizations.fdo.manufacturing_server_url: required"
+		return blueprintProblem{message: msg}
+	}
+	return blueprintProblem{path, msg}
+}
+
+// validateBlueprint returns all problems of the blueprint for the
+// given image type: the options that the image type does not support
+// or requires and the limits of the distribution
+func validateBlueprint(bp *blueprint.Blueprint, imgType distro.ImageType) []blueprintProblem {
+	bpv := reflect.ValueOf(*bp)
+	problems := checkSupportedOptions(imgType.SupportedBlueprintOptions(), bpv, "")
+	problems = append(problems, checkRequiredOptions(imgType.RequiredBlueprintOptions(), bpv, "")...)
+
+	// the distribution checks stop at the first problem, check every
+	// customization on its own to find all of them with their path
+	reported := make(map[string]bool)
+	if bp.Customizations != nil {
+		cv := reflect.ValueOf(*bp.Customizations)
+		for i := 0; i < cv.NumField(); i++ {
+			if cv.Field(i).IsZero() {
+				continue
+			}
+			var single blueprint.Customizations
+			reflect.ValueOf(&single).Elem().Field(i).Set(cv.Field(i))
+			singleBp := *bp
+			singleBp.Customizations = &single
+			if _, err := checkDistroLimits(&singleBp, imgType); err != nil {
+				path := blueprintload.JoinPath("customizations", blueprintload.FieldName(cv.Type().Field(i)))
+				problems = append(problems, distroLimitProblem(path, err, imgType))
+				reported[err.Error()] = true
+			}
+		}
+	}
+	// and all of them together for the checks that combine
+	// customizations (e.g. customizations.disk and .filesystem)
+	warnings, err := checkDistroLimits(bp, imgType)
+	for _, warning := range warnings {
+		if !strings.HasPrefix(warning, blueprintValidationWarningPrefix) {
+			problems = append(problems, blueprintProblem{message: strings.TrimSpace(warning)})
+		}
+	}
+	if err != nil && !reported[err.Error()] {
+		problems = append(problems, distroLimitProblem("", err, imgType))
+	}
+	return problems
+}
+
+func cmdBlueprintValidate(cmd *cobra.Command, args []string) error {
+	repoDir, err := cmd.Flags().GetString("force-repo-dir")
+	if err != nil {
+		return err
+	}
+	distroStr, err := cmd.Flags().GetString("distro")
+	if err != nil {
+		return err
+	}
+	archStr, err := cmd.Flags().GetString("arch")
+	if err != nil {
+		return err
+	}
+	if archStr == "" {
+		archStr = arch.Current().String()
+	}
+	forceDefsDir, err := cmd.Flags().GetString("force-defs-dir")
+	if err != nil {
+		return err
+	}
+	vars, err := blueprintVarsFromCmd(cmd)
+	if err != nil {
+		return err
+	}
+	// the values of the secrets do not matter for the validation
+	if vars != nil {
+		vars.MaskSecrets = true
+	}
+
+	imgTypeStr, blueprintPaths := args[0], args[1:]
+	bp, err := blueprintload.LoadAll(blueprintPaths, vars)
+	if err != nil {
+		return err
+	}
+	distroStr, err = findDistro(distroStr, bp.Distro)
+	if err != nil {
+		return err
+	}
+	res, err := getOneImage(distroStr, imgTypeStr, archStr, &repoOptions{RepoDir: repoDir, ForceDefsDir: forceDefsDir})
+	if err != nil {
+		return err
+	}
+
+	a := res.ImgType.Arch()
+	target := fmt.Sprintf("%s %s (%s)", a.Distro().Name(), res.ImgType.Name(), a.Name())
+	problems := validateBlueprint(bp, res.ImgType)
+	if len(problems) == 0 {
+		fmt.Fprintf(cmd.OutOrStdout(), "blueprint is valid for %s\n", target)
+		return nil
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(cmd.OutOrStdout(), problem)
+	}
+	return fmt.Errorf("blueprint is not valid for %s: %d problem(s) found", target, len(problems))
+}
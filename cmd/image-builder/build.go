@@ -4,12 +4,28 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/osbuild/image-builder-cli/pkg/progress"
 	"github.com/osbuild/images/pkg/imagefilter"
 )
 
+// buildJob contains a single image type that is part of a (potentially
+// multi image type) build and its result
+type buildJob struct {
+	res       *imagefilter.Result
+	manifest  []byte
+	uploaders []namedUploader
+	outputDir string
+	metadata  *artifactMetadata
+
+	imagePath string
+	err       error
+}
+
+func (job *buildJob) name() string {
+	return basenameFor(job.res, "")
+}
+
 type buildOptions struct {
 	OutputDir      string
 	StoreDir       string
@@ -19,6 +35,15 @@ type buildOptions struct {
 	WriteManifest bool
 	WriteBuildlog bool
 	Metrics       bool
+	// CacheMaxSize is passed to osbuild, 0 uses the default
+	CacheMaxSize int64
+	// Offline fails early if a source of the manifest is not
+	// in the store yet and keeps osbuild from downloading anything
+	Offline bool
+
+	// Metadata is written next to the artifact, if unset only the
+	// details of the artifact itself are written
+	Metadata *artifactMetadata
 }
 
 func buildImage(pbar progress.ProgressBar, res *imagefilter.Result, osbuildManifest []byte, opts *buildOptions) (string, error) {
@@ -27,6 +52,17 @@ func buildImage(pbar progress.ProgressBar, res *imagefilter.Result, osbuildManif
 	}
 
 	basename := basenameFor(res, opts.OutputBasename)
+	export := &manifestExport{
+		Pipeline: res.ImgType.Exports()[0],
+		Filename: res.ImgType.Filename(),
+	}
+	return buildArtifact(pbar, export, basename, osbuildManifest, opts)
+}
+
+// buildArtifact runs osbuild for the given manifest and moves the
+// artifact from the given export to "<basename>.<ext>" in the output
+// directory.
+func buildArtifact(pbar progress.ProgressBar, export *manifestExport, basename string, osbuildManifest []byte, opts *buildOptions) (string, error) {
 	if opts.WriteManifest {
 		p := filepath.Join(opts.OutputDir, fmt.Sprintf("%s.osbuild-manifest.json", basename))
 		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
@@ -37,11 +73,21 @@ func buildImage(pbar progress.ProgressBar, res *imagefilter.Result, osbuildManif
 		}
 	}
 
+	if opts.Offline {
+		if err := checkOfflineSources(opts.StoreDir, osbuildManifest); err != nil {
+			return "", err
+		}
+	}
+
 	osbuildOpts := &progress.OSBuildOptions{
-		StoreDir:  opts.StoreDir,
-		OutputDir: opts.OutputDir,
-		Metrics:   opts.Metrics,
-		InVm:      opts.InVm,
+		StoreDir:     opts.StoreDir,
+		OutputDir:    opts.OutputDir,
+		Metrics:      opts.Metrics,
+		InVm:         opts.InVm,
+		CacheMaxSize: opts.CacheMaxSize,
+	}
+	if opts.Offline {
+		osbuildOpts.ExtraEnv = offlineEnv
 	}
 	if opts.WriteBuildlog {
 		if err := os.MkdirAll(opts.OutputDir, 0755); err != nil {
@@ -56,21 +102,31 @@ func buildImage(pbar progress.ProgressBar, res *imagefilter.Result, osbuildManif
 
 		osbuildOpts.BuildLog = f
 	}
-	if err := progress.RunOSBuild(pbar, osbuildManifest, res.ImgType.Exports(), osbuildOpts); err != nil {
+	if err := progress.RunOSBuild(pbar, osbuildManifest, []string{export.Pipeline}, osbuildOpts); err != nil {
 		return "", err
 	}
 	// Rename *sigh*, see https://github.com/osbuild/images/pull/1039
 	// for my preferred way. Every frontend to images has to duplicate
 	// similar code like this.
-	pipelineDir := filepath.Join(opts.OutputDir, res.ImgType.Exports()[0])
-	srcName := filepath.Join(pipelineDir, res.ImgType.Filename())
-	imgExt := strings.SplitN(res.ImgType.Filename(), ".", 2)[1]
-	dstName := filepath.Join(opts.OutputDir, fmt.Sprintf("%s.%v", basename, imgExt))
+	pipelineDir := filepath.Join(opts.OutputDir, export.Pipeline)
+	srcName := filepath.Join(pipelineDir, export.Filename)
+	dstName := filepath.Join(opts.OutputDir, basename)
+	if imgExt := export.Ext(); imgExt != "" {
+		dstName = fmt.Sprintf("%s.%v", dstName, imgExt)
+	}
 	if err := os.Rename(srcName, dstName); err != nil {
 		return "", fmt.Errorf("cannot rename artifact to final name: %w", err)
 	}
 	// best effort, remove the now empty pipeline export dir from osbuild
 	_ = os.Remove(pipelineDir)
 
+	md := opts.Metadata
+	if md == nil {
+		md = &artifactMetadata{}
+	}
+	if err := writeArtifactMetadata(md, dstName, metadataPathFor(opts.OutputDir, basename)); err != nil {
+		return "", err
+	}
+
 	return dstName, nil
 }
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/osbuild/images/pkg/datasizes"
+
+	"github.com/osbuild/image-builder-cli/pkg/progress"
+)
+
+// cacheMaxSizeConfigFile contains the maximum size of the osbuild
+// store as set via "system cache set-max-size", it is passed to
+// osbuild via --cache-max-size. Note that "cache.size" is managed by
+// osbuild itself.
+const cacheMaxSizeConfigFile = "cache.max-size"
+
+// parseCacheMaxSize parses a size like "50 GiB" or "unlimited"
+func parseCacheMaxSize(s string) (int64, error) {
+	if s == "unlimited" {
+		return progress.CacheMaxSizeUnlimited, nil
+	}
+	size, err := datasizes.Parse(s)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse cache size %q: %w", s, err)
+	}
+	if size == 0 {
+		return 0, fmt.Errorf("cannot use a cache size of 0, use \"unlimited\" to disable the limit")
+	}
+	return int64(size), nil
+}
+
+// readConfiguredCacheMaxSize returns the maximum size of the given
+// osbuild store, 0 means that it was never configured.
+func readConfiguredCacheMaxSize(storeDir string) (int64, error) {
+	b, err := os.ReadFile(filepath.Join(storeDir, cacheMaxSizeConfigFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot read cache max size: %w", err)
+	}
+	s := strings.TrimSpace(string(b))
+	if s == "unlimited" {
+		return progress.CacheMaxSizeUnlimited, nil
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("cannot use cache max size %q from %q", s, filepath.Join(storeDir, cacheMaxSizeConfigFile))
+	}
+	return size, nil
+}
+
+func writeConfiguredCacheMaxSize(storeDir string, size int64) error {
+	s := strconv.FormatInt(size, 10)
+	if size == progress.CacheMaxSizeUnlimited {
+		s = "unlimited"
+	}
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		return fmt.Errorf("cannot create cache directory %q: %w", storeDir, err)
+	}
+	return os.WriteFile(filepath.Join(storeDir, cacheMaxSizeConfigFile), []byte(s+"\n"), 0644)
+}
+
+// cacheMaxSizeFromCmd returns the maximum size of the osbuild store,
+// the "--cache-max-size" flag wins over the configured size.
+func cacheMaxSizeFromCmd(cmd *cobra.Command, storeDir string) (int64, error) {
+	s, err := cmd.Flags().GetString("cache-max-size")
+	if err != nil {
+		return 0, err
+	}
+	if s != "" {
+		return parseCacheMaxSize(s)
+	}
+	return readConfiguredCacheMaxSize(storeDir)
+}
+
+func formatCacheMaxSize(size int64) string {
+	switch size {
+	case progress.CacheMaxSizeUnlimited:
+		return "unlimited"
+	case 0:
+		return fmt.Sprintf("%s (default)", formatSize(progress.DefaultCacheMaxSize))
+	default:
+		return formatSize(size)
+	}
+}
+
+// defaultRpmmdCacheDir returns the rpm metadata cache directory that
+// is used when no --rpmmd-cache is given, this is the same directory
+// that manifestgen uses.
+func defaultRpmmdCacheDir() string {
+	if cacheHome := os.Getenv("XDG_CACHE_HOME"); cacheHome != "" {
+		return filepath.Join(cacheHome, "osbuild-depsolve-dnf")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".cache", "osbuild-depsolve-dnf")
+}
+
+// cacheEntry is a single entry of the osbuild store (an object or a
+// source item) or of the rpm metadata cache
+type cacheEntry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// statCacheEntry returns the size of the given entry and the time of
+// its most recent modification.
+func statCacheEntry(path string) (cacheEntry, error) {
+	entry := cacheEntry{Path: path}
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			entry.Size += info.Size()
+		}
+		if info.ModTime().After(entry.ModTime) {
+			entry.ModTime = info.ModTime()
+		}
+		return nil
+	})
+	return entry, err
+}
+
+// listCacheEntries returns the prunable entries of the given osbuild
+// store and rpm metadata cache, the oldest entries come first.
+func listCacheEntries(storeDir, rpmmdCacheDir string) ([]cacheEntry, error) {
+	patterns := []string{
+		filepath.Join(storeDir, "objects", "*"),
+		filepath.Join(storeDir, "sources", "*", "*"),
+	}
+	if rpmmdCacheDir != "" {
+		// the metadata is cached per distro
+		patterns = append(patterns, filepath.Join(rpmmdCacheDir, "*", "*"))
+	}
+	return statCacheGlobs(patterns)
+}
+
+func statCacheGlobs(patterns []string) ([]cacheEntry, error) {
+	var entries []cacheEntry
+	for _, pattern := range patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			entry, err := statCacheEntry(p)
+			if err != nil {
+				return nil, fmt.Errorf("cannot inspect cache entry: %w", err)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	slices.SortStableFunc(entries, func(a, b cacheEntry) int {
+		return a.ModTime.Compare(b.ModTime)
+	})
+	return entries, nil
+}
+
+// selectPrunable returns the entries that are older than olderThan
+// and then the oldest entries until the remaining entries fit into
+// maxSize. A zero olderThan or maxSize is ignored.
+func selectPrunable(entries []cacheEntry, now time.Time, olderThan time.Duration, maxSize int64) (prune []cacheEntry, keep []cacheEntry) {
+	for _, entry := range entries {
+		if olderThan > 0 && now.Sub(entry.ModTime) > olderThan {
+			prune = append(prune, entry)
+			continue
+		}
+		keep = append(keep, entry)
+	}
+	if maxSize > 0 {
+		total := totalCacheSize(keep)
+		for len(keep) > 0 && total > maxSize {
+			total -= keep[0].Size
+			prune = append(prune, keep[0])
+			keep = keep[1:]
+		}
+	}
+	return prune, keep
+}
+
+func totalCacheSize(entries []cacheEntry) int64 {
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+	return total
+}
+
+// parseAge parses a duration like "36h" and additionally supports
+// days, e.g. "30d"
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseUint(days, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse age %q: %w", s, err)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse age %q: %w", s, err)
+	}
+	return d, nil
+}
+
+func cacheDirsFromCmd(cmd *cobra.Command) (string, string, error) {
+	storeDir, err := cmd.Flags().GetString("cache")
+	if err != nil {
+		return "", "", err
+	}
+	rpmmdCacheDir, err := cmd.Flags().GetString("rpmmd-cache")
+	if err != nil {
+		return "", "", err
+	}
+	return storeDir, rpmmdCacheDir, nil
+}
+
+// removeCacheEntries removes (or with dryRun just reports) the given
+// entries
+func removeCacheEntries(cmd *cobra.Command, entries []cacheEntry, dryRun bool) error {
+	for _, entry := range entries {
+		if dryRun {
+			fmt.Fprintf(cmd.OutOrStdout(), "would remove %s (%s)\n", entry.Path, formatSize(entry.Size))
+			continue
+		}
+		if err := os.RemoveAll(entry.Path); err != nil {
+			return fmt.Errorf("cannot remove cache entry: %w", err)
+		}
+	}
+	return nil
+}
+
+func cmdSystemCachePrune(cmd *cobra.Command, args []string) error {
+	storeDir, rpmmdCacheDir, err := cacheDirsFromCmd(cmd)
+	if err != nil {
+		return err
+	}
+	olderThanStr, err := cmd.Flags().GetString("older-than")
+	if err != nil {
+		return err
+	}
+	maxSizeStr, err := cmd.Flags().GetString("max-size")
+	if err != nil {
+		return err
+	}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	if olderThanStr == "" && maxSizeStr == "" {
+		return fmt.Errorf("need --older-than or --max-size (or both)")
+	}
+	var olderThan time.Duration
+	if olderThanStr != "" {
+		olderThan, err = parseAge(olderThanStr)
+		if err != nil {
+			return err
+		}
+	}
+	var maxSize int64
+	if maxSizeStr != "" {
+		size, err := datasizes.Parse(maxSizeStr)
+		if err != nil {
+			return fmt.Errorf("cannot parse --max-size %q: %w", maxSizeStr, err)
+		}
+		maxSize = int64(size)
+	}
+
+	entries, err := listCacheEntries(storeDir, rpmmdCacheDir)
+	if err != nil {
+		return err
+	}
+	prune, keep := selectPrunable(entries, time.Now(), olderThan, maxSize)
+	if err := removeCacheEntries(cmd, prune, dryRun); err != nil {
+		return err
+	}
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "%s %d cache entries (%s), %s left in the cache\n", verb, len(prune), formatSize(totalCacheSize(prune)), formatSize(totalCacheSize(keep)))
+	return nil
+}
+
+// osbuildStoreCacheDirs are the directories of the osbuild store that
+// contain cached data
+var osbuildStoreCacheDirs = []string{"objects", "refs", "sources", "tmp"}
+
+func cmdSystemCacheClear(cmd *cobra.Command, args []string) error {
+	storeDir, rpmmdCacheDir, err := cacheDirsFromCmd(cmd)
+	if err != nil {
+		return err
+	}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+
+	// only the cached data, the rest of the store (e.g. its lock
+	// files) may be used by an osbuild that is running right now
+	var patterns []string
+	for _, dir := range osbuildStoreCacheDirs {
+		patterns = append(patterns, filepath.Join(storeDir, dir))
+	}
+	if rpmmdCacheDir != "" {
+		patterns = append(patterns, filepath.Join(rpmmdCacheDir, "*"))
+	}
+	entries, err := statCacheGlobs(patterns)
+	if err != nil {
+		return err
+	}
+	if err := removeCacheEntries(cmd, entries, dryRun); err != nil {
+		return err
+	}
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "%s %d cache entries (%s)\n", verb, len(entries), formatSize(totalCacheSize(entries)))
+	return nil
+}
+
+func cmdSystemCacheSetMaxSize(cmd *cobra.Command, args []string) error {
+	storeDir, err := cmd.Flags().GetString("cache")
+	if err != nil {
+		return err
+	}
+	size, err := parseCacheMaxSize(args[0])
+	if err != nil {
+		return err
+	}
+	if err := writeConfiguredCacheMaxSize(storeDir, size); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "Maximum size of the osbuild cache in %s set to %s\n", storeDir, formatCacheMaxSize(size))
+	return nil
+}
@@ -0,0 +1,232 @@
+package main_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+	"github.com/osbuild/image-builder-cli/internal/testutil"
+)
+
+// makeTestCacheEntry creates a cache entry of the given size that was
+// last modified "age" ago, if a filename is given the entry is a
+// directory that contains this file
+func makeTestCacheEntry(t *testing.T, path, filename string, size int, age time.Duration) {
+	t.Helper()
+	filePath := path
+	if filename != "" {
+		filePath = filepath.Join(path, filename)
+	}
+	require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+	require.NoError(t, os.WriteFile(filePath, bytes.Repeat([]byte("x"), size), 0644))
+	mtime := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(filePath, mtime, mtime))
+	require.NoError(t, os.Chtimes(path, mtime, mtime))
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+func makeTestCache(t *testing.T) (storeDir, rpmmdCacheDir string) {
+	tmpdir := t.TempDir()
+	storeDir = filepath.Join(tmpdir, "store")
+	rpmmdCacheDir = filepath.Join(tmpdir, "rpmmd")
+
+	day := 24 * time.Hour
+	makeTestCacheEntry(t, filepath.Join(storeDir, "objects", "old-object"), "data", 1024, 40*day)
+	makeTestCacheEntry(t, filepath.Join(storeDir, "objects", "new-object"), "data", 2048, 1*day)
+	makeTestCacheEntry(t, filepath.Join(storeDir, "sources", "org.osbuild.files", "sha256:old"), "", 512, 35*day)
+	makeTestCacheEntry(t, filepath.Join(storeDir, "sources", "org.osbuild.files", "sha256:new"), "", 512, 2*day)
+	makeTestCacheEntry(t, filepath.Join(rpmmdCacheDir, "centos-9", "baseos"), "repomd.xml", 1024, 10*day)
+	makeTestCacheEntry(t, filepath.Join(storeDir, "cache.max-size"), "", 0, 50*day)
+	return storeDir, rpmmdCacheDir
+}
+
+func runSystemCache(t *testing.T, storeDir, rpmmdCacheDir string, args ...string) (string, error) {
+	t.Helper()
+	restore := main.MockOsArgs(append([]string{"system", "cache"}, append(args, "--cache", storeDir, "--rpmmd-cache", rpmmdCacheDir)...))
+	defer restore()
+
+	var fakeStdout bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+
+	err := main.Run()
+	return fakeStdout.String(), err
+}
+
+func TestSystemCachePrune(t *testing.T) {
+	for _, tc := range []struct {
+		args            []string
+		expectedRemoved []string
+		expectedOutput  string
+	}{
+		{
+			[]string{"--older-than", "30d"},
+			[]string{"objects/old-object", "sources/org.osbuild.files/sha256:old"},
+			"Removed 2 cache entries (1.5 KiB), 3.5 KiB left in the cache\n",
+		}, {
+			[]string{"--older-than", "168h"},
+			[]string{"objects/old-object", "sources/org.osbuild.files/sha256:old", "rpmmd/centos-9/baseos"},
+			"Removed 3 cache entries (2.5 KiB), 2.5 KiB left in the cache\n",
+		}, {
+			// the oldest entries are removed first
+			[]string{"--max-size", "2560"},
+			[]string{"objects/old-object", "sources/org.osbuild.files/sha256:old", "rpmmd/centos-9/baseos"},
+			"Removed 3 cache entries (2.5 KiB), 2.5 KiB left in the cache\n",
+		}, {
+			[]string{"--older-than", "30d", "--max-size", "3 KiB"},
+			[]string{"objects/old-object", "sources/org.osbuild.files/sha256:old", "rpmmd/centos-9/baseos"},
+			"Removed 3 cache entries (2.5 KiB), 2.5 KiB left in the cache\n",
+		}, {
+			[]string{"--older-than", "60d"},
+			nil,
+			"Removed 0 cache entries (0 B), 5.0 KiB left in the cache\n",
+		},
+	} {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			storeDir, rpmmdCacheDir := makeTestCache(t)
+			tmpdir := filepath.Dir(storeDir)
+			pathFor := func(p string) string {
+				if strings.HasPrefix(p, "rpmmd/") {
+					return filepath.Join(tmpdir, p)
+				}
+				return filepath.Join(storeDir, p)
+			}
+
+			// nothing is removed with --dry-run
+			output, err := runSystemCache(t, storeDir, rpmmdCacheDir, append([]string{"prune", "--dry-run"}, tc.args...)...)
+			require.NoError(t, err)
+			for _, p := range tc.expectedRemoved {
+				assert.Contains(t, output, fmt.Sprintf("would remove %s ", pathFor(p)))
+				assert.True(t, exists(pathFor(p)))
+			}
+			assert.Contains(t, output, strings.Replace(tc.expectedOutput, "Removed", "Would remove", 1))
+
+			output, err = runSystemCache(t, storeDir, rpmmdCacheDir, append([]string{"prune"}, tc.args...)...)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedOutput, output)
+			for _, p := range []string{"objects/old-object", "objects/new-object", "sources/org.osbuild.files/sha256:old", "sources/org.osbuild.files/sha256:new", "rpmmd/centos-9/baseos"} {
+				assert.Equal(t, !slices.Contains(tc.expectedRemoved, p), exists(pathFor(p)), p)
+			}
+			// the configuration is never pruned
+			assert.FileExists(t, filepath.Join(storeDir, "cache.max-size"))
+		})
+	}
+}
+
+func TestSystemCacheClear(t *testing.T) {
+	storeDir, rpmmdCacheDir := makeTestCache(t)
+	makeTestCacheEntry(t, filepath.Join(storeDir, "refs"), "abc", 1024, 0)
+	// not part of the cache, e.g. used by a running osbuild
+	makeTestCacheEntry(t, filepath.Join(storeDir, "stage"), "lock", 0, 0)
+
+	output, err := runSystemCache(t, storeDir, rpmmdCacheDir, "clear", "--dry-run")
+	require.NoError(t, err)
+	assert.Contains(t, output, fmt.Sprintf("would remove %s (3.0 KiB)\n", filepath.Join(storeDir, "objects")))
+	assert.Contains(t, output, "Would remove 4 cache entries (6.0 KiB)\n")
+	assert.DirExists(t, filepath.Join(storeDir, "objects"))
+
+	output, err = runSystemCache(t, storeDir, rpmmdCacheDir, "clear")
+	require.NoError(t, err)
+	assert.Equal(t, "Removed 4 cache entries (6.0 KiB)\n", output)
+	for _, dir := range []string{storeDir, rpmmdCacheDir} {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		if dir == storeDir {
+			assert.Equal(t, []string{"cache.max-size", "stage"}, names)
+		} else {
+			assert.Empty(t, names)
+		}
+	}
+}
+
+func TestSystemCacheSetMaxSize(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+	restore = main.MockOsbuildVersion(func() (string, error) { return "999", nil })
+	defer restore()
+	restore = main.MockDirSize(func(string) (int64, error) { return 0, nil })
+	defer restore()
+
+	storeDir := filepath.Join(t.TempDir(), "store")
+	restore = main.MockGetCacheDir(func() string { return storeDir })
+	defer restore()
+
+	output, err := runSystemCache(t, storeDir, "", "set-max-size", "50 GiB")
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("Maximum size of the osbuild cache in %s set to 50.0 GiB\n", storeDir), output)
+
+	// "system" shows the configured size
+	cache := cacheFromRaw(t, runSystemRaw(t))
+	assert.Equal(t, float64(50*1024*1024*1024), cache["max-size"])
+
+	// and it is passed to osbuild unless overridden
+	mf := generateTestManifest(t, "centos-9", "qcow2")
+	manifestPath := filepath.Join(t.TempDir(), "centos-9-qcow2-x86_64.osbuild-manifest.json")
+	require.NoError(t, os.WriteFile(manifestPath, mf, 0644))
+	for _, tc := range []struct {
+		extraArgs []string
+		expected  string
+	}{
+		{nil, "--cache-max-size=53687091200"},
+		{[]string{"--cache-max-size", "1 GiB"}, "--cache-max-size=1073741824"},
+		{[]string{"--cache-max-size", "unlimited"}, "--cache-max-size=unlimited"},
+	} {
+		restore := main.MockOsArgs(append([]string{
+			"build",
+			"--from-manifest", manifestPath,
+			"--cache", storeDir,
+			"--output-dir", t.TempDir(),
+		}, tc.extraArgs...))
+		defer restore()
+		restore = main.MockOsStdout(&bytes.Buffer{})
+		defer restore()
+		fakeOsbuildCmd := testutil.MockCommand(t, "osbuild", makeFakeOsbuildScript())
+
+		err := main.Run()
+		require.NoError(t, err)
+		require.Equal(t, 1, len(fakeOsbuildCmd.CallArgsList()))
+		assert.Contains(t, fakeOsbuildCmd.CallArgsList()[0], tc.expected)
+	}
+
+	output, err = runSystemCache(t, storeDir, "", "set-max-size", "unlimited")
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("Maximum size of the osbuild cache in %s set to unlimited\n", storeDir), output)
+	cache = cacheFromRaw(t, runSystemRaw(t))
+	assert.Equal(t, "unlimited", cache["max-size"])
+}
+
+func TestSystemCacheErrors(t *testing.T) {
+	storeDir, rpmmdCacheDir := makeTestCache(t)
+
+	for _, tc := range []struct {
+		args        []string
+		expectedErr string
+	}{
+		{[]string{"prune"}, "need --older-than or --max-size (or both)"},
+		{[]string{"prune", "--older-than", "forever"}, `cannot parse age "forever": time: invalid duration "forever"`},
+		{[]string{"prune", "--max-size", "lots"}, `cannot parse --max-size "lots": the size string is not a valid positive float number: lots`},
+		{[]string{"set-max-size", "0"}, `cannot use a cache size of 0, use "unlimited" to disable the limit`},
+	} {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			_, err := runSystemCache(t, storeDir, rpmmdCacheDir, tc.args...)
+			assert.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
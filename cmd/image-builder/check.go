@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"github.com/osbuild/images/pkg/arch"
+
+	"github.com/osbuild/image-builder-cli/pkg/setup"
+)
+
+// minOsbuildVersion is the oldest osbuild that can build the
+// manifests we generate (librepo sources are used by default)
+const minOsbuildVersion = 138
+
+type checkStatus string
+
+const (
+	checkPass checkStatus = "pass"
+	checkWarn checkStatus = "warn"
+	checkFail checkStatus = "fail"
+)
+
+type checkResult struct {
+	Name    string      `yaml:"name" json:"name"`
+	Status  checkStatus `yaml:"status" json:"status"`
+	Message string      `yaml:"message" json:"message"`
+	Hint    string      `yaml:"hint,omitempty" json:"hint,omitempty"`
+}
+
+type checkOptions struct {
+	StoreDir string
+	Arch     string
+}
+
+// hostCheck probes a single aspect of the build host, it returns nil
+// if the check does not apply to this host
+type hostCheck func(opts *checkOptions) *checkResult
+
+var hostChecks = []hostCheck{
+	checkOsbuild,
+	checkDepsolver,
+	checkRoot,
+	checkStore,
+	checkLoopDevices,
+	checkSELinux,
+	checkContainer,
+	checkContainerStorage,
+	checkTargetArch,
+}
+
+var depsolveDnfLocations = []string{"/usr/libexec/osbuild-depsolve-dnf", "/usr/lib/osbuild/osbuild-depsolve-dnf"}
+
+func checkOsbuild(opts *checkOptions) *checkResult {
+	res := &checkResult{Name: "osbuild"}
+	ver, err := osbuildVersion()
+	if err != nil {
+		res.Status = checkFail
+		res.Message = fmt.Sprintf("cannot run osbuild: %v", err)
+		res.Hint = "install osbuild (e.g. dnf install osbuild osbuild-depsolve-dnf)"
+		return res
+	}
+	major, _, _ := strings.Cut(ver, ".")
+	n, err := strconv.Atoi(major)
+	switch {
+	case err != nil:
+		res.Status = checkWarn
+		res.Message = fmt.Sprintf("cannot parse osbuild version %q", ver)
+	case n < minOsbuildVersion:
+		res.Status = checkFail
+		res.Message = fmt.Sprintf("osbuild version %s is too old, need at least %d", ver, minOsbuildVersion)
+		res.Hint = "update osbuild (e.g. dnf upgrade osbuild)"
+	default:
+		res.Status = checkPass
+		res.Message = fmt.Sprintf("osbuild version %s", ver)
+	}
+	return res
+}
+
+func checkDepsolver(opts *checkOptions) *checkResult {
+	res := &checkResult{Name: "depsolver"}
+	for _, p := range depsolveDnfLocations {
+		if _, err := os.Stat(p); err == nil {
+			res.Status = checkPass
+			res.Message = fmt.Sprintf("found %s", p)
+			return res
+		}
+	}
+	res.Status = checkFail
+	res.Message = "cannot find osbuild-depsolve-dnf"
+	res.Hint = "install osbuild-depsolve-dnf"
+	return res
+}
+
+func checkRoot(opts *checkOptions) *checkResult {
+	res := &checkResult{Name: "root"}
+	if os.Geteuid() != 0 {
+		res.Status = checkWarn
+		res.Message = "not running as root"
+		res.Hint = "building images needs root, use sudo for \"image-builder build\""
+		return res
+	}
+	res.Status = checkPass
+	res.Message = "running as root"
+	return res
+}
+
+func checkStore(opts *checkOptions) *checkResult {
+	res := &checkResult{Name: "store"}
+	if err := setup.ValidateStoreWritable(opts.StoreDir); err != nil {
+		res.Status = checkFail
+		res.Message = err.Error()
+		res.Hint = "use --cache to specify a writable path or run as root"
+		return res
+	}
+	res.Status = checkPass
+	res.Message = fmt.Sprintf("%s is writable", opts.StoreDir)
+	return res
+}
+
+func checkLoopDevices(opts *checkOptions) *checkResult {
+	res := &checkResult{Name: "loop-devices"}
+	if setupIsContainer() {
+		// the container setup mounts a fresh devtmpfs when building
+		res.Status = checkPass
+		res.Message = "loop devices are set up when building"
+		return res
+	}
+	if err := setup.ValidateHasLoopDevices(); err != nil {
+		res.Status = checkFail
+		res.Message = err.Error()
+		res.Hint = "load the loop kernel module (modprobe loop)"
+		return res
+	}
+	res.Status = checkPass
+	res.Message = "loop devices are available"
+	return res
+}
+
+func checkSELinux(opts *checkOptions) *checkResult {
+	res := &checkResult{Name: "selinux"}
+	if !setup.SELinuxEnforcing() {
+		res.Status = checkPass
+		res.Message = "SELinux is not enforcing"
+		return res
+	}
+	osbuildPath, err := exec.LookPath("osbuild")
+	if err != nil {
+		// reported by the osbuild check already
+		return nil
+	}
+	if err := setup.ValidateOsbuildSELinuxLabel(osbuildPath); err != nil {
+		res.Status = checkWarn
+		res.Message = err.Error()
+		res.Hint = "install osbuild-selinux or run \"restorecon " + osbuildPath + "\", otherwise labels that are unknown to the host cannot be set in the image"
+		return res
+	}
+	res.Status = checkPass
+	res.Message = "osbuild has the expected SELinux label"
+	return res
+}
+
+func checkContainer(opts *checkOptions) *checkResult {
+	if !setupIsContainer() {
+		return nil
+	}
+	res := &checkResult{Name: "container"}
+	if err := setup.Validate("", false); err != nil {
+		res.Status = checkFail
+		res.Message = err.Error()
+		res.Hint = "run the container with rootful podman and --privileged"
+		return res
+	}
+	res.Status = checkPass
+	res.Message = "running in a privileged container"
+	return res
+}
+
+func checkContainerStorage(opts *checkOptions) *checkResult {
+	if !setupIsContainer() {
+		return nil
+	}
+	res := &checkResult{Name: "container-storage"}
+	if err := setup.ValidateHasContainerStorageMounted(); err != nil {
+		res.Status = checkWarn
+		res.Message = err.Error()
+		res.Hint = "add -v /var/lib/containers/storage:/var/lib/containers/storage to build bootc based images"
+		return res
+	}
+	res.Status = checkPass
+	res.Message = "container storage is mounted"
+	return res
+}
+
+func checkTargetArch(opts *checkOptions) *checkResult {
+	if opts.Arch == "" || opts.Arch == arch.Current().String() {
+		return nil
+	}
+	res := &checkResult{Name: "target-arch"}
+	a, err := arch.FromString(opts.Arch)
+	if err != nil {
+		res.Status = checkFail
+		res.Message = err.Error()
+		return res
+	}
+	if err := setup.ValidateHasQemuUser(a.String()); err != nil {
+		res.Status = checkFail
+		res.Message = err.Error()
+		res.Hint = "install qemu-user-static (e.g. dnf install qemu-user-static)"
+		return res
+	}
+	if err := setup.ValidateCanRunTargetArch(a.GoArch()); err != nil {
+		res.Status = checkFail
+		res.Message = err.Error()
+		res.Hint = "check that the qemu-user-static binfmt handler is enabled"
+		return res
+	}
+	res.Status = checkPass
+	res.Message = fmt.Sprintf("can run %s binaries", a)
+	return res
+}
+
+type systemCheck struct {
+	Checks []*checkResult `yaml:"checks" json:"checks"`
+}
+
+func runHostChecks(opts *checkOptions) *systemCheck {
+	sc := &systemCheck{}
+	for _, check := range hostChecks {
+		if res := check(opts); res != nil {
+			sc.Checks = append(sc.Checks, res)
+		}
+	}
+	return sc
+}
+
+func cmdSystemCheck(cmd *cobra.Command, args []string) error {
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+	storeDir, err := cmd.Flags().GetString("cache")
+	if err != nil {
+		return err
+	}
+	targetArch, err := cmd.Flags().GetString("arch")
+	if err != nil {
+		return err
+	}
+	if format != "" && format != "yaml" && format != "json" {
+		return fmt.Errorf("unsupported format %q, supported formats: yaml, json", format)
+	}
+
+	sc := runHostChecks(&checkOptions{StoreDir: storeDir, Arch: targetArch})
+	switch format {
+	case "", "yaml":
+		enc := yaml.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent(2)
+		if err := enc.Encode(sc); err != nil {
+			return err
+		}
+	case "json":
+		b, err := json.MarshalIndent(sc, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "%s\n", b)
+	}
+
+	var failed int
+	for _, res := range sc.Checks {
+		if res.Status == checkFail {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(sc.Checks))
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+)
+
+func fakeCheck(name, status, hint string) func(*main.CheckOptions) *main.CheckResult {
+	return func(*main.CheckOptions) *main.CheckResult {
+		return &main.CheckResult{Name: name, Status: main.CheckStatus(status), Message: name + " is " + status, Hint: hint}
+	}
+}
+
+func runSystemCheck(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	restore := main.MockOsArgs(append([]string{"system", "check"}, args...))
+	defer restore()
+
+	var fakeStdout bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+
+	err := main.Run()
+	return fakeStdout.String(), err
+}
+
+func TestSystemCheckYAML(t *testing.T) {
+	restore := main.MockHostChecks([]func(*main.CheckOptions) *main.CheckResult{
+		fakeCheck("osbuild", "pass", ""),
+		// checks that do not apply are not shown
+		func(*main.CheckOptions) *main.CheckResult { return nil },
+		fakeCheck("root", "warn", "use sudo"),
+	})
+	defer restore()
+
+	output, err := runSystemCheck(t)
+	require.NoError(t, err)
+	assert.Equal(t, `checks:
+  - name: osbuild
+    status: pass
+    message: osbuild is pass
+  - name: root
+    status: warn
+    message: root is warn
+    hint: use sudo
+`, output)
+}
+
+func TestSystemCheckJSONFailure(t *testing.T) {
+	var seenOpts *main.CheckOptions
+	restore := main.MockHostChecks([]func(*main.CheckOptions) *main.CheckResult{
+		func(opts *main.CheckOptions) *main.CheckResult {
+			seenOpts = opts
+			return fakeCheck("osbuild", "pass", "")(opts)
+		},
+		fakeCheck("store", "fail", "use --cache"),
+		fakeCheck("loop-devices", "fail", "modprobe loop"),
+	})
+	defer restore()
+
+	output, err := runSystemCheck(t, "--format=json", "--cache", "/some/store", "--arch", "aarch64")
+	assert.EqualError(t, err, "2 of 3 checks failed")
+	assert.Equal(t, &main.CheckOptions{StoreDir: "/some/store", Arch: "aarch64"}, seenOpts)
+
+	var res struct {
+		Checks []map[string]string `json:"checks"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(output), &res))
+	require.Len(t, res.Checks, 3)
+	assert.Equal(t, map[string]string{
+		"name":    "store",
+		"status":  "fail",
+		"message": "store is fail",
+		"hint":    "use --cache",
+	}, res.Checks[1])
+}
+
+func TestSystemCheckBadFormat(t *testing.T) {
+	_, err := runSystemCheck(t, "--format=xml")
+	assert.EqualError(t, err, `unsupported format "xml", supported formats: yaml, json`)
+}
+
+func TestSystemCheckOsbuild(t *testing.T) {
+	for _, tc := range []struct {
+		version     string
+		versionErr  error
+		expectedRes *main.CheckResult
+	}{
+		{"999", nil, &main.CheckResult{Name: "osbuild", Status: "pass", Message: "osbuild version 999"}},
+		{"138", nil, &main.CheckResult{Name: "osbuild", Status: "pass", Message: "osbuild version 138"}},
+		{"100", nil, &main.CheckResult{Name: "osbuild", Status: "fail", Message: "osbuild version 100 is too old, need at least 138", Hint: "update osbuild (e.g. dnf upgrade osbuild)"}},
+		{"", fmt.Errorf("running osbuild failed: not found"), &main.CheckResult{Name: "osbuild", Status: "fail", Message: "cannot run osbuild: running osbuild failed: not found", Hint: "install osbuild (e.g. dnf install osbuild osbuild-depsolve-dnf)"}},
+	} {
+		t.Run(tc.version, func(t *testing.T) {
+			restore := main.MockOsbuildVersion(func() (string, error) { return tc.version, tc.versionErr })
+			defer restore()
+
+			assert.Equal(t, tc.expectedRes, main.CheckOsbuild(&main.CheckOptions{}))
+		})
+	}
+}
+
+func TestSystemCheckStore(t *testing.T) {
+	storeDir := filepath.Join(t.TempDir(), "store")
+	res := main.CheckStore(&main.CheckOptions{StoreDir: storeDir})
+	assert.Equal(t, &main.CheckResult{Name: "store", Status: "pass", Message: storeDir + " is writable"}, res)
+	// checking does not create the store
+	_, err := os.Stat(storeDir)
+	assert.True(t, os.IsNotExist(err))
+}
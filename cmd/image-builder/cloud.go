@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// cloudTagCreatedBy marks the images that image-builder created,
+	// "cloud list" and "cloud delete" only look at these
+	cloudTagCreatedBy = "image-builder:created-by"
+	cloudTagDistro    = "image-builder:distro"
+	cloudTagArch      = "image-builder:arch"
+	cloudTagImageType = "image-builder:image-type"
+
+	cloudCreatedByValue = "image-builder"
+)
+
+type cloudImageTag struct {
+	name  string
+	value string
+}
+
+// cloudImageTags returns the tags for an uploaded image, the metadata
+// is optional (e.g. when uploading an image that was not built by
+// image-builder)
+func cloudImageTags(targetArch string, md *artifactMetadata) []cloudImageTag {
+	tags := []cloudImageTag{
+		{cloudTagCreatedBy, cloudCreatedByValue},
+		{cloudTagArch, targetArch},
+	}
+	if md != nil && md.Distro != "" {
+		tags = append(tags, cloudImageTag{cloudTagDistro, md.Distro})
+	}
+	if md != nil && md.ImageType != "" {
+		tags = append(tags, cloudImageTag{cloudTagImageType, md.ImageType})
+	}
+	return tags
+}
+
+// cloudImage is an image in a cloud that image-builder created
+type cloudImage struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Created   time.Time `json:"created"`
+	Distro    string    `json:"distro,omitempty"`
+	Arch      string    `json:"arch,omitempty"`
+	ImageType string    `json:"image-type,omitempty"`
+	// Snapshots are the snapshots that back the image and that are
+	// deleted together with it
+	Snapshots []string `json:"snapshots,omitempty"`
+}
+
+// group is the key for --keep-latest, only images of the same distro,
+// arch and image type replace each other
+func (img *cloudImage) group() string {
+	return img.Distro + "/" + img.Arch + "/" + img.ImageType
+}
+
+// cloudImageManager finds and deletes the images that image-builder
+// created in a cloud
+type cloudImageManager interface {
+	listImages(ctx context.Context) ([]cloudImage, error)
+	deleteImage(ctx context.Context, img *cloudImage, status io.Writer) error
+}
+
+func cloudImageManagerFor(cmd *cobra.Command) (cloudImageManager, error) {
+	to, err := cmd.Flags().GetString("to")
+	if err != nil {
+		return nil, err
+	}
+	switch to {
+	case "aws":
+		region, err := cmd.Flags().GetString("aws-region")
+		if err != nil {
+			return nil, err
+		}
+		if region == "" {
+			return nil, fmt.Errorf("%w: %q", ErrMissingUploadConfig, []string{"--aws-region"})
+		}
+		profile, err := cmd.Flags().GetString("aws-profile")
+		if err != nil {
+			return nil, err
+		}
+		client, err := awsNewEC2Client(region, profile)
+		if err != nil {
+			return nil, err
+		}
+		return &awsImageManager{client: client}, nil
+	case "openstack":
+		client, err := openstackNewImageClient()
+		if err != nil {
+			return nil, err
+		}
+		return &openstackImageManager{client: client}, nil
+	case "":
+		return nil, fmt.Errorf("missing --to parameter, try --to=aws")
+	default:
+		return nil, fmt.Errorf("cannot manage images in %q, only aws and openstack are supported", to)
+	}
+}
+
+// listCloudImages returns the images newest first
+func listCloudImages(ctx context.Context, manager cloudImageManager) ([]cloudImage, error) {
+	images, err := manager.listImages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].Created.After(images[j].Created)
+	})
+	return images, nil
+}
+
+// selectExpiredCloudImages returns all images except the keepLatest
+// newest images of every distro, arch and image type, the images must
+// be sorted newest first
+func selectExpiredCloudImages(images []cloudImage, keepLatest int) []cloudImage {
+	var expired []cloudImage
+	kept := make(map[string]int)
+	for _, img := range images {
+		if kept[img.group()] < keepLatest {
+			kept[img.group()]++
+			continue
+		}
+		expired = append(expired, img)
+	}
+	return expired
+}
+
+// formatAge formats the age of an image in the largest sensible unit
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+}
+
+func cmdCloudList(cmd *cobra.Command, args []string) error {
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+	manager, err := cloudImageManagerFor(cmd)
+	if err != nil {
+		return err
+	}
+	images, err := listCloudImages(context.Background(), manager)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "json":
+		if images == nil {
+			images = []cloudImage{}
+		}
+		enc := json.NewEncoder(osStdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(images)
+	case "", "text":
+		tw := tabwriter.NewWriter(osStdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tAGE\tDISTRO\tARCH\tTYPE")
+		now := time.Now()
+		for _, img := range images {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", img.ID, img.Name, formatAge(now.Sub(img.Created)), img.Distro, img.Arch, img.ImageType)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unsupported format %q, use text or json", format)
+	}
+}
+
+func cmdCloudDelete(cmd *cobra.Command, args []string) error {
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	keepLatest, err := cmd.Flags().GetInt("keep-latest")
+	if err != nil {
+		return err
+	}
+	yes, err := cmd.Flags().GetBool("yes")
+	if err != nil {
+		return err
+	}
+	// keep-latest cannot come from a configuration file
+	withKeepLatest := cmd.Flags().Changed("keep-latest")
+	switch {
+	case len(args) == 0 && !withKeepLatest:
+		return fmt.Errorf("need the ids of the images to delete or --keep-latest")
+	case len(args) > 0 && withKeepLatest:
+		return fmt.Errorf("cannot use --keep-latest together with image ids")
+	case keepLatest < 0:
+		return fmt.Errorf("--keep-latest must not be negative, got %d", keepLatest)
+	case withKeepLatest && keepLatest == 0 && !yes && !dryRun:
+		return fmt.Errorf("--keep-latest 0 deletes all images that image-builder created, use --yes to confirm")
+	}
+
+	manager, err := cloudImageManagerFor(cmd)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	images, err := listCloudImages(ctx, manager)
+	if err != nil {
+		return err
+	}
+	var toDelete []cloudImage
+	if withKeepLatest {
+		toDelete = selectExpiredCloudImages(images, keepLatest)
+	} else {
+		// only images that image-builder created can be deleted
+		for _, id := range args {
+			idx := slices.IndexFunc(images, func(img cloudImage) bool { return img.ID == id })
+			if idx < 0 {
+				return fmt.Errorf("cannot find image %q created by image-builder", id)
+			}
+			toDelete = append(toDelete, images[idx])
+		}
+	}
+
+	verb := "Deleted"
+	if dryRun {
+		verb = "Would delete"
+	}
+	for _, img := range toDelete {
+		if !dryRun {
+			if err := manager.deleteImage(ctx, &img, osStderr); err != nil {
+				return fmt.Errorf("cannot delete image %s: %w", img.ID, err)
+			}
+		}
+		fmt.Fprintf(osStdout, "%s %s (%s)\n", verb, img.ID, img.Name)
+	}
+	fmt.Fprintf(osStdout, "%s %d images, %d images left\n", verb, len(toDelete), len(images)-len(toDelete))
+	return nil
+}
@@ -0,0 +1,387 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/images"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+)
+
+type fakeEC2 struct {
+	images    []types.Image
+	snapshots []types.Snapshot
+
+	deregistered     []string
+	deletedSnapshots []string
+	// failSnapshots cannot be deleted
+	failSnapshots []string
+}
+
+func (fe *fakeEC2) DescribeImages(ctx context.Context, params *ec2.DescribeImagesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error) {
+	if !slices.Equal(params.Owners, []string{"self"}) || len(params.Filters) != 1 {
+		return nil, fmt.Errorf("unexpected DescribeImages input %+v", params)
+	}
+	filter := params.Filters[0]
+	var found []types.Image
+	for _, img := range fe.images {
+		if slices.Contains(fe.deregistered, aws.ToString(img.ImageId)) {
+			continue
+		}
+		switch aws.ToString(filter.Name) {
+		case "tag:image-builder:created-by":
+			found = append(found, img)
+		case "name":
+			if slices.Contains(filter.Values, aws.ToString(img.Name)) {
+				found = append(found, img)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected DescribeImages filter %q", aws.ToString(filter.Name))
+		}
+	}
+	return &ec2.DescribeImagesOutput{Images: found}, nil
+}
+
+func (fe *fakeEC2) DescribeSnapshots(ctx context.Context, params *ec2.DescribeSnapshotsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSnapshotsOutput, error) {
+	if !slices.Equal(params.OwnerIds, []string{"self"}) || len(params.Filters) != 1 || aws.ToString(params.Filters[0].Name) != "tag:Name" {
+		return nil, fmt.Errorf("unexpected DescribeSnapshots input %+v", params)
+	}
+	var found []types.Snapshot
+	for _, snapshot := range fe.snapshots {
+		for _, tag := range snapshot.Tags {
+			if aws.ToString(tag.Key) == "Name" && slices.Contains(params.Filters[0].Values, aws.ToString(tag.Value)) {
+				found = append(found, snapshot)
+			}
+		}
+	}
+	return &ec2.DescribeSnapshotsOutput{Snapshots: found}, nil
+}
+
+func (fe *fakeEC2) CopyImage(ctx context.Context, params *ec2.CopyImageInput, optFns ...func(*ec2.Options)) (*ec2.CopyImageOutput, error) {
+	return nil, fmt.Errorf("unexpected CopyImage")
+}
+
+func (fe *fakeEC2) ModifyImageAttribute(ctx context.Context, params *ec2.ModifyImageAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifyImageAttributeOutput, error) {
+	return nil, fmt.Errorf("unexpected ModifyImageAttribute")
+}
+
+func (fe *fakeEC2) DeregisterImage(ctx context.Context, params *ec2.DeregisterImageInput, optFns ...func(*ec2.Options)) (*ec2.DeregisterImageOutput, error) {
+	fe.deregistered = append(fe.deregistered, aws.ToString(params.ImageId))
+	return &ec2.DeregisterImageOutput{}, nil
+}
+
+func (fe *fakeEC2) DeleteSnapshot(ctx context.Context, params *ec2.DeleteSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSnapshotOutput, error) {
+	if slices.Contains(fe.failSnapshots, aws.ToString(params.SnapshotId)) {
+		return nil, fmt.Errorf("snapshot %s is in use", aws.ToString(params.SnapshotId))
+	}
+	fe.deletedSnapshots = append(fe.deletedSnapshots, aws.ToString(params.SnapshotId))
+	return &ec2.DeleteSnapshotOutput{}, nil
+}
+
+func fakeAMI(id, distro, imageType string, age time.Duration) types.Image {
+	return types.Image{
+		ImageId:      aws.String(id),
+		Name:         aws.String("name-" + id),
+		Architecture: types.ArchitectureValuesX8664,
+		CreationDate: aws.String(time.Now().Add(-age).UTC().Format(time.RFC3339)),
+		Tags: []types.Tag{
+			{Key: aws.String("image-builder:created-by"), Value: aws.String("image-builder")},
+			{Key: aws.String("image-builder:distro"), Value: aws.String(distro)},
+			{Key: aws.String("image-builder:arch"), Value: aws.String("x86_64")},
+			{Key: aws.String("image-builder:image-type"), Value: aws.String(imageType)},
+		},
+		BlockDeviceMappings: []types.BlockDeviceMapping{
+			{Ebs: &types.EbsBlockDevice{SnapshotId: aws.String("snap-" + id)}},
+		},
+	}
+}
+
+func mockFakeEC2(t *testing.T) *fakeEC2 {
+	fe := &fakeEC2{
+		images: []types.Image{
+			fakeAMI("ami-1", "fedora-42", "ami", 72*time.Hour),
+			fakeAMI("ami-2", "fedora-42", "ami", 3*time.Hour),
+			fakeAMI("ami-3", "centos-9", "ami", 30*time.Minute),
+			fakeAMI("ami-4", "fedora-42", "ami", 5*24*time.Hour),
+		},
+	}
+	restore := main.MockAwsNewEC2Client(func(region, profile string) (main.AwsEC2Client, error) {
+		assert.Equal(t, "eu-west-1", region)
+		return fe, nil
+	})
+	t.Cleanup(restore)
+	return fe
+}
+
+func TestCloudListAWS(t *testing.T) {
+	mockFakeEC2(t)
+
+	var fakeStdout bytes.Buffer
+	restore := main.MockOsStdout(&fakeStdout)
+	defer restore()
+	restore = main.MockOsArgs([]string{"cloud", "list", "--to=aws", "--aws-region=eu-west-1"})
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	expected := `ID     NAME        AGE  DISTRO     ARCH    TYPE
+ami-3  name-ami-3  30m  centos-9   x86_64  ami
+ami-2  name-ami-2  3h   fedora-42  x86_64  ami
+ami-1  name-ami-1  3d   fedora-42  x86_64  ami
+ami-4  name-ami-4  5d   fedora-42  x86_64  ami
+`
+	assert.Equal(t, expected, fakeStdout.String())
+}
+
+func TestCloudListJSON(t *testing.T) {
+	mockFakeEC2(t)
+
+	var fakeStdout bytes.Buffer
+	restore := main.MockOsStdout(&fakeStdout)
+	defer restore()
+	restore = main.MockOsArgs([]string{"cloud", "list", "--to=aws", "--aws-region=eu-west-1", "--format=json"})
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	assert.Contains(t, fakeStdout.String(), `"id": "ami-3",`)
+	assert.Contains(t, fakeStdout.String(), `"snapshots": [
+      "snap-ami-3"
+    ]`)
+}
+
+func TestCloudDeleteAWS(t *testing.T) {
+	fe := mockFakeEC2(t)
+
+	var fakeStdout bytes.Buffer
+	restore := main.MockOsStdout(&fakeStdout)
+	defer restore()
+	restore = main.MockOsArgs([]string{"cloud", "delete", "--to=aws", "--aws-region=eu-west-1", "ami-2"})
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ami-2"}, fe.deregistered)
+	assert.Equal(t, []string{"snap-ami-2"}, fe.deletedSnapshots)
+	assert.Equal(t, "Deleted ami-2 (name-ami-2)\nDeleted 1 images, 3 images left\n", fakeStdout.String())
+
+	// images that image-builder did not create are never deleted
+	restore = main.MockOsArgs([]string{"cloud", "delete", "--to=aws", "--aws-region=eu-west-1", "ami-other"})
+	defer restore()
+	err = main.Run()
+	assert.EqualError(t, err, `cannot find image "ami-other" created by image-builder`)
+	assert.Equal(t, []string{"ami-2"}, fe.deregistered)
+}
+
+func TestCloudDeleteKeepLatest(t *testing.T) {
+	for _, tc := range []struct {
+		dryRun          bool
+		expectedDeleted []string
+		expectedOutput  string
+	}{
+		{
+			dryRun:          true,
+			expectedDeleted: nil,
+			expectedOutput:  "Would delete ami-1 (name-ami-1)\nWould delete ami-4 (name-ami-4)\nWould delete 2 images, 2 images left\n",
+		},
+		{
+			dryRun:          false,
+			expectedDeleted: []string{"ami-1", "ami-4"},
+			expectedOutput:  "Deleted ami-1 (name-ami-1)\nDeleted ami-4 (name-ami-4)\nDeleted 2 images, 2 images left\n",
+		},
+	} {
+		t.Run(fmt.Sprintf("dry-run-%v", tc.dryRun), func(t *testing.T) {
+			fe := mockFakeEC2(t)
+
+			var fakeStdout bytes.Buffer
+			restore := main.MockOsStdout(&fakeStdout)
+			defer restore()
+			restore = main.MockOsArgs([]string{"cloud", "delete", "--to=aws", "--aws-region=eu-west-1", "--keep-latest=1", fmt.Sprintf("--dry-run=%v", tc.dryRun)})
+			defer restore()
+
+			err := main.Run()
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedDeleted, fe.deregistered)
+			assert.Equal(t, tc.expectedOutput, fakeStdout.String())
+		})
+	}
+}
+
+func TestCloudDeleteSnapshotFailure(t *testing.T) {
+	fe := mockFakeEC2(t)
+	fe.images[1].BlockDeviceMappings = append(fe.images[1].BlockDeviceMappings, types.BlockDeviceMapping{
+		Ebs: &types.EbsBlockDevice{SnapshotId: aws.String("snap-ami-2-data")},
+	})
+	fe.failSnapshots = []string{"snap-ami-2"}
+
+	restore := main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+	restore = main.MockOsArgs([]string{"cloud", "delete", "--to=aws", "--aws-region=eu-west-1", "ami-2"})
+	defer restore()
+
+	// a failed snapshot does not stop the deletion of the others
+	err := main.Run()
+	assert.EqualError(t, err, "cannot delete image ami-2: cannot delete snapshot snap-ami-2: snapshot snap-ami-2 is in use")
+	assert.Equal(t, []string{"ami-2"}, fe.deregistered)
+	assert.Equal(t, []string{"snap-ami-2-data"}, fe.deletedSnapshots)
+}
+
+func TestCloudDeleteKeepLatestZero(t *testing.T) {
+	fe := mockFakeEC2(t)
+
+	var fakeStdout bytes.Buffer
+	restore := main.MockOsStdout(&fakeStdout)
+	defer restore()
+	cmdline := []string{"cloud", "delete", "--to=aws", "--aws-region=eu-west-1", "--keep-latest=0"}
+
+	// deleting all images needs a confirmation
+	restore = main.MockOsArgs(cmdline)
+	defer restore()
+	err := main.Run()
+	assert.EqualError(t, err, "--keep-latest 0 deletes all images that image-builder created, use --yes to confirm")
+	assert.Nil(t, fe.deregistered)
+
+	restore = main.MockOsArgs(append(cmdline, "--dry-run"))
+	defer restore()
+	err = main.Run()
+	require.NoError(t, err)
+	assert.Nil(t, fe.deregistered)
+	assert.Contains(t, fakeStdout.String(), "Would delete 4 images, 0 images left\n")
+
+	restore = main.MockOsArgs(append(cmdline, "--yes"))
+	defer restore()
+	err = main.Run()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"ami-1", "ami-2", "ami-3", "ami-4"}, fe.deregistered)
+}
+
+func TestCloudDeleteErrors(t *testing.T) {
+	mockFakeEC2(t)
+
+	for _, tc := range []struct {
+		args        []string
+		expectedErr string
+	}{
+		{
+			[]string{"cloud", "delete", "--to=aws", "--aws-region=eu-west-1"},
+			"need the ids of the images to delete or --keep-latest",
+		},
+		{
+			[]string{"cloud", "delete", "--to=aws", "--aws-region=eu-west-1", "--keep-latest=2", "ami-1"},
+			"cannot use --keep-latest together with image ids",
+		},
+		{
+			[]string{"cloud", "delete", "--to=aws", "ami-1"},
+			`missing upload configuration: ["--aws-region"]`,
+		},
+		{
+			[]string{"cloud", "list", "--to=gcp"},
+			`cannot manage images in "gcp", only aws and openstack are supported`,
+		},
+	} {
+		restore := main.MockOsArgs(tc.args)
+		defer restore()
+		err := main.Run()
+		assert.EqualError(t, err, tc.expectedErr)
+	}
+}
+
+type fakeGlance struct {
+	images []images.Image
+
+	updates map[string]images.UpdateOpts
+	deleted []string
+}
+
+func (fg *fakeGlance) FindImage(ctx context.Context, name string) (*images.Image, error) {
+	for i := range fg.images {
+		if fg.images[i].Name == name {
+			return &fg.images[i], nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find image %q", name)
+}
+
+func (fg *fakeGlance) ListImages(ctx context.Context, tag string) ([]images.Image, error) {
+	var found []images.Image
+	for _, img := range fg.images {
+		if slices.Contains(img.Tags, tag) && !slices.Contains(fg.deleted, img.ID) {
+			found = append(found, img)
+		}
+	}
+	return found, nil
+}
+
+func (fg *fakeGlance) UpdateImage(ctx context.Context, id string, opts images.UpdateOpts) error {
+	if fg.updates == nil {
+		fg.updates = make(map[string]images.UpdateOpts)
+	}
+	fg.updates[id] = opts
+	return nil
+}
+
+func (fg *fakeGlance) DeleteImage(ctx context.Context, id string) error {
+	fg.deleted = append(fg.deleted, id)
+	return nil
+}
+
+func mockFakeGlance(t *testing.T, fg *fakeGlance) {
+	restore := main.MockOpenstackNewImageClient(func() (main.OpenstackImageClient, error) {
+		return fg, nil
+	})
+	t.Cleanup(restore)
+}
+
+func TestCloudListAndDeleteOpenstack(t *testing.T) {
+	created := time.Now().Add(-50 * time.Hour)
+	fg := &fakeGlance{
+		images: []images.Image{
+			{
+				ID:        "1234-abcd",
+				Name:      "my-image",
+				Tags:      []string{"image-builder"},
+				CreatedAt: created,
+				Properties: map[string]any{
+					"image-builder:distro":     "fedora-42",
+					"image-builder:arch":       "x86_64",
+					"image-builder:image-type": "openstack",
+				},
+			},
+			{ID: "5678-efgh", Name: "other-image"},
+		},
+	}
+	mockFakeGlance(t, fg)
+
+	var fakeStdout bytes.Buffer
+	restore := main.MockOsStdout(&fakeStdout)
+	defer restore()
+	restore = main.MockOsArgs([]string{"cloud", "list", "--to=openstack"})
+	defer restore()
+	err := main.Run()
+	require.NoError(t, err)
+	expected := `ID         NAME      AGE  DISTRO     ARCH    TYPE
+1234-abcd  my-image  2d   fedora-42  x86_64  openstack
+`
+	assert.Equal(t, expected, fakeStdout.String())
+
+	fakeStdout.Reset()
+	restore = main.MockOsArgs([]string{"cloud", "delete", "--to=openstack", "1234-abcd"})
+	defer restore()
+	err = main.Run()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1234-abcd"}, fg.deleted)
+	assert.Equal(t, "Deleted 1234-abcd (my-image)\nDeleted 1 images, 0 images left\n", fakeStdout.String())
+}
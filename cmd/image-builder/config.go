@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.yaml.in/yaml/v3"
+)
+
+// configPaths returns the paths of the given configuration file in
+// the order they are applied, later files win. Like cacheDirForUid it
+// follows the XDG Base Directory specification and falls back to
+// ~/.config.
+func configPaths(name string) []string {
+	paths := []string{filepath.Join("/etc/image-builder", name)}
+	if configHome := os.Getenv("XDG_CONFIG_HOME"); configHome != "" {
+		return append(paths, filepath.Join(configHome, "image-builder", name))
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return paths
+	}
+	return append(paths, filepath.Join(home, ".config", "image-builder", name))
+}
+
+func defaultConfigFiles() []string {
+	return configPaths("config.toml")
+}
+
+var configFiles = defaultConfigFiles
+
+// configValue is a flag default from a configuration file
+type configValue struct {
+	Value  any
+	Source string
+}
+
+// userConfig contains the flag defaults from all configuration files.
+//
+// Top-level keys are the defaults for every command that has a flag
+// of this name, tables (e.g. [build] or [system.cache.prune]) contain
+// the defaults of a single command and win over top-level keys.
+type userConfig struct {
+	global   map[string]configValue
+	commands map[string]map[string]configValue
+}
+
+func loadUserConfig(rootCmd *cobra.Command) (*userConfig, error) {
+	uc := &userConfig{
+		global:   make(map[string]configValue),
+		commands: make(map[string]map[string]configValue),
+	}
+	for _, path := range configFiles() {
+		var content map[string]any
+		_, err := toml.DecodeFile(path, &content)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot load config file %q: %w", path, err)
+		}
+		if err := uc.add(rootCmd, nil, content, path); err != nil {
+			return nil, fmt.Errorf("cannot use config file %q: %w", path, err)
+		}
+	}
+	return uc, nil
+}
+
+func (uc *userConfig) add(cmd *cobra.Command, cmdPath []string, content map[string]any, source string) error {
+	for key, value := range content {
+		if table, ok := value.(map[string]any); ok {
+			subCmd := findSubcommand(cmd, key)
+			if subCmd == nil {
+				return fmt.Errorf("unknown command %q", strings.Join(append(slices.Clone(cmdPath), key), " "))
+			}
+			if err := uc.add(subCmd, append(slices.Clone(cmdPath), key), table, source); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(cmdPath) == 0 {
+			if !anyCommandHasFlag(cmd, key) {
+				return fmt.Errorf("unknown option %q", key)
+			}
+			if anyCommandHasCommandlineOnlyFlag(cmd, key) {
+				return fmt.Errorf("option %q can only be given on the commandline", key)
+			}
+			uc.global[key] = configValue{Value: value, Source: source}
+			continue
+		}
+		flag := lookupFlag(cmd, key)
+		if flag == nil {
+			return fmt.Errorf("unknown option %q for %q", key, strings.Join(cmdPath, " "))
+		}
+		if isCommandlineOnlyFlag(flag) {
+			return fmt.Errorf("option %q for %q can only be given on the commandline", key, strings.Join(cmdPath, " "))
+		}
+		name := strings.Join(cmdPath, " ")
+		if uc.commands[name] == nil {
+			uc.commands[name] = make(map[string]configValue)
+		}
+		uc.commands[name][key] = configValue{Value: value, Source: source}
+	}
+	return nil
+}
+
+// valuesFor returns the configured flag defaults for the given command
+func (uc *userConfig) valuesFor(cmd *cobra.Command) map[string]configValue {
+	values := make(map[string]configValue)
+	for key, val := range uc.global {
+		if lookupFlag(cmd, key) != nil {
+			values[key] = val
+		}
+	}
+	for key, val := range uc.commands[commandName(cmd)] {
+		values[key] = val
+	}
+	return values
+}
+
+// commandName returns the name of the command without the name of
+// the root command, e.g. "system cache prune"
+func commandName(cmd *cobra.Command) string {
+	var names []string
+	for c := cmd; c.HasParent(); c = c.Parent() {
+		names = append([]string{c.Name()}, names...)
+	}
+	return strings.Join(names, " ")
+}
+
+func findSubcommand(cmd *cobra.Command, name string) *cobra.Command {
+	for _, subCmd := range cmd.Commands() {
+		if subCmd.Name() == name {
+			return subCmd
+		}
+	}
+	return nil
+}
+
+func lookupFlag(cmd *cobra.Command, name string) *pflag.Flag {
+	if name == "help" {
+		return nil
+	}
+	if f := cmd.Flags().Lookup(name); f != nil {
+		return f
+	}
+	return cmd.InheritedFlags().Lookup(name)
+}
+
+func anyCommandHasFlag(cmd *cobra.Command, name string) bool {
+	if lookupFlag(cmd, name) != nil {
+		return true
+	}
+	for _, subCmd := range cmd.Commands() {
+		if anyCommandHasFlag(subCmd, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyCommandHasCommandlineOnlyFlag(cmd *cobra.Command, name string) bool {
+	if isCommandlineOnlyFlag(lookupFlag(cmd, name)) {
+		return true
+	}
+	for _, subCmd := range cmd.Commands() {
+		if anyCommandHasCommandlineOnlyFlag(subCmd, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// commandlineOnlyAnnotation marks the flags that cannot be set from a
+// configuration file because a default would be dangerous (e.g. the
+// number of images that "cloud delete --keep-latest" keeps)
+const commandlineOnlyAnnotation = "image-builder/commandline-only"
+
+func markCommandlineOnly(cmd *cobra.Command, name string) {
+	if err := cmd.Flags().SetAnnotation(name, commandlineOnlyAnnotation, []string{"true"}); err != nil {
+		panic(err)
+	}
+}
+
+func isCommandlineOnlyFlag(flag *pflag.Flag) bool {
+	if flag == nil {
+		return false
+	}
+	_, ok := flag.Annotations[commandlineOnlyAnnotation]
+	return ok
+}
+
+// configSourceAnnotation marks the flags that were set from a
+// configuration file. These flags are not marked as Changed, they are
+// defaults and must not conflict with other flags like flags from the
+// commandline do (e.g. "arch" and "build --filter").
+const configSourceAnnotation = "image-builder/config-source"
+
+func setFlagFromConfig(cmd *cobra.Command, name string, val configValue) error {
+	flag := lookupFlag(cmd, name)
+	values, ok := val.Value.([]any)
+	if !ok {
+		values = []any{val.Value}
+	} else if _, isSlice := flag.Value.(pflag.SliceValue); !isSlice {
+		return fmt.Errorf("cannot use a list for option %q from %q", name, val.Source)
+	}
+	for _, v := range values {
+		if _, isTable := v.(map[string]any); isTable {
+			return fmt.Errorf("cannot use a table for option %q from %q", name, val.Source)
+		}
+		if err := flag.Value.Set(fmt.Sprint(v)); err != nil {
+			return fmt.Errorf("cannot use option %q from %q: invalid argument %q for \"--%s\" flag: %w", name, val.Source, fmt.Sprint(v), flag.Name, err)
+		}
+	}
+	flag.DefValue = flag.Value.String()
+	if flag.Annotations == nil {
+		flag.Annotations = make(map[string][]string)
+	}
+	flag.Annotations[configSourceAnnotation] = []string{val.Source}
+	return nil
+}
+
+// flagIsSet returns true if the flag was given on the commandline or
+// set from a configuration file
+func flagIsSet(cmd *cobra.Command, name string) bool {
+	flag := lookupFlag(cmd, name)
+	if flag == nil {
+		return false
+	}
+	_, fromConfig := flag.Annotations[configSourceAnnotation]
+	return flag.Changed || fromConfig
+}
+
+// applyUserConfig sets all flags of the given command that were not
+// given on the commandline to the values from the configuration files
+func applyUserConfig(cmd *cobra.Command) error {
+	uc, err := loadUserConfig(cmd.Root())
+	if err != nil {
+		return err
+	}
+	for name, val := range uc.valuesFor(cmd) {
+		if cmd.Flags().Changed(name) {
+			continue
+		}
+		if err := setFlagFromConfig(cmd, name, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type configOption struct {
+	Name   string `yaml:"name" json:"name"`
+	Value  string `yaml:"value" json:"value"`
+	Source string `yaml:"source" json:"source"`
+}
+
+type configStatus struct {
+	Command     string         `yaml:"command" json:"command"`
+	ConfigFiles []string       `yaml:"config-files" json:"config-files"`
+	Options     []configOption `yaml:"options" json:"options"`
+}
+
+func cmdConfigShow(cmd *cobra.Command, args []string) error {
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+	if format != "" && format != "yaml" && format != "json" {
+		return fmt.Errorf("unsupported format %q, supported formats: yaml, json", format)
+	}
+	target, rest, err := cmd.Root().Find(args)
+	if err != nil || len(rest) > 0 {
+		return fmt.Errorf("unknown command %q", strings.Join(args, " "))
+	}
+	uc, err := loadUserConfig(cmd.Root())
+	if err != nil {
+		return err
+	}
+
+	cs := &configStatus{
+		Command:     strings.TrimSpace(cmd.Root().Name() + " " + commandName(target)),
+		ConfigFiles: []string{},
+		Options:     []configOption{},
+	}
+	for _, path := range configFiles() {
+		if _, err := os.Stat(path); err == nil {
+			cs.ConfigFiles = append(cs.ConfigFiles, path)
+		}
+	}
+	values := uc.valuesFor(target)
+	// merges the persistent flags of the parents into target.Flags()
+	target.InheritedFlags()
+	target.Flags().VisitAll(func(f *pflag.Flag) {
+		if f.Hidden || f.Deprecated != "" || f.Name == "help" {
+			return
+		}
+		opt := configOption{Name: f.Name, Value: f.DefValue, Source: "default"}
+		if val, ok := values[f.Name]; ok {
+			opt.Value = formatConfigValue(val.Value)
+			opt.Source = val.Source
+		}
+		cs.Options = append(cs.Options, opt)
+	})
+
+	switch format {
+	case "", "yaml":
+		enc := yaml.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent(2)
+		return enc.Encode(cs)
+	case "json":
+		b, err := json.MarshalIndent(cs, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "%s\n", b)
+	}
+	return nil
+}
+
+// formatConfigValue formats the value like pflag formats the defaults
+func formatConfigValue(v any) string {
+	values, ok := v.([]any)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	var l []string
+	for _, v := range values {
+		l = append(l, fmt.Sprint(v))
+	}
+	return "[" + strings.Join(l, ",") + "]"
+}
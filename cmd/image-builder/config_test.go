@@ -0,0 +1,154 @@
+package main_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.yaml.in/yaml/v3"
+
+	testrepos "github.com/osbuild/images/test/data/repositories"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+)
+
+func mockConfigFiles(t *testing.T, systemConfig, userConfig string) (systemPath, userPath string) {
+	t.Helper()
+	tmpdir := t.TempDir()
+	systemPath = filepath.Join(tmpdir, "etc", "config.toml")
+	userPath = filepath.Join(tmpdir, "home", "config.toml")
+	for path, content := range map[string]string{systemPath: systemConfig, userPath: userConfig} {
+		if content == "" {
+			continue
+		}
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	restore := main.MockConfigFiles(func() []string { return []string{systemPath, userPath} })
+	t.Cleanup(restore)
+	return systemPath, userPath
+}
+
+func TestDefaultConfigFiles(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", "/xdg/config")
+	assert.Equal(t, []string{"/etc/image-builder/config.toml", "/xdg/config/image-builder/config.toml"}, main.DefaultConfigFiles())
+
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("HOME", "/home/user")
+	assert.Equal(t, []string{"/etc/image-builder/config.toml", "/home/user/.config/image-builder/config.toml"}, main.DefaultConfigFiles())
+}
+
+func TestConfigDefaultsForFlags(t *testing.T) {
+	systemPath, userPath := mockConfigFiles(t, `
+cache = "/system/store"
+rpmmd-cache = "/system/rpmmd"
+
+[system.cache.prune]
+older-than = "30d"
+`, `
+rpmmd-cache = "/user/rpmmd"
+`)
+
+	storeDir, rpmmdCacheDir := makeTestCache(t)
+	restore := main.MockOsArgs([]string{"system", "cache", "prune", "--dry-run", "--cache", storeDir})
+	defer restore()
+	var fakeStdout bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+
+	// the rpmmd cache from the user config is used, explicit flags win
+	err := main.Run()
+	require.NoError(t, err)
+	assert.Contains(t, fakeStdout.String(), "Would remove 2 cache entries (1.5 KiB), 2.5 KiB left in the cache\n")
+	assert.NotContains(t, fakeStdout.String(), rpmmdCacheDir)
+
+	// and "config show" shows where the values come from
+	restore = main.MockOsArgs([]string{"config", "show", "system", "cache", "prune"})
+	defer restore()
+	fakeStdout.Reset()
+	err = main.Run()
+	require.NoError(t, err)
+
+	var cs struct {
+		Command     string              `yaml:"command"`
+		ConfigFiles []string            `yaml:"config-files"`
+		Options     []map[string]string `yaml:"options"`
+	}
+	require.NoError(t, yaml.Unmarshal(fakeStdout.Bytes(), &cs))
+	assert.Equal(t, "image-builder system cache prune", cs.Command)
+	assert.Equal(t, []string{systemPath, userPath}, cs.ConfigFiles)
+	options := make(map[string]map[string]string)
+	for _, opt := range cs.Options {
+		options[opt["name"]] = opt
+	}
+	assert.Equal(t, map[string]string{"name": "cache", "value": "/system/store", "source": systemPath}, options["cache"])
+	assert.Equal(t, map[string]string{"name": "rpmmd-cache", "value": "/user/rpmmd", "source": userPath}, options["rpmmd-cache"])
+	assert.Equal(t, map[string]string{"name": "older-than", "value": "30d", "source": systemPath}, options["older-than"])
+	assert.Equal(t, map[string]string{"name": "dry-run", "value": "false", "source": "default"}, options["dry-run"])
+	// options of other commands are not shown
+	assert.NotContains(t, options, "blueprint")
+}
+
+func TestConfigListValues(t *testing.T) {
+	mockConfigFiles(t, "", `
+extra-repo = ["https://example.com/repo1", "https://example.com/repo2"]
+`)
+	restore := main.MockOsArgs([]string{"config", "show", "build", "--format=json"})
+	defer restore()
+	var fakeStdout bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	assert.Contains(t, fakeStdout.String(), `"value": "[https://example.com/repo1,https://example.com/repo2]"`)
+}
+
+func TestConfigValuesDoNotConflictWithFlags(t *testing.T) {
+	restore := main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+	mockConfigFiles(t, "", `
+arch = "x86_64"
+`)
+
+	// the arch from the config is only a default, it does not
+	// conflict with --filter like --arch does
+	restore = main.MockOsArgs([]string{"build", "--cache", t.TempDir(), "--filter=distro:no-such-distro"})
+	defer restore()
+	err := main.Run()
+	assert.EqualError(t, err, `cannot find any image for filter ["distro:no-such-distro"]`)
+
+	restore = main.MockOsArgs([]string{"build", "--cache", t.TempDir(), "--filter=distro:centos-9", "--arch=x86_64"})
+	defer restore()
+	err = main.Run()
+	assert.EqualError(t, err, `cannot use --arch together with --filter`)
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		config      string
+		expectedErr string
+	}{
+		{`no-such-option = 1`, `cannot use config file "%s": unknown option "no-such-option"`},
+		{"[build]\nno-such-option = 1", `cannot use config file "%s": unknown option "no-such-option" for "build"`},
+		{"[no-such-command]\ncache = 1", `cannot use config file "%s": unknown command "no-such-command"`},
+		{`cache = ["a", "b"]`, `cannot use a list for option "cache" from "%s"`},
+		{"[system.cache.prune]\ndry-run = \"maybe\"", `cannot use option "dry-run" from "%s": invalid argument "maybe" for "--dry-run" flag: strconv.ParseBool: parsing "maybe": invalid syntax`},
+		{`keep-latest = 1`, `cannot use config file "%s": option "keep-latest" can only be given on the commandline`},
+		{"[cloud.delete]\nyes = true", `cannot use config file "%s": option "yes" for "cloud delete" can only be given on the commandline`},
+		{`cache = `, `cannot load config file "%s": toml: line 1 (last key "cache"): unexpected EOF; expected value`},
+	} {
+		t.Run(tc.config, func(t *testing.T) {
+			_, userPath := mockConfigFiles(t, "", tc.config)
+			restore := main.MockOsArgs([]string{"system", "cache", "prune", "--older-than", "1d"})
+			defer restore()
+
+			err := main.Run()
+			assert.EqualError(t, err, fmt.Sprintf(tc.expectedErr, userPath))
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/osbuild/images/pkg/depsolvednf"
+	"github.com/osbuild/images/pkg/distro"
+	"github.com/osbuild/images/pkg/manifestgen"
+	"github.com/osbuild/images/pkg/rpmmd"
+)
+
+// depsolveCache wraps a manifestgen.DepsolveFunc and remembers the
+// result for every package set chain it resolved. When building
+// multiple image types in a single invocation this ensures that
+// identical chains (e.g. the buildroot) are only depsolved once.
+type depsolveCache struct {
+	depsolve manifestgen.DepsolveFunc
+	results  map[string]depsolvednf.DepsolveResult
+}
+
+func newDepsolveCache(depsolve manifestgen.DepsolveFunc) *depsolveCache {
+	if depsolve == nil {
+		depsolve = manifestgen.DefaultDepsolve
+	}
+	return &depsolveCache{
+		depsolve: depsolve,
+		results:  make(map[string]depsolvednf.DepsolveResult),
+	}
+}
+
+func depsolveCacheKey(distroName, arch string, chain []rpmmd.PackageSet) (string, error) {
+	b, err := json.Marshal(struct {
+		Distro string
+		Arch   string
+		Chain  []rpmmd.PackageSet
+	}{distroName, arch, chain})
+	if err != nil {
+		return "", fmt.Errorf("cannot compute depsolve cache key: %w", err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
+// Depsolve implements manifestgen.DepsolveFunc, only the package set
+// chains that were not seen before are passed to the real depsolver.
+func (dc *depsolveCache) Depsolve(solver *depsolvednf.Solver, cacheDir string, depsolveWarningsOutput io.Writer, packageSets map[string][]rpmmd.PackageSet, d distro.Distro, arch string) (map[string]depsolvednf.DepsolveResult, error) {
+	res := make(map[string]depsolvednf.DepsolveResult, len(packageSets))
+	missing := make(map[string][]rpmmd.PackageSet)
+	keys := make(map[string]string)
+	for name, chain := range packageSets {
+		key, err := depsolveCacheKey(d.Name(), arch, chain)
+		if err != nil {
+			return nil, err
+		}
+		if cached, ok := dc.results[key]; ok {
+			res[name] = cached
+			continue
+		}
+		missing[name] = chain
+		keys[name] = key
+	}
+	if len(missing) == 0 {
+		return res, nil
+	}
+
+	solved, err := dc.depsolve(solver, cacheDir, depsolveWarningsOutput, missing, d, arch)
+	if err != nil {
+		return nil, err
+	}
+	for name, r := range solved {
+		res[name] = r
+		dc.results[keys[name]] = r
+	}
+	return res, nil
+}
@@ -0,0 +1,66 @@
+package main_test
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/osbuild/images/pkg/depsolvednf"
+	"github.com/osbuild/images/pkg/distro"
+	"github.com/osbuild/images/pkg/distro/test_distro"
+	"github.com/osbuild/images/pkg/rpmmd"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+)
+
+func TestDepsolveCacheOnlyDepsolvesNewChains(t *testing.T) {
+	var depsolved [][]string
+	depsolve := main.NewDepsolveCache(func(solver *depsolvednf.Solver, cacheDir string, depsolveWarningsOutput io.Writer, packageSets map[string][]rpmmd.PackageSet, d distro.Distro, arch string) (map[string]depsolvednf.DepsolveResult, error) {
+		res := make(map[string]depsolvednf.DepsolveResult)
+		var names []string
+		for name := range packageSets {
+			names = append(names, name)
+			res[name] = depsolvednf.DepsolveResult{Solver: fmt.Sprintf("%s-%v", name, len(depsolved))}
+		}
+		depsolved = append(depsolved, names)
+		return res, nil
+	})
+
+	d := test_distro.DistroFactory(test_distro.TestDistro1Name)
+	buildChain := []rpmmd.PackageSet{{Include: []string{"rpm", "xfsprogs"}}}
+
+	res1, err := depsolve(nil, "", nil, map[string][]rpmmd.PackageSet{
+		"build": buildChain,
+		"os":    {{Include: []string{"kernel"}}},
+	}, d, "x86_64")
+	require.NoError(t, err)
+	assert.Len(t, res1, 2)
+
+	res2, err := depsolve(nil, "", nil, map[string][]rpmmd.PackageSet{
+		"build": buildChain,
+		"os":    {{Include: []string{"kernel", "lvm2"}}},
+	}, d, "x86_64")
+	require.NoError(t, err)
+	assert.Len(t, res2, 2)
+	assert.Equal(t, "build-0", res2["build"].Solver)
+	assert.Equal(t, "os-1", res2["os"].Solver)
+
+	// a different arch is never shared
+	_, err = depsolve(nil, "", nil, map[string][]rpmmd.PackageSet{
+		"build": buildChain,
+	}, d, "aarch64")
+	require.NoError(t, err)
+
+	assert.Equal(t, [][]string{{"build", "os"}, {"os"}, {"build"}}, sortedEach(depsolved))
+}
+
+func sortedEach(l [][]string) [][]string {
+	for _, names := range l {
+		slices.Sort(names)
+	}
+	return l
+}
@@ -4,12 +4,20 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
+
+	"google.golang.org/api/option"
 
 	"github.com/osbuild/images/pkg/bootc"
 	"github.com/osbuild/images/pkg/cloud"
 	"github.com/osbuild/images/pkg/cloud/awscloud"
+	"github.com/osbuild/images/pkg/cloud/azure"
+	"github.com/osbuild/images/pkg/cloud/ibmcloud"
+	"github.com/osbuild/images/pkg/cloud/openstack"
+	"github.com/osbuild/images/pkg/depsolvednf"
 	"github.com/osbuild/images/pkg/manifestgen"
 	"github.com/osbuild/images/pkg/reporegistry"
+	"github.com/osbuild/images/pkg/rpmmd"
 )
 
 var (
@@ -78,6 +86,48 @@ func MockAwscloudNewUploader(f func(string, string, string, *awscloud.UploaderOp
 	}
 }
 
+func MockLibvirtNewUploader(f func(string, string, string) (cloud.Uploader, error)) (restore func()) {
+	saved := libvirtNewUploader
+	libvirtNewUploader = f
+	return func() {
+		libvirtNewUploader = saved
+	}
+}
+
+type LibvirtDomainOptions = libvirtDomainOptions
+
+var LibvirtDomainXML = libvirtDomainXML
+
+func MockLibvirtDomain(check func(*LibvirtDomainOptions) error, define func(*LibvirtDomainOptions, io.Writer) error) (restore func()) {
+	savedCheck := libvirtCheckDomain
+	savedDefine := libvirtDefineDomain
+	libvirtCheckDomain = check
+	libvirtDefineDomain = define
+	return func() {
+		libvirtCheckDomain = savedCheck
+		libvirtDefineDomain = savedDefine
+	}
+}
+
+func MockLibvirtVolume(check, delete func(connection, pool, volume string) error) (restore func()) {
+	savedCheck := libvirtCheckVolume
+	savedDelete := libvirtDeleteVolume
+	libvirtCheckVolume = check
+	libvirtDeleteVolume = delete
+	return func() {
+		libvirtCheckVolume = savedCheck
+		libvirtDeleteVolume = savedDelete
+	}
+}
+
+func MockIbmNewUploader(f func(string, string, string, *ibmcloud.Credentials) (cloud.Uploader, error)) (restore func()) {
+	saved := ibmNewUploader
+	ibmNewUploader = f
+	return func() {
+		ibmNewUploader = saved
+	}
+}
+
 func MockBootcResolveInfo(f func(string) (*bootc.Info, error)) (restore func()) {
 	saved := bootcResolveInfo
 	bootcResolveInfo = f
@@ -109,3 +159,153 @@ func MockManifestgenDepsolver(new manifestgen.DepsolveFunc) (restore func()) {
 		manifestgenDepsolver = saved
 	}
 }
+
+func MockSetupIsContainer(f func() bool) (restore func()) {
+	saved := setupIsContainer
+	setupIsContainer = f
+	return func() {
+		setupIsContainer = saved
+	}
+}
+
+func MockOsbuildVersion(f func() (string, error)) (restore func()) {
+	saved := osbuildVersion
+	osbuildVersion = f
+	return func() {
+		osbuildVersion = saved
+	}
+}
+
+func MockLockFetchMetadata(f func(*depsolvednf.Solver, []rpmmd.RepoConfig) (rpmmd.PackageList, error)) (restore func()) {
+	saved := lockFetchMetadata
+	lockFetchMetadata = f
+	return func() {
+		lockFetchMetadata = saved
+	}
+}
+
+func NewDepsolveCache(depsolve manifestgen.DepsolveFunc) manifestgen.DepsolveFunc {
+	return newDepsolveCache(depsolve).Depsolve
+}
+
+type ManifestExport = manifestExport
+
+var ExportFromManifest = exportFromManifest
+
+var FormatSize = formatSize
+
+func DecompressedSize(imagePath string, format string, status io.Writer) (uint64, error) {
+	info, err := decompressedImageInfo(imagePath, imageFormat(format), status)
+	return info.size, err
+}
+
+type CheckResult = checkResult
+type CheckOptions = checkOptions
+type CheckStatus = checkStatus
+
+var (
+	CheckOsbuild = checkOsbuild
+	CheckStore   = checkStore
+)
+
+func MockHostChecks(checks []func(*CheckOptions) *CheckResult) (restore func()) {
+	saved := hostChecks
+	hostChecks = nil
+	for _, check := range checks {
+		hostChecks = append(hostChecks, check)
+	}
+	return func() {
+		hostChecks = saved
+	}
+}
+
+func MockConfigFiles(f func() []string) (restore func()) {
+	saved := configFiles
+	configFiles = f
+	return func() {
+		configFiles = saved
+	}
+}
+
+var DefaultConfigFiles = defaultConfigFiles
+
+func MockUploadTargetsFiles(f func() []string) (restore func()) {
+	saved := uploadTargetsFiles
+	uploadTargetsFiles = f
+	return func() {
+		uploadTargetsFiles = saved
+	}
+}
+
+type AzureClient = azureClient
+
+func MockAzureNewClient(f func(azure.Credentials, string, string) (AzureClient, error)) (restore func()) {
+	saved := azureNewClient
+	azureNewClient = f
+	return func() {
+		azureNewClient = saved
+	}
+}
+
+// MockGcpAuthOptions makes the gcp clients work without credentials
+func MockGcpAuthOptions() (restore func()) {
+	saved := gcpAuthOptions
+	gcpAuthOptions = func() []option.ClientOption {
+		return []option.ClientOption{option.WithoutAuthentication()}
+	}
+	return func() {
+		gcpAuthOptions = saved
+	}
+}
+
+func MockS3PartSize(size int64) (restore func()) {
+	saved := s3PartSize
+	s3PartSize = size
+	return func() {
+		s3PartSize = saved
+	}
+}
+
+func MockUploadRetrySleep(f func(time.Duration)) (restore func()) {
+	saved := uploadRetrySleep
+	uploadRetrySleep = f
+	return func() {
+		uploadRetrySleep = saved
+	}
+}
+
+func MockOpenstackNewUploader(f func(string, *openstack.UploaderOptions) (cloud.Uploader, error)) (restore func()) {
+	saved := openstackNewUploader
+	openstackNewUploader = f
+	return func() {
+		openstackNewUploader = saved
+	}
+}
+
+func MockAwsImageWaitDelay(d time.Duration) (restore func()) {
+	saved := awsImageWaitDelay
+	awsImageWaitDelay = d
+	return func() {
+		awsImageWaitDelay = saved
+	}
+}
+
+type OpenstackImageClient = openstackImageClient
+
+func MockOpenstackNewImageClient(f func() (OpenstackImageClient, error)) (restore func()) {
+	saved := openstackNewImageClient
+	openstackNewImageClient = f
+	return func() {
+		openstackNewImageClient = saved
+	}
+}
+
+type AwsEC2Client = awsEC2Client
+
+func MockAwsNewEC2Client(f func(region, profile string) (AwsEC2Client, error)) (restore func()) {
+	saved := awsNewEC2Client
+	awsNewEC2Client = f
+	return func() {
+		awsNewEC2Client = saved
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/osbuild/image-builder-cli/pkg/progress"
+	"github.com/osbuild/image-builder-cli/pkg/setup"
+)
+
+func cmdFetch(cmd *cobra.Command, args []string) error {
+	cacheDir, err := cmd.Flags().GetString("cache")
+	if err != nil {
+		return err
+	}
+	outputDir, err := cmd.Flags().GetString("output-dir")
+	if err != nil {
+		return err
+	}
+	fromManifest, err := cmd.Flags().GetString("from-manifest")
+	if err != nil {
+		return err
+	}
+	exportDir, err := cmd.Flags().GetString("export-dir")
+	if err != nil {
+		return err
+	}
+	if fromManifest != "" && len(args) > 0 {
+		return fmt.Errorf("cannot use image type arguments %q together with --from-manifest", args)
+	}
+	if fromManifest == "" && len(args) != 1 {
+		return fmt.Errorf("need exactly one image type or --from-manifest")
+	}
+	lock, err := lockFromCmd(cmd)
+	if err != nil {
+		return err
+	}
+	cacheMaxSize, err := cacheMaxSizeFromCmd(cmd, cacheDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return fmt.Errorf("cannot create cache directory %q: %w\nHint: use --cache to specify a writable path", cacheDir, err)
+	}
+	if setupIsContainer() {
+		if err := setup.EnsureEnvironment(cacheDir, false); err != nil {
+			return fmt.Errorf("entrypoint setup failed: %w", err)
+		}
+	}
+
+	output, err := outputFromCmd(cmd)
+	if err != nil {
+		return err
+	}
+	pbar, err := progressFromCmd(cmd)
+	if err != nil {
+		return err
+	}
+	pbar.Start()
+	defer pbar.Stop()
+
+	var mf []byte
+	manifestPath := fromManifest
+	if fromManifest != "" {
+		mf, err = os.ReadFile(fromManifest)
+		if err != nil {
+			return fmt.Errorf("cannot read manifest: %w", err)
+		}
+	} else {
+		var buf bytes.Buffer
+		wrapperOpts := &cmdManifestWrapperOptions{useBootstrapIfNeeded: true}
+		if lock != nil {
+			wrapperOpts.depsolve = lock.Depsolve
+		}
+		res, err := cmdManifestWrapper(pbar, cmd, args, &buf, io.Discard, wrapperOpts)
+		if err != nil {
+			return err
+		}
+		mf = buf.Bytes()
+		// write the manifest so that it can be built later via
+		// "build --offline --from-manifest"
+		basename := basenameFor(res, "")
+		if outputDir == "" {
+			outputDir = basename
+		}
+		manifestPath = filepath.Join(outputDir, fmt.Sprintf("%s.osbuild-manifest.json", basename))
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(manifestPath, mf, 0644); err != nil {
+			return err
+		}
+	}
+	items, err := sourcesFromManifest(mf)
+	if err != nil {
+		return err
+	}
+
+	// osbuild downloads all sources before building, without any
+	// exports nothing gets built
+	tmpOutputDir, err := os.MkdirTemp("", "image-builder-fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpOutputDir)
+	pbar.SetPulseMsgf("Fetching sources")
+	pbar.SetMessagef("Fetching %d sources into %s", len(items), cacheDir)
+	osbuildOpts := &progress.OSBuildOptions{
+		StoreDir:     cacheDir,
+		OutputDir:    tmpOutputDir,
+		CacheMaxSize: cacheMaxSize,
+	}
+	if err := progress.RunOSBuild(pbar, mf, nil, osbuildOpts); err != nil {
+		return err
+	}
+	missing, err := missingSources(cacheDir, items)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("cannot find %d source(s) in %q after fetching, first missing: %s", len(missing), cacheDir, missing[0])
+	}
+	size, err := sourcesSize(cacheDir, items)
+	if err != nil {
+		return err
+	}
+	// the export directory only contains what is needed for this
+	// manifest and can be copied to the offline host as a whole
+	offlineCacheDir := cacheDir
+	if exportDir != "" {
+		pbar.SetMessagef("Exporting %d sources into %s", len(items), exportDir)
+		if err := exportSources(cacheDir, exportDir, items); err != nil {
+			return err
+		}
+		exportedManifestPath := filepath.Join(exportDir, filepath.Base(manifestPath))
+		if err := os.WriteFile(exportedManifestPath, mf, 0644); err != nil {
+			return err
+		}
+		offlineCacheDir = exportDir
+		manifestPath = exportedManifestPath
+	}
+	pbar.Stop()
+
+	fmt.Fprintf(output, "Fetched %d sources (%s) into %s\n", len(items), formatSize(size), cacheDir)
+	switch {
+	case exportDir != "":
+		fmt.Fprintf(output, "Exported the sources and the manifest into %s, to build it offline use:\n", exportDir)
+	case fromManifest == "":
+		fmt.Fprintf(output, "Manifest written to %s, to build it offline use:\n", manifestPath)
+	default:
+		fmt.Fprintf(output, "To build it offline use:\n")
+	}
+	fmt.Fprintf(output, "  image-builder build --offline --cache %s --from-manifest %s\n", offlineCacheDir, manifestPath)
+	return nil
+}
@@ -0,0 +1,254 @@
+package main_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	testrepos "github.com/osbuild/images/test/data/repositories"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+	"github.com/osbuild/image-builder-cli/internal/testutil"
+)
+
+// makeFakeOsbuildFetchScript puts every checksum that is referenced
+// in the manifest into the sources of the store (like the osbuild
+// curl/librepo sources would)
+func makeFakeOsbuildFetchScript() string {
+	return `
+cat - > "$0".stdin
+
+store=""
+while [[ $# -gt 0 ]]; do
+  case "$1" in
+    --store)
+      store="$2"
+      shift 2
+      ;;
+    *)
+      shift 1
+  esac
+done
+mkdir -p "$store/sources/org.osbuild.files"
+for sum in $(grep -o 'sha256:[0-9a-f]\{64\}' "$0".stdin | sort -u); do
+  echo "fake-rpm" > "$store/sources/org.osbuild.files/$sum"
+done
+`
+}
+
+func TestFetchIntegration(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+	restore = main.MockManifestgenDepsolver(fakeDepsolve)
+	defer restore()
+	restore = main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+
+	var fakeStdout bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+
+	tmpdir := t.TempDir()
+	cacheDir := filepath.Join(tmpdir, "cache")
+	outputDir := filepath.Join(tmpdir, "output")
+	restore = main.MockOsArgs([]string{
+		"fetch",
+		"qcow2",
+		"--arch=x86_64",
+		"--distro=centos-9",
+		"--cache", cacheDir,
+		"--output-dir", outputDir,
+	})
+	defer restore()
+
+	fakeOsbuildCmd := testutil.MockCommand(t, "osbuild", makeFakeOsbuildFetchScript())
+
+	err := main.Run()
+	require.NoError(t, err)
+
+	// osbuild is only used to download the sources, nothing is exported
+	require.Equal(t, 1, len(fakeOsbuildCmd.CallArgsList()))
+	osbuildCall := fakeOsbuildCmd.CallArgsList()[0]
+	assert.False(t, slices.Contains(osbuildCall, "--export"))
+	assert.Equal(t, cacheDir, osbuildCall[slices.Index(osbuildCall, "--store")+1])
+
+	// the manifest is written so that it can be built offline
+	manifestPath := filepath.Join(outputDir, "centos-9-qcow2-x86_64.osbuild-manifest.json")
+	mf, err := os.ReadFile(manifestPath)
+	require.NoError(t, err)
+	usedManifest, err := os.ReadFile(fakeOsbuildCmd.Path() + ".stdin")
+	require.NoError(t, err)
+	assert.Equal(t, mf, usedManifest)
+
+	sources, err := os.ReadDir(filepath.Join(cacheDir, "sources/org.osbuild.files"))
+	require.NoError(t, err)
+	require.NotEmpty(t, sources)
+	assert.Contains(t, fakeStdout.String(), fmt.Sprintf("Fetched %d sources (%s) into %s\n", len(sources), main.FormatSize(int64(len(sources)*len("fake-rpm\n"))), cacheDir))
+	assert.Contains(t, fakeStdout.String(), fmt.Sprintf("image-builder build --offline --cache %s --from-manifest %s\n", cacheDir, manifestPath))
+
+	// and an offline build works with the fetched sources
+	restore = main.MockOsbuildVersion(func() (string, error) { return "999", nil })
+	defer restore()
+	restore = main.MockOsArgs([]string{
+		"build",
+		"--offline",
+		"--from-manifest", manifestPath,
+		"--cache", cacheDir,
+		"--output-dir", outputDir,
+	})
+	defer restore()
+	fakeOsbuildCmd = testutil.MockCommand(t, "osbuild", `echo "$https_proxy $HTTP_PROXY no_proxy=$no_proxy" > "$0".proxy`+makeFakeOsbuildScript())
+	err = main.Run()
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(outputDir, "centos-9-qcow2-x86_64.qcow2"))
+	// osbuild cannot reach the network during an offline build
+	proxy, err := os.ReadFile(fakeOsbuildCmd.Path() + ".proxy")
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:9 http://127.0.0.1:9 no_proxy=\n", string(proxy))
+}
+
+func TestFetchExportDir(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+	restore = main.MockManifestgenDepsolver(fakeDepsolve)
+	defer restore()
+	restore = main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+
+	var fakeStdout bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+
+	tmpdir := t.TempDir()
+	cacheDir := filepath.Join(tmpdir, "cache")
+	exportDir := filepath.Join(tmpdir, "export")
+	// sources of other images are not exported
+	require.NoError(t, os.MkdirAll(filepath.Join(cacheDir, "sources/org.osbuild.files"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, "sources/org.osbuild.files/sha256:other"), nil, 0644))
+	restore = main.MockOsArgs([]string{
+		"fetch",
+		"qcow2",
+		"--arch=x86_64",
+		"--distro=centos-9",
+		"--cache", cacheDir,
+		"--output-dir", filepath.Join(tmpdir, "output"),
+		"--export-dir", exportDir,
+	})
+	defer restore()
+	testutil.MockCommand(t, "osbuild", makeFakeOsbuildFetchScript())
+
+	err := main.Run()
+	require.NoError(t, err)
+
+	manifestPath := filepath.Join(exportDir, "centos-9-qcow2-x86_64.osbuild-manifest.json")
+	assert.FileExists(t, manifestPath)
+	sources, err := os.ReadDir(filepath.Join(cacheDir, "sources/org.osbuild.files"))
+	require.NoError(t, err)
+	exported, err := os.ReadDir(filepath.Join(exportDir, "sources/org.osbuild.files"))
+	require.NoError(t, err)
+	assert.Equal(t, len(sources)-1, len(exported))
+	assert.NoFileExists(t, filepath.Join(exportDir, "sources/org.osbuild.files/sha256:other"))
+	assert.Contains(t, fakeStdout.String(), fmt.Sprintf("Exported the sources and the manifest into %s, to build it offline use:\n  image-builder build --offline --cache %s --from-manifest %s\n", exportDir, exportDir, manifestPath))
+
+	// the export directory is all that an offline build needs
+	restore = main.MockOsbuildVersion(func() (string, error) { return "999", nil })
+	defer restore()
+	restore = main.MockOsArgs([]string{
+		"build",
+		"--offline",
+		"--from-manifest", manifestPath,
+		"--cache", exportDir,
+		"--output-dir", filepath.Join(tmpdir, "output"),
+	})
+	defer restore()
+	testutil.MockCommand(t, "osbuild", makeFakeOsbuildScript())
+	err = main.Run()
+	require.NoError(t, err)
+}
+
+func TestBuildOfflineMissingSources(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+
+	tmpdir := t.TempDir()
+	mf := []byte(`{
+  "version": "2",
+  "pipelines": [{"name": "qcow2", "stages": [{"type": "org.osbuild.qemu", "options": {"filename": "disk.qcow2"}}]}],
+  "sources": {
+    "org.osbuild.librepo": {"items": {"sha256:aaa": {}, "sha256:bbb": {}}},
+    "org.osbuild.skopeo": {"items": {"sha256:ccc": {}}},
+    "org.osbuild.containers-storage": {"items": {"sha256:ddd": {}}}
+  }
+}`)
+	manifestPath := filepath.Join(tmpdir, "manifest.json")
+	require.NoError(t, os.WriteFile(manifestPath, mf, 0644))
+	cacheDir := filepath.Join(tmpdir, "cache")
+	require.NoError(t, os.MkdirAll(filepath.Join(cacheDir, "sources/org.osbuild.files"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, "sources/org.osbuild.files/sha256:bbb"), nil, 0644))
+
+	restore = main.MockOsArgs([]string{
+		"build",
+		"--offline",
+		"--from-manifest", manifestPath,
+		"--cache", cacheDir,
+		"--output-dir", filepath.Join(tmpdir, "output"),
+	})
+	defer restore()
+	fakeOsbuildCmd := testutil.MockCommand(t, "osbuild", makeFakeOsbuildScript())
+
+	err := main.Run()
+	assert.EqualError(t, err, fmt.Sprintf(`cannot build offline, 2 source(s) are missing from %q:
+  org.osbuild.librepo:sha256:aaa
+  org.osbuild.skopeo:sha256:ccc
+Hint: use "image-builder fetch" to download them first`, cacheDir))
+	// fail early, osbuild is never run
+	assert.Equal(t, 0, len(fakeOsbuildCmd.CallArgsList()))
+}
+
+func TestFetchErrors(t *testing.T) {
+	for _, tc := range []struct {
+		cmdline     []string
+		expectedErr string
+	}{
+		{
+			[]string{"fetch"},
+			"need exactly one image type or --from-manifest",
+		}, {
+			[]string{"fetch", "qcow2", "--from-manifest", "foo.json"},
+			`cannot use image type arguments ["qcow2"] together with --from-manifest`,
+		}, {
+			[]string{"build", "qcow2", "--offline"},
+			`--offline requires --from-manifest (e.g. from "image-builder fetch")`,
+		},
+	} {
+		t.Run(fmt.Sprintf("%v", tc.cmdline), func(t *testing.T) {
+			restore := main.MockOsArgs(tc.cmdline)
+			defer restore()
+
+			err := main.Run()
+			assert.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for _, tc := range []struct {
+		size     int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 * 1024 * 1024, "5.0 MiB"},
+		{3 * 1024 * 1024 * 1024, "3.0 GiB"},
+	} {
+		assert.Equal(t, tc.expected, main.FormatSize(tc.size))
+	}
+}
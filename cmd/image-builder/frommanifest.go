@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/osbuild/image-builder-cli/pkg/progress"
+)
+
+// manifestExport describes the artifact that an osbuild manifest
+// produces, i.e. the pipeline to export and the filename of the
+// artifact inside the pipeline export directory.
+type manifestExport struct {
+	Pipeline string `json:"pipeline"`
+	Filename string `json:"filename"`
+}
+
+// Ext returns the extension of the artifact (e.g. "qcow2" or
+// "raw.xz"), the ImgType filenames are always of the form
+// $name.$ext.$extraExt
+func (me *manifestExport) Ext() string {
+	l := strings.SplitN(me.Filename, ".", 2)
+	if len(l) < 2 {
+		return ""
+	}
+	return l[1]
+}
+
+type osbuildManifestV2 struct {
+	Version   string `json:"version"`
+	Pipelines []struct {
+		Name   string `json:"name"`
+		Stages []struct {
+			Type    string         `json:"type"`
+			Options map[string]any `json:"options"`
+		} `json:"stages"`
+	} `json:"pipelines"`
+}
+
+// exportFromManifest finds the artifact that the given osbuild
+// manifest produces. The manifests generated by "images" always have
+// the exported pipeline last and the final stage that writes the
+// artifact has a "filename" option.
+func exportFromManifest(mf []byte) (*manifestExport, error) {
+	var m osbuildManifestV2
+	if err := json.Unmarshal(mf, &m); err != nil {
+		return nil, fmt.Errorf("cannot parse osbuild manifest: %w", err)
+	}
+	if m.Version != "2" {
+		return nil, fmt.Errorf("unsupported osbuild manifest version %q (only version 2 is supported)", m.Version)
+	}
+	if len(m.Pipelines) == 0 {
+		return nil, fmt.Errorf("cannot find any pipelines in osbuild manifest")
+	}
+
+	pipeline := m.Pipelines[len(m.Pipelines)-1]
+	for i := len(pipeline.Stages) - 1; i >= 0; i-- {
+		if filename, ok := pipeline.Stages[i].Options["filename"].(string); ok && filename != "" {
+			return &manifestExport{
+				Pipeline: pipeline.Name,
+				Filename: filename,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find artifact filename in pipeline %q of osbuild manifest", pipeline.Name)
+}
+
+// basenameForManifest returns the basename of the artifact that is
+// built from the given manifest path. Manifests written via
+// "build --with-manifest" are named $basename.osbuild-manifest.json
+// so this gives the same names as the original build.
+func basenameForManifest(manifestPath string, export *manifestExport, userBasename string) string {
+	if userBasename != "" {
+		if ext := export.Ext(); ext != "" {
+			userBasename = strings.TrimSuffix(userBasename, "."+ext)
+		}
+		return userBasename
+	}
+	basename := filepath.Base(manifestPath)
+	basename = strings.TrimSuffix(basename, ".osbuild-manifest.json")
+	return strings.TrimSuffix(basename, ".json")
+}
+
+// buildFromManifest builds the artifact from the given (previously
+// generated) osbuild manifest without any manifest generation.
+func buildFromManifest(pbar progress.ProgressBar, manifestPath string, opts *buildOptions) (string, error) {
+	mf, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot read manifest: %w", err)
+	}
+	export, err := exportFromManifest(mf)
+	if err != nil {
+		return "", fmt.Errorf("cannot use manifest %q: %w", manifestPath, err)
+	}
+	basename := basenameForManifest(manifestPath, export, opts.OutputBasename)
+	if opts.OutputDir == "" {
+		opts.OutputDir = basename
+	}
+	// the artifact metadata is written to $basename.json which may
+	// be the manifest itself
+	if sameFile(manifestPath, metadataPathFor(opts.OutputDir, basename)) {
+		return "", fmt.Errorf("cannot build manifest %q: the artifact metadata would overwrite it, use --output-dir or --output-name", manifestPath)
+	}
+
+	pbar.SetPulseMsgf("Image building step")
+	pbar.SetMessagef("Building %s from manifest %s", basename, manifestPath)
+	return buildArtifact(pbar, export, basename, mf, opts)
+}
+
+func sameFile(a, b string) bool {
+	st1, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	st2, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(st1, st2)
+}
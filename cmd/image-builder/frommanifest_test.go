@@ -0,0 +1,166 @@
+package main_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	testrepos "github.com/osbuild/images/test/data/repositories"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+	"github.com/osbuild/image-builder-cli/internal/testutil"
+)
+
+func generateTestManifest(t *testing.T, distroName, imgTypeName string) []byte {
+	t.Helper()
+
+	restore := main.MockManifestgenDepsolver(fakeDepsolve)
+	defer restore()
+	restore = main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+
+	restore = main.MockOsArgs([]string{
+		"manifest",
+		imgTypeName,
+		"--arch=x86_64",
+		"--distro", distroName,
+	})
+	defer restore()
+
+	var fakeStdout bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+
+	var err error
+	testutil.CaptureStdio(t, func() {
+		err = main.Run()
+	})
+	require.NoError(t, err)
+	return fakeStdout.Bytes()
+}
+
+func TestExportFromManifestMatchesImageType(t *testing.T) {
+	restore := main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+
+	for _, imgTypeName := range []string{"qcow2", "ami", "vmdk", "vhd", "minimal-raw", "gce", "ova", "tar", "wsl", "image-installer"} {
+		t.Run(imgTypeName, func(t *testing.T) {
+			res, err := main.GetOneImage("centos-9", imgTypeName, "x86_64", nil)
+			require.NoError(t, err)
+
+			mf := generateTestManifest(t, "centos-9", imgTypeName)
+			export, err := main.ExportFromManifest(mf)
+			require.NoError(t, err)
+			assert.Equal(t, &main.ManifestExport{
+				Pipeline: res.ImgType.Exports()[0],
+				Filename: res.ImgType.Filename(),
+			}, export)
+		})
+	}
+}
+
+func TestExportFromManifestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		mf          string
+		expectedErr string
+	}{
+		{`not-json`, `cannot parse osbuild manifest: invalid character 'o' in literal null (expecting 'u')`},
+		{`{"version": "1"}`, `unsupported osbuild manifest version "1" (only version 2 is supported)`},
+		{`{"version": "2"}`, `cannot find any pipelines in osbuild manifest`},
+		{`{"version": "2", "pipelines": [{"name": "tree", "stages": [{"type": "org.osbuild.rpm"}]}]}`, `cannot find artifact filename in pipeline "tree" of osbuild manifest`},
+	} {
+		_, err := main.ExportFromManifest([]byte(tc.mf))
+		assert.EqualError(t, err, tc.expectedErr)
+	}
+}
+
+func TestBuildIntegrationFromManifest(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+
+	restore = main.MockOsbuildVersion(func() (string, error) { return "999", nil })
+	defer restore()
+
+	tmpdir := t.TempDir()
+	mf := generateTestManifest(t, "centos-9", "qcow2")
+	manifestPath := filepath.Join(tmpdir, "centos-9-qcow2-x86_64.osbuild-manifest.json")
+	err := os.WriteFile(manifestPath, mf, 0644)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		extraArgs        []string
+		expectedBasename string
+	}{
+		{nil, "centos-9-qcow2-x86_64"},
+		{[]string{"--output-name=foo.qcow2"}, "foo"},
+	} {
+		t.Run(fmt.Sprintf("%v", tc.extraArgs), func(t *testing.T) {
+			var fakeStdout bytes.Buffer
+			restore := main.MockOsStdout(&fakeStdout)
+			defer restore()
+
+			outputDir := filepath.Join(t.TempDir(), "output")
+			restore = main.MockOsArgs(append([]string{
+				"build",
+				"--from-manifest", manifestPath,
+				"--cache", tmpdir,
+				"--output-dir", outputDir,
+			}, tc.extraArgs...))
+			defer restore()
+
+			fakeOsbuildCmd := testutil.MockCommand(t, "osbuild", makeFakeOsbuildScript())
+
+			err := main.Run()
+			require.NoError(t, err)
+
+			imgPath := filepath.Join(outputDir, tc.expectedBasename+".qcow2")
+			assert.Contains(t, fakeStdout.String(), fmt.Sprintf("Image build successful: %s\n", imgPath))
+			assert.FileExists(t, imgPath)
+			// the metadata only knows about the artifact itself
+			b, err := os.ReadFile(filepath.Join(outputDir, tc.expectedBasename+".json"))
+			require.NoError(t, err)
+			assert.Contains(t, string(b), fmt.Sprintf(`"filename": "%s.qcow2"`, tc.expectedBasename))
+			assert.NotContains(t, string(b), `"distro"`)
+
+			// exactly the given manifest is passed to osbuild
+			require.Equal(t, 1, len(fakeOsbuildCmd.CallArgsList()))
+			osbuildCall := fakeOsbuildCmd.CallArgsList()[0]
+			exportPos := slices.Index(osbuildCall, "--export")
+			require.True(t, exportPos > -1)
+			assert.Equal(t, "qcow2", osbuildCall[exportPos+1])
+			usedManifest, err := os.ReadFile(fakeOsbuildCmd.Path() + ".stdin")
+			require.NoError(t, err)
+			assert.Equal(t, mf, usedManifest)
+		})
+	}
+}
+
+func TestBuildFromManifestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		cmdline     []string
+		expectedErr string
+	}{
+		{
+			[]string{"qcow2"},
+			`cannot use image type arguments ["qcow2"] together with --from-manifest`,
+		}, {
+			[]string{"--distro=centos-9"},
+			`cannot use --distro together with --from-manifest`,
+		}, {
+			[]string{"--blueprint=bp.toml"},
+			`cannot use --blueprint together with --from-manifest`,
+		},
+	} {
+		restore := main.MockOsArgs(append([]string{"build", "--from-manifest=foo.json"}, tc.cmdline...))
+		defer restore()
+
+		err := main.Run()
+		assert.EqualError(t, err, tc.expectedErr)
+	}
+}
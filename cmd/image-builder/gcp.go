@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	compute "cloud.google.com/go/compute/apiv1"
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	"github.com/osbuild/images/pkg/arch"
+	"github.com/osbuild/images/pkg/platform"
+)
+
+// gcpAuthOptions returns the authentication options for the storage
+// and compute clients, by default the application default credentials
+// (e.g. $GOOGLE_APPLICATION_CREDENTIALS) are used. Mocked in tests.
+var gcpAuthOptions = func() []option.ClientOption {
+	return nil
+}
+
+type gcpUploaderOptions struct {
+	Project   string
+	Bucket    string
+	ImageName string
+	// Region is optional, it is the storage location of the image
+	Region string
+	// StorageEndpoint and ComputeEndpoint are optional, they default
+	// to the Google Cloud endpoints
+	StorageEndpoint string
+	ComputeEndpoint string
+
+	TargetArch      arch.Arch
+	GuestOsFeatures []string
+}
+
+// gcpUploader uploads a tar.gz with a disk.raw into a bucket and
+// creates a compute image from it
+type gcpUploader struct {
+	opts gcpUploaderOptions
+
+	// objectMD5 is the md5 of the uploaded object as reported by
+	// the storage API
+	objectMD5 []byte
+}
+
+func newGCPUploader(opts *gcpUploaderOptions) *gcpUploader {
+	return &gcpUploader{opts: *opts}
+}
+
+// gcpGuestOsFeatures returns the guest OS features of an image with
+// the given boot mode, images without a boot mode are assumed to
+// support UEFI as all GCE images do
+func gcpGuestOsFeatures(bootMode *platform.BootMode) []string {
+	features := []string{"VIRTIO_SCSI_MULTIQUEUE", "GVNIC"}
+	if bootMode == nil || *bootMode == platform.BOOT_UEFI || *bootMode == platform.BOOT_HYBRID {
+		features = append(features, "UEFI_COMPATIBLE")
+	}
+	return features
+}
+
+func (gu *gcpUploader) objectName() string {
+	return gu.opts.ImageName + ".tar.gz"
+}
+
+func (gu *gcpUploader) storageClient(ctx context.Context) (*storage.Client, error) {
+	opts := gcpAuthOptions()
+	if gu.opts.StorageEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(strings.TrimSuffix(gu.opts.StorageEndpoint, "/")+"/storage/v1/"))
+	}
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create a storage client: %w", err)
+	}
+	return client, nil
+}
+
+func (gu *gcpUploader) imagesClient(ctx context.Context) (*compute.ImagesClient, error) {
+	opts := gcpAuthOptions()
+	if gu.opts.ComputeEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(strings.TrimSuffix(gu.opts.ComputeEndpoint, "/")))
+	}
+	client, err := compute.NewImagesRESTClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create a compute client: %w", err)
+	}
+	return client, nil
+}
+
+func isGoogleAPINotFound(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusNotFound
+}
+
+func (gu *gcpUploader) Check(status io.Writer) error {
+	ctx := context.Background()
+	storageClient, err := gu.storageClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer storageClient.Close()
+	fmt.Fprintf(status, "Checking GCP bucket %q\n", gu.opts.Bucket)
+	if _, err := storageClient.Bucket(gu.opts.Bucket).Attrs(ctx); err != nil {
+		return fmt.Errorf("cannot access bucket %q: %w", gu.opts.Bucket, err)
+	}
+
+	imagesClient, err := gu.imagesClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer imagesClient.Close()
+	fmt.Fprintf(status, "Checking GCP project %q\n", gu.opts.Project)
+	_, err = imagesClient.Get(ctx, &computepb.GetImageRequest{
+		Project: gu.opts.Project,
+		Image:   gu.opts.ImageName,
+	})
+	switch {
+	case err == nil:
+		return fmt.Errorf("image %q already exists in project %q", gu.opts.ImageName, gu.opts.Project)
+	case !isGoogleAPINotFound(err):
+		return fmt.Errorf("cannot access images of project %q: %w", gu.opts.Project, err)
+	}
+	return nil
+}
+
+func (gu *gcpUploader) UploadAndRegister(r io.Reader, uploadSize uint64, status io.Writer) error {
+	ctx := context.Background()
+
+	// GCP can only import a gzip compressed tarball with a disk.raw
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); string(magic) != "\x1f\x8b" {
+		return permanentUploadErrorf("cannot upload to gcp: image is not a .tar.gz (is this a gce image?)")
+	}
+
+	storageClient, err := gu.storageClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer storageClient.Close()
+
+	fmt.Fprintf(status, "Uploading %s to GCP bucket %q\n", gu.objectName(), gu.opts.Bucket)
+	obj := storageClient.Bucket(gu.opts.Bucket).Object(gu.objectName())
+	w := obj.NewWriter(ctx)
+	w.ContentType = "application/gzip"
+	if _, err := io.Copy(w, br); err != nil {
+		w.Close()
+		return fmt.Errorf("cannot upload %s: %w", gu.objectName(), err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("cannot upload %s: %w", gu.objectName(), err)
+	}
+	gu.objectMD5 = w.Attrs().MD5
+	// the object is only needed to create the image
+	defer func() {
+		if delErr := obj.Delete(ctx); delErr != nil {
+			fmt.Fprintf(status, "WARNING: cannot delete %s from bucket %q: %v\n", gu.objectName(), gu.opts.Bucket, delErr)
+		}
+	}()
+
+	imagesClient, err := gu.imagesClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer imagesClient.Close()
+
+	fmt.Fprintf(status, "Creating image %q in project %q\n", gu.opts.ImageName, gu.opts.Project)
+	image := &computepb.Image{
+		Name: &gu.opts.ImageName,
+		RawDisk: &computepb.RawDisk{
+			Source: googleapi.String(fmt.Sprintf("https://storage.googleapis.com/%s/%s", gu.opts.Bucket, gu.objectName())),
+		},
+	}
+	if gu.opts.Region != "" {
+		image.StorageLocations = []string{gu.opts.Region}
+	}
+	switch gu.opts.TargetArch {
+	case arch.ARCH_X86_64:
+		image.Architecture = googleapi.String(computepb.Image_X86_64.String())
+	case arch.ARCH_AARCH64:
+		image.Architecture = googleapi.String(computepb.Image_ARM64.String())
+	}
+	for _, feature := range gu.opts.GuestOsFeatures {
+		image.GuestOsFeatures = append(image.GuestOsFeatures, &computepb.GuestOsFeature{
+			Type: googleapi.String(feature),
+		})
+	}
+	op, err := imagesClient.Insert(ctx, &computepb.InsertImageRequest{
+		Project:       gu.opts.Project,
+		ImageResource: image,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot create image %q: %w", gu.opts.ImageName, err)
+	}
+	if err := op.Wait(ctx); err != nil {
+		return fmt.Errorf("cannot create image %q: %w", gu.opts.ImageName, err)
+	}
+	if opErr := op.Proto().GetError(); opErr != nil && len(opErr.GetErrors()) > 0 {
+		var msgs []string
+		for _, e := range opErr.GetErrors() {
+			msgs = append(msgs, e.GetMessage())
+		}
+		return fmt.Errorf("cannot create image %q: %s", gu.opts.ImageName, strings.Join(msgs, ", "))
+	}
+	return nil
+}
+
+// retryable implements retryableUploader, a retry overwrites the
+// object and the image is only created after a complete upload
+func (gu *gcpUploader) retryable() bool {
+	return true
+}
+
+func (gu *gcpUploader) verifyUpload(size uint64, sums *uploadChecksums, status io.Writer) error {
+	if !bytes.Equal(gu.objectMD5, sums.MD5) {
+		return fmt.Errorf("object %s had md5 %x instead of %x", gu.objectName(), gu.objectMD5, sums.MD5)
+	}
+	return nil
+}
+
+func (gu *gcpUploader) remoteID() string {
+	return fmt.Sprintf("projects/%s/global/images/%s", gu.opts.Project, gu.opts.ImageName)
+}
@@ -0,0 +1,269 @@
+package main_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	testrepos "github.com/osbuild/images/test/data/repositories"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+	"github.com/osbuild/image-builder-cli/internal/testutil"
+)
+
+// fakeGCP is a minimal stand-in for the cloud storage and compute
+// APIs, it supports simple uploads and the creation of images
+type fakeGCP struct {
+	mu      sync.Mutex
+	buckets map[string]bool
+	objects map[string][]byte
+	deleted []string
+	images  map[string]map[string]any
+}
+
+func newFakeGCP(t *testing.T) (*fakeGCP, string) {
+	fg := &fakeGCP{
+		buckets: map[string]bool{"my-bucket": true},
+		objects: make(map[string][]byte),
+		images:  make(map[string]map[string]any),
+	}
+	srv := httptest.NewServer(fg)
+	t.Cleanup(srv.Close)
+	return fg, srv.URL
+}
+
+func (fg *fakeGCP) reply(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		panic(err)
+	}
+}
+
+func (fg *fakeGCP) fail(w http.ResponseWriter, status int, msg string) {
+	fg.reply(w, status, map[string]any{"error": map[string]any{"code": status, "message": msg}})
+}
+
+func (fg *fakeGCP) upload(w http.ResponseWriter, r *http.Request, bucket string) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.URL.Query().Get("uploadType") != "multipart" || err != nil {
+		fg.fail(w, http.StatusNotImplemented, "only multipart uploads are supported")
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	var attrs map[string]any
+	for i := 0; i < 2; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			fg.fail(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		body, _ := io.ReadAll(part)
+		if i == 0 {
+			if err := json.Unmarshal(body, &attrs); err != nil {
+				fg.fail(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		} else {
+			fg.objects[bucket+"/"+attrs["name"].(string)] = body
+			attrs["size"] = fmt.Sprintf("%d", len(body))
+			sum := md5.Sum(body)
+			attrs["md5Hash"] = base64.StdEncoding.EncodeToString(sum[:])
+		}
+	}
+	attrs["bucket"] = bucket
+	fg.reply(w, http.StatusOK, attrs)
+}
+
+func (fg *fakeGCP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	// /storage/v1/b/<bucket>
+	case r.Method == http.MethodGet && len(parts) == 4 && parts[0] == "storage":
+		if !fg.buckets[parts[3]] {
+			fg.fail(w, http.StatusNotFound, "bucket not found")
+			return
+		}
+		fg.reply(w, http.StatusOK, map[string]any{"name": parts[3]})
+	// /upload/storage/v1/b/<bucket>/o
+	case r.Method == http.MethodPost && len(parts) == 6 && parts[0] == "upload":
+		fg.upload(w, r, parts[4])
+	// /storage/v1/b/<bucket>/o/<object>
+	case r.Method == http.MethodDelete && len(parts) == 6 && parts[0] == "storage":
+		name := parts[3] + "/" + parts[5]
+		delete(fg.objects, name)
+		fg.deleted = append(fg.deleted, name)
+		w.WriteHeader(http.StatusNoContent)
+	// /compute/v1/projects/<project>/global/images/<image>
+	case r.Method == http.MethodGet && len(parts) == 7 && parts[5] == "images":
+		image, ok := fg.images[parts[3]+"/"+parts[6]]
+		if !ok {
+			fg.fail(w, http.StatusNotFound, "image not found")
+			return
+		}
+		fg.reply(w, http.StatusOK, image)
+	// /compute/v1/projects/<project>/global/images
+	case r.Method == http.MethodPost && len(parts) == 6 && parts[5] == "images":
+		var image map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&image); err != nil {
+			fg.fail(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		fg.images[parts[3]+"/"+image["name"].(string)] = image
+		fg.reply(w, http.StatusOK, map[string]any{"name": "operation-1", "status": "RUNNING"})
+	// /compute/v1/projects/<project>/global/operations/<operation>
+	case r.Method == http.MethodGet && len(parts) == 7 && parts[5] == "operations":
+		fg.reply(w, http.StatusOK, map[string]any{"name": parts[6], "status": "DONE"})
+	default:
+		fg.fail(w, http.StatusNotImplemented, r.Method+" "+r.URL.Path)
+	}
+}
+
+func mockGCP(t *testing.T) (*fakeGCP, string) {
+	fg, endpoint := newFakeGCP(t)
+	restore := main.MockGcpAuthOptions()
+	t.Cleanup(restore)
+	return fg, endpoint
+}
+
+func TestUploadGCP(t *testing.T) {
+	fg, endpoint := mockGCP(t)
+
+	img := []byte("\x1f\x8bfake-tar-gz")
+	imagePath := filepath.Join(t.TempDir(), "image.tar.gz")
+	require.NoError(t, os.WriteFile(imagePath, img, 0644))
+
+	var fakeStdout bytes.Buffer
+	restore := main.MockOsStdout(&fakeStdout)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+	restore = main.MockOsArgs([]string{
+		"upload",
+		"--to=gcp",
+		"--arch=aarch64",
+		"--gcp-storage-endpoint", endpoint,
+		"--gcp-compute-endpoint", endpoint,
+		"--gcp-project", "my-project",
+		"--gcp-bucket", "my-bucket",
+		"--gcp-image-name", "my-image",
+		"--gcp-region", "europe-west3",
+		imagePath,
+	})
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]any{
+		"my-project/my-image": {
+			"name":             "my-image",
+			"architecture":     "ARM64",
+			"rawDisk":          map[string]any{"source": "https://storage.googleapis.com/my-bucket/my-image.tar.gz"},
+			"storageLocations": []any{"europe-west3"},
+			"guestOsFeatures": []any{
+				map[string]any{"type": "VIRTIO_SCSI_MULTIQUEUE"},
+				map[string]any{"type": "GVNIC"},
+				map[string]any{"type": "UEFI_COMPATIBLE"},
+			},
+		},
+	}, fg.images)
+	// the intermediate object is removed again
+	assert.Equal(t, []string{"my-bucket/my-image.tar.gz"}, fg.deleted)
+	assert.Empty(t, fg.objects)
+	assert.Contains(t, fakeStdout.String(), "100.00%")
+}
+
+func TestUploadGCPErrors(t *testing.T) {
+	_, endpoint := mockGCP(t)
+
+	imagePath := filepath.Join(t.TempDir(), "disk.raw")
+	require.NoError(t, os.WriteFile(imagePath, []byte("raw"), 0644))
+	restore := main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+
+	for _, tc := range []struct {
+		cmdline     []string
+		expectedErr string
+	}{
+		{
+			[]string{"--to=gcp"},
+			`missing all upload configuration: ["--gcp-project" "--gcp-bucket" "--gcp-image-name"]`,
+		}, {
+			[]string{"--to=gcp", "--gcp-image-name=img"},
+			`missing upload configuration: ["--gcp-project" "--gcp-bucket"]`,
+		}, {
+			[]string{"--to=gcp", "--gcp-image-name=img", "--gcp-project=p", "--gcp-bucket=b", "--gcp-storage-endpoint", endpoint, "--gcp-compute-endpoint", endpoint},
+			`cannot upload to gcp: image is not a .tar.gz (is this a gce image?)`,
+		},
+	} {
+		t.Run(strings.Join(tc.cmdline, ","), func(t *testing.T) {
+			restore := main.MockOsArgs(append(append([]string{"upload", "--arch=x86_64"}, tc.cmdline...), imagePath))
+			defer restore()
+
+			err := main.Run()
+			assert.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestBuildAndUploadGCEWithFakeGCP(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+	restore = main.MockOsbuildVersion(func() (string, error) { return "999", nil })
+	defer restore()
+	restore = main.MockManifestgenDepsolver(fakeDepsolve)
+	defer restore()
+	restore = main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+	fg, endpoint := mockGCP(t)
+	testutil.MockCommand(t, "osbuild", makeFakeOsbuildScript())
+
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+	cmdline := []string{
+		"build",
+		"--output-dir", t.TempDir(),
+		"--cache", t.TempDir(),
+		"--gcp-storage-endpoint", endpoint,
+		"--gcp-compute-endpoint", endpoint,
+		"--gcp-project", "my-project",
+		"--gcp-bucket", "my-bucket",
+		"--gcp-image-name", "my-image",
+		"gce",
+		"--distro=centos-9",
+	}
+	restore = main.MockOsArgs(cmdline)
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	require.Contains(t, fg.images, "my-project/my-image")
+	assert.Equal(t, "X86_64", fg.images["my-project/my-image"]["architecture"])
+	assert.Contains(t, fg.images["my-project/my-image"]["guestOsFeatures"], map[string]any{"type": "UEFI_COMPATIBLE"})
+
+	// the preflight check fails if the image exists already
+	restore = main.MockOsArgs(cmdline)
+	defer restore()
+	err = main.Run()
+	assert.ErrorContains(t, err, `image "my-image" already exists in project "my-project"`)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// imageFormat is the format of the image data, it is detected from the
+// header of the data and not from the filename
+type imageFormat string
+
+const (
+	imageFormatRaw imageFormat = "raw"
+	// imageFormatVHD is a fixed VHD, a raw disk with a footer
+	imageFormatVHD   imageFormat = "vhd"
+	imageFormatQcow2 imageFormat = "qcow2"
+	imageFormatVMDK  imageFormat = "vmdk"
+	imageFormatXZ    imageFormat = "xz"
+	imageFormatZstd  imageFormat = "zstd"
+	imageFormatGzip  imageFormat = "gzip"
+)
+
+var imageFormatMagics = []struct {
+	format imageFormat
+	magic  []byte
+}{
+	{imageFormatXZ, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{imageFormatZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{imageFormatGzip, []byte{0x1f, 0x8b}},
+	{imageFormatQcow2, []byte{'Q', 'F', 'I', 0xfb}},
+	{imageFormatVMDK, []byte{'K', 'D', 'M', 'V'}},
+}
+
+// detectImageFormat returns the format of the given header, anything
+// that is not known is treated as raw data
+func detectImageFormat(header []byte) imageFormat {
+	for _, m := range imageFormatMagics {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.format
+		}
+	}
+	return imageFormatRaw
+}
+
+// raw returns true for the formats that are a raw disk, the footer of
+// a fixed VHD does not disturb a user of a raw disk
+func (f imageFormat) raw() bool {
+	return f == imageFormatRaw || f == imageFormatVHD
+}
+
+func (f imageFormat) compressed() bool {
+	switch f {
+	case imageFormatXZ, imageFormatZstd, imageFormatGzip:
+		return true
+	default:
+		return false
+	}
+}
+
+// imageFormatUploader is implemented by uploaders that cannot upload
+// images in every format, the image is decompressed and converted to
+// raw while it is uploaded if the uploader does not accept it as is
+type imageFormatUploader interface {
+	acceptsImageFormat(f imageFormat) bool
+}
+
+// uploadFormatUploader is implemented by uploaders that need to know
+// the format of the data that is uploaded after the conversion
+type uploadFormatUploader interface {
+	setUploadFormat(f imageFormat)
+}
+
+// imageFormatOf returns the format of the image at the given path
+func imageFormatOf(imagePath string) (imageFormat, error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, 8)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	format := detectImageFormat(header[:n])
+	if format != imageFormatRaw {
+		return format, nil
+	}
+	// the VHD footer is at the end of the image
+	st, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if st.Size() < vhdFooterSize {
+		return format, nil
+	}
+	footer := make([]byte, vhdFooterSize)
+	if _, err := f.ReadAt(footer, st.Size()-vhdFooterSize); err != nil {
+		return "", err
+	}
+	if isVHDFooter(footer) {
+		return imageFormatVHD, nil
+	}
+	return format, nil
+}
+
+// newDecompressor returns a reader for the decompressed data of r
+func newDecompressor(format imageFormat, r io.Reader) (io.ReadCloser, error) {
+	switch format {
+	case imageFormatXZ:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case imageFormatZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case imageFormatGzip:
+		return gzip.NewReader(r)
+	default:
+		return nil, fmt.Errorf("cannot decompress %s data", format)
+	}
+}
+
+// decompressedImage is the decompressed data of an image file
+type decompressedImage struct {
+	io.Reader
+	dc io.ReadCloser
+	f  *os.File
+}
+
+func openDecompressedImage(imagePath string, format imageFormat) (*decompressedImage, error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := newDecompressor(format, bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot decompress %s: %w", imagePath, err)
+	}
+	return &decompressedImage{Reader: dc, dc: dc, f: f}, nil
+}
+
+func (di *decompressedImage) Close() error {
+	di.dc.Close()
+	return di.f.Close()
+}
+
+// decompressedInfoEntry is the decompressed size of one image, the
+// mutex is held while the image is decompressed so that it only
+// happens once per image but images at other paths are not blocked
+type decompressedInfoEntry struct {
+	sync.Mutex
+	info  decompressedInfo
+	known bool
+}
+
+// decompressedInfo is what is known about a decompressed image
+// without decompressing it again
+type decompressedInfo struct {
+	size uint64
+	// vhd is set when the decompressed image ends with a VHD footer
+	vhd bool
+}
+
+var decompressedInfos = struct {
+	sync.Mutex
+	entries map[string]*decompressedInfoEntry
+}{entries: make(map[string]*decompressedInfoEntry)}
+
+// tailWriter keeps the last bytes that were written to it
+type tailWriter struct {
+	tail []byte
+	size int
+}
+
+func (tw *tailWriter) Write(p []byte) (int, error) {
+	tw.tail = append(tw.tail, p[max(len(p)-tw.size, 0):]...)
+	tw.tail = tw.tail[max(len(tw.tail)-tw.size, 0):]
+	return len(p), nil
+}
+
+// decompressedImageInfo returns the size of the decompressed image and
+// if it is a VHD. None of the compression formats records the size
+// reliably (the gzip trailer only has the lower 32 bits), so the image
+// is decompressed once without uploading it. The result is remembered
+// for retries and other targets.
+func decompressedImageInfo(imagePath string, format imageFormat, status io.Writer) (decompressedInfo, error) {
+	decompressedInfos.Lock()
+	entry, ok := decompressedInfos.entries[imagePath]
+	if !ok {
+		entry = &decompressedInfoEntry{}
+		decompressedInfos.entries[imagePath] = entry
+	}
+	decompressedInfos.Unlock()
+
+	entry.Lock()
+	defer entry.Unlock()
+	if entry.known {
+		return entry.info, nil
+	}
+	fmt.Fprintf(status, "Determining the size of the decompressed %s image\n", format)
+	di, err := openDecompressedImage(imagePath, format)
+	if err != nil {
+		return decompressedInfo{}, err
+	}
+	defer di.Close()
+	tail := &tailWriter{size: vhdFooterSize}
+	n, err := io.Copy(tail, di)
+	if err != nil {
+		return decompressedInfo{}, fmt.Errorf("cannot decompress %s: %w", imagePath, err)
+	}
+	entry.info = decompressedInfo{size: uint64(n), vhd: isVHDFooter(tail.tail)}
+	entry.known = true
+	return entry.info, nil
+}
+
+// openConvertedImage opens the image in a format that the uploader
+// accepts and returns the format and the size of the data that will be
+// read. Images are decompressed, qcow2 and vmdk images are converted to
+// raw and raw images to a fixed VHD (e.g. for azure).
+func openConvertedImage(imagePath string, accepts func(imageFormat) bool, status io.Writer) (io.ReadCloser, imageFormat, uint64, error) {
+	// a fixed VHD can be used as a raw disk
+	acceptsAs := func(f imageFormat) bool {
+		return accepts(f) || (f == imageFormatVHD && accepts(imageFormatRaw))
+	}
+	format, err := imageFormatOf(imagePath)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if acceptsAs(format) {
+		f, size, err := openImageFile(imagePath)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		return f, format, size, nil
+	}
+
+	// rc reads the image in the (raw) inner format
+	var rc io.ReadCloser
+	var size uint64
+	inner := format
+	switch {
+	case format.compressed():
+		di, err := openDecompressedImage(imagePath, format)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		header, err := bufio.NewReader(di).Peek(8)
+		di.Close()
+		if err != nil && err != io.EOF {
+			return nil, "", 0, fmt.Errorf("cannot decompress %s: %w", imagePath, err)
+		}
+		inner = detectImageFormat(header)
+		if !acceptsAs(inner) && !(inner.raw() && acceptsAs(imageFormatVHD)) {
+			// qcow2 and vmdk need random access for the conversion
+			return nil, "", 0, fmt.Errorf("cannot convert the %s compressed %s image %s while uploading, decompress it first", format, inner, imagePath)
+		}
+		info, err := decompressedImageInfo(imagePath, format, status)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		if info.vhd {
+			inner = imageFormatVHD
+		}
+		fmt.Fprintf(status, "Decompressing the %s image while uploading\n", format)
+		rc, err = openDecompressedImage(imagePath, format)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		size = info.size
+	case (format == imageFormatQcow2 || format == imageFormatVMDK) && (acceptsAs(imageFormatRaw) || acceptsAs(imageFormatVHD)):
+		f, fileSize, err := openImageFile(imagePath)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		var rr *rawImageReader
+		if format == imageFormatQcow2 {
+			rr, err = newQcow2RawReader(f)
+		} else {
+			rr, err = newVMDKRawReader(f, int64(fileSize))
+		}
+		if err != nil {
+			f.Close()
+			return nil, "", 0, fmt.Errorf("cannot convert %s: %w", imagePath, err)
+		}
+		fmt.Fprintf(status, "Converting the %s image to raw while uploading\n", format)
+		rc = struct {
+			io.Reader
+			io.Closer
+		}{rr, multiCloser{rr, f}}
+		size = rr.size
+		inner = imageFormatRaw
+	case format == imageFormatRaw && acceptsAs(imageFormatVHD):
+		rc, size, err = openImageFile(imagePath)
+		if err != nil {
+			return nil, "", 0, err
+		}
+	default:
+		return nil, "", 0, fmt.Errorf("cannot upload %s image %s to this target", format, imagePath)
+	}
+
+	if !acceptsAs(inner) {
+		// only a raw disk is left that needs to become a VHD
+		fmt.Fprintf(status, "Converting the raw image to a fixed VHD while uploading\n")
+		rc, size = newVHDReader(rc, size)
+		inner = imageFormatVHD
+	}
+	return rc, inner, size, nil
+}
+
+func openImageFile(imagePath string) (*os.File, uint64, error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("cannot stat upload: %v", err)
+	}
+	return f, uint64(st.Size()), nil
+}
+
+// rawImageReader reads a disk image with a sparse format as raw data,
+// one block (a qcow2 cluster or a vmdk grain) at a time
+type rawImageReader struct {
+	size      uint64
+	blockSize uint64
+	// readBlock fills buf with the given block, buf is zeroed
+	readBlock func(idx uint64, buf []byte) error
+	// release frees what readBlock allocated, it can be nil
+	release func()
+
+	// pos is the offset of the next block
+	pos     uint64
+	buf     []byte
+	pending []byte
+}
+
+// Close releases the resources of the reader, the underlying image is
+// not closed
+func (rr *rawImageReader) Close() error {
+	if rr.release != nil {
+		rr.release()
+		rr.release = nil
+	}
+	return nil
+}
+
+// multiCloser closes all closers in order
+type multiCloser []io.Closer
+
+func (mc multiCloser) Close() error {
+	var errs []error
+	for _, c := range mc {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (rr *rawImageReader) Read(p []byte) (int, error) {
+	if len(rr.pending) == 0 {
+		if rr.pos >= rr.size {
+			return 0, io.EOF
+		}
+		if rr.buf == nil {
+			rr.buf = make([]byte, rr.blockSize)
+		}
+		clear(rr.buf)
+		if err := rr.readBlock(rr.pos/rr.blockSize, rr.buf); err != nil {
+			return 0, err
+		}
+		n := min(rr.blockSize, rr.size-rr.pos)
+		rr.pending = rr.buf[:n]
+		rr.pos += n
+	}
+	n := copy(p, rr.pending)
+	rr.pending = rr.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,293 @@
+package main_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+)
+
+// testRawDisk returns a disk with data and zeros that does not end on
+// a cluster or grain boundary
+func testRawDisk() []byte {
+	var disk []byte
+	disk = append(disk, bytes.Repeat([]byte("A"), 4096)...)
+	disk = append(disk, bytes.Repeat([]byte("B"), 512)...)
+	disk = append(disk, make([]byte, 4096+512)...)
+	disk = append(disk, bytes.Repeat([]byte("C"), 1024)...)
+	return disk
+}
+
+func padToSector(b []byte) []byte {
+	return append(b, make([]byte, (512-len(b)%512)%512)...)
+}
+
+// makeQcow2 returns a version 3 qcow2 image with 512 byte clusters of
+// the given disk, odd data clusters are compressed, odd zero clusters
+// use the zero flag and even ones are not allocated
+func makeQcow2(t *testing.T, disk []byte) []byte {
+	const clusterSize = 512
+	nClusters := (len(disk) + clusterSize - 1) / clusterSize
+	require.LessOrEqual(t, nClusters, clusterSize/8)
+
+	img := make([]byte, 3*clusterSize)
+	copy(img, "QFI\xfb")
+	binary.BigEndian.PutUint32(img[4:], 3)
+	binary.BigEndian.PutUint32(img[20:], 9)
+	binary.BigEndian.PutUint64(img[24:], uint64(len(disk)))
+	binary.BigEndian.PutUint32(img[36:], 1)
+	binary.BigEndian.PutUint64(img[40:], clusterSize)
+	binary.BigEndian.PutUint32(img[96:], 4)
+	binary.BigEndian.PutUint32(img[100:], 104)
+	// the L1 table in cluster 1 points to the L2 table in cluster 2
+	binary.BigEndian.PutUint64(img[clusterSize:], 2*clusterSize)
+
+	for i := 0; i < nClusters; i++ {
+		cluster := make([]byte, clusterSize)
+		copy(cluster, disk[i*clusterSize:])
+		var entry uint64
+		switch {
+		case bytes.Equal(cluster, make([]byte, clusterSize)):
+			if i%2 == 1 {
+				entry = 1
+			}
+		case i%2 == 1:
+			var buf bytes.Buffer
+			fw, err := flate.NewWriter(&buf, flate.BestCompression)
+			require.NoError(t, err)
+			_, err = fw.Write(cluster)
+			require.NoError(t, err)
+			require.NoError(t, fw.Close())
+			// with 512 byte clusters there is one bit for the number
+			// of additional sectors
+			offset := uint64(len(img)) + 100
+			sectors := (offset%512 + uint64(buf.Len()) + 511) / 512
+			require.LessOrEqual(t, sectors, uint64(2))
+			entry = 1<<62 | (sectors-1)<<61 | offset
+			img = append(img, make([]byte, 100)...)
+			img = padToSector(append(img, buf.Bytes()...))
+		default:
+			entry = uint64(len(img))
+			img = append(img, cluster...)
+		}
+		binary.BigEndian.PutUint64(img[2*clusterSize+i*8:], entry)
+	}
+	return img
+}
+
+// makeStreamOptimizedVMDK returns a streamOptimized vmdk image with 4k
+// grains of the given disk
+func makeStreamOptimizedVMDK(t *testing.T, disk []byte) []byte {
+	const grainSize = 4096
+	require.Zero(t, len(disk)%512)
+
+	header := make([]byte, 512)
+	copy(header, "KDMV")
+	binary.LittleEndian.PutUint32(header[4:], 3)
+	binary.LittleEndian.PutUint32(header[8:], 1<<0|1<<16|1<<17)
+	binary.LittleEndian.PutUint64(header[12:], uint64(len(disk)/512))
+	binary.LittleEndian.PutUint64(header[20:], grainSize/512)
+	binary.LittleEndian.PutUint32(header[44:], 512)
+	binary.LittleEndian.PutUint64(header[56:], 0xffffffffffffffff)
+	binary.LittleEndian.PutUint16(header[77:], 1)
+
+	img := append([]byte(nil), header...)
+	gt := make([]byte, 512*4)
+	for i := 0; i*grainSize < len(disk); i++ {
+		grain := disk[i*grainSize : min((i+1)*grainSize, len(disk))]
+		if bytes.Equal(grain, make([]byte, len(grain))) {
+			continue
+		}
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		_, err := zw.Write(grain)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+
+		binary.LittleEndian.PutUint32(gt[i*4:], uint32(len(img)/512))
+		marker := make([]byte, 12)
+		binary.LittleEndian.PutUint64(marker, uint64(i*grainSize/512))
+		binary.LittleEndian.PutUint32(marker[8:], uint32(buf.Len()))
+		img = padToSector(append(append(img, marker...), buf.Bytes()...))
+	}
+	gtSector := len(img) / 512
+	img = append(img, gt...)
+	gdSector := len(img) / 512
+	gd := make([]byte, 512)
+	binary.LittleEndian.PutUint32(gd, uint32(gtSector))
+	img = append(img, gd...)
+
+	// footer marker, footer and end-of-stream marker
+	footer := append([]byte(nil), header...)
+	binary.LittleEndian.PutUint64(footer[56:], uint64(gdSector))
+	img = append(img, make([]byte, 512)...)
+	img = append(img, footer...)
+	img = append(img, make([]byte, 512)...)
+	return img
+}
+
+func compressTestData(t *testing.T, format string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch format {
+	case "xz":
+		w, err = xz.NewWriter(&buf)
+	case "zstd":
+		w, err = zstd.NewWriter(&buf)
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	}
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func uploadToFakeAWS(t *testing.T, imagePath string) (*fakeAwsUploader, string, error) {
+	fa := &fakeAwsUploader{amiID: "ami-fake"}
+	mockAWSUploads(t, fa)
+	var fakeStderr bytes.Buffer
+	restore := main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(&fakeStderr)
+	defer restore()
+	restore = main.MockOsArgs([]string{
+		"upload",
+		"--to=aws",
+		"--arch=x86_64",
+		"--aws-region=eu-west-1",
+		"--aws-bucket=my-bucket",
+		"--aws-ami-name=my-ami",
+		"--upload-retries=0",
+		imagePath,
+	})
+	defer restore()
+
+	err := main.Run()
+	return fa, fakeStderr.String(), err
+}
+
+func TestUploadConvertsImages(t *testing.T) {
+	disk := testRawDisk()
+
+	for _, tc := range []struct {
+		filename       string
+		content        []byte
+		expectedStatus string
+	}{
+		{"disk.raw", disk, ""},
+		{"disk.raw.xz", compressTestData(t, "xz", disk), "Decompressing the xz image while uploading\n"},
+		{"disk.raw.zst", compressTestData(t, "zstd", disk), "Decompressing the zstd image while uploading\n"},
+		{"disk.raw.gz", compressTestData(t, "gzip", disk), "Decompressing the gzip image while uploading\n"},
+		{"disk.qcow2", makeQcow2(t, disk), "Converting the qcow2 image to raw while uploading\n"},
+		{"disk.vmdk", makeStreamOptimizedVMDK(t, disk), "Converting the vmdk image to raw while uploading\n"},
+		// the format is detected from the content and not the name
+		{"disk.img", compressTestData(t, "xz", disk), "Decompressing the xz image while uploading\n"},
+	} {
+		t.Run(tc.filename, func(t *testing.T) {
+			imagePath := filepath.Join(t.TempDir(), tc.filename)
+			require.NoError(t, os.WriteFile(imagePath, tc.content, 0644))
+			fa, status, err := uploadToFakeAWS(t, imagePath)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(len(disk)), fa.uploadAndRegisterSize)
+			assert.Equal(t, disk, fa.uploadAndRegisterRead.Bytes())
+			if tc.expectedStatus == "" {
+				assert.NotContains(t, status, "while uploading")
+			} else {
+				assert.Contains(t, status, tc.expectedStatus)
+			}
+		})
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that can be written concurrently
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(p)
+}
+
+func TestDecompressedSizeOncePerImage(t *testing.T) {
+	disk := testRawDisk()
+	tmpdir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"a.raw.xz", "b.raw.xz"} {
+		path := filepath.Join(tmpdir, name)
+		require.NoError(t, os.WriteFile(path, compressTestData(t, "xz", disk), 0644))
+		paths = append(paths, path)
+	}
+
+	var status lockedBuffer
+	var wg sync.WaitGroup
+	sizes := make([]uint64, 8)
+	errs := make([]error, 8)
+	for i := range sizes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sizes[i], errs[i] = main.DecompressedSize(paths[i%2], "xz", &status)
+		}()
+	}
+	wg.Wait()
+
+	for i := range sizes {
+		require.NoError(t, errs[i])
+		assert.Equal(t, uint64(len(disk)), sizes[i])
+	}
+	// every image is only decompressed once
+	assert.Equal(t, 2, strings.Count(status.buf.String(), "Determining the size of the decompressed xz image\n"))
+}
+
+func TestUploadConvertErrors(t *testing.T) {
+	disk := testRawDisk()
+
+	qcow2WithBackingFile := makeQcow2(t, disk)
+	binary.BigEndian.PutUint64(qcow2WithBackingFile[8:], 1024)
+
+	for _, tc := range []struct {
+		filename    string
+		content     []byte
+		expectedErr string
+	}{
+		{
+			"disk.qcow2.xz",
+			compressTestData(t, "xz", makeQcow2(t, disk)),
+			"cannot convert the xz compressed qcow2 image %s while uploading, decompress it first",
+		},
+		{
+			"disk.qcow2",
+			qcow2WithBackingFile,
+			"cannot convert %s: qcow2 images with a backing file are not supported",
+		},
+	} {
+		t.Run(tc.filename, func(t *testing.T) {
+			imagePath := filepath.Join(t.TempDir(), tc.filename)
+			require.NoError(t, os.WriteFile(imagePath, tc.content, 0644))
+			fa, _, err := uploadToFakeAWS(t, imagePath)
+			assert.EqualError(t, err, fmt.Sprintf(tc.expectedErr, imagePath))
+			assert.Equal(t, 0, fa.uploadAndRegisterCalls)
+		})
+	}
+}
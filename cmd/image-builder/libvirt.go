@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/osbuild/images/pkg/arch"
+	"github.com/osbuild/images/pkg/cloud"
+	"github.com/osbuild/images/pkg/platform"
+)
+
+const (
+	libvirtDefaultMemoryMiB   = 2048
+	libvirtInstallerMemoryMiB = 4096
+	libvirtVCPUs              = 2
+)
+
+// libvirtDomainOptions describe the domain that is defined for an
+// uploaded libvirt volume with --libvirt-define-domain
+type libvirtDomainOptions struct {
+	Connection string
+	Name       string
+	Pool       string
+	Volume     string
+	Arch       arch.Arch
+	BootMode   platform.BootMode
+	// MemoryMiB of 0 picks the memory based on the image type
+	MemoryMiB uint64
+	Network   string
+
+	Start        bool
+	StartTimeout time.Duration
+
+	// set from the uploaded artifact
+	imagePath   string
+	imageType   string
+	imageFormat imageFormat
+}
+
+// imageExt returns the extension of the image without the extension
+// of the compression, compressed images are decompressed for libvirt
+func (opts *libvirtDomainOptions) imageExt() string {
+	name := opts.imagePath
+	switch filepath.Ext(name) {
+	case ".xz", ".zst", ".gz":
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return filepath.Ext(name)
+}
+
+// diskFormat returns the libvirt disk format of the image, it is the
+// format of the uploaded data and not the one of the file
+func (opts *libvirtDomainOptions) diskFormat() (string, error) {
+	switch opts.imageExt() {
+	case ".qcow2", ".img", ".raw", ".iso", ".vhd":
+	default:
+		return "", fmt.Errorf("cannot define a domain for %q, only qcow2, raw and iso images are supported", filepath.Base(opts.imagePath))
+	}
+	switch opts.imageFormat {
+	case imageFormatQcow2, imageFormatVMDK:
+		return string(opts.imageFormat), nil
+	case imageFormatRaw, imageFormatVHD:
+		return "raw", nil
+	default:
+		return "", fmt.Errorf("cannot define a domain for the %s data of %q", opts.imageFormat, filepath.Base(opts.imagePath))
+	}
+}
+
+func (opts *libvirtDomainOptions) isInstaller() bool {
+	return opts.imageExt() == ".iso" || strings.Contains(opts.imageType, "installer")
+}
+
+func (opts *libvirtDomainOptions) memoryMiB() uint64 {
+	switch {
+	case opts.MemoryMiB > 0:
+		return opts.MemoryMiB
+	case opts.isInstaller():
+		// anaconda needs more memory than an installed system
+		return libvirtInstallerMemoryMiB
+	default:
+		return libvirtDefaultMemoryMiB
+	}
+}
+
+var libvirtDomainTmpl = template.Must(template.New("domain").Funcs(template.FuncMap{
+	"xml": func(s string) (string, error) {
+		var buf bytes.Buffer
+		err := xml.EscapeText(&buf, []byte(s))
+		return buf.String(), err
+	},
+}).Parse(`<domain type="{{.Type}}">
+  <name>{{xml .Name}}</name>
+  <memory unit="MiB">{{.MemoryMiB}}</memory>
+  <vcpu>{{.VCPUs}}</vcpu>
+  <os{{if .EFI}} firmware="efi"{{end}}>
+    <type arch="{{.Arch}}"{{if .Machine}} machine="{{.Machine}}"{{end}}>hvm</type>
+  </os>
+{{- if .ACPI}}
+  <features>
+    <acpi/>
+  </features>
+{{- end}}
+{{- if eq .Type "kvm"}}
+  <cpu mode="host-passthrough"/>
+{{- end}}
+  <devices>
+    <disk type="volume" device="{{.Device}}">
+      <driver name="qemu" type="{{.DiskFormat}}"/>
+      <source pool="{{xml .Pool}}" volume="{{xml .Volume}}"/>
+      <target dev="{{.TargetDev}}" bus="{{.Bus}}"/>
+{{- if eq .Device "cdrom"}}
+      <readonly/>
+{{- end}}
+      <boot order="1"/>
+    </disk>
+{{- if eq .Bus "scsi"}}
+    <controller type="scsi" model="virtio-scsi"/>
+{{- end}}
+    <interface type="network">
+      <source network="{{xml .Network}}"/>
+      <model type="virtio"/>
+    </interface>
+    <serial type="pty"/>
+    <console type="pty"/>
+    <channel type="unix">
+      <target type="virtio" name="org.qemu.guest_agent.0"/>
+    </channel>
+  </devices>
+</domain>
+`))
+
+// libvirtDomainXML returns the domain XML for the given options, the
+// hypervisor is the type of the libvirt connection (e.g. "QEMU")
+func libvirtDomainXML(opts *libvirtDomainOptions, hypervisor string) (string, error) {
+	diskFormat, err := opts.diskFormat()
+	if err != nil {
+		return "", err
+	}
+	data := struct {
+		Type       string
+		Name       string
+		MemoryMiB  uint64
+		VCPUs      int
+		EFI        bool
+		Arch       string
+		Machine    string
+		ACPI       bool
+		Device     string
+		DiskFormat string
+		Pool       string
+		Volume     string
+		TargetDev  string
+		Bus        string
+		Network    string
+	}{
+		Name:       opts.Name,
+		MemoryMiB:  opts.memoryMiB(),
+		VCPUs:      libvirtVCPUs,
+		Arch:       opts.Arch.String(),
+		Device:     "disk",
+		DiskFormat: diskFormat,
+		Pool:       opts.Pool,
+		Volume:     opts.Volume,
+		TargetDev:  "vda",
+		Bus:        "virtio",
+		Network:    opts.Network,
+	}
+
+	switch {
+	case strings.EqualFold(hypervisor, "test"):
+		// libvirt's test:///default driver
+		data.Type = "test"
+	case opts.Arch == arch.Current():
+		data.Type = "kvm"
+	default:
+		// foreign architectures need to be emulated
+		data.Type = "qemu"
+	}
+
+	switch opts.BootMode {
+	case platform.BOOT_NONE:
+		return "", fmt.Errorf("cannot define a domain for an image that is not bootable")
+	case platform.BOOT_LEGACY:
+		if opts.Arch == arch.ARCH_AARCH64 {
+			return "", fmt.Errorf("cannot boot a legacy BIOS image on %s", opts.Arch)
+		}
+	case platform.BOOT_UEFI, platform.BOOT_HYBRID:
+		// hybrid images prefer UEFI, like AWS does
+		data.EFI = opts.Arch == arch.ARCH_X86_64 || opts.Arch == arch.ARCH_AARCH64
+	}
+
+	switch opts.Arch {
+	case arch.ARCH_X86_64:
+		data.Machine = "q35"
+		data.ACPI = true
+	case arch.ARCH_AARCH64:
+		data.Machine = "virt"
+		data.ACPI = true
+	case arch.ARCH_PPC64LE:
+		data.Machine = "pseries"
+	case arch.ARCH_S390X:
+		data.Machine = "s390-ccw-virtio"
+	}
+
+	if opts.imageExt() == ".iso" {
+		data.Device = "cdrom"
+		data.TargetDev = "sda"
+		data.Bus = "scsi"
+		if opts.Arch == arch.ARCH_X86_64 {
+			data.Bus = "sata"
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := libvirtDomainTmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// libvirtUploader uploads into a libvirt volume with the uploader of
+// the images library and optionally defines and starts a domain that
+// boots from the volume
+type libvirtUploader struct {
+	cloud.Uploader
+	connection string
+	pool       string
+	volume     string
+
+	// domain is nil unless --libvirt-define-domain is used
+	domain *libvirtDomainOptions
+}
+
+// setArtifact implements artifactUploader, the filename and image type
+// decide the disk device and the memory of the domain
+func (lu *libvirtUploader) setArtifact(imagePath string, md *artifactMetadata) {
+	if lu.domain == nil {
+		return
+	}
+	lu.domain.imagePath = imagePath
+	lu.domain.imageType = ""
+	if md != nil {
+		lu.domain.imageType = md.ImageType
+	}
+}
+
+// acceptsImageFormat implements imageFormatUploader, libvirt cannot
+// use a compressed volume
+func (lu *libvirtUploader) acceptsImageFormat(f imageFormat) bool {
+	return !f.compressed()
+}
+
+// setUploadFormat implements uploadFormatUploader, the uploaded and
+// not the artifact's format is the disk format of the domain
+func (lu *libvirtUploader) setUploadFormat(f imageFormat) {
+	if lu.domain == nil {
+		return
+	}
+	lu.domain.imageFormat = f
+}
+
+func (lu *libvirtUploader) Check(status io.Writer) error {
+	if err := lu.Uploader.Check(status); err != nil {
+		return err
+	}
+	if lu.domain == nil {
+		return nil
+	}
+	return libvirtCheckDomain(lu.domain)
+}
+
+func (lu *libvirtUploader) UploadAndRegister(r io.Reader, uploadSize uint64, status io.Writer) error {
+	if lu.domain != nil {
+		// fail before the upload if the domain cannot work, "upload"
+		// does not call Check()
+		if _, err := libvirtDomainXML(lu.domain, ""); err != nil {
+			return &permanentUploadError{err: err}
+		}
+		if err := libvirtCheckDomain(lu.domain); err != nil {
+			return &permanentUploadError{err: err}
+		}
+	}
+	// the volume cannot be created again, the upload is not retried
+	// and a failed upload removes the partial volume
+	if err := libvirtCheckVolume(lu.connection, lu.pool, lu.volume); err != nil {
+		return &permanentUploadError{err: err}
+	}
+	if err := lu.Uploader.UploadAndRegister(r, uploadSize, status); err != nil {
+		if delErr := libvirtDeleteVolume(lu.connection, lu.pool, lu.volume); delErr != nil {
+			fmt.Fprintf(status, "WARNING: cannot delete the partial volume %q: %v\n", lu.volume, delErr)
+		}
+		return err
+	}
+	if lu.domain == nil {
+		return nil
+	}
+	return registeredUploadError(libvirtDefineDomain(lu.domain, status))
+}
+
+func (lu *libvirtUploader) remoteID() string {
+	return lu.pool + "/" + lu.volume
+}
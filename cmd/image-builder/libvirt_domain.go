@@ -0,0 +1,207 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	lv "libvirt.org/go/libvirt"
+
+	"github.com/osbuild/images/pkg/olog"
+)
+
+// libvirtAgentPollInterval is how often the guest agent is pinged
+// while waiting for a started domain
+const libvirtAgentPollInterval = 2 * time.Second
+
+// libvirtCheckDomain makes sure that the domain can be defined, mocked
+// in tests
+var libvirtCheckDomain = func(opts *libvirtDomainOptions) error {
+	conn, err := lv.NewConnect(opts.Connection)
+	if err != nil {
+		return fmt.Errorf("cannot connect to libvirt: %w", err)
+	}
+	defer conn.Close()
+
+	dom, err := conn.LookupDomainByName(opts.Name)
+	if err == nil {
+		dom.Free()
+		return fmt.Errorf("domain %q already exists", opts.Name)
+	}
+	var lvErr lv.Error
+	if errors.As(err, &lvErr) && lvErr.Code == lv.ERR_NO_DOMAIN {
+		return nil
+	}
+	return fmt.Errorf("cannot look up domain %q: %w", opts.Name, err)
+}
+
+// libvirtDefineDomain defines (and starts) the domain for the uploaded
+// volume, mocked in tests
+var libvirtDefineDomain = func(opts *libvirtDomainOptions, status io.Writer) error {
+	conn, err := lv.NewConnect(opts.Connection)
+	if err != nil {
+		return fmt.Errorf("cannot connect to libvirt: %w", err)
+	}
+	defer conn.Close()
+
+	hypervisor, err := conn.GetType()
+	if err != nil {
+		return fmt.Errorf("cannot get the libvirt hypervisor: %w", err)
+	}
+	domainXML, err := libvirtDomainXML(opts, hypervisor)
+	if err != nil {
+		return err
+	}
+	dom, err := conn.DomainDefineXML(domainXML)
+	if err != nil {
+		return fmt.Errorf("cannot define domain %q: %w", opts.Name, err)
+	}
+	defer func() {
+		if err := dom.Free(); err != nil {
+			olog.Printf("cannot free domain: %v", err)
+		}
+	}()
+	fmt.Fprintf(status, "Defined domain %s\n", opts.Name)
+
+	if !opts.Start {
+		return nil
+	}
+	if err := dom.Create(); err != nil {
+		return fmt.Errorf("cannot start domain %q: %w", opts.Name, err)
+	}
+	fmt.Fprintf(status, "Started domain %s, waiting for it to boot\n", opts.Name)
+	// the test driver has no guests that could boot
+	if strings.EqualFold(hypervisor, "test") {
+		return nil
+	}
+	how, err := libvirtWaitForGuest(conn, dom, opts.StartTimeout)
+	if err != nil {
+		return fmt.Errorf("domain %q did not boot: %w", opts.Name, err)
+	}
+	fmt.Fprintf(status, "Domain %s is up (%s)\n", opts.Name, how)
+	return nil
+}
+
+// libvirtCheckVolume makes sure that the volume does not exist yet, a
+// failed upload deletes the volume again, mocked in tests
+var libvirtCheckVolume = func(connection, poolName, volume string) error {
+	conn, err := lv.NewConnect(connection)
+	if err != nil {
+		return fmt.Errorf("cannot connect to libvirt: %w", err)
+	}
+	defer conn.Close()
+
+	pool, err := conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		return fmt.Errorf("cannot find storage pool %q: %w", poolName, err)
+	}
+	defer pool.Free()
+	vol, err := pool.LookupStorageVolByName(volume)
+	if err == nil {
+		vol.Free()
+		return fmt.Errorf("volume %q already exists in storage pool %q", volume, poolName)
+	}
+	var lvErr lv.Error
+	if errors.As(err, &lvErr) && lvErr.Code == lv.ERR_NO_STORAGE_VOL {
+		return nil
+	}
+	return fmt.Errorf("cannot look up volume %q: %w", volume, err)
+}
+
+// libvirtDeleteVolume deletes the volume of a failed upload, mocked in
+// tests
+var libvirtDeleteVolume = func(connection, poolName, volume string) error {
+	conn, err := lv.NewConnect(connection)
+	if err != nil {
+		return fmt.Errorf("cannot connect to libvirt: %w", err)
+	}
+	defer conn.Close()
+
+	pool, err := conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		return fmt.Errorf("cannot find storage pool %q: %w", poolName, err)
+	}
+	defer pool.Free()
+	vol, err := pool.LookupStorageVolByName(volume)
+	if err != nil {
+		var lvErr lv.Error
+		if errors.As(err, &lvErr) && lvErr.Code == lv.ERR_NO_STORAGE_VOL {
+			// the upload failed before the volume was created
+			return nil
+		}
+		return fmt.Errorf("cannot look up volume %q: %w", volume, err)
+	}
+	defer vol.Free()
+	if err := vol.Delete(lv.STORAGE_VOL_DELETE_NORMAL); err != nil {
+		return fmt.Errorf("cannot delete volume %q: %w", volume, err)
+	}
+	return nil
+}
+
+// libvirtWaitForGuest waits until either the guest agent answers or
+// the serial console shows a login prompt, images without the guest
+// agent usually still have a getty on the console
+func libvirtWaitForGuest(conn *lv.Connect, dom *lv.Domain, timeout time.Duration) (string, error) {
+	loginPrompt := make(chan struct{})
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return "", fmt.Errorf("cannot create console stream: %w", err)
+	}
+	defer func() {
+		if err := stream.Free(); err != nil {
+			olog.Printf("cannot free stream: %v", err)
+		}
+	}()
+	if err := dom.OpenConsole("", stream, lv.DOMAIN_CONSOLE_FORCE); err == nil {
+		consoleDone := make(chan struct{})
+		// the abort makes a pending Recv() return, the stream must
+		// not be freed before the goroutine stopped using it
+		defer func() {
+			stream.Abort()
+			<-consoleDone
+		}()
+		go func() {
+			defer close(consoleDone)
+			var seen bytes.Buffer
+			buf := make([]byte, 4096)
+			for {
+				n, err := stream.Recv(buf)
+				if err != nil || n == 0 {
+					return
+				}
+				seen.Write(buf[:n])
+				if bytes.Contains(seen.Bytes(), []byte("login:")) {
+					close(loginPrompt)
+					return
+				}
+				// only the end of the output can contain the prompt
+				if seen.Len() > 64*1024 {
+					tail := bytes.Clone(seen.Bytes()[seen.Len()-1024:])
+					seen.Reset()
+					seen.Write(tail)
+				}
+			}
+		}()
+	}
+
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(libvirtAgentPollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := dom.QemuAgentCommand(`{"execute":"guest-ping"}`, lv.DOMAIN_QEMU_AGENT_COMMAND_NOWAIT, 0); err == nil {
+			return "guest agent", nil
+		}
+		select {
+		case <-loginPrompt:
+			return "login prompt", nil
+		case <-deadline:
+			return "", fmt.Errorf("no guest agent or login prompt after %s", timeout)
+		case <-ticker.C:
+		}
+	}
+}
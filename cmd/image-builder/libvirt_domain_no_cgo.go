@@ -0,0 +1,24 @@
+//go:build !cgo
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+var libvirtCheckDomain = func(opts *libvirtDomainOptions) error {
+	return fmt.Errorf("cannot use libvirt: build without cgo")
+}
+
+var libvirtDefineDomain = func(opts *libvirtDomainOptions, status io.Writer) error {
+	return fmt.Errorf("cannot use libvirt: build without cgo")
+}
+
+var libvirtCheckVolume = func(connection, poolName, volume string) error {
+	return fmt.Errorf("cannot use libvirt: build without cgo")
+}
+
+var libvirtDeleteVolume = func(connection, poolName, volume string) error {
+	return fmt.Errorf("cannot use libvirt: build without cgo")
+}
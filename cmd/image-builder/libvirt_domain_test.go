@@ -0,0 +1,53 @@
+//go:build cgo
+
+package main_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+)
+
+func TestUploadLibvirtTestDriver(t *testing.T) {
+	imagePath := writeFakeImage(t, "fedora-43-qcow2-x86_64.qcow2", map[string]string{"arch": "x86_64", "boot-mode": "uefi"})
+
+	var fakeStderr bytes.Buffer
+	restore := main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(&fakeStderr)
+	defer restore()
+	// the domains of test:///default live as long as the process
+	name := fmt.Sprintf("ibcli-test-%d", os.Getpid())
+	restore = main.MockOsArgs([]string{
+		"upload",
+		"--to=libvirt",
+		"--libvirt-connection=test:///default",
+		"--libvirt-pool=default-pool",
+		"--libvirt-volume=" + name + ".qcow2",
+		"--libvirt-domain=" + name,
+		"--libvirt-start",
+		"--upload-retries=0",
+		imagePath,
+	})
+	defer restore()
+
+	err := main.Run()
+	if err != nil && strings.Contains(err.Error(), "cannot connect to libvirt") {
+		t.Skipf("libvirt is not available: %v", err)
+	}
+	require.NoError(t, err)
+	assert.Contains(t, fakeStderr.String(), "Defined domain "+name+"\n")
+	assert.Contains(t, fakeStderr.String(), "Started domain "+name+", waiting for it to boot\n")
+
+	// the domain exists now
+	err = main.Run()
+	assert.EqualError(t, err, fmt.Sprintf("domain %q already exists", name))
+}
@@ -0,0 +1,305 @@
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/osbuild/images/pkg/arch"
+	"github.com/osbuild/images/pkg/cloud"
+	"github.com/osbuild/images/pkg/platform"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+)
+
+// writeFakeImage writes a fake image with the artifact metadata that
+// "build" writes next to it, the data matches the extensions
+func writeFakeImage(t *testing.T, filename string, md map[string]string) string {
+	tmpdir := t.TempDir()
+	imagePath := filepath.Join(tmpdir, filename)
+	data := []byte("fake-disk")
+	if strings.Contains(filename, ".qcow2") {
+		data = makeQcow2(t, testRawDisk())
+	}
+	switch filepath.Ext(filename) {
+	case ".xz":
+		data = compressTestData(t, "xz", data)
+	case ".zst":
+		data = compressTestData(t, "zstd", data)
+	}
+	require.NoError(t, os.WriteFile(imagePath, data, 0644))
+	md["filename"] = filename
+	b, err := json.Marshal(md)
+	require.NoError(t, err)
+	base := strings.SplitN(filename, ".", 2)[0]
+	require.NoError(t, os.WriteFile(filepath.Join(tmpdir, base+".json"), b, 0644))
+	return imagePath
+}
+
+func TestUploadLibvirtDefineDomain(t *testing.T) {
+	imagePath := writeFakeImage(t, "fedora-43-qcow2-x86_64.qcow2", map[string]string{
+		"distro":     "fedora-43",
+		"arch":       "x86_64",
+		"image-type": "qcow2",
+		"boot-mode":  "uefi",
+	})
+
+	var fa fakeAwsUploader
+	restore := main.MockLibvirtNewUploader(func(connection, pool, volume string) (cloud.Uploader, error) {
+		assert.Equal(t, "test:///default", connection)
+		assert.Equal(t, "default-pool", pool)
+		assert.Equal(t, "fedora-vol", volume)
+		return &fa, nil
+	})
+	defer restore()
+	restore = main.MockLibvirtVolume(func(connection, pool, volume string) error {
+		return nil
+	}, func(connection, pool, volume string) error {
+		panic("unexpected volume delete")
+	})
+	defer restore()
+	var checked, defined *main.LibvirtDomainOptions
+	restore = main.MockLibvirtDomain(func(opts *main.LibvirtDomainOptions) error {
+		checked = opts
+		return nil
+	}, func(opts *main.LibvirtDomainOptions, status io.Writer) error {
+		defined = opts
+		return nil
+	})
+	defer restore()
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+	restore = main.MockOsArgs([]string{
+		"upload",
+		"--to=libvirt",
+		"--libvirt-connection=test:///default",
+		"--libvirt-pool=default-pool",
+		"--libvirt-volume=fedora-vol",
+		"--libvirt-define-domain",
+		imagePath,
+	})
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	require.NotNil(t, checked)
+	assert.Equal(t, checked, defined)
+	assert.Equal(t, 1, fa.uploadAndRegisterCalls)
+	assert.Equal(t, "fedora-vol", defined.Name)
+	assert.Equal(t, arch.ARCH_X86_64, defined.Arch)
+	assert.Equal(t, platform.BOOT_UEFI, defined.BootMode)
+	assert.False(t, defined.Start)
+
+	domainXML, err := main.LibvirtDomainXML(defined, "TEST")
+	require.NoError(t, err)
+	assert.Equal(t, `<domain type="test">
+  <name>fedora-vol</name>
+  <memory unit="MiB">2048</memory>
+  <vcpu>2</vcpu>
+  <os firmware="efi">
+    <type arch="x86_64" machine="q35">hvm</type>
+  </os>
+  <features>
+    <acpi/>
+  </features>
+  <devices>
+    <disk type="volume" device="disk">
+      <driver name="qemu" type="qcow2"/>
+      <source pool="default-pool" volume="fedora-vol"/>
+      <target dev="vda" bus="virtio"/>
+      <boot order="1"/>
+    </disk>
+    <interface type="network">
+      <source network="default"/>
+      <model type="virtio"/>
+    </interface>
+    <serial type="pty"/>
+    <console type="pty"/>
+    <channel type="unix">
+      <target type="virtio" name="org.qemu.guest_agent.0"/>
+    </channel>
+  </devices>
+</domain>
+`, domainXML)
+}
+
+func TestLibvirtDomainXMLFitsImage(t *testing.T) {
+	for _, tc := range []struct {
+		filename string
+		metadata map[string]string
+		args     []string
+
+		expected    []string
+		notExpected []string
+		expectedErr string
+	}{
+		{
+			filename:    "centos-9-qcow2-x86_64.qcow2",
+			metadata:    map[string]string{"arch": "x86_64", "boot-mode": "legacy"},
+			expected:    []string{"<os>", `<type arch="x86_64" machine="q35">hvm</type>`},
+			notExpected: []string{"firmware="},
+		},
+		{
+			filename: "fedora-43-raw-aarch64.raw",
+			metadata: map[string]string{"arch": "aarch64", "boot-mode": "hybrid"},
+			expected: []string{`<os firmware="efi">`, `machine="virt"`, `<driver name="qemu" type="raw"/>`},
+		},
+		{
+			filename: "fedora-43-minimal-installer-x86_64.iso",
+			metadata: map[string]string{"arch": "x86_64", "image-type": "minimal-installer", "boot-mode": "hybrid"},
+			expected: []string{`<memory unit="MiB">4096</memory>`, `device="cdrom"`, `<target dev="sda" bus="sata"/>`, "<readonly/>"},
+		},
+		{
+			filename: "fedora-43-qcow2-x86_64.qcow2",
+			metadata: map[string]string{"arch": "x86_64", "boot-mode": "uefi"},
+			args:     []string{"--libvirt-memory=8 GiB", "--libvirt-network=isolated", "--libvirt-domain=my-vm<1>"},
+			expected: []string{`<memory unit="MiB">8192</memory>`, `<source network="isolated"/>`, "<name>my-vm&lt;1&gt;</name>"},
+		},
+		{
+			filename: "fedora-43-raw-x86_64.raw.xz",
+			metadata: map[string]string{"arch": "x86_64", "boot-mode": "uefi"},
+			expected: []string{`<driver name="qemu" type="raw"/>`, `device="disk"`},
+		},
+		{
+			filename: "fedora-43-qcow2-x86_64.qcow2.zst",
+			metadata: map[string]string{"arch": "x86_64", "boot-mode": "uefi"},
+			expected: []string{`<driver name="qemu" type="qcow2"/>`},
+		},
+		{
+			// the filename does not decide the disk format
+			filename: "fedora-43-raw-x86_64.raw",
+			metadata: map[string]string{"arch": "x86_64", "boot-mode": "uefi"},
+			expected: []string{`<driver name="qemu" type="raw"/>`},
+		},
+		{
+			filename: "fedora-43-minimal-installer-x86_64.iso.xz",
+			metadata: map[string]string{"arch": "x86_64", "image-type": "minimal-installer", "boot-mode": "hybrid"},
+			expected: []string{`<driver name="qemu" type="raw"/>`, `device="cdrom"`},
+		},
+		{
+			filename:    "fedora-43-container-x86_64.tar",
+			metadata:    map[string]string{"arch": "x86_64", "boot-mode": "uefi"},
+			expectedErr: `cannot define a domain for "fedora-43-container-x86_64.tar", only qcow2, raw and iso images are supported`,
+		},
+		{
+			filename:    "fedora-43-tar-x86_64.raw",
+			metadata:    map[string]string{"arch": "x86_64", "boot-mode": "none"},
+			expectedErr: "cannot define a domain for an image that is not bootable",
+		},
+	} {
+		t.Run(tc.filename, func(t *testing.T) {
+			imagePath := writeFakeImage(t, tc.filename, tc.metadata)
+
+			restore := main.MockLibvirtNewUploader(func(connection, pool, volume string) (cloud.Uploader, error) {
+				return &fakeAwsUploader{}, nil
+			})
+			defer restore()
+			restore = main.MockLibvirtVolume(func(connection, pool, volume string) error {
+				return nil
+			}, func(connection, pool, volume string) error {
+				return nil
+			})
+			defer restore()
+			var defined *main.LibvirtDomainOptions
+			restore = main.MockLibvirtDomain(func(opts *main.LibvirtDomainOptions) error {
+				return nil
+			}, func(opts *main.LibvirtDomainOptions, status io.Writer) error {
+				defined = opts
+				return nil
+			})
+			defer restore()
+			restore = main.MockOsStdout(io.Discard)
+			defer restore()
+			restore = main.MockOsStderr(io.Discard)
+			defer restore()
+			restore = main.MockOsArgs(append([]string{
+				"upload",
+				"--to=libvirt",
+				"--libvirt-pool=default-pool",
+				"--libvirt-volume=vol",
+				"--libvirt-define-domain",
+				"--upload-retries=0",
+				imagePath,
+			}, tc.args...))
+			defer restore()
+
+			err := main.Run()
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+				assert.Nil(t, defined)
+				return
+			}
+			require.NoError(t, err)
+			domainXML, err := main.LibvirtDomainXML(defined, "QEMU")
+			require.NoError(t, err)
+			for _, s := range tc.expected {
+				assert.Contains(t, domainXML, s)
+			}
+			for _, s := range tc.notExpected {
+				assert.NotContains(t, domainXML, s)
+			}
+		})
+	}
+}
+
+func TestUploadLibvirtFailureDeletesVolume(t *testing.T) {
+	imagePath := writeFakeImage(t, "fedora-43-raw-x86_64.raw", map[string]string{"arch": "x86_64", "boot-mode": "uefi"})
+
+	fa := &fakeAwsUploader{uploadAndRegisterErr: fmt.Errorf("injected stream error")}
+	restore := main.MockLibvirtNewUploader(func(connection, pool, volume string) (cloud.Uploader, error) {
+		return fa, nil
+	})
+	defer restore()
+	volumeExists := false
+	var deleted []string
+	restore = main.MockLibvirtVolume(func(connection, pool, volume string) error {
+		if volumeExists {
+			return fmt.Errorf("volume %q already exists in storage pool %q", volume, pool)
+		}
+		return nil
+	}, func(connection, pool, volume string) error {
+		deleted = append(deleted, pool+"/"+volume)
+		return nil
+	})
+	defer restore()
+	var sleeps []time.Duration
+	restore = main.MockUploadRetrySleep(func(d time.Duration) { sleeps = append(sleeps, d) })
+	defer restore()
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+	restore = main.MockOsArgs([]string{
+		"upload",
+		"--to=libvirt",
+		"--libvirt-pool=default-pool",
+		"--libvirt-volume=vol",
+		imagePath,
+	})
+	defer restore()
+
+	// the partial volume is deleted and the upload is not retried
+	err := main.Run()
+	assert.EqualError(t, err, "injected stream error")
+	assert.Equal(t, 1, fa.uploadAndRegisterCalls)
+	assert.Equal(t, []string{"default-pool/vol"}, deleted)
+	assert.Empty(t, sleeps)
+
+	// an existing volume is not touched
+	volumeExists = true
+	deleted = nil
+	err = main.Run()
+	assert.EqualError(t, err, `volume "vol" already exists in storage pool "default-pool"`)
+	assert.Equal(t, 1, fa.uploadAndRegisterCalls)
+	assert.Empty(t, deleted)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/osbuild/images/pkg/depsolvednf"
+	"github.com/osbuild/images/pkg/distro"
+	"github.com/osbuild/images/pkg/manifestgen"
+	"github.com/osbuild/images/pkg/rpmmd"
+)
+
+const lockFileVersion = 1
+
+// lockFile contains a (pinned) depsolve result, it is written via
+// "manifest --write-lock" and replayed via "--lock" so that the exact
+// same packages are used for later builds.
+type lockFile struct {
+	Version   int                     `json:"version"`
+	Distro    string                  `json:"distro"`
+	Arch      string                  `json:"arch"`
+	Repos     []rpmmd.RepoConfig      `json:"repos"`
+	Pipelines map[string]lockPipeline `json:"pipelines"`
+
+	path string
+}
+
+type lockPipeline struct {
+	// Request is the digest of the requested package set chain,
+	// used to detect that e.g. the blueprint changed
+	Request      string          `json:"request"`
+	Repos        []string        `json:"repos"`
+	Transactions [][]lockPackage `json:"transactions"`
+}
+
+type lockPackage struct {
+	Name     string `json:"name"`
+	Epoch    uint   `json:"epoch"`
+	Version  string `json:"version"`
+	Release  string `json:"release"`
+	Arch     string `json:"arch"`
+	Checksum string `json:"checksum"`
+	RepoID   string `json:"repo-id"`
+}
+
+func (lp *lockPackage) String() string {
+	return fmt.Sprintf("%s-%d:%s-%s.%s (%s)", lp.Name, lp.Epoch, lp.Version, lp.Release, lp.Arch, lp.Checksum)
+}
+
+func lockPackageKey(pkg rpmmd.Package) string {
+	lp := lockPackage{
+		Name:     pkg.Name,
+		Epoch:    pkg.Epoch,
+		Version:  pkg.Version,
+		Release:  pkg.Release,
+		Arch:     pkg.Arch,
+		Checksum: pkg.Checksum.String(),
+	}
+	return lp.String()
+}
+
+// lockRequestDigest returns the digest of the given package set
+// chain. The order of the package names is not stable between runs
+// and the repository ids are only filled in while depsolving so both
+// are normalized.
+func lockRequestDigest(distroName, arch string, chain []rpmmd.PackageSet) (string, error) {
+	normalized := make([]rpmmd.PackageSet, 0, len(chain))
+	for _, ps := range chain {
+		ps.Include = slices.Sorted(slices.Values(ps.Include))
+		ps.Exclude = slices.Sorted(slices.Values(ps.Exclude))
+		repos := slices.Clone(ps.Repositories)
+		for i := range repos {
+			repos[i].Id = ""
+		}
+		ps.Repositories = repos
+		normalized = append(normalized, ps)
+	}
+	return depsolveCacheKey(distroName, arch, normalized)
+}
+
+// used in tests
+var lockFetchMetadata = func(solver *depsolvednf.Solver, repos []rpmmd.RepoConfig) (rpmmd.PackageList, error) {
+	return solver.FetchMetadata(repos)
+}
+
+func newLockFile() *lockFile {
+	return &lockFile{
+		Version:   lockFileVersion,
+		Pipelines: make(map[string]lockPipeline),
+	}
+}
+
+func readLockFile(path string) (*lockFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read lock file: %w", err)
+	}
+	var l lockFile
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, fmt.Errorf("cannot parse lock file %q: %w", path, err)
+	}
+	if l.Version != lockFileVersion {
+		return nil, fmt.Errorf("unsupported lock file version %v in %q (only version %v is supported)", l.Version, path, lockFileVersion)
+	}
+	l.path = path
+	return &l, nil
+}
+
+func (l *lockFile) write(path string) error {
+	if len(l.Pipelines) == 0 {
+		return fmt.Errorf("cannot write lock file: no packages were depsolved")
+	}
+	b, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("cannot write lock file: %w", err)
+	}
+	return nil
+}
+
+// record wraps the given depsolve function and records its result in
+// the lock file.
+func (l *lockFile) record(depsolve manifestgen.DepsolveFunc) manifestgen.DepsolveFunc {
+	if depsolve == nil {
+		depsolve = manifestgen.DefaultDepsolve
+	}
+	return func(solver *depsolvednf.Solver, cacheDir string, depsolveWarningsOutput io.Writer, packageSets map[string][]rpmmd.PackageSet, d distro.Distro, arch string) (map[string]depsolvednf.DepsolveResult, error) {
+		requests := make(map[string]string, len(packageSets))
+		for name, chain := range packageSets {
+			request, err := lockRequestDigest(d.Name(), arch, chain)
+			if err != nil {
+				return nil, err
+			}
+			requests[name] = request
+		}
+		res, err := depsolve(solver, cacheDir, depsolveWarningsOutput, packageSets, d, arch)
+		if err != nil {
+			return nil, err
+		}
+		l.Distro = d.Name()
+		l.Arch = arch
+		for name, r := range res {
+			if len(r.Modules) > 0 {
+				return nil, fmt.Errorf("cannot write lock file: modules are not supported")
+			}
+			lp := lockPipeline{Request: requests[name]}
+			for _, repo := range r.Repos {
+				lp.Repos = append(lp.Repos, repo.Id)
+				if !slices.ContainsFunc(l.Repos, func(r rpmmd.RepoConfig) bool { return r.Id == repo.Id }) {
+					l.Repos = append(l.Repos, repo)
+				}
+			}
+			for _, tx := range r.Transactions {
+				var pkgs []lockPackage
+				for _, pkg := range tx {
+					pkgs = append(pkgs, lockPackage{
+						Name:     pkg.Name,
+						Epoch:    pkg.Epoch,
+						Version:  pkg.Version,
+						Release:  pkg.Release,
+						Arch:     pkg.Arch,
+						Checksum: pkg.Checksum.String(),
+						RepoID:   pkg.RepoID,
+					})
+				}
+				lp.Transactions = append(lp.Transactions, pkgs)
+			}
+			l.Pipelines[name] = lp
+		}
+		return res, nil
+	}
+}
+
+// Depsolve implements manifestgen.DepsolveFunc, instead of running the
+// solver the pinned packages are looked up in the repository metadata.
+func (l *lockFile) Depsolve(solver *depsolvednf.Solver, cacheDir string, depsolveWarningsOutput io.Writer, packageSets map[string][]rpmmd.PackageSet, d distro.Distro, arch string) (map[string]depsolvednf.DepsolveResult, error) {
+	if l.Distro != d.Name() || l.Arch != arch {
+		return nil, fmt.Errorf("lock file %q is for %s/%s but building %s/%s", l.path, l.Distro, l.Arch, d.Name(), arch)
+	}
+	for _, name := range slices.Sorted(maps.Keys(packageSets)) {
+		chain := packageSets[name]
+		lp, ok := l.Pipelines[name]
+		if !ok {
+			return nil, fmt.Errorf("lock file %q has no packages for pipeline %q, was it written for a different image type?", l.path, name)
+		}
+		request, err := lockRequestDigest(d.Name(), arch, chain)
+		if err != nil {
+			return nil, err
+		}
+		if request != lp.Request {
+			return nil, fmt.Errorf("lock file %q does not match the requested packages for pipeline %q (did the blueprint change?), regenerate it with \"manifest --write-lock\"", l.path, name)
+		}
+	}
+
+	available, err := lockFetchMetadata(solver, l.Repos)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch repository metadata for lock file: %w", err)
+	}
+	availableByKey := make(map[string]rpmmd.Package, len(available))
+	for _, pkg := range available {
+		availableByKey[lockPackageKey(pkg)] = pkg
+	}
+
+	res := make(map[string]depsolvednf.DepsolveResult, len(packageSets))
+	var missing []string
+	for name := range packageSets {
+		lp := l.Pipelines[name]
+		var transactions depsolvednf.TransactionList
+		for _, tx := range lp.Transactions {
+			var pkgs rpmmd.PackageList
+			for _, lpkg := range tx {
+				pkg, ok := availableByKey[lpkg.String()]
+				if !ok {
+					if !slices.Contains(missing, lpkg.String()) {
+						missing = append(missing, lpkg.String())
+					}
+					continue
+				}
+				pkgs = append(pkgs, pkg)
+			}
+			transactions = append(transactions, pkgs)
+		}
+		var repos []rpmmd.RepoConfig
+		for _, repo := range l.Repos {
+			if slices.Contains(lp.Repos, repo.Id) {
+				repos = append(repos, repo)
+			}
+		}
+		res[name] = depsolvednf.DepsolveResult{
+			Transactions: transactions,
+			Repos:        repos,
+			Solver:       "lock",
+		}
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		return nil, fmt.Errorf("cannot find %d pinned package(s) from lock file %q in the repositories:\n  %s", len(missing), l.path, strings.Join(missing, "\n  "))
+	}
+	return res, nil
+}
@@ -0,0 +1,225 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/osbuild/images/pkg/depsolvednf"
+	"github.com/osbuild/images/pkg/distro"
+	"github.com/osbuild/images/pkg/rpmmd"
+	testrepos "github.com/osbuild/images/test/data/repositories"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+	"github.com/osbuild/image-builder-cli/internal/testutil"
+)
+
+// writeTestLock writes a lock file for centos-9 qcow2 and returns
+// its path, the generated manifest and all depsolved packages
+func writeTestLock(t *testing.T, extraArgs ...string) (string, []byte, rpmmd.PackageList) {
+	var depsolved rpmmd.PackageList
+	restore := main.MockManifestgenDepsolver(func(solver *depsolvednf.Solver, cacheDir string, depsolveWarningsOutput io.Writer, packageSets map[string][]rpmmd.PackageSet, d distro.Distro, arch string) (map[string]depsolvednf.DepsolveResult, error) {
+		res, err := fakeDepsolve(solver, cacheDir, depsolveWarningsOutput, packageSets, d, arch)
+		for _, r := range res {
+			depsolved = append(depsolved, r.Transactions.AllPackages()...)
+		}
+		return res, err
+	})
+	defer restore()
+
+	var fakeStdout bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+
+	lockPath := filepath.Join(t.TempDir(), "image.lock")
+	restore = main.MockOsArgs(append([]string{
+		"manifest",
+		"qcow2",
+		"--arch=x86_64",
+		"--distro=centos-9",
+		"--seed=0",
+		"--write-lock", lockPath,
+	}, extraArgs...))
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	return lockPath, fakeStdout.Bytes(), depsolved
+}
+
+func TestManifestWriteLock(t *testing.T) {
+	restore := main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+
+	lockPath, _, depsolved := writeTestLock(t)
+
+	b, err := os.ReadFile(lockPath)
+	require.NoError(t, err)
+	var lock struct {
+		Version   int    `json:"version"`
+		Distro    string `json:"distro"`
+		Arch      string `json:"arch"`
+		Pipelines map[string]struct {
+			Transactions [][]map[string]any `json:"transactions"`
+		} `json:"pipelines"`
+	}
+	err = json.Unmarshal(b, &lock)
+	require.NoError(t, err)
+	assert.Equal(t, 1, lock.Version)
+	assert.Equal(t, "centos-9", lock.Distro)
+	assert.Equal(t, "x86_64", lock.Arch)
+	assert.Contains(t, lock.Pipelines, "build")
+	assert.Contains(t, lock.Pipelines, "os")
+
+	var pinned int
+	for _, p := range lock.Pipelines {
+		for _, tx := range p.Transactions {
+			for _, pkg := range tx {
+				assert.NotEmpty(t, pkg["name"])
+				assert.NotEmpty(t, pkg["checksum"])
+				assert.Contains(t, pkg, "repo-id")
+				pinned++
+			}
+		}
+	}
+	assert.Equal(t, len(depsolved), pinned)
+}
+
+func TestBuildIntegrationWithLock(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+
+	restore = main.MockOsbuildVersion(func() (string, error) { return "999", nil })
+	defer restore()
+
+	restore = main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+
+	lockPath, expectedManifest, depsolved := writeTestLock(t)
+
+	restore = main.MockManifestgenDepsolver(func(*depsolvednf.Solver, string, io.Writer, map[string][]rpmmd.PackageSet, distro.Distro, string) (map[string]depsolvednf.DepsolveResult, error) {
+		return nil, fmt.Errorf("depsolve must not be called when using a lock file")
+	})
+	defer restore()
+	restore = main.MockLockFetchMetadata(func(*depsolvednf.Solver, []rpmmd.RepoConfig) (rpmmd.PackageList, error) {
+		return depsolved, nil
+	})
+	defer restore()
+
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+
+	tmpdir := t.TempDir()
+	restore = main.MockOsArgs([]string{
+		"build",
+		"qcow2",
+		"--arch=x86_64",
+		"--distro=centos-9",
+		"--seed=0",
+		"--lock", lockPath,
+		"--cache", tmpdir,
+		"--output-dir", filepath.Join(tmpdir, "output"),
+	})
+	defer restore()
+
+	fakeOsbuildCmd := testutil.MockCommand(t, "osbuild", makeFakeOsbuildScript())
+
+	err := main.Run()
+	require.NoError(t, err)
+
+	// the build used exactly the locked packages
+	usedManifest, err := os.ReadFile(fakeOsbuildCmd.Path() + ".stdin")
+	require.NoError(t, err)
+	assert.Equal(t, string(expectedManifest), string(usedManifest))
+}
+
+func TestManifestWithLockMissingPackage(t *testing.T) {
+	restore := main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+
+	lockPath, _, depsolved := writeTestLock(t)
+
+	// the first package vanished from the repositories
+	missing := depsolved[0]
+	restore = main.MockLockFetchMetadata(func(*depsolvednf.Solver, []rpmmd.RepoConfig) (rpmmd.PackageList, error) {
+		var available rpmmd.PackageList
+		for _, pkg := range depsolved {
+			if pkg.FullNEVRA() != missing.FullNEVRA() {
+				available = append(available, pkg)
+			}
+		}
+		return available, nil
+	})
+	defer restore()
+
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsArgs([]string{
+		"manifest",
+		"qcow2",
+		"--arch=x86_64",
+		"--distro=centos-9",
+		"--lock", lockPath,
+	})
+	defer restore()
+
+	err := main.Run()
+	assert.EqualError(t, err, fmt.Sprintf("cannot find 1 pinned package(s) from lock file %q in the repositories:\n  %s (%s)", lockPath, missing.FullNEVRA(), missing.Checksum))
+}
+
+func TestLockErrors(t *testing.T) {
+	restore := main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+	restore = main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+
+	lockPath, _, _ := writeTestLock(t)
+	bpPath := makeTestBlueprint(t, `
+[[packages]]
+name = "vim-enhanced"
+`)
+
+	restore = main.MockLockFetchMetadata(func(*depsolvednf.Solver, []rpmmd.RepoConfig) (rpmmd.PackageList, error) {
+		return nil, nil
+	})
+	defer restore()
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+
+	for _, tc := range []struct {
+		cmdline     []string
+		expectedErr string
+	}{
+		{
+			[]string{"manifest", "qcow2", "--arch=x86_64", "--distro=centos-10", "--lock", lockPath},
+			fmt.Sprintf("lock file %q is for centos-9/x86_64 but building centos-10/x86_64", lockPath),
+		}, {
+			[]string{"manifest", "qcow2", "--arch=x86_64", "--distro=centos-9", "--blueprint", bpPath, "--lock", lockPath},
+			fmt.Sprintf(`lock file %q does not match the requested packages for pipeline "os" (did the blueprint change?), regenerate it with "manifest --write-lock"`, lockPath),
+		}, {
+			[]string{"manifest", "qcow2", "--with-sbom", "--lock", lockPath},
+			"cannot use --with-sbom together with --lock",
+		}, {
+			[]string{"build", "qcow2", "ami", "--lock", lockPath},
+			"cannot use --lock when building multiple image types",
+		}, {
+			[]string{"build", "--from-manifest", "foo.json", "--lock", lockPath},
+			"cannot use --lock together with --from-manifest",
+		},
+	} {
+		t.Run(fmt.Sprintf("%v", tc.cmdline), func(t *testing.T) {
+			restore := main.MockOsArgs(tc.cmdline)
+			defer restore()
+
+			err := main.Run()
+			assert.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
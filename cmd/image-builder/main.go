@@ -10,9 +10,11 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -39,6 +41,7 @@ var (
 	osStdout         io.Writer = os.Stdout
 	osStderr         io.Writer = os.Stderr
 	bootcResolveInfo           = bootc.ResolveBootcInfo
+	setupIsContainer           = setup.IsContainer
 )
 
 // cacheDirForUid returns the cache directory for the given uid.
@@ -157,7 +160,6 @@ func cmdBootcInspect(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-
 func cmdListImages(cmd *cobra.Command, args []string) error {
 	filter, err := cmd.Flags().GetStringArray("filter")
 	if err != nil {
@@ -241,6 +243,19 @@ func subscriptionImageOptions(cmd *cobra.Command) (*subscription.ImageOptions, e
 
 type cmdManifestWrapperOptions struct {
 	useBootstrapIfNeeded bool
+
+	// depsolve overrides the default depsolver, this is used
+	// to share depsolve results between multiple image types
+	depsolve manifestgen.DepsolveFunc
+
+	// img is set when the image was already resolved by the
+	// caller (e.g. via "build --filter"), distro and arch are
+	// taken from it
+	img *imagefilter.Result
+	// outputDir overrides the --output-dir flag
+	outputDir string
+	// metadata is filled with the details of the generated manifest
+	metadata *artifactMetadata
 }
 
 // used in tests
@@ -250,6 +265,10 @@ func cmdManifestWrapper(pbar progress.ProgressBar, cmd *cobra.Command, args []st
 	if wrapperOpts == nil {
 		wrapperOpts = &cmdManifestWrapperOptions{}
 	}
+	depsolve := manifestgenDepsolver
+	if wrapperOpts.depsolve != nil {
+		depsolve = wrapperOpts.depsolve
+	}
 	repoDir, err := cmd.Flags().GetString("force-repo-dir")
 	if err != nil {
 		return nil, err
@@ -277,6 +296,10 @@ func cmdManifestWrapper(pbar progress.ProgressBar, cmd *cobra.Command, args []st
 	if err != nil {
 		return nil, err
 	}
+	if wrapperOpts.img != nil {
+		distroStr = wrapperOpts.img.ImgType.Arch().Distro().Name()
+		archStr = wrapperOpts.img.ImgType.Arch().Name()
+	}
 	withSBOM, err := cmd.Flags().GetBool("with-sbom")
 	if err != nil {
 		return nil, err
@@ -293,6 +316,9 @@ func cmdManifestWrapper(pbar progress.ProgressBar, cmd *cobra.Command, args []st
 	if err != nil {
 		return nil, err
 	}
+	if wrapperOpts.outputDir != "" {
+		outputDir = wrapperOpts.outputDir
+	}
 	ostreeImgOpts, err := ostreeImageOptions(cmd)
 	if err != nil {
 		return nil, err
@@ -310,7 +336,7 @@ func cmdManifestWrapper(pbar progress.ProgressBar, cmd *cobra.Command, args []st
 	// we keep our nil value so that images used the distro-defined
 	// value for preview. Otherwise use the provided value so the
 	// distro value gets overridden.
-	if cmd.Flags().Lookup("preview").Changed {
+	if flagIsSet(cmd, "preview") {
 		value, err := cmd.Flags().GetBool("preview")
 		if err != nil {
 			return nil, err
@@ -321,12 +347,16 @@ func cmdManifestWrapper(pbar progress.ProgressBar, cmd *cobra.Command, args []st
 	if useLibrepo {
 		rpmDownloader = osbuild.RpmDownloaderLibrepo
 	}
-	blueprintPath, err := cmd.Flags().GetString("blueprint")
+	blueprintPaths, err := cmd.Flags().GetStringArray("blueprint")
+	if err != nil {
+		return nil, err
+	}
+	blueprintVars, err := blueprintVarsFromCmd(cmd)
 	if err != nil {
 		return nil, err
 	}
 	var customSeed *int64
-	if cmd.Flags().Changed("seed") {
+	if flagIsSet(cmd, "seed") {
 		seedFlagVal, err := cmd.Flags().GetInt64("seed")
 		if err != nil {
 			return nil, err
@@ -366,7 +396,7 @@ func cmdManifestWrapper(pbar progress.ProgressBar, cmd *cobra.Command, args []st
 	// manifests we would change this
 	outputFilename, _ := cmd.Flags().GetString("output-name")
 
-	bp, err := blueprintload.Load(blueprintPath)
+	bp, err := blueprintload.LoadAll(blueprintPaths, blueprintVars)
 	if err != nil {
 		return nil, err
 	}
@@ -419,16 +449,18 @@ func cmdManifestWrapper(pbar progress.ProgressBar, cmd *cobra.Command, args []st
 		if err != nil {
 			return nil, err
 		}
-		img = &imagefilter.Result{imgType, nil}
+		img = &imagefilter.Result{ImgType: imgType}
 		// XXX: hack to skip repo loading for the bootc image.
 		// We need to add a SkipRepositories or similar to
 		// manifestgen instead to make this clean
 		forceRepos = []string{"https://example.com/not-used"}
+	} else if wrapperOpts.img != nil {
+		img = wrapperOpts.img
 	} else {
 		repoOpts := &repoOptions{
-			RepoDir:    repoDir,
-			ExtraRepos: extraRepos,
-			ForceRepos: forceRepos,
+			RepoDir:      repoDir,
+			ExtraRepos:   extraRepos,
+			ForceRepos:   forceRepos,
 			ForceDefsDir: forceDefsDir,
 		}
 		img, err = getOneImage(distroStr, imgTypeStr, archStr, repoOpts)
@@ -440,17 +472,27 @@ func cmdManifestWrapper(pbar progress.ProgressBar, cmd *cobra.Command, args []st
 		return nil, fmt.Errorf("image %q has multiple exports: this is current unsupport: please report this as a bug", basenameFor(img, ""))
 	}
 
+	if md := wrapperOpts.metadata; md != nil {
+		md.setImage(img)
+		if err := md.setBlueprint(bp); err != nil {
+			return nil, err
+		}
+		customSeed = md.setSeed(customSeed)
+		depsolve = md.recordRepos(depsolve)
+	}
+
 	opts := &manifestOptions{
 		ManifestgenOptions: manifestgen.Options{
 			Cachedir:               rpmmdCacheDir,
 			CustomSeed:             customSeed,
 			RpmDownloader:          rpmDownloader,
 			DepsolveWarningsOutput: wd,
-			Depsolve:               manifestgenDepsolver,
+			Depsolve:               depsolve,
 		},
 		OutputDir:                  outputDir,
 		OutputFilename:             outputFilename,
-		BlueprintPath:              blueprintPath,
+		BlueprintPaths:             blueprintPaths,
+		BlueprintVars:              blueprintVars,
 		Ostree:                     ostreeImgOpts,
 		BootcRef:                   bootcRef,
 		BootcInstallerPayloadRef:   bootcInstallerPayloadRef,
@@ -471,13 +513,61 @@ func cmdManifestWrapper(pbar progress.ProgressBar, cmd *cobra.Command, args []st
 	return img, err
 }
 
+// lockFromCmd reads the lock file given via "--lock", it returns nil
+// if no lock file was given.
+func lockFromCmd(cmd *cobra.Command) (*lockFile, error) {
+	lockPath, err := cmd.Flags().GetString("lock")
+	if err != nil {
+		return nil, err
+	}
+	if lockPath == "" {
+		return nil, nil
+	}
+	// the SBOM is generated by the solver
+	withSBOM, err := cmd.Flags().GetBool("with-sbom")
+	if err != nil {
+		return nil, err
+	}
+	if withSBOM {
+		return nil, fmt.Errorf("cannot use --with-sbom together with --lock")
+	}
+	return readLockFile(lockPath)
+}
+
 func cmdManifest(cmd *cobra.Command, args []string) error {
+	writeLock, err := cmd.Flags().GetString("write-lock")
+	if err != nil {
+		return err
+	}
+	lock, err := lockFromCmd(cmd)
+	if err != nil {
+		return err
+	}
 	pbar, err := progress.New("")
 	if err != nil {
 		return err
 	}
-	_, err = cmdManifestWrapper(pbar, cmd, args, osStdout, io.Discard, nil)
-	return err
+
+	wrapperOpts := &cmdManifestWrapperOptions{}
+	if lock != nil {
+		wrapperOpts.depsolve = lock.Depsolve
+	}
+	var newLock *lockFile
+	if writeLock != "" {
+		newLock = newLockFile()
+		depsolve := manifestgenDepsolver
+		if wrapperOpts.depsolve != nil {
+			depsolve = wrapperOpts.depsolve
+		}
+		wrapperOpts.depsolve = newLock.record(depsolve)
+	}
+	if _, err := cmdManifestWrapper(pbar, cmd, args, osStdout, io.Discard, wrapperOpts); err != nil {
+		return err
+	}
+	if newLock != nil {
+		return newLock.write(writeLock)
+	}
+	return nil
 }
 
 func progressFromCmd(cmd *cobra.Command) (progress.ProgressBar, error) {
@@ -492,8 +582,93 @@ func progressFromCmd(cmd *cobra.Command) (progress.ProgressBar, error) {
 	if progressType == "auto" && verbose {
 		progressType = "verbose"
 	}
+	progressFd, err := cmd.Flags().GetInt("progress-fd")
+	if err != nil {
+		return nil, err
+	}
 
-	return progress.New(progressType)
+	return newProgressBar(progressType, progressFd)
+}
+
+// outputFromCmd returns where the human-readable output of a command
+// with a progress bar goes. This is stdout unless the json progress
+// is written to stdout, the json-seq stream must not be mixed with
+// other output.
+func outputFromCmd(cmd *cobra.Command) (io.Writer, error) {
+	progressType, err := cmd.Flags().GetString("progress")
+	if err != nil {
+		return nil, err
+	}
+	progressFd, err := cmd.Flags().GetInt("progress-fd")
+	if err != nil {
+		return nil, err
+	}
+	if progressType == "json" && progressFd == 0 {
+		return osStderr, nil
+	}
+	return osStdout, nil
+}
+
+// newProgressBar creates a progress bar of the given type, json
+// progress is written to the given fd (if set) instead of stdout so
+// that callers can keep it separate from the regular output.
+func newProgressBar(progressType string, progressFd int) (progress.ProgressBar, error) {
+	if progressFd == 0 {
+		return progress.New(progressType)
+	}
+	if progressType != "json" {
+		return nil, fmt.Errorf("--progress-fd requires --progress=json")
+	}
+	f := os.NewFile(uintptr(progressFd), "progress-fd")
+	if f == nil {
+		return nil, fmt.Errorf("invalid --progress-fd %d", progressFd)
+	}
+	if _, err := f.Stat(); err != nil {
+		return nil, fmt.Errorf("cannot use --progress-fd %d: %w", progressFd, err)
+	}
+	return progress.NewJSONProgressBar(f)
+}
+
+// buildMatrixFromCmd expands the "--filter" expressions of the build
+// command into the list of images to build. It returns nil if no
+// filter was given.
+func buildMatrixFromCmd(cmd *cobra.Command, args []string) ([]imagefilter.Result, error) {
+	filterExprs, err := cmd.Flags().GetStringArray("filter")
+	if err != nil {
+		return nil, err
+	}
+	if len(filterExprs) == 0 {
+		return nil, nil
+	}
+	if len(args) > 0 {
+		return nil, fmt.Errorf("cannot use image type arguments %q together with --filter", args)
+	}
+	for _, flagName := range []string{"distro", "arch", "bootc-ref"} {
+		if cmd.Flags().Changed(flagName) {
+			return nil, fmt.Errorf("cannot use --%s together with --filter", flagName)
+		}
+	}
+	repoDir, err := cmd.Flags().GetString("force-repo-dir")
+	if err != nil {
+		return nil, err
+	}
+	extraRepos, err := cmd.Flags().GetStringArray("extra-repo")
+	if err != nil {
+		return nil, err
+	}
+	forceDefsDir, err := cmd.Flags().GetString("force-defs-dir")
+	if err != nil {
+		return nil, err
+	}
+
+	matrix, err := getAllImages(&repoOptions{RepoDir: repoDir, ExtraRepos: extraRepos, ForceDefsDir: forceDefsDir}, filterExprs...)
+	if err != nil {
+		return nil, err
+	}
+	if len(matrix) == 0 {
+		return nil, fmt.Errorf("cannot find any image for filter %q", filterExprs)
+	}
+	return matrix, nil
 }
 
 func cmdBuild(cmd *cobra.Command, args []string) error {
@@ -525,6 +700,84 @@ func cmdBuild(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	fromManifest, err := cmd.Flags().GetString("from-manifest")
+	if err != nil {
+		return err
+	}
+	offline, err := cmd.Flags().GetBool("offline")
+	if err != nil {
+		return err
+	}
+	// generating a manifest needs to depsolve which needs the
+	// network
+	if offline && fromManifest == "" {
+		return fmt.Errorf("--offline requires --from-manifest (e.g. from \"image-builder fetch\")")
+	}
+	if fromManifest != "" {
+		if len(args) > 0 {
+			return fmt.Errorf("cannot use image type arguments %q together with --from-manifest", args)
+		}
+		// these only influence the manifest generation
+		for _, flagName := range []string{"filter", "distro", "arch", "blueprint", "blueprint-var", "blueprint-vars-file", "blueprint-templating", "bootc-ref", "with-sbom", "lock"} {
+			if cmd.Flags().Changed(flagName) {
+				return fmt.Errorf("cannot use --%s together with --from-manifest", flagName)
+			}
+		}
+	}
+	matrix, err := buildMatrixFromCmd(cmd, args)
+	if err != nil {
+		return err
+	}
+	if outputBasename != "" && (len(args) > 1 || len(matrix) > 0) {
+		return fmt.Errorf("cannot use --output-name when building multiple image types")
+	}
+	lock, err := lockFromCmd(cmd)
+	if err != nil {
+		return err
+	}
+	// a lock file is always for a single image type
+	if lock != nil && (len(args) > 1 || len(matrix) > 0) {
+		return fmt.Errorf("cannot use --lock when building multiple image types")
+	}
+	cacheMaxSize, err := cacheMaxSizeFromCmd(cmd, cacheDir)
+	if err != nil {
+		return err
+	}
+	uploadTarget, err := uploadTargetFromCmd(cmd, "upload-target")
+	if err != nil {
+		return err
+	}
+	if uploadTarget != nil && fromManifest != "" {
+		return fmt.Errorf("cannot use --upload-target together with --from-manifest")
+	}
+	uploadTo, err := cmd.Flags().GetStringArray("to")
+	if err != nil {
+		return err
+	}
+	if len(uploadTo) > 0 && fromManifest != "" {
+		return fmt.Errorf("cannot use --to together with --from-manifest")
+	}
+	if uploadTarget != nil {
+		for _, to := range uploadTo {
+			if to != uploadTarget.Type {
+				return fmt.Errorf("cannot use --to=%s with upload target %q of type %q", to, uploadTarget.Name, uploadTarget.Type)
+			}
+		}
+		uploadTo = nil
+	}
+	for i, to := range uploadTo {
+		if slices.Contains(uploadTo[:i], to) {
+			return fmt.Errorf("cannot use --to=%s more than once", to)
+		}
+	}
+	uploadOpts, err := uploadOptionsFromCmd(cmd)
+	if err != nil {
+		return err
+	}
+	uploadResultPath, err := cmd.Flags().GetString("upload-result")
+	if err != nil {
+		return err
+	}
 	// Fail early if the cache directory is not writable, instead of
 	// waiting for osbuild to fail after slow manifest generation.
 	if err := os.MkdirAll(cacheDir, 0755); err != nil {
@@ -532,16 +785,31 @@ func cmdBuild(cmd *cobra.Command, args []string) error {
 	}
 
 	// Setup osbuild environment if running in a container
-	if setup.IsContainer() {
+	if setupIsContainer() {
 		if err := setup.EnsureEnvironment(cacheDir, runInVm); err != nil {
 			return fmt.Errorf("entrypoint setup failed: %w", err)
 		}
 	}
 
-	if runInVm && !setup.IsContainer() {
+	if runInVm && !setupIsContainer() {
 		return fmt.Errorf("running in VM outside container is not supported yet")
 	}
 
+	output, err := outputFromCmd(cmd)
+	if err != nil {
+		return err
+	}
+	if len(matrix) > 0 {
+		fmt.Fprintf(output, "Building %d images:\n", len(matrix))
+		fmter, err := imagefilter.NewResultsFormatter(imagefilter.OutputFormat("text"))
+		if err != nil {
+			return err
+		}
+		if err := fmter.Output(output, matrix); err != nil {
+			return err
+		}
+	}
+
 	pbar, err := progressFromCmd(cmd)
 	if err != nil {
 		return err
@@ -555,64 +823,185 @@ func cmdBuild(cmd *cobra.Command, args []string) error {
 		pbar.Stop()
 	}()
 
-	var mf bytes.Buffer
-	opts := &cmdManifestWrapperOptions{
-		useBootstrapIfNeeded: true,
+	if fromManifest != "" {
+		buildOpts := &buildOptions{
+			OutputDir:      outputDir,
+			OutputBasename: outputBasename,
+			StoreDir:       cacheDir,
+			WriteManifest:  withManifest,
+			WriteBuildlog:  withBuildlog,
+			Metrics:        withMetrics,
+			Offline:        offline,
+			CacheMaxSize:   cacheMaxSize,
+		}
+		if runInVm {
+			buildOpts.InVm = []string{"image"}
+		}
+		imagePath, err := buildFromManifest(pbar, fromManifest, buildOpts)
+		if err != nil {
+			return err
+		}
+		pbar.Stop()
+		fmt.Fprintf(output, "Image build successful: %s\n", imagePath)
+		return nil
 	}
 
-	// We discard any warnings from the depsolver until we figure out a better
-	// idea (likely in manifestgen)
-	res, err := cmdManifestWrapper(pbar, cmd, args, &mf, io.Discard, opts)
-	if err != nil {
-		return err
+	// All image types share a single depsolve cache and the same
+	// osbuild store so that building multiple image types in one
+	// go does not redo work that is common between them.
+	opts := &cmdManifestWrapperOptions{
+		useBootstrapIfNeeded: true,
+		depsolve:             newDepsolveCache(manifestgenDepsolver).Depsolve,
 	}
-
-	bootMode := res.ImgType.BootMode()
-	uploader, err := uploaderFor(cmd, res.ImgType.Name(), res.ImgType.Arch().Name(), &bootMode)
-	if errors.Is(err, ErrUploadTypeUnsupported) || errors.Is(err, ErrUploadConfigNotProvided) {
-		err = nil
+	if lock != nil {
+		opts.depsolve = lock.Depsolve
 	}
 
-	if err != nil {
-		return err
+	// when building from --filter the images are already resolved
+	// and each of them gets its own output directory
+	if len(matrix) > 0 {
+		args = nil
+		for _, img := range matrix {
+			args = append(args, img.ImgType.Name())
+		}
 	}
+	var jobs []*buildJob
+	for i, imgTypeStr := range args {
+		jobOutputDir := outputDir
+		if len(matrix) > 0 {
+			opts.img = &matrix[i]
+			if outputDir != "" {
+				jobOutputDir = filepath.Join(outputDir, basenameFor(opts.img, ""))
+				opts.outputDir = jobOutputDir
+			}
+		}
 
-	if uploader != nil {
-		pbar.SetPulseMsgf("Checking cloud access")
-		if err := uploaderCheckWithProgress(pbar, uploader); err != nil {
+		var mf bytes.Buffer
+		opts.metadata = &artifactMetadata{}
+		// We discard any warnings from the depsolver until we figure out a better
+		// idea (likely in manifestgen)
+		res, err := cmdManifestWrapper(pbar, cmd, []string{imgTypeStr}, &mf, io.Discard, opts)
+		if err != nil {
 			return err
 		}
-	}
-	outputDir = basenameFor(res, outputDir)
 
-	buildOpts := &buildOptions{
-		OutputDir:      outputDir,
-		OutputBasename: outputBasename,
-		StoreDir:       cacheDir,
-		WriteManifest:  withManifest,
-		WriteBuildlog:  withBuildlog,
-		Metrics:        withMetrics,
-	}
-	if runInVm {
-		buildOpts.InVm = []string{"image"}
-	}
-	pbar.SetPulseMsgf("Image building step")
-	imagePath, err := buildImage(pbar, res, mf.Bytes(), buildOpts)
-	if err != nil {
-		return err
+		bootMode := res.ImgType.BootMode()
+		targetArch := res.ImgType.Arch().Name()
+		var uploaders []namedUploader
+		switch {
+		case uploadTarget != nil:
+			// an explicit upload target must be usable
+			uploader, err := uploaderFor(cmd, uploadTarget.Type, targetArch, &bootMode, opts.metadata, uploadTarget.credentials())
+			if err != nil {
+				return err
+			}
+			uploaders = append(uploaders, namedUploader{name: uploadTarget.Name, uploader: uploader})
+		case len(uploadTo) > 0:
+			for _, to := range uploadTo {
+				uploader, err := uploaderFor(cmd, to, targetArch, &bootMode, opts.metadata, nil)
+				if err != nil {
+					return fmt.Errorf("cannot upload to %s: %w", to, err)
+				}
+				uploaders = append(uploaders, namedUploader{name: to, uploader: uploader})
+			}
+		default:
+			uploadType := res.ImgType.Name()
+			uploader, err := uploaderFor(cmd, uploadType, targetArch, &bootMode, opts.metadata, nil)
+			if errors.Is(err, ErrUploadTypeUnsupported) || errors.Is(err, ErrUploadConfigNotProvided) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			uploaders = append(uploaders, namedUploader{name: uploadType, uploader: uploader})
+		}
+
+		// all targets are checked before anything is built
+		for _, nu := range uploaders {
+			pbar.SetPulseMsgf("Checking cloud access")
+			if err := uploaderCheckWithProgress(pbar, nu.uploader); err != nil {
+				if len(uploaders) > 1 {
+					return fmt.Errorf("cannot upload to %s: %w", nu.name, err)
+				}
+				return err
+			}
+		}
+		jobs = append(jobs, &buildJob{
+			res:       res,
+			manifest:  mf.Bytes(),
+			uploaders: uploaders,
+			outputDir: basenameFor(res, jobOutputDir),
+			metadata:  opts.metadata,
+		})
+	}
+
+	for i, job := range jobs {
+		buildOpts := &buildOptions{
+			OutputDir:      job.outputDir,
+			OutputBasename: outputBasename,
+			StoreDir:       cacheDir,
+			WriteManifest:  withManifest,
+			WriteBuildlog:  withBuildlog,
+			Metrics:        withMetrics,
+			Metadata:       job.metadata,
+			CacheMaxSize:   cacheMaxSize,
+		}
+		if runInVm {
+			buildOpts.InVm = []string{"image"}
+		}
+		if len(jobs) > 1 {
+			pbar.SetPulseMsgf("Image building step (%d/%d): %s", i+1, len(jobs), job.name())
+		} else {
+			pbar.SetPulseMsgf("Image building step")
+		}
+		job.imagePath, job.err = buildImage(pbar, job.res, job.manifest, buildOpts)
+		// keep the existing behavior for single image builds and
+		// just error out
+		if job.err != nil && len(jobs) == 1 {
+			return job.err
+		}
 	}
 	pbar.Stop()
 
-	fmt.Fprintf(osStdout, "Image build successful: %s\n", imagePath)
+	var failed []string
+	for _, job := range jobs {
+		if job.err != nil {
+			fmt.Fprintf(osStderr, "Image build failed: %s: %v\n", job.name(), job.err)
+			failed = append(failed, job.name())
+			continue
+		}
+		fmt.Fprintf(output, "Image build successful: %s\n", job.imagePath)
+	}
 
-	if uploader != nil {
+	var uploadErrs []error
+	var uploadResults []*uploadResult
+	for _, job := range jobs {
+		if job.err != nil || len(job.uploaders) == 0 {
+			continue
+		}
 		// XXX: integrate better into the progress, see bib
-		if err := uploadImageWithProgress(uploader, imagePath); err != nil {
-			return err
+		if len(job.uploaders) == 1 {
+			res := uploadImageWithProgress(pbar, job.uploaders[0], job.imagePath, uploadOpts)
+			uploadResults = append(uploadResults, res)
+			if res.err != nil {
+				uploadErrs = append(uploadErrs, res.err)
+			}
+			continue
+		}
+		results := uploadImageToTargets(pbar, job.uploaders, job.imagePath, uploadOpts)
+		uploadResults = append(uploadResults, results...)
+		if err := reportUploadResults(output, job.imagePath, results); err != nil {
+			uploadErrs = append(uploadErrs, err)
 		}
 	}
+	if err := writeUploadResults(uploadResultPath, uploadResults); err != nil {
+		uploadErrs = append(uploadErrs, err)
+	}
+	if len(failed) > 0 {
+		uploadErrs = append([]error{fmt.Errorf("cannot build %d of %d images: %s", len(failed), len(jobs), strings.Join(failed, ", "))}, uploadErrs...)
+	}
 
-	return nil
+	return errors.Join(uploadErrs...)
 }
 
 func cmdDescribeImg(cmd *cobra.Command, args []string) error {
@@ -709,22 +1098,27 @@ operating systems like Fedora, CentOS and RHEL with easy customizations support.
 	rootCmd.PersistentFlags().String("output-dir", "", `Put output into the specified directory`)
 	rootCmd.PersistentFlags().BoolP("verbose", "v", false, `Switch to verbose mode (more logging on stderr and verbose progress)`)
 	registerMemProfileFlags(rootCmd)
-	rootCmd.PersistentPreRun = memProfilePersistentPreRun
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		memProfilePersistentPreRun(cmd, args)
+		// flags that are not given on the commandline default to
+		// the values from the configuration files
+		return applyUserConfig(cmd)
+	}
 
 	rootCmd.SetOut(osStdout)
 	rootCmd.SetErr(osStderr)
 
 	bootcCommand := &cobra.Command{
-		Use:	"bootc",
-		Short:  "bootc-related commands",
-		Args:   cobra.NoArgs,
+		Use:   "bootc",
+		Short: "bootc-related commands",
+		Args:  cobra.NoArgs,
 	}
 
 	bootcInspectCommand := &cobra.Command{
-		Use:	"inspect",
-		Short:  "Show data gathered by `image-builder` for a container",
-		RunE:   cmdBootcInspect,
-		Args:   cobra.NoArgs,
+		Use:   "inspect",
+		Short: "Show data gathered by `image-builder` for a container",
+		RunE:  cmdBootcInspect,
+		Args:  cobra.NoArgs,
 	}
 	bootcInspectCommand.Flags().String("ref", "", `bootc container ref`)
 	_ = bootcInspectCommand.MarkFlagRequired("ref")
@@ -763,6 +1157,108 @@ operating systems like Fedora, CentOS and RHEL with easy customizations support.
 	systemCmd.Flags().String("format", "", "Output in a specific format (yaml, json)")
 	rootCmd.AddCommand(systemCmd)
 
+	systemCacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the osbuild and rpm metadata caches",
+		Args:  cobra.NoArgs,
+	}
+	systemCacheCmd.PersistentFlags().String("cache", getCacheDir(), `osbuild directory to manage`)
+	systemCacheCmd.PersistentFlags().String("rpmmd-cache", defaultRpmmdCacheDir(), `rpm metadata cache directory to manage`)
+	systemCmd.AddCommand(systemCacheCmd)
+
+	systemCachePruneCmd := &cobra.Command{
+		Use:          "prune",
+		Short:        "Remove old cache entries, use --older-than and/or --max-size",
+		RunE:         cmdSystemCachePrune,
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+	}
+	systemCachePruneCmd.Flags().String("older-than", "", `remove entries that were not modified for the given time (e.g. "30d", "12h")`)
+	systemCachePruneCmd.Flags().String("max-size", "", `remove the oldest entries until the cache is smaller than the given size (e.g. "10 GiB")`)
+	systemCachePruneCmd.Flags().Bool("dry-run", false, `only show what would be removed`)
+	systemCacheCmd.AddCommand(systemCachePruneCmd)
+
+	systemCacheClearCmd := &cobra.Command{
+		Use:          "clear",
+		Short:        "Remove all cache entries",
+		RunE:         cmdSystemCacheClear,
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+	}
+	systemCacheClearCmd.Flags().Bool("dry-run", false, `only show what would be removed`)
+	systemCacheCmd.AddCommand(systemCacheClearCmd)
+
+	systemCacheSetMaxSizeCmd := &cobra.Command{
+		Use:          "set-max-size <size>",
+		Short:        `Set the maximum size of the osbuild cache (e.g. "50 GiB" or "unlimited")`,
+		RunE:         cmdSystemCacheSetMaxSize,
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+	}
+	systemCacheCmd.AddCommand(systemCacheSetMaxSizeCmd)
+
+	systemCheckCmd := &cobra.Command{
+		Use:          "check",
+		Short:        "Check if this host is ready to build images",
+		RunE:         cmdSystemCheck,
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+	}
+	systemCheckCmd.Flags().String("format", "", "Output in a specific format (yaml, json)")
+	systemCheckCmd.Flags().String("cache", getCacheDir(), `osbuild directory to check`)
+	systemCheckCmd.Flags().String("arch", "", `also check that images for the given (foreign) architecture can be built`)
+	systemCmd.AddCommand(systemCheckCmd)
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Show the configuration",
+		Args:  cobra.NoArgs,
+	}
+	rootCmd.AddCommand(configCmd)
+
+	configShowCmd := &cobra.Command{
+		Use:          "show [<command>...]",
+		Short:        `Show the effective options of the given command (e.g. "build") and where they come from`,
+		RunE:         cmdConfigShow,
+		SilenceUsage: true,
+	}
+	configShowCmd.Flags().String("format", "", "Output in a specific format (yaml, json)")
+	configCmd.AddCommand(configShowCmd)
+
+	blueprintCmd := &cobra.Command{
+		Use:   "blueprint",
+		Short: "Work with blueprints",
+		Args:  cobra.NoArgs,
+	}
+	rootCmd.AddCommand(blueprintCmd)
+
+	blueprintMergeCmd := &cobra.Command{
+		Use:          "merge <blueprint>...",
+		Short:        "Merge the given blueprints in order and show the effective blueprint",
+		RunE:         cmdBlueprintMerge,
+		SilenceUsage: true,
+		Args:         cobra.MinimumNArgs(1),
+	}
+	blueprintMergeCmd.Flags().String("format", "", "Output in a specific format (toml, json, yaml)")
+	blueprintMergeCmd.Flags().StringArray("blueprint-var", nil, `set a blueprint variable NAME=VALUE for "${NAME}", can be given multiple times`)
+	blueprintMergeCmd.Flags().StringArray("blueprint-vars-file", nil, `read blueprint variables from a file with NAME=VALUE lines, can be given multiple times`)
+	blueprintMergeCmd.Flags().Bool("blueprint-templating", false, `substitute the "${...}" references in the blueprints, implied by --blueprint-var and --blueprint-vars-file`)
+	blueprintCmd.AddCommand(blueprintMergeCmd)
+
+	blueprintValidateCmd := &cobra.Command{
+		Use:          "validate <image-type> <blueprint>...",
+		Short:        "Check that the given (merged) blueprints can be used for the image-type (tip: combine with --distro, --arch)",
+		RunE:         cmdBlueprintValidate,
+		SilenceUsage: true,
+		Args:         cobra.MinimumNArgs(2),
+	}
+	blueprintValidateCmd.Flags().String("arch", "", `validate for a different architecture`)
+	blueprintValidateCmd.Flags().String("distro", "", `validate for a different distroname (e.g. centos-9)`)
+	blueprintValidateCmd.Flags().StringArray("blueprint-var", nil, `set a blueprint variable NAME=VALUE for "${NAME}", can be given multiple times`)
+	blueprintValidateCmd.Flags().StringArray("blueprint-vars-file", nil, `read blueprint variables from a file with NAME=VALUE lines, can be given multiple times`)
+	blueprintValidateCmd.Flags().Bool("blueprint-templating", false, `substitute the "${...}" references in the blueprints, implied by --blueprint-var and --blueprint-vars-file`)
+	blueprintCmd.AddCommand(blueprintValidateCmd)
+
 	manifestCmd := &cobra.Command{
 		Use:          "manifest <image-type>",
 		Short:        "Build manifest for the given image-type, e.g. qcow2 (tip: combine with --distro, --arch)",
@@ -771,7 +1267,10 @@ operating systems like Fedora, CentOS and RHEL with easy customizations support.
 		Args:         cobra.ExactArgs(1),
 		Hidden:       true,
 	}
-	manifestCmd.Flags().String("blueprint", "", `filename of a blueprint to customize an image`)
+	manifestCmd.Flags().StringArray("blueprint", nil, `filename of a blueprint to customize an image, can be given multiple times to merge the blueprints in order`)
+	manifestCmd.Flags().StringArray("blueprint-var", nil, `set a blueprint variable NAME=VALUE for "${NAME}", can be given multiple times`)
+	manifestCmd.Flags().StringArray("blueprint-vars-file", nil, `read blueprint variables from a file with NAME=VALUE lines, can be given multiple times`)
+	manifestCmd.Flags().Bool("blueprint-templating", false, `substitute the "${...}" references in the blueprints, implied by --blueprint-var and --blueprint-vars-file`)
 	manifestCmd.Flags().Int64("seed", 0, `rng seed, some values are derived randomly, pinning the seed allows more reproducibility if you need it. must be an integer. only used when changed.`)
 	manifestCmd.Flags().String("arch", "", `build manifest for a different architecture`)
 	manifestCmd.Flags().String("distro", "", `build manifest for a different distroname (e.g. centos-9)`)
@@ -793,6 +1292,7 @@ operating systems like Fedora, CentOS and RHEL with easy customizations support.
 	manifestCmd.Flags().String("rpmmd-cache", "", `osbuild directory to cache rpm metadata`)
 	manifestCmd.Flags().Bool("preview", true, `override distro default preview state if passed`)
 	manifestCmd.Flags().MarkHidden("preview")
+	manifestCmd.Flags().String("lock", "", `use the pinned packages from the given lock file instead of depsolving`)
 	rootCmd.AddCommand(manifestCmd)
 
 	uploadCmd := &cobra.Command{
@@ -807,40 +1307,139 @@ operating systems like Fedora, CentOS and RHEL with easy customizations support.
 	uploadCmd.Flags().String("aws-region", "", "target region for AWS uploads (only for type=ami)")
 	uploadCmd.Flags().String("aws-profile", "", "name of the AWS credentials profile (only for type=aws)")
 	uploadCmd.Flags().StringArray("aws-tag", []string{}, "tag the AMI with this Key=Value (only for type=aws)")
+	uploadCmd.Flags().StringArray("aws-copy-to-region", nil, "copy the AMI into this region too, can be given multiple times (only for type=aws)")
+	uploadCmd.Flags().StringArray("aws-share-with-account", nil, "share the AMI and its copies with this account id, can be given multiple times (only for type=aws)")
+	uploadCmd.Flags().String("aws-boot-mode", "", "boot mode of the AMI (legacy-bios, uefi, uefi-preferred), defaults to the boot mode of the image (only for type=aws)")
 	uploadCmd.Flags().String("libvirt-connection", "", "connection URI (only for type=libvirt)")
 	uploadCmd.Flags().String("libvirt-pool", "", "pool name (only for type=libvirt)")
 	uploadCmd.Flags().String("libvirt-volume", "", "volume name (only for type=libvirt)")
+	uploadCmd.Flags().Bool("libvirt-define-domain", false, "define a domain that boots the uploaded volume (only for type=libvirt)")
+	uploadCmd.Flags().String("libvirt-domain", "", "name of the defined domain, defaults to the volume name (only for type=libvirt)")
+	uploadCmd.Flags().String("libvirt-memory", "", `memory of the defined domain (e.g. "4 GiB"), defaults to 2 GiB and 4 GiB for installers (only for type=libvirt)`)
+	uploadCmd.Flags().String("libvirt-network", "default", "network of the defined domain (only for type=libvirt)")
+	uploadCmd.Flags().Bool("libvirt-start", false, "start the defined domain and wait for the guest agent or a login prompt, implies --libvirt-define-domain (only for type=libvirt)")
+	uploadCmd.Flags().Duration("libvirt-start-timeout", 5*time.Minute, "how long to wait for the started domain to boot (only for type=libvirt)")
 	uploadCmd.Flags().String("openstack-image", "", "name for the uploaded image (only for type=openstack)")
 	uploadCmd.Flags().String("openstack-disk-format", "raw", "the disk format of a virtual machine image (only for type=openstack)")
 	uploadCmd.Flags().String("openstack-container-format", "bare", "this indicates if the image contains metadata about the VM (only for type=openstack)")
 	uploadCmd.Flags().String("ibmcloud-bucket", "", "target bucket name for storing the image (only for type=ibmcloud)")
 	uploadCmd.Flags().String("ibmcloud-region", "", "target region for IBM Cloud uploads (only for type=ibmcloud)")
 	uploadCmd.Flags().String("ibmcloud-image-name", "", "name for the uploaded image (only for type=ibmcloud)")
+	uploadCmd.Flags().String("azure-storage-account", "", "storage account for the VHD page blob (only for type=azure)")
+	uploadCmd.Flags().String("azure-storage-container", "", "storage container for the VHD page blob, created if needed (only for type=azure)")
+	uploadCmd.Flags().String("azure-storage-endpoint", "", "blob service URL of the storage account, e.g. for Azurite (only for type=azure)")
+	uploadCmd.Flags().String("azure-resource-group", "", "resource group for the managed image (only for type=azure)")
+	uploadCmd.Flags().String("azure-image-name", "", "name for the managed image (only for type=azure)")
+	uploadCmd.Flags().String("azure-location", "", "location of the managed image, defaults to the location of the resource group (only for type=azure)")
+	uploadCmd.Flags().String("azure-tenant-id", "", "Azure tenant, defaults to $AZURE_TENANT_ID (only for type=azure)")
+	uploadCmd.Flags().String("azure-subscription-id", "", "Azure subscription, defaults to $AZURE_SUBSCRIPTION_ID (only for type=azure)")
+	uploadCmd.Flags().String("gcp-project", "", "project for the compute image (only for type=gcp)")
+	uploadCmd.Flags().String("gcp-bucket", "", "bucket for the intermediate storage of the image (only for type=gcp)")
+	uploadCmd.Flags().String("gcp-image-name", "", "name for the compute image (only for type=gcp)")
+	uploadCmd.Flags().String("gcp-region", "", "storage location of the compute image, defaults to the multi-region closest to the bucket (only for type=gcp)")
+	uploadCmd.Flags().String("gcp-storage-endpoint", "", "URL of the cloud storage API, e.g. for a storage emulator (only for type=gcp)")
+	uploadCmd.Flags().String("gcp-compute-endpoint", "", "URL of the compute engine API (only for type=gcp)")
+	uploadCmd.Flags().String("s3-endpoint", "", "URL of the S3 compatible object storage, e.g. MinIO (only for type=s3)")
+	uploadCmd.Flags().String("s3-region", "us-east-1", "region used to sign the requests (only for type=s3)")
+	uploadCmd.Flags().String("s3-bucket", "", "target bucket name (only for type=s3)")
+	uploadCmd.Flags().String("s3-key-prefix", "", `prefix for the object key, e.g. "images/" (only for type=s3)`)
+	uploadCmd.Flags().Bool("s3-path-style", false, "use path-style instead of virtual-hosted-style bucket URLs (only for type=s3)")
+	uploadCmd.Flags().String("s3-ca-cert", "", "PEM file with the CA certificates to trust for the endpoint (only for type=s3)")
+	uploadCmd.Flags().String("ref", "", `push to the given registry reference, e.g. "registry.example.com/images/fedora-qcow2:43" (only for type=oci)`)
 	uploadCmd.Flags().String("arch", "", "upload for the given architecture")
+	uploadCmd.Flags().Int("upload-retries", 3, "retry a failed upload to s3, gcp, azure or oci the given number of times, uploads to s3 resume where they stopped")
+	uploadCmd.Flags().Duration("upload-retry-delay", 10*time.Second, "delay before the first retry of an upload, doubled for every further retry")
+	uploadCmd.Flags().String("upload-result", "", "write the result of the uploads (e.g. the AMI id) as json to the given file")
 	rootCmd.AddCommand(uploadCmd)
 
+	cloudCmd := &cobra.Command{
+		Use:   "cloud",
+		Short: "Manage the images that image-builder uploaded to a cloud",
+		Args:  cobra.NoArgs,
+	}
+	cloudCmd.PersistentFlags().String("to", "", "cloud to manage the images of (aws, openstack)")
+	cloudCmd.PersistentFlags().AddFlag(uploadCmd.Flags().Lookup("aws-region"))
+	cloudCmd.PersistentFlags().AddFlag(uploadCmd.Flags().Lookup("aws-profile"))
+	rootCmd.AddCommand(cloudCmd)
+
+	cloudListCmd := &cobra.Command{
+		Use:          "list",
+		Short:        "List the images that image-builder uploaded",
+		RunE:         cmdCloudList,
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+	}
+	cloudListCmd.Flags().String("format", "", "Output in a specific format (text, json)")
+	cloudCmd.AddCommand(cloudListCmd)
+
+	cloudDeleteCmd := &cobra.Command{
+		Use:          "delete [<image-id>...]",
+		Short:        "Delete uploaded images and their snapshots, use image ids or --keep-latest",
+		RunE:         cmdCloudDelete,
+		SilenceUsage: true,
+	}
+	cloudDeleteCmd.Flags().Int("keep-latest", 0, "delete all but the given number of newest images of every distro, arch and image type")
+	cloudDeleteCmd.Flags().Bool("dry-run", false, `only show what would be removed`)
+	cloudDeleteCmd.Flags().Bool("yes", false, `confirm that "--keep-latest 0" deletes all images`)
+	markCommandlineOnly(cloudDeleteCmd, "keep-latest")
+	markCommandlineOnly(cloudDeleteCmd, "yes")
+	cloudCmd.AddCommand(cloudDeleteCmd)
+
+	fetchCmd := &cobra.Command{
+		Use:          "fetch <image-type>",
+		Short:        "Download all sources of the given image-type into the cache, e.g. for offline builds",
+		RunE:         cmdFetch,
+		SilenceUsage: true,
+		Args:         cobra.MaximumNArgs(1),
+	}
+	fetchCmd.Flags().AddFlagSet(manifestCmd.Flags())
+	fetchCmd.Flags().String("cache", defaultCacheDir(), `osbuild directory to download the sources to`)
+	fetchCmd.Flags().String("cache-max-size", "", `maximum size of the osbuild cache (e.g. "50 GiB", default: the size set via "system cache set-max-size")`)
+	fetchCmd.Flags().String("from-manifest", "", `download the sources of the given osbuild manifest instead of generating one`)
+	fetchCmd.Flags().String("export-dir", "", `also copy the sources and the manifest into the given directory that can be used as the cache of an offline build`)
+	fetchCmd.Flags().String("progress", "auto", "type of progress bar to use (e.g. verbose,term,json)")
+	fetchCmd.Flags().Int("progress-fd", 0, "write the json progress to the given file descriptor instead of stdout")
+	rootCmd.AddCommand(fetchCmd)
+
 	buildCmd := &cobra.Command{
-		Use:          "build <image-type>",
-		Short:        "Build the given image-type, e.g. qcow2 (tip: combine with --distro, --arch)",
+		Use:          "build <image-type> [<image-type>...]",
+		Short:        "Build the given image-types, e.g. qcow2 (tip: combine with --distro, --arch)",
 		RunE:         cmdBuild,
 		SilenceUsage: true,
-		Args:         cobra.ExactArgs(1),
+		Args: func(cmd *cobra.Command, args []string) error {
+			// the images to build can come from --filter or
+			// --from-manifest as well
+			if cmd.Flags().Changed("filter") || cmd.Flags().Changed("from-manifest") {
+				return nil
+			}
+			return cobra.MinimumNArgs(1)(cmd, args)
+		},
 	}
 	buildCmd.Flags().AddFlagSet(manifestCmd.Flags())
 	buildCmd.Flags().Bool("with-manifest", false, `export osbuild manifest`)
 	buildCmd.Flags().Bool("with-buildlog", false, `export osbuild buildlog`)
 	buildCmd.Flags().String("cache", defaultCacheDir(), `osbuild directory to cache intermediate build artifacts"`)
+	buildCmd.Flags().String("cache-max-size", "", `maximum size of the osbuild cache (e.g. "50 GiB", default: the size set via "system cache set-max-size")`)
 	// XXX: add "--verbose" here, similar to how bib is doing this
 	// (see https://github.com/osbuild/bootc-image-builder/pull/790/commits/5cec7ffd8a526e2ca1e8ada0ea18f927695dfe43)
-	buildCmd.Flags().String("progress", "auto", "type of progress bar to use (e.g. verbose,term)")
+	buildCmd.Flags().String("progress", "auto", "type of progress bar to use (e.g. verbose,term,json)")
+	buildCmd.Flags().Int("progress-fd", 0, "write the json progress to the given file descriptor instead of stdout")
 	buildCmd.Flags().Bool("with-metrics", false, `print timing information at the end of the build`)
 	buildCmd.Flags().String("output-name", "", "set specific output basename")
 	buildCmd.Flags().Bool("in-vm", false, `run the osbuild pipeline in a virtual machine`)
+	buildCmd.Flags().String("from-manifest", "", `build from the given osbuild manifest instead of generating one (e.g. from "--with-manifest")`)
+	buildCmd.Flags().StringArray("filter", nil, `build all images matching the filter, same syntax as "list --filter" (e.g. "distro:centos-*")`)
+	buildCmd.Flags().Bool("offline", false, `fail early if a source of the manifest is not in the cache and never download anything (needs --from-manifest)`)
 	rootCmd.AddCommand(buildCmd)
 	buildCmd.Flags().AddFlagSet(uploadCmd.Flags())
-	// add after the rest of the uploadCmd flag set is added to avoid
-	// that build gets a "--to" parameter
-	uploadCmd.Flags().String("to", "", "upload to the given cloud")
+	// add after the rest of the uploadCmd flag set is added, build
+	// gets its own "--to" with a different help text
+	uploadCmd.Flags().StringArray("to", nil, "upload to the given cloud, can be given multiple times")
+	buildCmd.Flags().StringArray("to", nil, `upload to the given cloud after building instead of picking it from the image type, can be given multiple times (e.g. "--to aws --to s3")`)
+	uploadCmd.Flags().String("target", "", `upload to the given named target from the targets file (e.g. "prod-aws")`)
+	buildCmd.Flags().String("upload-target", "", `upload to the given named target from the targets file after building (e.g. "prod-aws")`)
+	// same for "--write-lock", build and fetch use the manifest flag set
+	manifestCmd.Flags().String("write-lock", "", `write the depsolved packages to the given lock file`)
 
 	// XXX: add --format=json too?
 	describeImgCmd := &cobra.Command{
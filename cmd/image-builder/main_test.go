@@ -2,6 +2,7 @@ package main_test
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -371,6 +372,16 @@ case $export in
   image)
     echo "fake-img-raw" > "$output_dir/$export/image.raw"
     ;;
+  vpc)
+    truncate -s 1M "$output_dir/$export/disk.vhd"
+    ;;
+  xz)
+    truncate -s 1M "$output_dir/$export/disk.vhd"
+    xz "$output_dir/$export/disk.vhd"
+    ;;
+  archive)
+    printf '\037\213fake-img-tar-gz' > "$output_dir/$export/image.tar.gz"
+    ;;
   *)
     echo "Unknown export: $1 - add to testscript"
     exit 1
@@ -390,6 +401,9 @@ func TestBuildIntegrationHappy(t *testing.T) {
 	restore := main.MockNewRepoRegistry(testrepos.New)
 	defer restore()
 
+	restore = main.MockOsbuildVersion(func() (string, error) { return "999", nil })
+	defer restore()
+
 	var fakeStdout bytes.Buffer
 	restore = main.MockOsStdout(&fakeStdout)
 	defer restore()
@@ -437,6 +451,109 @@ func TestBuildIntegrationHappy(t *testing.T) {
 	assertJsonContains(t, string(manifest), `"image":{"name":"registry.gitlab.com/redhat/services/products/image-builder/ci/osbuild-composer/fedora-minimal"`)
 }
 
+func TestBuildIntegrationJSONProgress(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+
+	restore = main.MockManifestgenDepsolver(fakeDepsolve)
+	defer restore()
+
+	restore = main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+
+	var fakeStdout bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+
+	progressFile, err := os.Create(filepath.Join(t.TempDir(), "progress"))
+	require.NoError(t, err)
+	defer progressFile.Close()
+
+	tmpdir := t.TempDir()
+	outputDir := filepath.Join(tmpdir, "output")
+	restore = main.MockOsArgs([]string{
+		"build",
+		"qcow2",
+		"--arch=x86_64",
+		"--distro", "centos-9",
+		"--cache", tmpdir,
+		"--output-dir", outputDir,
+		"--progress=json",
+		fmt.Sprintf("--progress-fd=%d", progressFile.Fd()),
+	})
+	defer restore()
+
+	script := makeFakeOsbuildScript()
+	testutil.MockCommand(t, "osbuild", script)
+
+	err = main.Run()
+	assert.NoError(t, err)
+	assert.Contains(t, fakeStdout.String(), "Image build successful: ")
+
+	content, err := os.ReadFile(progressFile.Name())
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "\x1e{\"type\":\"message\",\"message\":\"Building manifest for centos-9-qcow2\"}\n")
+	assert.Contains(t, string(content), "\x1e{\"type\":\"pulse\",\"message\":\"Image building step\"}\n")
+	// every record is a RFC7464 json text sequence
+	for _, rec := range strings.SplitAfter(string(content), "\n") {
+		if rec == "" {
+			continue
+		}
+		assert.True(t, strings.HasPrefix(rec, "\x1e"), rec)
+		assert.True(t, json.Valid([]byte(strings.TrimPrefix(rec, "\x1e"))), rec)
+	}
+}
+
+func TestBuildIntegrationJSONProgressOnStdout(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+
+	restore = main.MockManifestgenDepsolver(fakeDepsolve)
+	defer restore()
+
+	restore = main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+
+	var fakeStdout, fakeStderr bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+	restore = main.MockOsStderr(&fakeStderr)
+	defer restore()
+
+	tmpdir := t.TempDir()
+	restore = main.MockOsArgs([]string{
+		"build",
+		"--filter", "distro:centos-9",
+		"--filter", "arch:x86_64",
+		"--filter", "type:qcow2",
+		"--cache", tmpdir,
+		"--output-dir", filepath.Join(tmpdir, "output"),
+		"--progress=json",
+	})
+	defer restore()
+
+	testutil.MockCommand(t, "osbuild", makeFakeOsbuildScript())
+
+	var err error
+	stdout, _ := testutil.CaptureStdio(t, func() {
+		err = main.Run()
+	})
+	assert.NoError(t, err)
+
+	// the json progress uses stdout, the regular output goes to stderr
+	assert.Equal(t, "", fakeStdout.String())
+	assert.Contains(t, fakeStderr.String(), "Building 1 images:\ncentos-9 type:qcow2 arch:x86_64\n")
+	assert.Contains(t, fakeStderr.String(), "Image build successful: ")
+	assert.Contains(t, stdout, "\x1e{\"type\":\"pulse\",\"message\":\"Image building step\"}\n")
+	for _, rec := range strings.SplitAfter(stdout, "\n") {
+		if rec == "" {
+			continue
+		}
+		assert.True(t, strings.HasPrefix(rec, "\x1e"), rec)
+		assert.True(t, json.Valid([]byte(strings.TrimPrefix(rec, "\x1e"))), rec)
+	}
+}
+
 func TestBuildIntegrationArgs(t *testing.T) {
 	if testing.Short() {
 		t.Skip("manifest generation takes a while")
@@ -448,6 +565,9 @@ func TestBuildIntegrationArgs(t *testing.T) {
 	restore := main.MockNewRepoRegistry(testrepos.New)
 	defer restore()
 
+	restore = main.MockOsbuildVersion(func() (string, error) { return "999", nil })
+	defer restore()
+
 	cacheDir := t.TempDir()
 	for _, tc := range []struct {
 		args          []string
@@ -755,6 +875,7 @@ arch: %s`, arch.Current().String()))
 func TestProgressFromCmd(t *testing.T) {
 	cmd := &cobra.Command{}
 	cmd.Flags().String("progress", "auto", "")
+	cmd.Flags().Int("progress-fd", 0, "")
 	cmd.Flags().Bool("verbose", false, "")
 
 	for _, tc := range []struct {
@@ -770,6 +891,8 @@ func TestProgressFromCmd(t *testing.T) {
 		{"auto", true, "*progress.verboseProgressBar"},
 		{"term", false, "*progress.terminalProgressBar"},
 		{"term", true, "*progress.terminalProgressBar"},
+		{"json", false, "*progress.jsonProgressBar"},
+		{"json", true, "*progress.jsonProgressBar"},
 	} {
 		cmd.Flags().Set("progress", tc.progress)
 		cmd.Flags().Set("verbose", fmt.Sprintf("%v", tc.verbose))
@@ -779,6 +902,41 @@ func TestProgressFromCmd(t *testing.T) {
 	}
 }
 
+func TestProgressFromCmdProgressFd(t *testing.T) {
+	progressFile, err := os.Create(filepath.Join(t.TempDir(), "progress"))
+	require.NoError(t, err)
+	defer progressFile.Close()
+
+	for _, tc := range []struct {
+		progress    string
+		progressFd  int
+		expectedErr string
+	}{
+		{"json", int(progressFile.Fd()), ""},
+		{"term", int(progressFile.Fd()), "--progress-fd requires --progress=json"},
+		{"json", 9999, "cannot use --progress-fd 9999: stat progress-fd: bad file descriptor"},
+	} {
+		cmd := &cobra.Command{}
+		cmd.Flags().String("progress", "auto", "")
+		cmd.Flags().Int("progress-fd", 0, "")
+		cmd.Flags().Bool("verbose", false, "")
+		cmd.Flags().Set("progress", tc.progress)
+		cmd.Flags().Set("progress-fd", fmt.Sprintf("%v", tc.progressFd))
+
+		pbar, err := main.ProgressFromCmd(cmd)
+		if tc.expectedErr != "" {
+			assert.EqualError(t, err, tc.expectedErr)
+			continue
+		}
+		assert.NoError(t, err)
+		pbar.SetMessagef("some-message")
+	}
+
+	content, err := os.ReadFile(progressFile.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "\x1e{\"type\":\"message\",\"message\":\"some-message\"}\n", string(content))
+}
+
 func TestManifestExtraRepos(t *testing.T) {
 	if testing.Short() {
 		t.Skip("manifest generation takes a while")
@@ -884,6 +1042,9 @@ func TestBuildCrossArchSmoke(t *testing.T) {
 	restore := main.MockNewRepoRegistry(testrepos.New)
 	defer restore()
 
+	restore = main.MockOsbuildVersion(func() (string, error) { return "999", nil })
+	defer restore()
+
 	tmpdir := t.TempDir()
 	for _, withCrossArch := range []bool{false, true} {
 		cmd := []string{
@@ -1201,3 +1362,250 @@ func TestCacheDirForUidNonRootFallback(t *testing.T) {
 	expected := filepath.Join(home, ".cache", "image-builder", "store")
 	assert.Equal(t, expected, main.CacheDirForUid(1000))
 }
+
+func TestBuildIntegrationMultipleImageTypes(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+
+	restore = main.MockOsbuildVersion(func() (string, error) { return "999", nil })
+	defer restore()
+
+	restore = main.MockManifestgenDepsolver(fakeDepsolve)
+	defer restore()
+
+	restore = main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+
+	var fakeStdout bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+
+	tmpdir := t.TempDir()
+	outputDir := filepath.Join(tmpdir, "output")
+	restore = main.MockOsArgs([]string{
+		"build",
+		"qcow2",
+		"oci",
+		"--arch=x86_64",
+		"--distro", "centos-9",
+		"--cache", tmpdir,
+		"--output-dir", outputDir,
+	})
+	defer restore()
+
+	fakeOsbuildCmd := testutil.MockCommand(t, "osbuild", makeFakeOsbuildScript())
+
+	err := main.Run()
+	require.NoError(t, err)
+
+	assert.Contains(t, fakeStdout.String(), fmt.Sprintf("Image build successful: %s/centos-9-qcow2-x86_64.qcow2\n", outputDir))
+	assert.Contains(t, fakeStdout.String(), fmt.Sprintf("Image build successful: %s/centos-9-oci-x86_64.qcow2\n", outputDir))
+
+	// osbuild is run once per image type with the same store
+	require.Equal(t, 2, len(fakeOsbuildCmd.CallArgsList()))
+	for _, osbuildCall := range fakeOsbuildCmd.CallArgsList() {
+		storePos := slices.Index(osbuildCall, "--store")
+		require.True(t, storePos > -1)
+		assert.Equal(t, tmpdir, osbuildCall[storePos+1])
+	}
+}
+
+func TestBuildIntegrationMultipleImageTypesPartialFailure(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+
+	restore = main.MockManifestgenDepsolver(fakeDepsolve)
+	defer restore()
+
+	restore = main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+
+	var fakeStdout, fakeStderr bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+	restore = main.MockOsStderr(&fakeStderr)
+	defer restore()
+
+	tmpdir := t.TempDir()
+	outputDir := filepath.Join(tmpdir, "output")
+	restore = main.MockOsArgs([]string{
+		"build",
+		"qcow2",
+		"vmdk",
+		"--arch=x86_64",
+		"--distro", "centos-9",
+		"--cache", tmpdir,
+		"--output-dir", outputDir,
+		"--progress=verbose",
+	})
+	defer restore()
+
+	// the fake osbuild does not know about the "vmdk" export
+	testutil.MockCommand(t, "osbuild", makeFakeOsbuildScript())
+
+	var err error
+	testutil.CaptureStdio(t, func() {
+		err = main.Run()
+	})
+	assert.EqualError(t, err, "cannot build 1 of 2 images: centos-9-vmdk-x86_64")
+	assert.Contains(t, fakeStdout.String(), fmt.Sprintf("Image build successful: %s/centos-9-qcow2-x86_64.qcow2\n", outputDir))
+	assert.Contains(t, fakeStderr.String(), "Image build failed: centos-9-vmdk-x86_64: error running osbuild: exit status 1\n")
+}
+
+func TestBuildIntegrationWritesArtifactMetadata(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+
+	restore = main.MockOsbuildVersion(func() (string, error) { return "999", nil })
+	defer restore()
+
+	restore = main.MockManifestgenDepsolver(fakeDepsolve)
+	defer restore()
+
+	restore = main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+
+	tmpdir := t.TempDir()
+	outputDir := filepath.Join(tmpdir, "output")
+	restore = main.MockOsArgs([]string{
+		"build",
+		"qcow2",
+		"--arch=x86_64",
+		"--distro", "centos-9",
+		"--seed=42",
+		"--cache", tmpdir,
+		"--output-dir", outputDir,
+	})
+	defer restore()
+
+	testutil.MockCommand(t, "osbuild", makeFakeOsbuildScript())
+
+	err := main.Run()
+	require.NoError(t, err)
+
+	b, err := os.ReadFile(filepath.Join(outputDir, "centos-9-qcow2-x86_64.json"))
+	require.NoError(t, err)
+	var md map[string]any
+	err = json.Unmarshal(b, &md)
+	require.NoError(t, err)
+
+	assert.Equal(t, "centos-9", md["distro"])
+	assert.Equal(t, "qcow2", md["image-type"])
+	assert.Equal(t, "x86_64", md["arch"])
+	assert.Equal(t, "hybrid", md["boot-mode"])
+	assert.Equal(t, float64(42), md["seed"])
+	assert.Regexp(t, "^sha256:[0-9a-f]{64}$", md["blueprint-digest"])
+	assert.NotEmpty(t, md["repositories"])
+	assert.Equal(t, "999", md["versions"].(map[string]any)["osbuild"])
+	assert.Equal(t, "centos-9-qcow2-x86_64.qcow2", md["filename"])
+	// the fake osbuild writes "fake-img-qcow2\n"
+	assert.Equal(t, float64(15), md["size"])
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("fake-img-qcow2\n"))), md["sha256"])
+}
+
+func TestBuildMultipleImageTypesNoOutputName(t *testing.T) {
+	restore := main.MockOsArgs([]string{
+		"build",
+		"qcow2",
+		"ami",
+		"--cache", t.TempDir(),
+		"--output-name=foo",
+	})
+	defer restore()
+
+	err := main.Run()
+	assert.EqualError(t, err, "cannot use --output-name when building multiple image types")
+}
+
+func TestBuildIntegrationFilterMatrix(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+
+	restore = main.MockOsbuildVersion(func() (string, error) { return "999", nil })
+	defer restore()
+
+	restore = main.MockManifestgenDepsolver(fakeDepsolve)
+	defer restore()
+
+	restore = main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+
+	var fakeStdout bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+
+	tmpdir := t.TempDir()
+	outputDir := filepath.Join(tmpdir, "output")
+	restore = main.MockOsArgs([]string{
+		"build",
+		"--filter", "distro:centos-*",
+		"--filter", "arch:x86_64",
+		"--filter", "type:qcow2",
+		"--cache", tmpdir,
+		"--output-dir", outputDir,
+		"--progress=verbose",
+	})
+	defer restore()
+
+	fakeOsbuildCmd := testutil.MockCommand(t, "osbuild", makeFakeOsbuildScript())
+
+	var err error
+	testutil.CaptureStdio(t, func() {
+		err = main.Run()
+	})
+	require.NoError(t, err)
+
+	// the plan is shown first
+	assert.True(t, strings.HasPrefix(fakeStdout.String(), `Building 2 images:
+centos-9 type:qcow2 arch:x86_64
+centos-10 type:qcow2 arch:x86_64
+`), fakeStdout.String())
+	// every image gets its own directory
+	for _, basename := range []string{"centos-10-qcow2-x86_64", "centos-9-qcow2-x86_64"} {
+		imgPath := filepath.Join(outputDir, basename, basename+".qcow2")
+		assert.Contains(t, fakeStdout.String(), fmt.Sprintf("Image build successful: %s\n", imgPath))
+		assert.FileExists(t, imgPath)
+	}
+	require.Equal(t, 2, len(fakeOsbuildCmd.CallArgsList()))
+}
+
+func TestBuildFilterErrors(t *testing.T) {
+	restore := main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+
+	for _, tc := range []struct {
+		cmdline     []string
+		expectedErr string
+	}{
+		{
+			[]string{"qcow2", "--filter=type:qcow2"},
+			`cannot use image type arguments ["qcow2"] together with --filter`,
+		}, {
+			[]string{"--filter=type:qcow2", "--distro=centos-9"},
+			`cannot use --distro together with --filter`,
+		}, {
+			[]string{"--filter=type:qcow2", "--arch=x86_64"},
+			`cannot use --arch together with --filter`,
+		}, {
+			[]string{"--filter=type:qcow2", "--output-name=foo"},
+			`cannot use --output-name when building multiple image types`,
+		}, {
+			[]string{"--filter=distro:no-such-distro"},
+			`cannot find any image for filter ["distro:no-such-distro"]`,
+		}, {
+			nil,
+			`requires at least 1 arg(s), only received 0`,
+		},
+	} {
+		t.Run(strings.Join(tc.cmdline, ","), func(t *testing.T) {
+			restore := main.MockOsArgs(append([]string{"build", "--cache", t.TempDir()}, tc.cmdline...))
+			defer restore()
+
+			err := main.Run()
+			assert.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
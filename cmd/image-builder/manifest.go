@@ -26,7 +26,8 @@ type manifestOptions struct {
 
 	OutputDir                  string
 	OutputFilename             string
-	BlueprintPath              string
+	BlueprintPaths             []string
+	BlueprintVars              *blueprintload.Vars
 	Ostree                     *ostree.ImageOptions
 	BootcRef                   string
 	BootcInstallerPayloadRef   string
@@ -97,7 +98,7 @@ func generateManifest(repoDir string, extraRepos []string, img *imagefilter.Resu
 		return err
 	}
 
-	bp, err := blueprintload.Load(opts.BlueprintPath)
+	bp, err := blueprintload.LoadAll(opts.BlueprintPaths, opts.BlueprintVars)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/osbuild/blueprint/pkg/blueprint"
+	"github.com/osbuild/images/pkg/depsolvednf"
+	"github.com/osbuild/images/pkg/distro"
+	"github.com/osbuild/images/pkg/imagefilter"
+	"github.com/osbuild/images/pkg/manifestgen"
+	"github.com/osbuild/images/pkg/platform"
+	"github.com/osbuild/images/pkg/rpmmd"
+)
+
+// artifactMetadata describes how an artifact was built, it is written
+// as "<basename>.json" next to every artifact.
+type artifactMetadata struct {
+	Distro          string   `json:"distro,omitempty"`
+	ImageType       string   `json:"image-type,omitempty"`
+	Arch            string   `json:"arch,omitempty"`
+	BootMode        string   `json:"boot-mode,omitempty"`
+	BlueprintDigest string   `json:"blueprint-digest,omitempty"`
+	Repositories    []string `json:"repositories,omitempty"`
+	Seed            *int64   `json:"seed,omitempty"`
+
+	Versions struct {
+		OSBuild string `json:"osbuild"`
+		Images  string `json:"images"`
+	} `json:"versions"`
+
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Sha256   string `json:"sha256"`
+}
+
+func (md *artifactMetadata) setImage(img *imagefilter.Result) {
+	md.Distro = img.ImgType.Arch().Distro().Name()
+	md.ImageType = img.ImgType.Name()
+	md.Arch = img.ImgType.Arch().Name()
+	md.BootMode = img.ImgType.BootMode().String()
+}
+
+func (md *artifactMetadata) setBlueprint(bp *blueprint.Blueprint) error {
+	// use the json encoding so that the digest does not depend on
+	// the blueprint file format or formatting
+	b, err := json.Marshal(bp)
+	if err != nil {
+		return fmt.Errorf("cannot compute blueprint digest: %w", err)
+	}
+	md.BlueprintDigest = fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+	return nil
+}
+
+// setSeed records the given seed, if there is none a random seed is
+// picked (just like "images" would do) so that it can be recorded.
+func (md *artifactMetadata) setSeed(seed *int64) *int64 {
+	s := distro.SeedFrom(seed)
+	md.Seed = &s
+	return md.Seed
+}
+
+// recordRepos wraps the given depsolve function and records the URLs
+// of all repositories that were used for depsolving.
+func (md *artifactMetadata) recordRepos(depsolve manifestgen.DepsolveFunc) manifestgen.DepsolveFunc {
+	if depsolve == nil {
+		depsolve = manifestgen.DefaultDepsolve
+	}
+	return func(solver *depsolvednf.Solver, cacheDir string, depsolveWarningsOutput io.Writer, packageSets map[string][]rpmmd.PackageSet, d distro.Distro, arch string) (map[string]depsolvednf.DepsolveResult, error) {
+		res, err := depsolve(solver, cacheDir, depsolveWarningsOutput, packageSets, d, arch)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range res {
+			for _, repo := range r.Repos {
+				for _, url := range append(slices.Clone(repo.BaseURLs), repo.Metalink, repo.MirrorList) {
+					if url != "" && !slices.Contains(md.Repositories, url) {
+						md.Repositories = append(md.Repositories, url)
+					}
+				}
+			}
+		}
+		slices.Sort(md.Repositories)
+		return res, nil
+	}
+}
+
+// metadataPathFor returns the path of the metadata sidecar for the
+// given basename in the given directory.
+func metadataPathFor(outputDir, basename string) string {
+	return filepath.Join(outputDir, basename+".json")
+}
+
+// writeArtifactMetadata writes the metadata for the given artifact
+// to metadataPath, the file details and versions are filled in here.
+func writeArtifactMetadata(md *artifactMetadata, artifactPath, metadataPath string) error {
+	f, err := os.Open(artifactPath)
+	if err != nil {
+		return fmt.Errorf("cannot open artifact: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("cannot compute artifact checksum: %w", err)
+	}
+	md.Filename = filepath.Base(artifactPath)
+	md.Size = size
+	md.Sha256 = fmt.Sprintf("%x", h.Sum(nil))
+	md.Versions.Images = imagesVersion()
+	md.Versions.OSBuild, err = osbuildVersion()
+	if err != nil {
+		md.Versions.OSBuild = "unknown"
+	}
+
+	b, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(metadataPath, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("cannot write artifact metadata: %w", err)
+	}
+	return nil
+}
+
+// readArtifactMetadata reads the metadata sidecar for the given
+// artifact (if there is one). The artifact extension is not known
+// here so all candidates are tried, e.g. for "foo.raw.xz" first
+// "foo.raw.json" then "foo.json".
+func readArtifactMetadata(artifactPath string) (*artifactMetadata, error) {
+	p := artifactPath
+	for ext := filepath.Ext(p); ext != ""; ext = filepath.Ext(p) {
+		p = strings.TrimSuffix(p, ext)
+		b, err := os.ReadFile(p + ".json")
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read artifact metadata: %w", err)
+		}
+		var md artifactMetadata
+		if err := json.Unmarshal(b, &md); err != nil {
+			return nil, fmt.Errorf("cannot parse artifact metadata %q: %w", p+".json", err)
+		}
+		// a json file with the same basename that is not
+		// about this artifact (e.g. a manifest)
+		if md.Filename != filepath.Base(artifactPath) {
+			continue
+		}
+		return &md, nil
+	}
+	return nil, nil
+}
+
+func bootModeFromString(s string) (platform.BootMode, error) {
+	for _, bm := range []platform.BootMode{platform.BOOT_NONE, platform.BOOT_LEGACY, platform.BOOT_UEFI, platform.BOOT_HYBRID} {
+		if bm.String() == s {
+			return bm, nil
+		}
+	}
+	return platform.BOOT_NONE, fmt.Errorf("unknown boot mode %q", s)
+}
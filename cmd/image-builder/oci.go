@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/stream"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// ociImageArtifactType is the artifactType of the manifest of
+	// a pushed image
+	ociImageArtifactType = "application/vnd.osbuild.image.v1"
+	// ociSBOMArtifactType is the artifactType of the manifest of an
+	// SBOM that refers to a pushed image
+	ociSBOMArtifactType = "application/spdx+json"
+
+	ociAnnotationDistro    = "org.osbuild.image.distro"
+	ociAnnotationArch      = "org.osbuild.image.arch"
+	ociAnnotationImageType = "org.osbuild.image.type"
+)
+
+// ociLayerMediaTypes maps the image file extension to the media type
+// of the layer, everything else is "application/octet-stream"
+var ociLayerMediaTypes = map[string]string{
+	".qcow2": "application/x-qemu-disk",
+	".vmdk":  "application/x-vmdk",
+	".vhd":   "application/x-vhd",
+	".iso":   "application/x-iso9660-image",
+	".tar":   "application/x-tar",
+	".gz":    "application/gzip",
+	".xz":    "application/x-xz",
+	".zst":   "application/zstd",
+}
+
+// ociUploader pushes an image as an OCI artifact (like "oras push"
+// does) and attaches the SBOMs of the image as referrers
+type ociUploader struct {
+	ref  name.Tag
+	arch string
+
+	imagePath string
+	metadata  *artifactMetadata
+	sboms     []string
+
+	layerDigest digest.Digest
+	imageDigest digest.Digest
+}
+
+func newOCIUploader(refStr, targetArch string) (*ociUploader, error) {
+	ref, err := name.NewTag(refStr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot use OCI reference %q: %w", refStr, err)
+	}
+	return &ociUploader{ref: ref, arch: targetArch}, nil
+}
+
+// setArtifact implements artifactUploader, the SBOMs written by
+// "build --with-sbom" next to the image are attached as referrers
+func (ou *ociUploader) setArtifact(imagePath string, md *artifactMetadata) {
+	ou.imagePath = imagePath
+	ou.metadata = md
+	ou.sboms = sbomsFor(imagePath)
+}
+
+// sbomsFor returns the SPDX documents that belong to the given image,
+// e.g. "foo.image-os.spdx.json" for "foo.qcow2"
+func sbomsFor(imagePath string) []string {
+	p := imagePath
+	for ext := filepath.Ext(p); ext != ""; ext = filepath.Ext(p) {
+		p = strings.TrimSuffix(p, ext)
+		if sboms, _ := filepath.Glob(p + ".*.spdx.json"); len(sboms) > 0 {
+			return sboms
+		}
+	}
+	return nil
+}
+
+func (ou *ociUploader) annotations() map[string]string {
+	annotations := map[string]string{
+		ociAnnotationArch: ou.arch,
+	}
+	if ou.metadata != nil {
+		for key, val := range map[string]string{
+			ociAnnotationDistro:    ou.metadata.Distro,
+			ociAnnotationImageType: ou.metadata.ImageType,
+		} {
+			if val != "" {
+				annotations[key] = val
+			}
+		}
+	}
+	return annotations
+}
+
+func (ou *ociUploader) options() []remote.Option {
+	return []remote.Option{
+		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		remote.WithContext(context.Background()),
+	}
+}
+
+// ociStreamLayer is the image as the layer of an OCI artifact. Unlike
+// stream.Layer it is not compressed, the digest is known once the
+// layer is pushed.
+type ociStreamLayer struct {
+	r         io.Reader
+	size      int64
+	mediaType types.MediaType
+
+	mu       sync.Mutex
+	consumed bool
+	digest   *v1.Hash
+}
+
+var _ v1.Layer = (*ociStreamLayer)(nil)
+
+func (l *ociStreamLayer) Digest() (v1.Hash, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.digest == nil {
+		return v1.Hash{}, stream.ErrNotComputed
+	}
+	return *l.digest, nil
+}
+
+func (l *ociStreamLayer) DiffID() (v1.Hash, error) {
+	return l.Digest()
+}
+
+func (l *ociStreamLayer) Size() (int64, error) {
+	return l.size, nil
+}
+
+func (l *ociStreamLayer) MediaType() (types.MediaType, error) {
+	return l.mediaType, nil
+}
+
+func (l *ociStreamLayer) Uncompressed() (io.ReadCloser, error) {
+	return l.Compressed()
+}
+
+func (l *ociStreamLayer) Compressed() (io.ReadCloser, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.consumed {
+		return nil, stream.ErrConsumed
+	}
+	l.consumed = true
+	return &ociDigestReader{l: l, h: sha256.New()}, nil
+}
+
+// ociDigestReader computes the digest of the layer while it is read,
+// the transport stops reading at the size of the layer
+type ociDigestReader struct {
+	l    *ociStreamLayer
+	h    hash.Hash
+	read int64
+}
+
+func (dr *ociDigestReader) Read(p []byte) (int, error) {
+	n, err := dr.l.r.Read(p)
+	dr.h.Write(p[:n])
+	dr.read += int64(n)
+	if err == io.EOF || dr.read == dr.l.size {
+		dr.l.mu.Lock()
+		dr.l.digest = &v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(dr.h.Sum(nil))}
+		dr.l.mu.Unlock()
+	}
+	return n, err
+}
+
+func (dr *ociDigestReader) Close() error {
+	return nil
+}
+
+// ociManifest implements remote.Taggable
+type ociManifest struct {
+	manifest *ocispec.Manifest
+}
+
+func (om ociManifest) RawManifest() ([]byte, error) {
+	return json.Marshal(om.manifest)
+}
+
+func (om ociManifest) MediaType() (types.MediaType, error) {
+	return types.OCIManifestSchema1, nil
+}
+
+// descriptor returns the descriptor of the manifest, e.g. for the
+// subject of a referrer
+func (om ociManifest) descriptor() (ocispec.Descriptor, error) {
+	b, err := om.RawManifest()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: om.manifest.ArtifactType,
+		Digest:       digest.FromBytes(b),
+		Size:         int64(len(b)),
+	}, nil
+}
+
+// pushLayer pushes a small layer (e.g. an SBOM) and returns its
+// descriptor
+func (ou *ociUploader) pushLayer(content []byte, mediaType string) (ocispec.Descriptor, error) {
+	layer := static.NewLayer(content, types.MediaType(mediaType))
+	if err := remote.WriteLayer(ou.ref.Context(), layer, ou.options()...); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	h, err := layer.Digest()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.Digest(h.String()),
+		Size:      int64(len(content)),
+	}, nil
+}
+
+func newOCIArtifactManifest(artifactType string, layer ocispec.Descriptor) *ocispec.Manifest {
+	return &ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       ocispec.DescriptorEmptyJSON,
+		Layers:       []ocispec.Descriptor{layer},
+	}
+}
+
+func (ou *ociUploader) Check(status io.Writer) error {
+	fmt.Fprintf(status, "Checking OCI registry %q\n", ou.ref.RegistryStr())
+	if err := remote.CheckPushPermission(ou.ref, authn.DefaultKeychain, remote.DefaultTransport); err != nil {
+		return fmt.Errorf("cannot push to %q: %w", ou.ref.Context(), err)
+	}
+	return nil
+}
+
+func (ou *ociUploader) UploadAndRegister(r io.Reader, uploadSize uint64, status io.Writer) error {
+	if ou.imagePath == "" {
+		return permanentUploadErrorf("cannot push to oci: missing artifact path")
+	}
+	if _, err := ou.pushLayer(ocispec.DescriptorEmptyJSON.Data, ocispec.MediaTypeEmptyJSON); err != nil {
+		return fmt.Errorf("cannot push empty config: %w", err)
+	}
+
+	filename := filepath.Base(ou.imagePath)
+	fmt.Fprintf(status, "Pushing %s to %s\n", filename, ou.ref)
+	mediaType, ok := ociLayerMediaTypes[filepath.Ext(filename)]
+	if !ok {
+		mediaType = "application/octet-stream"
+	}
+	layer := &ociStreamLayer{r: r, size: int64(uploadSize), mediaType: types.MediaType(mediaType)}
+	if err := remote.WriteLayer(ou.ref.Context(), layer, ou.options()...); err != nil {
+		return fmt.Errorf("cannot push %s: %w", filename, err)
+	}
+	h, err := layer.Digest()
+	if err != nil {
+		return fmt.Errorf("cannot push %s: %w", filename, err)
+	}
+	layerDigest := digest.Digest(h.String())
+	manifest := newOCIArtifactManifest(ociImageArtifactType, ocispec.Descriptor{
+		MediaType:   mediaType,
+		Digest:      layerDigest,
+		Size:        int64(uploadSize),
+		Annotations: map[string]string{ocispec.AnnotationTitle: filename},
+	})
+	manifest.Annotations = ou.annotations()
+	image := ociManifest{manifest}
+	if err := remote.Put(ou.ref, image, ou.options()...); err != nil {
+		return fmt.Errorf("cannot push manifest: %w", err)
+	}
+	imageDesc, err := image.descriptor()
+	if err != nil {
+		return err
+	}
+
+	for _, sbomPath := range ou.sboms {
+		fmt.Fprintf(status, "Attaching SBOM %s\n", filepath.Base(sbomPath))
+		content, err := os.ReadFile(sbomPath)
+		if err != nil {
+			return fmt.Errorf("cannot read SBOM: %w", err)
+		}
+		sbomDesc, err := ou.pushLayer(content, ociSBOMArtifactType)
+		if err != nil {
+			return fmt.Errorf("cannot push SBOM: %w", err)
+		}
+		sbomDesc.Annotations = map[string]string{ocispec.AnnotationTitle: filepath.Base(sbomPath)}
+		sbomManifest := newOCIArtifactManifest(ociSBOMArtifactType, sbomDesc)
+		// remote.Put adds the manifest to the referrers of the
+		// subject (via the fallback tag for registries without the
+		// referrers API)
+		sbomManifest.Subject = &imageDesc
+		sbom := ociManifest{sbomManifest}
+		sbomManifestDesc, err := sbom.descriptor()
+		if err != nil {
+			return err
+		}
+		if err := remote.Put(ou.ref.Context().Digest(sbomManifestDesc.Digest.String()), sbom, ou.options()...); err != nil {
+			return fmt.Errorf("cannot push SBOM manifest: %w", err)
+		}
+	}
+	ou.layerDigest = layerDigest
+	ou.imageDigest = imageDesc.Digest
+	fmt.Fprintf(status, "Pushed %s@%s\n", ou.ref.Context(), imageDesc.Digest)
+	return nil
+}
+
+// retryable implements retryableUploader, blobs are addressed by their
+// digest and pushing them again is harmless
+func (ou *ociUploader) retryable() bool {
+	return true
+}
+
+func (ou *ociUploader) verifyUpload(size uint64, sums *uploadChecksums, status io.Writer) error {
+	expected := digest.NewDigestFromBytes(digest.SHA256, sums.SHA256)
+	if ou.layerDigest != expected {
+		return fmt.Errorf("pushed layer %s instead of %s", ou.layerDigest, expected)
+	}
+	fmt.Fprintf(status, "Verifying %s@%s\n", ou.ref.Context(), ou.layerDigest)
+	layer, err := remote.Layer(ou.ref.Context().Digest(ou.layerDigest.String()), ou.options()...)
+	if err != nil {
+		return fmt.Errorf("cannot get layer %s: %w", ou.layerDigest, err)
+	}
+	pushedSize, err := layer.Size()
+	if err != nil {
+		return fmt.Errorf("cannot get layer %s: %w", ou.layerDigest, err)
+	}
+	if pushedSize != int64(size) {
+		return fmt.Errorf("layer %s has %d bytes instead of %d", ou.layerDigest, pushedSize, size)
+	}
+	return nil
+}
+
+func (ou *ociUploader) remoteID() string {
+	return fmt.Sprintf("%s@%s", ou.ref.Context(), ou.imageDigest)
+}
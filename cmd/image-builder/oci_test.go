@@ -0,0 +1,164 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+)
+
+func mockOCIRegistry(t *testing.T, referrersSupport bool) string {
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0)), registry.WithReferrersSupport(referrersSupport)))
+	t.Cleanup(srv.Close)
+	// do not pick up any credentials of the user
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	t.Setenv("REGISTRY_AUTH_FILE", filepath.Join(t.TempDir(), "auth.json"))
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func fetchOCIManifest(t *testing.T, ref name.Reference) *ocispec.Manifest {
+	desc, err := remote.Get(ref)
+	require.NoError(t, err)
+	var manifest ocispec.Manifest
+	require.NoError(t, json.Unmarshal(desc.Manifest, &manifest))
+	return &manifest
+}
+
+func fetchOCIBlob(t *testing.T, repo name.Repository, desc ocispec.Descriptor) []byte {
+	layer, err := remote.Layer(repo.Digest(desc.Digest.String()))
+	require.NoError(t, err)
+	rc, err := layer.Compressed()
+	require.NoError(t, err)
+	defer rc.Close()
+	content, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return content
+}
+
+func TestUploadOCI(t *testing.T) {
+	registryHost := mockOCIRegistry(t, true)
+
+	tmpdir := t.TempDir()
+	imagePath := filepath.Join(tmpdir, "centos-9-qcow2-x86_64.qcow2")
+	require.NoError(t, os.WriteFile(imagePath, []byte("fake-img-qcow2"), 0644))
+	md := `{"distro": "centos-9", "image-type": "qcow2", "arch": "x86_64", "filename": "centos-9-qcow2-x86_64.qcow2"}`
+	require.NoError(t, os.WriteFile(filepath.Join(tmpdir, "centos-9-qcow2-x86_64.json"), []byte(md), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpdir, "centos-9-qcow2-x86_64.image-os.spdx.json"), []byte(`{"spdxVersion": "SPDX-2.3"}`), 0644))
+
+	var fakeStdout, fakeStderr bytes.Buffer
+	restore := main.MockOsStdout(&fakeStdout)
+	defer restore()
+	restore = main.MockOsStderr(&fakeStderr)
+	defer restore()
+	restore = main.MockOsArgs([]string{"upload", "--to=oci", "--ref", registryHost + "/images/centos-qcow2:9", imagePath})
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	assert.Contains(t, fakeStdout.String(), "100.00%")
+
+	ref, err := name.ParseReference(registryHost + "/images/centos-qcow2:9")
+	require.NoError(t, err)
+	manifest := fetchOCIManifest(t, ref)
+	assert.Equal(t, "application/vnd.osbuild.image.v1", manifest.ArtifactType)
+	assert.Equal(t, ocispec.MediaTypeEmptyJSON, manifest.Config.MediaType)
+	assert.Equal(t, map[string]string{
+		"org.osbuild.image.distro": "centos-9",
+		"org.osbuild.image.arch":   "x86_64",
+		"org.osbuild.image.type":   "qcow2",
+	}, manifest.Annotations)
+	require.Len(t, manifest.Layers, 1)
+	assert.Equal(t, "application/x-qemu-disk", manifest.Layers[0].MediaType)
+	assert.Equal(t, map[string]string{ocispec.AnnotationTitle: "centos-9-qcow2-x86_64.qcow2"}, manifest.Layers[0].Annotations)
+	assert.Equal(t, []byte("fake-img-qcow2"), fetchOCIBlob(t, ref.Context(), manifest.Layers[0]))
+
+	// the SBOM refers to the image
+	desc, err := remote.Head(ref)
+	require.NoError(t, err)
+	assert.Contains(t, fakeStderr.String(), "Pushed "+registryHost+"/images/centos-qcow2@"+desc.Digest.String())
+	referrers, err := remote.Referrers(ref.Context().Digest(desc.Digest.String()))
+	require.NoError(t, err)
+	idx, err := referrers.IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, idx.Manifests, 1)
+	sbomManifest := fetchOCIManifest(t, ref.Context().Digest(idx.Manifests[0].Digest.String()))
+	assert.Equal(t, "application/spdx+json", sbomManifest.ArtifactType)
+	assert.Equal(t, desc.Digest.String(), sbomManifest.Subject.Digest.String())
+	require.Len(t, sbomManifest.Layers, 1)
+	assert.Equal(t, "centos-9-qcow2-x86_64.image-os.spdx.json", sbomManifest.Layers[0].Annotations[ocispec.AnnotationTitle])
+	assert.Equal(t, []byte(`{"spdxVersion": "SPDX-2.3"}`), fetchOCIBlob(t, ref.Context(), sbomManifest.Layers[0]))
+}
+
+func TestUploadOCIWithoutReferrersAPI(t *testing.T) {
+	registryHost := mockOCIRegistry(t, false)
+
+	tmpdir := t.TempDir()
+	imagePath := filepath.Join(tmpdir, "centos-9-qcow2-x86_64.qcow2")
+	require.NoError(t, os.WriteFile(imagePath, []byte("fake-img-qcow2"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpdir, "centos-9-qcow2-x86_64.image-os.spdx.json"), []byte(`{"spdxVersion": "SPDX-2.3"}`), 0644))
+
+	restore := main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+	restore = main.MockOsArgs([]string{"upload", "--to=oci", "--arch=x86_64", "--ref", registryHost + "/images/centos-qcow2:9", imagePath})
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+
+	// the SBOM is found via the fallback tag of the image
+	ref, err := name.ParseReference(registryHost + "/images/centos-qcow2:9")
+	require.NoError(t, err)
+	desc, err := remote.Head(ref)
+	require.NoError(t, err)
+	referrers, err := remote.Referrers(ref.Context().Digest(desc.Digest.String()))
+	require.NoError(t, err)
+	idx, err := referrers.IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, idx.Manifests, 1)
+	sbomManifest := fetchOCIManifest(t, ref.Context().Digest(idx.Manifests[0].Digest.String()))
+	assert.Equal(t, desc.Digest.String(), sbomManifest.Subject.Digest.String())
+}
+
+func TestUploadOCIErrors(t *testing.T) {
+	restore := main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+
+	for _, tc := range []struct {
+		cmdline     []string
+		expectedErr string
+	}{
+		{
+			[]string{"--to=oci"},
+			`missing all upload configuration: ["--ref"]`,
+		}, {
+			[]string{"--to=oci", "--ref=registry.example.com/Images:9"},
+			`cannot use OCI reference "registry.example.com/Images:9": repository can only contain the characters ` + "`abcdefghijklmnopqrstuvwxyz0123456789_-./`: Images",
+		},
+	} {
+		t.Run(strings.Join(tc.cmdline, ","), func(t *testing.T) {
+			restore := main.MockOsArgs(append(append([]string{"upload", "--arch=x86_64"}, tc.cmdline...), "disk.qcow2"))
+			defer restore()
+
+			err := main.Run()
+			assert.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
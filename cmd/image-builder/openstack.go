@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/gophercloud/gophercloud/v2"
+	ostack "github.com/gophercloud/gophercloud/v2/openstack"
+	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/images"
+	"github.com/osbuild/images/pkg/cloud"
+)
+
+// openstackImageClient is the subset of the glance API that is needed
+// to verify, tag, list and delete images
+type openstackImageClient interface {
+	// FindImage returns the newest image with the given name
+	FindImage(ctx context.Context, name string) (*images.Image, error)
+	// ListImages returns all images with the given tag
+	ListImages(ctx context.Context, tag string) ([]images.Image, error)
+	UpdateImage(ctx context.Context, id string, opts images.UpdateOpts) error
+	DeleteImage(ctx context.Context, id string) error
+}
+
+// openstackNewImageClient is mocked in tests
+var openstackNewImageClient = func() (openstackImageClient, error) {
+	opts, err := ostack.AuthOptionsFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read OpenStack environment: %w", err)
+	}
+	// see the openstack uploader of the images library
+	if opts.DomainName == "" {
+		opts.DomainName = os.Getenv("OS_USER_DOMAIN_NAME")
+	}
+	provider, err := ostack.AuthenticatedClient(context.Background(), opts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot authenticate to OpenStack: %w", err)
+	}
+	client, err := ostack.NewImageV2(provider, gophercloud.EndpointOpts{
+		Region: os.Getenv("OS_REGION_NAME"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create an image client: %w", err)
+	}
+	return &glanceClient{client: client}, nil
+}
+
+type glanceClient struct {
+	client *gophercloud.ServiceClient
+}
+
+func (gc *glanceClient) listImages(ctx context.Context, opts images.ListOpts) ([]images.Image, error) {
+	page, err := images.List(gc.client, opts).AllPages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list images: %w", err)
+	}
+	found, err := images.ExtractImages(page)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list images: %w", err)
+	}
+	return found, nil
+}
+
+func (gc *glanceClient) FindImage(ctx context.Context, name string) (*images.Image, error) {
+	found, err := gc.listImages(ctx, images.ListOpts{Name: name, Sort: "created_at:desc", Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("cannot find image %q", name)
+	}
+	return &found[0], nil
+}
+
+func (gc *glanceClient) ListImages(ctx context.Context, tag string) ([]images.Image, error) {
+	return gc.listImages(ctx, images.ListOpts{Tags: []string{tag}})
+}
+
+func (gc *glanceClient) UpdateImage(ctx context.Context, id string, opts images.UpdateOpts) error {
+	return images.Update(ctx, gc.client, id, opts).Err
+}
+
+func (gc *glanceClient) DeleteImage(ctx context.Context, id string) error {
+	return images.Delete(ctx, gc.client, id).Err
+}
+
+// openstackUploader looks up the uploaded image in glance after the
+// upload of the images library uploader, glance knows the checksum
+// of the image data and the image gets tagged for "cloud list"
+type openstackUploader struct {
+	cloud.Uploader
+	imageName  string
+	diskFormat string
+	tags       []cloudImageTag
+
+	image *images.Image
+}
+
+func (ou *openstackUploader) UploadAndRegister(r io.Reader, uploadSize uint64, status io.Writer) error {
+	if err := ou.Uploader.UploadAndRegister(r, uploadSize, status); err != nil {
+		ou.deleteIncompleteImage(status)
+		return err
+	}
+	client, err := openstackNewImageClient()
+	if err != nil {
+		return registeredUploadError(err)
+	}
+	ctx := context.Background()
+	img, err := client.FindImage(ctx, ou.imageName)
+	if err != nil {
+		return registeredUploadError(err)
+	}
+	ou.image = img
+	// glance tags are plain strings, the details go into properties
+	var opts images.UpdateOpts
+	if !slices.Contains(img.Tags, cloudCreatedByValue) {
+		newTags := append(slices.Clone(img.Tags), cloudCreatedByValue)
+		opts = append(opts, images.ReplaceImageTags{NewTags: newTags})
+	}
+	for _, tag := range ou.tags {
+		if tag.name == cloudTagCreatedBy {
+			continue
+		}
+		opts = append(opts, images.UpdateImageProperty{Op: images.AddOp, Name: tag.name, Value: tag.value})
+	}
+	if err := client.UpdateImage(ctx, img.ID, opts); err != nil {
+		return registeredUploadError(fmt.Errorf("cannot tag image %s: %w", img.ID, err))
+	}
+	return nil
+}
+
+// deleteIncompleteImage deletes the image that a failed upload left
+// behind without data, the upload is not retried as every attempt
+// creates a new image
+func (ou *openstackUploader) deleteIncompleteImage(status io.Writer) {
+	client, err := openstackNewImageClient()
+	if err != nil {
+		fmt.Fprintf(status, "WARNING: cannot look for the incomplete image %q: %v\n", ou.imageName, err)
+		return
+	}
+	ctx := context.Background()
+	img, err := client.FindImage(ctx, ou.imageName)
+	if err != nil || img.Status == images.ImageStatusActive {
+		// the upload failed before the image was created
+		return
+	}
+	if err := client.DeleteImage(ctx, img.ID); err != nil {
+		fmt.Fprintf(status, "WARNING: cannot delete the incomplete image %s: %v\n", img.ID, err)
+		return
+	}
+	fmt.Fprintf(status, "Deleted the incomplete image %s\n", img.ID)
+}
+
+// acceptsImageFormat implements imageFormatUploader, the data must be
+// in the disk format that glance is told about
+func (ou *openstackUploader) acceptsImageFormat(f imageFormat) bool {
+	switch ou.diskFormat {
+	case "raw", "qcow2", "vmdk":
+		return f == imageFormat(ou.diskFormat)
+	default:
+		return !f.compressed()
+	}
+}
+
+func (ou *openstackUploader) verifyUpload(size uint64, sums *uploadChecksums, status io.Writer) error {
+	img := ou.image
+	if img.SizeBytes != int64(size) {
+		return fmt.Errorf("image %s has %d bytes instead of %d", img.ID, img.SizeBytes, size)
+	}
+	if img.Checksum != hex.EncodeToString(sums.MD5) {
+		return fmt.Errorf("image %s has checksum %s instead of %x", img.ID, img.Checksum, sums.MD5)
+	}
+	fmt.Fprintf(status, "Created image %s (ID: %s)\n", img.Name, img.ID)
+	return nil
+}
+
+func (ou *openstackUploader) remoteID() string {
+	if ou.image == nil {
+		return ""
+	}
+	return ou.image.ID
+}
+
+// openstackImageManager implements "cloud list" and "cloud delete"
+// for glance, glance images have no separate snapshots
+type openstackImageManager struct {
+	client openstackImageClient
+}
+
+func (om *openstackImageManager) listImages(ctx context.Context) ([]cloudImage, error) {
+	found, err := om.client.ListImages(ctx, cloudCreatedByValue)
+	if err != nil {
+		return nil, err
+	}
+	var result []cloudImage
+	for _, img := range found {
+		prop := func(name string) string {
+			s, _ := img.Properties[name].(string)
+			return s
+		}
+		result = append(result, cloudImage{
+			ID:        img.ID,
+			Name:      img.Name,
+			Created:   img.CreatedAt,
+			Distro:    prop(cloudTagDistro),
+			Arch:      prop(cloudTagArch),
+			ImageType: prop(cloudTagImageType),
+		})
+	}
+	return result, nil
+}
+
+func (om *openstackImageManager) deleteImage(ctx context.Context, img *cloudImage, status io.Writer) error {
+	return om.client.DeleteImage(ctx, img.ID)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// qcow2 header fields, see docs/interop/qcow2.txt in qemu
+type qcow2Header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+	// version 3 only
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+	CompressionType      uint8
+}
+
+const (
+	qcow2IncompatDirty        = 1 << 0
+	qcow2IncompatCompression  = 1 << 3
+	qcow2IncompatKnownFeature = qcow2IncompatDirty | qcow2IncompatCompression
+
+	qcow2CompressionZlib = 0
+	qcow2CompressionZstd = 1
+
+	qcow2OffsetMask     = 0x00fffffffffffe00
+	qcow2L2Compressed   = 1 << 62
+	qcow2L2ZeroCluster  = 1 << 0
+	qcow2MaxClusterBits = 21
+)
+
+// newQcow2RawReader returns a reader for the raw disk of a qcow2 image,
+// images with a backing file or encryption are not supported
+func newQcow2RawReader(r io.ReaderAt) (*rawImageReader, error) {
+	var hdr qcow2Header
+	buf := make([]byte, binary.Size(hdr))
+	if _, err := r.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("cannot read qcow2 header: %w", err)
+	}
+	if _, err := binary.Decode(buf, binary.BigEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("cannot read qcow2 header: %w", err)
+	}
+	switch hdr.Version {
+	case 2:
+		hdr.IncompatibleFeatures = 0
+		hdr.CompressionType = qcow2CompressionZlib
+	case 3:
+		if hdr.HeaderLength <= 104 {
+			hdr.CompressionType = qcow2CompressionZlib
+		}
+	default:
+		return nil, fmt.Errorf("unsupported qcow2 version %d", hdr.Version)
+	}
+	if hdr.BackingFileOffset != 0 {
+		return nil, fmt.Errorf("qcow2 images with a backing file are not supported")
+	}
+	if hdr.CryptMethod != 0 {
+		return nil, fmt.Errorf("encrypted qcow2 images are not supported")
+	}
+	if unknown := hdr.IncompatibleFeatures &^ qcow2IncompatKnownFeature; unknown != 0 {
+		return nil, fmt.Errorf("unsupported qcow2 features 0x%x", unknown)
+	}
+	if hdr.ClusterBits < 9 || hdr.ClusterBits > qcow2MaxClusterBits {
+		return nil, fmt.Errorf("invalid qcow2 cluster size 2^%d", hdr.ClusterBits)
+	}
+	if hdr.CompressionType != qcow2CompressionZlib && hdr.CompressionType != qcow2CompressionZstd {
+		return nil, fmt.Errorf("unsupported qcow2 compression type %d", hdr.CompressionType)
+	}
+
+	clusterSize := uint64(1) << hdr.ClusterBits
+	l2Entries := clusterSize / 8
+	if needed := (hdr.Size + clusterSize*l2Entries - 1) / (clusterSize * l2Entries); uint64(hdr.L1Size) < needed {
+		return nil, fmt.Errorf("qcow2 L1 table has %d entries, need %d", hdr.L1Size, needed)
+	}
+	l1, err := readBigEndianTable(r, hdr.L1TableOffset, uint64(hdr.L1Size))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read qcow2 L1 table: %w", err)
+	}
+
+	qr := &qcow2Reader{r: r, hdr: &hdr, clusterSize: clusterSize, l1: l1}
+	return &rawImageReader{
+		size:      hdr.Size,
+		blockSize: clusterSize,
+		readBlock: qr.readCluster,
+		release:   qr.release,
+	}, nil
+}
+
+type qcow2Reader struct {
+	r           io.ReaderAt
+	hdr         *qcow2Header
+	clusterSize uint64
+	l1          []uint64
+
+	// the last used L2 table
+	l2       []uint64
+	l2Offset uint64
+	// zr is created for the first zstd compressed cluster
+	zr *zstd.Decoder
+}
+
+func (qr *qcow2Reader) readCluster(idx uint64, buf []byte) error {
+	l2Entries := qr.clusterSize / 8
+	l2Offset := qr.l1[idx/l2Entries] & qcow2OffsetMask
+	if l2Offset == 0 {
+		// no L2 table, all clusters read as zeros
+		return nil
+	}
+	if qr.l2 == nil || l2Offset != qr.l2Offset {
+		l2, err := readBigEndianTable(qr.r, l2Offset, l2Entries)
+		if err != nil {
+			return fmt.Errorf("cannot read qcow2 L2 table: %w", err)
+		}
+		qr.l2 = l2
+		qr.l2Offset = l2Offset
+	}
+
+	entry := qr.l2[idx%l2Entries]
+	if entry&qcow2L2Compressed != 0 {
+		return qr.readCompressedCluster(entry, buf)
+	}
+	offset := entry & qcow2OffsetMask
+	if offset == 0 || entry&qcow2L2ZeroCluster != 0 {
+		return nil
+	}
+	if _, err := qr.r.ReadAt(buf, int64(offset)); err != nil {
+		return fmt.Errorf("cannot read qcow2 cluster %d: %w", idx, err)
+	}
+	return nil
+}
+
+// release closes the zstd decoder, its goroutines would leak otherwise
+func (qr *qcow2Reader) release() {
+	if qr.zr != nil {
+		qr.zr.Close()
+		qr.zr = nil
+	}
+}
+
+func (qr *qcow2Reader) readCompressedCluster(entry uint64, buf []byte) error {
+	x := 62 - (qr.hdr.ClusterBits - 8)
+	offset := entry & (1<<x - 1)
+	sectors := (entry>>x)&(1<<(62-x)-1) + 1
+	compressed := make([]byte, sectors*512-offset%512)
+	// the last compressed cluster can end before the last sector
+	if n, err := qr.r.ReadAt(compressed, int64(offset)); err != nil && (err != io.EOF || n == 0) {
+		return fmt.Errorf("cannot read compressed qcow2 cluster: %w", err)
+	}
+
+	var dr io.Reader
+	switch qr.hdr.CompressionType {
+	case qcow2CompressionZstd:
+		if qr.zr == nil {
+			zr, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return err
+			}
+			qr.zr = zr
+		}
+		if err := qr.zr.Reset(bytes.NewReader(compressed)); err != nil {
+			return fmt.Errorf("cannot decompress qcow2 cluster: %w", err)
+		}
+		dr = qr.zr
+	default:
+		// raw deflate without the zlib header
+		dr = flate.NewReader(bytes.NewReader(compressed))
+	}
+	if _, err := io.ReadFull(dr, buf); err != nil {
+		return fmt.Errorf("cannot decompress qcow2 cluster: %w", err)
+	}
+	return nil
+}
+
+// readBigEndianTable reads a table of n 64 bit big endian entries
+func readBigEndianTable(r io.ReaderAt, offset, n uint64) ([]uint64, error) {
+	buf := make([]byte, n*8)
+	if _, err := r.ReadAt(buf, int64(offset)); err != nil {
+		return nil, err
+	}
+	table := make([]uint64, n)
+	for i := range table {
+		table[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	return table, nil
+}
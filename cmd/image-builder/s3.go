@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3PartSize is the size of the parts of the multipart upload, S3
+// needs at least 5 MiB for all but the last part. Mocked in tests.
+var s3PartSize int64 = 64 * 1024 * 1024
+
+// s3MaxParts is the maximum number of parts of a multipart upload
+const s3MaxParts = 10000
+
+// s3MaxAttempts is how often a request is tried before giving up
+const s3MaxAttempts = 5
+
+type s3UploaderOptions struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	KeyPrefix string
+	PathStyle bool
+	// CACert is the path to a PEM file with the CA certificates
+	// that are trusted for the endpoint (instead of the system ones)
+	CACert string
+	// static credentials, the default credential chain of the AWS
+	// SDK is used if AccessKeyID is unset
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// s3Uploader uploads an artifact into a bucket of an S3 compatible
+// object storage (e.g. MinIO or Ceph RGW). The multipart upload is
+// resumed if an upload of the same key was interrupted before.
+type s3Uploader struct {
+	client *s3.Client
+	opts   s3UploaderOptions
+
+	filename string
+	metadata map[string]string
+
+	// etag is the expected ETag of the uploaded object
+	etag string
+}
+
+func newS3Uploader(opts *s3UploaderOptions) (*s3Uploader, error) {
+	loadOpts := []func(*config.LoadOptions) error{
+		config.WithRegion(opts.Region),
+		config.WithRetryer(func() aws.Retryer {
+			return retry.AddWithMaxAttempts(retry.NewStandard(), s3MaxAttempts)
+		}),
+		// S3 compatible storages do not necessarily support the
+		// checksums that the AWS SDK sends by default
+		config.WithRequestChecksumCalculation(aws.RequestChecksumCalculationWhenRequired),
+		config.WithResponseChecksumValidation(aws.ResponseChecksumValidationWhenRequired),
+	}
+	if opts.CACert != "" {
+		pem, err := os.ReadFile(opts.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA certificates: %w", err)
+		}
+		loadOpts = append(loadOpts, config.WithCustomCABundle(bytes.NewReader(pem)))
+	}
+	if opts.AccessKeyID != "" {
+		loadOpts = append(loadOpts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(opts.AccessKeyID, opts.SecretAccessKey, opts.SessionToken)))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load s3 configuration: %w", err)
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.BaseEndpoint = aws.String(opts.Endpoint)
+		o.UsePathStyle = opts.PathStyle
+	})
+	return &s3Uploader{client: client, opts: *opts}, nil
+}
+
+// setArtifact implements artifactUploader, the metadata of the
+// artifact is stored as object metadata
+func (su *s3Uploader) setArtifact(imagePath string, md *artifactMetadata) {
+	su.filename = filepath.Base(imagePath)
+	su.metadata = nil
+	if md == nil {
+		return
+	}
+	su.metadata = make(map[string]string)
+	for key, val := range map[string]string{
+		"distro":     md.Distro,
+		"arch":       md.Arch,
+		"image-type": md.ImageType,
+	} {
+		if val != "" {
+			su.metadata[key] = val
+		}
+	}
+}
+
+func (su *s3Uploader) key() string {
+	return su.opts.KeyPrefix + su.filename
+}
+
+func (su *s3Uploader) Check(status io.Writer) error {
+	fmt.Fprintf(status, "Checking S3 bucket %q\n", su.opts.Bucket)
+	if _, err := su.client.HeadBucket(context.Background(), &s3.HeadBucketInput{
+		Bucket: aws.String(su.opts.Bucket),
+	}); err != nil {
+		return fmt.Errorf("cannot access bucket %q: %w", su.opts.Bucket, err)
+	}
+	return nil
+}
+
+// findUpload returns the id and the already uploaded parts of the
+// latest unfinished multipart upload for key (if any)
+func (su *s3Uploader) findUpload(ctx context.Context, key string) (string, map[int32]types.Part, error) {
+	var latest *types.MultipartUpload
+	uploads := s3.NewListMultipartUploadsPaginator(su.client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(su.opts.Bucket),
+		Prefix: aws.String(key),
+	})
+	for uploads.HasMorePages() {
+		page, err := uploads.NextPage(ctx)
+		if err != nil {
+			return "", nil, fmt.Errorf("cannot list multipart uploads: %w", err)
+		}
+		for _, upload := range page.Uploads {
+			if aws.ToString(upload.Key) != key {
+				continue
+			}
+			if latest == nil || aws.ToTime(upload.Initiated).After(aws.ToTime(latest.Initiated)) {
+				latest = &upload
+			}
+		}
+	}
+	if latest == nil {
+		return "", nil, nil
+	}
+
+	done := make(map[int32]types.Part)
+	parts := s3.NewListPartsPaginator(su.client, &s3.ListPartsInput{
+		Bucket:   aws.String(su.opts.Bucket),
+		Key:      aws.String(key),
+		UploadId: latest.UploadId,
+	})
+	for parts.HasMorePages() {
+		page, err := parts.NextPage(ctx)
+		if err != nil {
+			return "", nil, fmt.Errorf("cannot list parts of multipart upload: %w", err)
+		}
+		for _, part := range page.Parts {
+			done[aws.ToInt32(part.PartNumber)] = part
+		}
+	}
+	return aws.ToString(latest.UploadId), done, nil
+}
+
+func (su *s3Uploader) UploadAndRegister(r io.Reader, uploadSize uint64, status io.Writer) error {
+	ctx := context.Background()
+	if su.filename == "" {
+		return permanentUploadErrorf("cannot upload to s3: missing artifact filename")
+	}
+	key := su.key()
+	uploadID, done, err := su.findUpload(ctx, key)
+	if err != nil {
+		return err
+	}
+	if uploadID == "" {
+		fmt.Fprintf(status, "Uploading %s to s3://%s/%s\n", su.filename, su.opts.Bucket, key)
+		out, err := su.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:   aws.String(su.opts.Bucket),
+			Key:      aws.String(key),
+			Metadata: su.metadata,
+		})
+		if err != nil {
+			return fmt.Errorf("cannot start multipart upload: %w", err)
+		}
+		uploadID = aws.ToString(out.UploadId)
+	} else {
+		fmt.Fprintf(status, "Resuming upload of %s to s3://%s/%s (%d parts done)\n", su.filename, su.opts.Bucket, key, len(done))
+	}
+
+	// the part size only depends on the upload size so that the
+	// parts of an interrupted upload can be reused
+	partSize := max(s3PartSize, (int64(uploadSize)+s3MaxParts-1)/s3MaxParts)
+	buf := make([]byte, partSize)
+	var completed []types.CompletedPart
+	// the ETag of a multipart upload is the md5 of the md5s
+	// of all parts
+	partSums := md5.New()
+	for partNumber := int32(1); ; partNumber++ {
+		n, err := io.ReadFull(r, buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("cannot read the image: %w", err)
+		}
+		chunk := buf[:n]
+		sum := md5.Sum(chunk)
+		partSums.Write(sum[:])
+		etag := fmt.Sprintf(`"%x"`, sum)
+		if part, ok := done[partNumber]; ok && aws.ToInt64(part.Size) == int64(n) && aws.ToString(part.ETag) == etag {
+			completed = append(completed, types.CompletedPart{ETag: part.ETag, PartNumber: aws.Int32(partNumber)})
+			continue
+		}
+		out, err := su.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(su.opts.Bucket),
+			Key:           aws.String(key),
+			UploadId:      aws.String(uploadID),
+			PartNumber:    aws.Int32(partNumber),
+			Body:          bytes.NewReader(chunk),
+			ContentLength: aws.Int64(int64(n)),
+		})
+		if err != nil {
+			return fmt.Errorf("cannot upload part %d (run the upload again to resume): %w", partNumber, err)
+		}
+		completed = append(completed, types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(partNumber)})
+		if int64(n) < partSize {
+			break
+		}
+	}
+
+	if _, err := su.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(su.opts.Bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	}); err != nil {
+		return fmt.Errorf("cannot complete multipart upload (run the upload again to resume): %w", err)
+	}
+	su.etag = fmt.Sprintf(`"%x-%d"`, partSums.Sum(nil), len(completed))
+	return nil
+}
+
+// retryable implements retryableUploader, a retry resumes the
+// multipart upload with the parts that are already uploaded
+func (su *s3Uploader) retryable() bool {
+	return true
+}
+
+func (su *s3Uploader) verifyUpload(size uint64, sums *uploadChecksums, status io.Writer) error {
+	fmt.Fprintf(status, "Verifying s3://%s/%s\n", su.opts.Bucket, su.key())
+	out, err := su.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(su.opts.Bucket),
+		Key:    aws.String(su.key()),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot get object %q: %w", su.key(), err)
+	}
+	if aws.ToInt64(out.ContentLength) != int64(size) {
+		return fmt.Errorf("object %q has %d bytes instead of %d", su.key(), aws.ToInt64(out.ContentLength), size)
+	}
+	if aws.ToString(out.ETag) != su.etag {
+		return fmt.Errorf("object %q has ETag %s instead of %s", su.key(), aws.ToString(out.ETag), su.etag)
+	}
+	return nil
+}
+
+func (su *s3Uploader) remoteID() string {
+	return fmt.Sprintf("s3://%s/%s", su.opts.Bucket, su.key())
+}
@@ -0,0 +1,396 @@
+package main_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+)
+
+type fakeS3Upload struct {
+	key      string
+	metadata map[string]string
+	parts    map[int][]byte
+}
+
+// fakeS3 is a minimal stand-in for an S3 compatible object storage
+// with path-style URLs, it only supports multipart uploads
+type fakeS3 struct {
+	mu       sync.Mutex
+	buckets  map[string]bool
+	objects  map[string][]byte
+	etags    map[string]string
+	metadata map[string]map[string]string
+	uploads  map[string]*fakeS3Upload
+	partPuts int
+	// failPart makes the upload of the given part fail with the
+	// given status code (once)
+	failPart   map[int]int
+	nextUpload int
+	// badETag makes the object report a wrong ETag
+	badETag bool
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	fs := &fakeS3{
+		buckets:  map[string]bool{"my-bucket": true},
+		objects:  make(map[string][]byte),
+		etags:    make(map[string]string),
+		metadata: make(map[string]map[string]string),
+		uploads:  make(map[string]*fakeS3Upload),
+		failPart: make(map[int]int),
+	}
+	srv := httptest.NewTLSServer(fs)
+	t.Cleanup(srv.Close)
+	return fs, srv
+}
+
+func (fs *fakeS3) reply(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		panic(err)
+	}
+}
+
+func (fs *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+type fakeS3Part struct {
+	PartNumber int
+	ETag       string
+	Size       int `xml:",omitempty"`
+}
+
+func (fs *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") {
+		fs.fail(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := parts[0]
+	if !fs.buckets[bucket] {
+		fs.fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodHead && len(parts) == 1:
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodHead && len(parts) == 2:
+		obj, ok := fs.objects[bucket+"/"+parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj)))
+		etag := fs.etags[bucket+"/"+parts[1]]
+		if fs.badETag {
+			etag = `"bad-etag"`
+		}
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet && len(parts) == 1 && q.Has("uploads"):
+		type upload struct {
+			Key       string
+			UploadId  string
+			Initiated string
+		}
+		var res struct {
+			XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+			Bucket      string
+			IsTruncated bool
+			Upload      []upload
+		}
+		res.Bucket = bucket
+		for id, u := range fs.uploads {
+			if strings.HasPrefix(u.key, q.Get("prefix")) {
+				res.Upload = append(res.Upload, upload{Key: u.key, UploadId: id, Initiated: "2026-10-17T10:00:00.000Z"})
+			}
+		}
+		fs.reply(w, res)
+	case r.Method == http.MethodPost && len(parts) == 2 && q.Has("uploads"):
+		fs.nextUpload++
+		id := fmt.Sprintf("upload-%d", fs.nextUpload)
+		u := &fakeS3Upload{key: parts[1], metadata: make(map[string]string), parts: make(map[int][]byte)}
+		for name, val := range r.Header {
+			if key, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); ok {
+				u.metadata[key] = val[0]
+			}
+		}
+		fs.uploads[id] = u
+		fs.reply(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: parts[1], UploadId: id})
+	case r.Method == http.MethodPut && len(parts) == 2 && q.Has("partNumber"):
+		u, ok := fs.uploads[q.Get("uploadId")]
+		if !ok {
+			fs.fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		partNumber, _ := strconv.Atoi(q.Get("partNumber"))
+		if status := fs.failPart[partNumber]; status != 0 {
+			delete(fs.failPart, partNumber)
+			fs.fail(w, status, "InjectedFailure")
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		u.parts[partNumber] = body
+		fs.partPuts++
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+	case r.Method == http.MethodGet && len(parts) == 2 && q.Has("uploadId"):
+		u, ok := fs.uploads[q.Get("uploadId")]
+		if !ok {
+			fs.fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var res struct {
+			XMLName     xml.Name `xml:"ListPartsResult"`
+			IsTruncated bool
+			Part        []fakeS3Part
+		}
+		for n, body := range u.parts {
+			res.Part = append(res.Part, fakeS3Part{PartNumber: n, ETag: fmt.Sprintf(`"%x"`, md5.Sum(body)), Size: len(body)})
+		}
+		sort.Slice(res.Part, func(i, j int) bool { return res.Part[i].PartNumber < res.Part[j].PartNumber })
+		fs.reply(w, res)
+	case r.Method == http.MethodPost && len(parts) == 2 && q.Has("uploadId"):
+		u, ok := fs.uploads[q.Get("uploadId")]
+		if !ok {
+			fs.fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var req struct {
+			Part []fakeS3Part
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			fs.fail(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var obj []byte
+		partSums := md5.New()
+		for i, part := range req.Part {
+			body := u.parts[part.PartNumber]
+			if part.PartNumber != i+1 || body == nil || part.ETag != fmt.Sprintf(`"%x"`, md5.Sum(body)) {
+				fs.fail(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			obj = append(obj, body...)
+			sum := md5.Sum(body)
+			partSums.Write(sum[:])
+		}
+		fs.objects[bucket+"/"+u.key] = obj
+		fs.etags[bucket+"/"+u.key] = fmt.Sprintf(`"%x-%d"`, partSums.Sum(nil), len(req.Part))
+		fs.metadata[bucket+"/"+u.key] = u.metadata
+		delete(fs.uploads, q.Get("uploadId"))
+		fs.reply(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+		}{Bucket: bucket, Key: u.key})
+	default:
+		fs.fail(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func mockS3(t *testing.T) (*fakeS3, []string) {
+	fs, srv := newFakeS3(t)
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caPath, caPEM, 0644))
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "no-config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "no-credentials"))
+	restore := main.MockS3PartSize(4)
+	t.Cleanup(restore)
+
+	return fs, []string{
+		"--to=s3",
+		"--s3-endpoint", srv.URL,
+		"--s3-ca-cert", caPath,
+		"--s3-path-style",
+		"--s3-bucket", "my-bucket",
+		"--s3-key-prefix", "images/",
+	}
+}
+
+func makeTestS3Image(t *testing.T) string {
+	tmpdir := t.TempDir()
+	imagePath := filepath.Join(tmpdir, "centos-9-minimal-raw-x86_64.raw")
+	require.NoError(t, os.WriteFile(imagePath, []byte("0123456789"), 0644))
+	md := `{"distro": "centos-9", "image-type": "minimal-raw", "arch": "x86_64", "filename": "centos-9-minimal-raw-x86_64.raw"}`
+	require.NoError(t, os.WriteFile(filepath.Join(tmpdir, "centos-9-minimal-raw-x86_64.json"), []byte(md), 0644))
+	return imagePath
+}
+
+func TestUploadS3(t *testing.T) {
+	fs, args := mockS3(t)
+	imagePath := makeTestS3Image(t)
+	// transient errors are retried
+	fs.failPart[2] = http.StatusServiceUnavailable
+
+	var fakeStdout bytes.Buffer
+	restore := main.MockOsStdout(&fakeStdout)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+	restore = main.MockOsArgs(append(append([]string{"upload"}, args...), imagePath))
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	key := "my-bucket/images/centos-9-minimal-raw-x86_64.raw"
+	assert.Equal(t, []byte("0123456789"), fs.objects[key])
+	assert.Equal(t, map[string]string{"distro": "centos-9", "arch": "x86_64", "image-type": "minimal-raw"}, fs.metadata[key])
+	assert.Equal(t, 3, fs.partPuts)
+	assert.Empty(t, fs.uploads)
+	assert.Contains(t, fakeStdout.String(), "100.00%")
+}
+
+func TestUploadS3Resume(t *testing.T) {
+	fs, args := mockS3(t)
+	imagePath := makeTestS3Image(t)
+	fs.failPart[2] = http.StatusBadRequest
+
+	var fakeStderr bytes.Buffer
+	restore := main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(&fakeStderr)
+	defer restore()
+	restore = main.MockOsArgs(append(append([]string{"upload", "--upload-retries=0"}, args...), imagePath))
+	defer restore()
+
+	err := main.Run()
+	assert.ErrorContains(t, err, "cannot upload part 2 (run the upload again to resume)")
+	assert.Equal(t, 1, fs.partPuts)
+	assert.Len(t, fs.uploads, 1)
+
+	// the second run only uploads the missing parts
+	err = main.Run()
+	require.NoError(t, err)
+	assert.Contains(t, fakeStderr.String(), "Resuming upload of centos-9-minimal-raw-x86_64.raw to s3://my-bucket/images/centos-9-minimal-raw-x86_64.raw (1 parts done)\n")
+	assert.Equal(t, []byte("0123456789"), fs.objects["my-bucket/images/centos-9-minimal-raw-x86_64.raw"])
+	assert.Equal(t, 3, fs.partPuts)
+	assert.Empty(t, fs.uploads)
+}
+
+func TestUploadS3RetryResumes(t *testing.T) {
+	fs, args := mockS3(t)
+	imagePath := makeTestS3Image(t)
+	fs.failPart[2] = http.StatusBadRequest
+	var sleeps []time.Duration
+	restore := main.MockUploadRetrySleep(func(d time.Duration) { sleeps = append(sleeps, d) })
+	defer restore()
+
+	var fakeStderr bytes.Buffer
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(&fakeStderr)
+	defer restore()
+	resultPath := filepath.Join(t.TempDir(), "result.json")
+	restore = main.MockOsArgs(append(append([]string{"upload", "--upload-result", resultPath}, args...), imagePath))
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	assert.Equal(t, []time.Duration{10 * time.Second}, sleeps)
+	assert.Contains(t, fakeStderr.String(), "WARNING: upload to s3 failed (attempt 1 of 4): cannot upload part 2 (run the upload again to resume)")
+	assert.Contains(t, fakeStderr.String(), "Resuming upload of centos-9-minimal-raw-x86_64.raw to s3://my-bucket/images/centos-9-minimal-raw-x86_64.raw (1 parts done)\n")
+	assert.Equal(t, []byte("0123456789"), fs.objects["my-bucket/images/centos-9-minimal-raw-x86_64.raw"])
+	assert.Equal(t, 3, fs.partPuts)
+
+	var results []map[string]any
+	content, err := os.ReadFile(resultPath)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(content, &results))
+	assert.Equal(t, []map[string]any{
+		{
+			"target":    "s3",
+			"image":     "centos-9-minimal-raw-x86_64.raw",
+			"size":      float64(10),
+			"sha256":    "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882",
+			"remote_id": "s3://my-bucket/images/centos-9-minimal-raw-x86_64.raw",
+			"verified":  true,
+			"attempts":  float64(2),
+		},
+	}, results)
+}
+
+func TestUploadS3VerifyFails(t *testing.T) {
+	fs, args := mockS3(t)
+	imagePath := makeTestS3Image(t)
+	fs.badETag = true
+
+	restore := main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+	restore = main.MockOsArgs(append(append([]string{"upload", "--upload-retries=0"}, args...), imagePath))
+	defer restore()
+
+	err := main.Run()
+	assert.ErrorContains(t, err, `cannot verify upload: object "images/centos-9-minimal-raw-x86_64.raw" has ETag "bad-etag" instead of "`)
+}
+
+func TestUploadS3Errors(t *testing.T) {
+	_, args := mockS3(t)
+	imagePath := makeTestS3Image(t)
+	restore := main.MockUploadRetrySleep(func(time.Duration) {})
+	defer restore()
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+
+	for _, tc := range []struct {
+		cmdline     []string
+		expectedErr string
+	}{
+		{
+			[]string{"--to=s3"},
+			`missing all upload configuration: ["--s3-endpoint" "--s3-bucket"]`,
+		}, {
+			[]string{"--to=s3", "--s3-bucket=b"},
+			`missing upload configuration: ["--s3-endpoint"]`,
+		}, {
+			append(args, "--s3-bucket=other-bucket"),
+			`cannot list multipart uploads: operation error S3: ListMultipartUploads, https response error StatusCode: 404`,
+		},
+	} {
+		t.Run(strings.Join(tc.cmdline, ","), func(t *testing.T) {
+			restore := main.MockOsArgs(append(append([]string{"upload"}, tc.cmdline...), imagePath))
+			defer restore()
+
+			err := main.Run()
+			assert.ErrorContains(t, err, tc.expectedErr)
+		})
+	}
+}
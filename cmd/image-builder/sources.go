@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// sourceItem is a single item (e.g. an rpm or a container) of the
+// sources of an osbuild manifest
+type sourceItem struct {
+	Source string
+	ID     string
+}
+
+func (si sourceItem) String() string {
+	return fmt.Sprintf("%s:%s", si.Source, si.ID)
+}
+
+// storePath returns the path of the item inside the osbuild store,
+// this is the same layout that the osbuild sources use. It returns
+// "" for sources that are not fetched into the store.
+func (si sourceItem) storePath(storeDir string) (string, error) {
+	sourcesDir := filepath.Join(storeDir, "sources")
+	switch si.Source {
+	case "org.osbuild.curl", "org.osbuild.librepo", "org.osbuild.inline", "org.osbuild.skopeo-index":
+		return filepath.Join(sourcesDir, "org.osbuild.files", si.ID), nil
+	case "org.osbuild.skopeo":
+		return filepath.Join(sourcesDir, "org.osbuild.containers", si.ID), nil
+	case "org.osbuild.ostree":
+		if len(si.ID) < 3 {
+			return "", fmt.Errorf("invalid ostree commit %q", si.ID)
+		}
+		return filepath.Join(sourcesDir, "org.osbuild.ostree", "repo", "objects", si.ID[:2], si.ID[2:]+".commit"), nil
+	case "org.osbuild.containers-storage":
+		// used directly from the host container storage
+		return "", nil
+	default:
+		return "", fmt.Errorf("unsupported source %q", si.Source)
+	}
+}
+
+// sourcesFromManifest returns all source items of the given osbuild
+// manifest.
+func sourcesFromManifest(mf []byte) ([]sourceItem, error) {
+	var m struct {
+		Sources map[string]struct {
+			Items map[string]json.RawMessage `json:"items"`
+		} `json:"sources"`
+	}
+	if err := json.Unmarshal(mf, &m); err != nil {
+		return nil, fmt.Errorf("cannot parse osbuild manifest: %w", err)
+	}
+	var items []sourceItem
+	for name, source := range m.Sources {
+		for id := range source.Items {
+			items = append(items, sourceItem{Source: name, ID: id})
+		}
+	}
+	slices.SortFunc(items, func(a, b sourceItem) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	return items, nil
+}
+
+// missingSources returns the items that are not in the given osbuild
+// store yet.
+func missingSources(storeDir string, items []sourceItem) ([]sourceItem, error) {
+	var missing []sourceItem
+	for _, item := range items {
+		p, err := item.storePath(storeDir)
+		if err != nil {
+			return nil, err
+		}
+		if p == "" {
+			continue
+		}
+		_, err = os.Stat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, item)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+// sourcesSize returns the size of the given items in the osbuild store.
+func sourcesSize(storeDir string, items []sourceItem) (int64, error) {
+	var total int64
+	for _, item := range items {
+		p, err := item.storePath(storeDir)
+		if err != nil {
+			return 0, err
+		}
+		if p == "" {
+			continue
+		}
+		size, err := calcDirSize(p)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// exportSources copies the given items from the osbuild store into
+// exportDir with the same layout, the result can be used as the cache
+// of an offline build. Files are hardlinked if possible.
+func exportSources(storeDir, exportDir string, items []sourceItem) error {
+	ostreeRepo := filepath.Join(storeDir, "sources", "org.osbuild.ostree", "repo")
+	exported := make(map[string]bool)
+	for _, item := range items {
+		p, err := item.storePath(storeDir)
+		if err != nil {
+			return err
+		}
+		if p == "" {
+			continue
+		}
+		// an ostree commit needs all objects of the repository
+		if item.Source == "org.osbuild.ostree" {
+			p = ostreeRepo
+		}
+		if exported[p] {
+			continue
+		}
+		exported[p] = true
+		rel, err := filepath.Rel(storeDir, p)
+		if err != nil {
+			return err
+		}
+		if err := copyTree(p, filepath.Join(exportDir, rel)); err != nil {
+			return fmt.Errorf("cannot export source %s: %w", item, err)
+		}
+	}
+	return nil
+}
+
+// copyTree copies the file or directory src to dst, existing files
+// are kept as the sources are content addressed
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil && !errors.Is(err, os.ErrExist) {
+				return err
+			}
+			return nil
+		case d.Type().IsRegular():
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			return copyFile(path, target, info.Mode().Perm())
+		default:
+			return fmt.Errorf("cannot copy %q: unsupported file type %s", path, d.Type())
+		}
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return nil
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// offlineProxy refuses all connections, it is the proxy of all osbuild
+// sources (curl, librepo, skopeo, ostree) during an offline build so
+// that they cannot download anything even if a check is missing here
+const offlineProxy = "http://127.0.0.1:9"
+
+var offlineEnv = []string{
+	"http_proxy=" + offlineProxy,
+	"https_proxy=" + offlineProxy,
+	"all_proxy=" + offlineProxy,
+	"HTTP_PROXY=" + offlineProxy,
+	"HTTPS_PROXY=" + offlineProxy,
+	"ALL_PROXY=" + offlineProxy,
+	"no_proxy=",
+	"NO_PROXY=",
+}
+
+// checkOfflineSources ensures that all sources of the given manifest
+// are in the osbuild store so that osbuild does not need to download
+// anything.
+func checkOfflineSources(storeDir string, mf []byte) error {
+	items, err := sourcesFromManifest(mf)
+	if err != nil {
+		return err
+	}
+	missing, err := missingSources(storeDir, items)
+	if err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	const maxShown = 10
+	var l []string
+	for _, item := range missing[:min(len(missing), maxShown)] {
+		l = append(l, item.String())
+	}
+	if len(missing) > maxShown {
+		l = append(l, fmt.Sprintf("... and %d more", len(missing)-maxShown))
+	}
+	return fmt.Errorf("cannot build offline, %d source(s) are missing from %q:\n  %s\nHint: use \"image-builder fetch\" to download them first", len(missing), storeDir, strings.Join(l, "\n  "))
+}
+
+// formatSize returns the given size in a human readable form
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
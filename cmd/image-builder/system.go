@@ -10,6 +10,8 @@ import (
 	"strings"
 
 	"go.yaml.in/yaml/v3"
+
+	"github.com/osbuild/image-builder-cli/pkg/progress"
 )
 
 type cacheMaxSize struct {
@@ -69,6 +71,13 @@ func calcDirSize(path string) (int64, error) {
 }
 
 func readCacheMaxSize(cacheDir string) cacheMaxSize {
+	// the size set via "system cache set-max-size" wins
+	if configured, err := readConfiguredCacheMaxSize(cacheDir); err == nil && configured != 0 {
+		if configured == progress.CacheMaxSizeUnlimited {
+			configured = 0
+		}
+		return cacheMaxSize{set: true, value: configured}
+	}
 	data, err := os.ReadFile(filepath.Join(cacheDir, "cache.size"))
 	if err != nil {
 		return cacheMaxSize{}
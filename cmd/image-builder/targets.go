@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+)
+
+func defaultUploadTargetsFiles() []string {
+	return configPaths("targets.toml")
+}
+
+var uploadTargetsFiles = defaultUploadTargetsFiles
+
+// credentialSource describes where the value of a credential
+// environment variable (e.g. IBMCLOUD_API_KEY) comes from
+type credentialSource struct {
+	Env  string `toml:"env"`
+	File string `toml:"file"`
+}
+
+func (cs credentialSource) read() (string, error) {
+	switch {
+	case cs.Env != "" && cs.File != "":
+		return "", fmt.Errorf("cannot use both env and file")
+	case cs.Env != "":
+		val, ok := os.LookupEnv(cs.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", cs.Env)
+		}
+		return val, nil
+	case cs.File != "":
+		b, err := os.ReadFile(cs.File)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\n"), nil
+	default:
+		return "", fmt.Errorf("need env or file")
+	}
+}
+
+// uploadTargetCredentials are the credentials that an upload target
+// of the given type can set, the names are the environment variables
+// that are used without an upload target
+var uploadTargetCredentials = map[string][]string{
+	"azure":    {"AZURE_CLIENT_ID", "AZURE_CLIENT_SECRET", "AZURE_TENANT_ID", "AZURE_SUBSCRIPTION_ID", "AZURE_STORAGE_KEY"},
+	"ibmcloud": {"IBMCLOUD_API_KEY", "IBMCLOUD_CRN"},
+	"s3":       {"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"},
+}
+
+// uploadCredentials are the credentials of an upload target by the
+// name of the environment variable that they replace. They are given
+// to the uploaders and never put into the environment that e.g.
+// osbuild inherits.
+type uploadCredentials map[string]string
+
+// getenv returns the credential or the environment variable of the
+// same name if the upload target does not set it
+func (uc uploadCredentials) getenv(name string) string {
+	if val, ok := uc[name]; ok {
+		return val
+	}
+	return os.Getenv(name)
+}
+
+// uploadTarget is a named upload destination, e.g. "prod-aws". The
+// options are the upload flags (e.g. "aws-region") without the "--".
+type uploadTarget struct {
+	Name        string
+	Type        string
+	Options     map[string]any
+	Credentials map[string]credentialSource
+	Source      string
+
+	// secrets are the values of the Credentials
+	secrets uploadCredentials
+}
+
+// credentials returns the credentials of the upload target, it is
+// fine to call it without a target
+func (t *uploadTarget) credentials() uploadCredentials {
+	if t == nil {
+		return nil
+	}
+	return t.secrets
+}
+
+// loadUploadTargets reads all targets files, a target in a later file
+// replaces a target of the same name in an earlier file
+func loadUploadTargets() (map[string]*uploadTarget, error) {
+	targets := make(map[string]*uploadTarget)
+	for _, path := range uploadTargetsFiles() {
+		var content map[string]toml.Primitive
+		md, err := toml.DecodeFile(path, &content)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot load upload targets file %q: %w", path, err)
+		}
+		for name, prim := range content {
+			target := &uploadTarget{Name: name, Source: path}
+			var header struct {
+				Type        string                      `toml:"type"`
+				Credentials map[string]credentialSource `toml:"credentials"`
+			}
+			if err := md.PrimitiveDecode(prim, &header); err != nil {
+				return nil, fmt.Errorf("cannot use upload target %q from %q: %w", name, path, err)
+			}
+			if err := md.PrimitiveDecode(prim, &target.Options); err != nil {
+				return nil, fmt.Errorf("cannot use upload target %q from %q: %w", name, path, err)
+			}
+			if header.Type == "" {
+				return nil, fmt.Errorf("cannot use upload target %q from %q: missing type", name, path)
+			}
+			target.Type = header.Type
+			target.Credentials = header.Credentials
+			delete(target.Options, "type")
+			delete(target.Options, "credentials")
+			targets[name] = target
+		}
+	}
+	return targets, nil
+}
+
+// uploadTargetFromCmd returns the upload target that is selected via
+// the given flag (nil if unset). The options of the target become the
+// defaults of the upload flags of cmd so that the regular uploader
+// constructors can be used, explicit flags still win. The credentials
+// are read but only given to the uploader, see uploadCredentials.
+func uploadTargetFromCmd(cmd *cobra.Command, flagName string) (*uploadTarget, error) {
+	name, err := cmd.Flags().GetString(flagName)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, nil
+	}
+	targets, err := loadUploadTargets()
+	if err != nil {
+		return nil, err
+	}
+	target, ok := targets[name]
+	if !ok {
+		var names []string
+		for name := range targets {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return nil, fmt.Errorf("unknown upload target %q, available targets: %s", name, strings.Join(names, ", "))
+	}
+
+	// only the cloud specific options of "upload" can be used
+	uploadCmd := findSubcommand(cmd.Root(), "upload")
+	for key, value := range target.Options {
+		if slices.Contains([]string{"to", "target", "arch"}, key) || uploadCmd.Flags().Lookup(key) == nil {
+			return nil, fmt.Errorf("unknown option %q for upload target %q in %q", key, target.Name, target.Source)
+		}
+		if cmd.Flags().Changed(key) {
+			continue
+		}
+		if err := setFlagFromConfig(cmd, key, configValue{Value: value, Source: target.Source}); err != nil {
+			return nil, err
+		}
+	}
+	known := uploadTargetCredentials[target.Type]
+	target.secrets = make(uploadCredentials)
+	for envName, source := range target.Credentials {
+		if !slices.Contains(known, envName) {
+			if len(known) == 0 {
+				return nil, fmt.Errorf("cannot use credential %q for upload target %q in %q: targets of type %q take no credentials", envName, target.Name, target.Source, target.Type)
+			}
+			return nil, fmt.Errorf("cannot use credential %q for upload target %q in %q: targets of type %q only take %s", envName, target.Name, target.Source, target.Type, strings.Join(known, ", "))
+		}
+		val, err := source.read()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read credential %q for upload target %q: %w", envName, target.Name, err)
+		}
+		target.secrets[envName] = val
+	}
+	return target, nil
+}
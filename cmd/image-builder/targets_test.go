@@ -0,0 +1,243 @@
+package main_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/osbuild/images/pkg/arch"
+	"github.com/osbuild/images/pkg/cloud"
+	"github.com/osbuild/images/pkg/cloud/awscloud"
+	"github.com/osbuild/images/pkg/cloud/ibmcloud"
+	"github.com/osbuild/images/pkg/platform"
+	testrepos "github.com/osbuild/images/test/data/repositories"
+
+	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
+	"github.com/osbuild/image-builder-cli/internal/testutil"
+)
+
+func mockUploadTargetsFiles(t *testing.T, systemTargets, userTargets string) (systemPath, userPath string) {
+	t.Helper()
+	tmpdir := t.TempDir()
+	systemPath = filepath.Join(tmpdir, "etc", "targets.toml")
+	userPath = filepath.Join(tmpdir, "home", "targets.toml")
+	for path, content := range map[string]string{systemPath: systemTargets, userPath: userTargets} {
+		if content == "" {
+			continue
+		}
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	restore := main.MockUploadTargetsFiles(func() []string { return []string{systemPath, userPath} })
+	t.Cleanup(restore)
+	return systemPath, userPath
+}
+
+const testUploadTargets = `
+[prod-aws]
+type = "aws"
+aws-region = "eu-central-1"
+aws-bucket = "prod-bucket"
+aws-ami-name = "prod-image"
+aws-tag = ["env=prod", "team=os"]
+
+[lab-ibm]
+type = "ibmcloud"
+ibmcloud-region = "us-south"
+ibmcloud-bucket = "lab-bucket"
+ibmcloud-image-name = "lab-image"
+[lab-ibm.credentials]
+IBMCLOUD_API_KEY = { file = "%s" }
+IBMCLOUD_CRN = { env = "LAB_IBMCLOUD_CRN" }
+`
+
+func TestUploadTarget(t *testing.T) {
+	mockUploadTargetsFiles(t, `
+[prod-aws]
+type = "aws"
+aws-region = "replaced-by-user-targets"
+`, fmt.Sprintf(testUploadTargets, "unused"))
+
+	fakeImageFilePath := filepath.Join(t.TempDir(), "disk.raw")
+	require.NoError(t, os.WriteFile(fakeImageFilePath, []byte("fake-raw-img"), 0644))
+
+	fa := fakeAwsUploader{amiID: "ami-fake"}
+	mockAWSUploads(t, &fa)
+	restore := main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+
+	// explicit flags win over the target options
+	restore = main.MockOsArgs([]string{"upload", "--target", "prod-aws", "--aws-ami-name", "other-image", "--arch", "x86_64", fakeImageFilePath})
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	assert.Equal(t, "eu-central-1", fa.region)
+	assert.Equal(t, "prod-bucket", fa.bucket)
+	assert.Equal(t, "other-image", fa.ami)
+	expectedBootMode := platform.BOOT_HYBRID
+	assert.Equal(t, &awscloud.UploaderOptions{
+		TargetArch: arch.ARCH_X86_64,
+		BootMode:   &expectedBootMode,
+		Tags: []awscloud.AWSTag{
+			{Name: "env", Value: "prod"},
+			{Name: "team", Value: "os"},
+			{Name: "image-builder:created-by", Value: "image-builder"},
+			{Name: "image-builder:arch", Value: "x86_64"},
+		},
+	}, fa.opts)
+	assert.Equal(t, 1, fa.uploadAndRegisterCalls)
+}
+
+func TestUploadTargetCredentials(t *testing.T) {
+	apiKeyPath := filepath.Join(t.TempDir(), "api-key")
+	require.NoError(t, os.WriteFile(apiKeyPath, []byte("secret-api-key\n"), 0600))
+	mockUploadTargetsFiles(t, "", fmt.Sprintf(testUploadTargets, apiKeyPath))
+	// restored by t.Setenv when the test is done
+	t.Setenv("IBMCLOUD_API_KEY", "")
+	t.Setenv("IBMCLOUD_CRN", "")
+	t.Setenv("LAB_IBMCLOUD_CRN", "crn:v1:lab")
+
+	fakeImageFilePath := filepath.Join(t.TempDir(), "disk.qcow2")
+	require.NoError(t, os.WriteFile(fakeImageFilePath, []byte("fake-img"), 0644))
+
+	var region, bucket, imageName string
+	var creds *ibmcloud.Credentials
+	restore := main.MockIbmNewUploader(func(r, b, i string, c *ibmcloud.Credentials) (cloud.Uploader, error) {
+		region, bucket, imageName, creds = r, b, i, c
+		return &fakeAwsUploader{}, nil
+	})
+	defer restore()
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+	restore = main.MockOsArgs([]string{"upload", "--target=lab-ibm", "--arch=x86_64", fakeImageFilePath})
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"us-south", "lab-bucket", "lab-image"}, []string{region, bucket, imageName})
+	assert.Equal(t, "secret-api-key", creds.ApiKey)
+	assert.Equal(t, "crn:v1:lab", creds.Crn)
+	// the credentials do not leak into the environment of e.g. osbuild
+	assert.Equal(t, "", os.Getenv("IBMCLOUD_API_KEY"))
+	assert.Equal(t, "", os.Getenv("IBMCLOUD_CRN"))
+}
+
+func TestUploadTargetCredentialsS3(t *testing.T) {
+	fs, s3Args := mockS3(t)
+	imagePath := makeTestS3Image(t)
+	// the fake s3 only accepts "test-key"
+	t.Setenv("AWS_ACCESS_KEY_ID", "other-key")
+	t.Setenv("TEST_S3_ACCESS_KEY", "test-key")
+	mockUploadTargetsFiles(t, "", "[minio]\ntype = \"s3\"\n[minio.credentials]\nAWS_ACCESS_KEY_ID = { env = \"TEST_S3_ACCESS_KEY\" }\n")
+
+	restore := main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+	restore = main.MockOsArgs(append(append([]string{"upload", "--target=minio"}, s3Args...), imagePath))
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("0123456789"), fs.objects["my-bucket/images/centos-9-minimal-raw-x86_64.raw"])
+	assert.Equal(t, "other-key", os.Getenv("AWS_ACCESS_KEY_ID"))
+}
+
+func TestUploadTargetErrors(t *testing.T) {
+	for _, tc := range []struct {
+		targets     string
+		cmdline     []string
+		expectedErr string
+	}{
+		{
+			testUploadTargets,
+			[]string{"--target=no-such-target"},
+			`unknown upload target "no-such-target", available targets: lab-ibm, prod-aws`,
+		}, {
+			testUploadTargets,
+			[]string{"--target=prod-aws", "--to=libvirt"},
+			`cannot use --to=libvirt with upload target "prod-aws" of type "aws"`,
+		}, {
+			"[t]\naws-region = \"r\"",
+			[]string{"--target=t"},
+			`cannot use upload target "t" from "%s": missing type`,
+		}, {
+			"[t]\ntype = \"aws\"\nblueprint = \"bp.toml\"",
+			[]string{"--target=t"},
+			`unknown option "blueprint" for upload target "t" in "%s"`,
+		}, {
+			"[t]\ntype = \"ibmcloud\"\n[t.credentials]\nIBMCLOUD_API_KEY = { env = \"NO_SUCH_ENV_FOR_TESTING\" }",
+			[]string{"--target=t"},
+			`cannot read credential "IBMCLOUD_API_KEY" for upload target "t": environment variable "NO_SUCH_ENV_FOR_TESTING" is not set`,
+		},
+		{
+			"[t]\ntype = \"ibmcloud\"\n[t.credentials]\nLD_PRELOAD = { env = \"HOME\" }",
+			[]string{"--target=t"},
+			`cannot use credential "LD_PRELOAD" for upload target "t" in "%s": targets of type "ibmcloud" only take IBMCLOUD_API_KEY, IBMCLOUD_CRN`,
+		}, {
+			"[t]\ntype = \"aws\"\n[t.credentials]\nAWS_ACCESS_KEY_ID = { env = \"HOME\" }",
+			[]string{"--target=t"},
+			`cannot use credential "AWS_ACCESS_KEY_ID" for upload target "t" in "%s": targets of type "aws" take no credentials`,
+		},
+	} {
+		t.Run(strings.Join(tc.cmdline, ","), func(t *testing.T) {
+			_, userPath := mockUploadTargetsFiles(t, "", tc.targets)
+			restore := main.MockOsArgs(append([]string{"upload"}, append(tc.cmdline, "/path/to/some/image")...))
+			defer restore()
+
+			err := main.Run()
+			expectedErr := tc.expectedErr
+			if strings.Contains(expectedErr, "%s") {
+				expectedErr = fmt.Sprintf(expectedErr, userPath)
+			}
+			assert.EqualError(t, err, expectedErr)
+		})
+	}
+}
+
+func TestBuildUploadTarget(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+	restore = main.MockOsbuildVersion(func() (string, error) { return "999", nil })
+	defer restore()
+	restore = main.MockManifestgenDepsolver(fakeDepsolve)
+	defer restore()
+	restore = main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+	mockUploadTargetsFiles(t, "", testUploadTargets)
+
+	fa := fakeAwsUploader{amiID: "ami-fake"}
+	mockAWSUploads(t, &fa)
+	testutil.MockCommand(t, "osbuild", makeFakeOsbuildScript())
+
+	var fakeStdout bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+	restore = main.MockOsArgs([]string{
+		"build",
+		"--output-dir", t.TempDir(),
+		"--cache", t.TempDir(),
+		"--upload-target", "prod-aws",
+		"ami",
+		"--distro=centos-9",
+	})
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	assert.Equal(t, "eu-central-1", fa.region)
+	assert.Equal(t, 1, fa.checkCalls)
+	assert.Equal(t, 1, fa.uploadAndRegisterCalls)
+}
@@ -2,12 +2,19 @@ package main
 
 import (
 	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cheggaaa/pb/v3"
 	"github.com/spf13/cobra"
@@ -16,9 +23,11 @@ import (
 	"github.com/osbuild/images/pkg/arch"
 	"github.com/osbuild/images/pkg/cloud"
 	"github.com/osbuild/images/pkg/cloud/awscloud"
+	"github.com/osbuild/images/pkg/cloud/azure"
 	"github.com/osbuild/images/pkg/cloud/ibmcloud"
 	"github.com/osbuild/images/pkg/cloud/libvirt"
 	"github.com/osbuild/images/pkg/cloud/openstack"
+	"github.com/osbuild/images/pkg/datasizes"
 	"github.com/osbuild/images/pkg/platform"
 )
 
@@ -39,27 +48,424 @@ var (
 	ibmNewUploader       = ibmcloud.NewUploader
 )
 
-func uploadImageWithProgress(uploader cloud.Uploader, imagePath string) error {
-	f, err := os.Open(imagePath)
+// uploadProgressReader reports the bytes read from the underlying
+// reader to a progress reporter (e.g. the json progress)
+type uploadProgressReader struct {
+	r        io.Reader
+	reporter progress.UploadProgressReporter
+
+	done     uint64
+	total    uint64
+	reported uint64
+}
+
+func newUploadProgressReader(r io.Reader, total uint64, reporter progress.UploadProgressReporter) *uploadProgressReader {
+	reporter.SetUploadProgress(0, total)
+	return &uploadProgressReader{r: r, reporter: reporter, total: total}
+}
+
+func (u *uploadProgressReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	if n > 0 {
+		u.done += uint64(n)
+		// only report every percent to not flood the reporter
+		if u.done == u.total || u.done-u.reported >= u.total/100 {
+			u.reporter.SetUploadProgress(u.done, u.total)
+			u.reported = u.done
+		}
+	}
+	return n, err
+}
+
+// artifactUploader is implemented by uploaders that need to know
+// about the artifact, e.g. to name the uploaded object after it
+type artifactUploader interface {
+	setArtifact(imagePath string, md *artifactMetadata)
+}
+
+// openImageForUpload opens the image for the given uploader and
+// tells the uploader about the artifact if it wants to know. The image
+// is decompressed or converted if the uploader does not accept it.
+func openImageForUpload(uploader cloud.Uploader, imagePath string) (io.ReadCloser, uint64, error) {
+	var f io.ReadCloser
+	var size uint64
+	var err error
+	if fu, ok := uploader.(imageFormatUploader); ok {
+		var format imageFormat
+		f, format, size, err = openConvertedImage(imagePath, fu.acceptsImageFormat, osStderr)
+		if uf, ok := uploader.(uploadFormatUploader); ok && err == nil {
+			uf.setUploadFormat(format)
+		}
+	} else {
+		f, size, err = openImageFile(imagePath)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if au, ok := uploader.(artifactUploader); ok {
+		md, err := readArtifactMetadata(imagePath)
+		if err != nil {
+			fmt.Fprintf(osStderr, "WARNING: ignoring image metadata: %v\n", err)
+		}
+		au.setArtifact(imagePath, md)
+	}
+	return f, size, nil
+}
+
+// uploadRetrySleep is mocked in tests
+var uploadRetrySleep = time.Sleep
+
+// uploadOptions controls how failed uploads are retried
+type uploadOptions struct {
+	Retries    int
+	RetryDelay time.Duration
+}
+
+func uploadOptionsFromCmd(cmd *cobra.Command) (*uploadOptions, error) {
+	retries, err := cmd.Flags().GetInt("upload-retries")
+	if err != nil {
+		return nil, err
+	}
+	if retries < 0 {
+		return nil, fmt.Errorf("--upload-retries must not be negative, got %d", retries)
+	}
+	retryDelay, err := cmd.Flags().GetDuration("upload-retry-delay")
+	if err != nil {
+		return nil, err
+	}
+	return &uploadOptions{Retries: retries, RetryDelay: retryDelay}, nil
+}
+
+// permanentUploadError is an upload error that retrying cannot fix,
+// e.g. an image in the wrong format
+type permanentUploadError struct {
+	err error
+
+	// registered is set when the image was registered before the
+	// error (e.g. when sharing it failed), a retry would upload and
+	// register it again
+	registered bool
+}
+
+func (e *permanentUploadError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentUploadError) Unwrap() error {
+	return e.err
+}
+
+func permanentUploadErrorf(format string, a ...any) error {
+	return &permanentUploadError{err: fmt.Errorf(format, a...)}
+}
+
+// registeredUploadError returns the error of a step after the image
+// was registered, it is not retried
+func registeredUploadError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentUploadError{err: err, registered: true}
+}
+
+// retryableUploader is implemented by uploaders that can run the
+// upload again after a failed transfer, the retry resumes the upload
+// or overwrites what the failed attempt left behind. Other uploads are
+// not retried, a retry would e.g. fail on the libvirt volume that
+// already exists or create a second OpenStack image.
+type retryableUploader interface {
+	retryable() bool
+}
+
+func isRetryableUploader(uploader cloud.Uploader) bool {
+	ru, ok := uploader.(retryableUploader)
+	return ok && ru.retryable()
+}
+
+// uploadChecksums are the checksums of the data that was uploaded
+type uploadChecksums struct {
+	MD5    []byte
+	SHA256 []byte
+}
+
+// verifyingUploader is implemented by uploaders that can check the
+// uploaded data against the remote object after the upload
+type verifyingUploader interface {
+	verifyUpload(size uint64, sums *uploadChecksums, status io.Writer) error
+}
+
+// remoteIDUploader is implemented by uploaders that know the
+// identifier of the uploaded image, e.g. the AMI id
+type remoteIDUploader interface {
+	remoteID() string
+}
+
+// regionalIDUploader is implemented by uploaders that register the
+// image in more than one region, e.g. the AMI and its copies
+type regionalIDUploader interface {
+	regionalIDs() map[string]string
+}
+
+// uploadResult is the machine-readable outcome of the upload to a
+// single target, see --upload-result
+type uploadResult struct {
+	Target   string `json:"target"`
+	Image    string `json:"image"`
+	Size     uint64 `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+	RemoteID string `json:"remote_id,omitempty"`
+	// RegionalIDs are the identifiers of the image by region, e.g.
+	// of the AMI copies
+	RegionalIDs map[string]string `json:"regional_ids,omitempty"`
+	Verified    bool              `json:"verified"`
+	Attempts    int               `json:"attempts"`
+	Error       string            `json:"error,omitempty"`
+
+	err error
+}
+
+// writeUploadResults writes the results as json to the given path,
+// nothing is written if the path is empty
+func writeUploadResults(path string, results []*uploadResult) error {
+	if path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(results, "", "  ")
 	if err != nil {
 		return err
 	}
+	if err := os.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("cannot write upload result: %w", err)
+	}
+	return nil
+}
+
+// uploadWithRetries uploads the image and retries failed uploads with
+// an exponential backoff if the uploader can be retried. The wrap
+// function adds the progress reporting to the reader of every attempt.
+func uploadWithRetries(nu namedUploader, imagePath string, opts *uploadOptions, wrap func(r io.Reader, size uint64) io.Reader) *uploadResult {
+	res := &uploadResult{Target: nu.name, Image: filepath.Base(imagePath)}
+	retryable := isRetryableUploader(nu.uploader)
+	delay := opts.RetryDelay
+	for {
+		res.Attempts++
+		res.err = uploadAttempt(nu.uploader, imagePath, res, wrap)
+		var permanent *permanentUploadError
+		if res.err == nil || errors.As(res.err, &permanent) || !retryable || res.Attempts > opts.Retries {
+			break
+		}
+		fmt.Fprintf(osStderr, "WARNING: upload to %s failed (attempt %d of %d): %v\nRetrying in %s\n", nu.name, res.Attempts, opts.Retries+1, res.err, delay)
+		uploadRetrySleep(delay)
+		delay *= 2
+	}
+	if res.err != nil {
+		res.Error = res.err.Error()
+	}
+	return res
+}
+
+func uploadAttempt(uploader cloud.Uploader, imagePath string, res *uploadResult, wrap func(r io.Reader, size uint64) io.Reader) error {
+	f, size, err := openImageForUpload(uploader, imagePath)
+	if err != nil {
+		return &permanentUploadError{err: err}
+	}
 	defer f.Close()
 
-	// setup basic progress
-	st, err := f.Stat()
+	md5sum := md5.New()
+	sha256sum := sha256.New()
+	r := wrap(io.TeeReader(f, io.MultiWriter(md5sum, sha256sum)), size)
+	// only the transfer is retried, once the image is registered the
+	// result reports it even if a later step failed
+	err = uploader.UploadAndRegister(r, size, osStderr)
+	var permanent *permanentUploadError
+	if err != nil && !(errors.As(err, &permanent) && permanent.registered) {
+		return err
+	}
+	res.Size = size
+	res.SHA256 = hex.EncodeToString(sha256sum.Sum(nil))
+	if ru, ok := uploader.(remoteIDUploader); ok {
+		res.RemoteID = ru.remoteID()
+	}
+	if ru, ok := uploader.(regionalIDUploader); ok {
+		res.RegionalIDs = ru.regionalIDs()
+	}
+	if err != nil {
+		return err
+	}
+	if vu, ok := uploader.(verifyingUploader); ok {
+		sums := &uploadChecksums{MD5: md5sum.Sum(nil), SHA256: sha256sum.Sum(nil)}
+		if err := vu.verifyUpload(size, sums, osStderr); err != nil {
+			return registeredUploadError(fmt.Errorf("cannot verify upload: %w", err))
+		}
+		res.Verified = true
+	}
+	return nil
+}
+
+func uploadImageWithProgress(progressBar progress.ProgressBar, nu namedUploader, imagePath string, opts *uploadOptions) *uploadResult {
+	if reporter, ok := progressBar.(progress.UploadProgressReporter); ok {
+		return uploadWithRetries(nu, imagePath, opts, func(r io.Reader, size uint64) io.Reader {
+			return newUploadProgressReader(r, size, reporter)
+		})
+	}
+
+	// setup basic progress, every attempt gets a new bar
+	var pbar *pb.ProgressBar
+	res := uploadWithRetries(nu, imagePath, opts, func(r io.Reader, size uint64) io.Reader {
+		if pbar != nil {
+			pbar.Finish()
+		}
+		pbar = pb.New64(int64(size))
+		pbar.Set(pb.Bytes, true)
+		pbar.SetWriter(osStdout)
+		pbar.Start()
+		return pbar.NewProxyReader(r)
+	})
+	if pbar != nil {
+		pbar.Finish()
+	}
+	return res
+}
+
+// namedUploader is the uploader for one of the targets of an upload,
+// the name is the cloud (e.g. "aws") or the name of the upload target
+type namedUploader struct {
+	name     string
+	uploader cloud.Uploader
+}
+
+// uploadProgressFunc is an UploadProgressReporter for a single upload
+// of many concurrent ones
+type uploadProgressFunc func(done, total uint64)
+
+func (f uploadProgressFunc) SetUploadProgress(done, total uint64) {
+	f(done, total)
+}
+
+// multiUploadReporter reports the sum of the progress of concurrent
+// uploads to a single reporter (e.g. the json progress)
+type multiUploadReporter struct {
+	mu       sync.Mutex
+	reporter progress.UploadProgressReporter
+	done     []uint64
+	total    []uint64
+}
+
+func newMultiUploadReporter(reporter progress.UploadProgressReporter, n int) *multiUploadReporter {
+	return &multiUploadReporter{
+		reporter: reporter,
+		done:     make([]uint64, n),
+		total:    make([]uint64, n),
+	}
+}
+
+func (m *multiUploadReporter) forUpload(i int) progress.UploadProgressReporter {
+	return uploadProgressFunc(func(done, total uint64) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.done[i] = done
+		m.total[i] = total
+		var sumDone, sumTotal uint64
+		for j := range m.done {
+			sumDone += m.done[j]
+			sumTotal += m.total[j]
+		}
+		m.reporter.SetUploadProgress(sumDone, sumTotal)
+	})
+}
+
+// uploadImageToTargets uploads the image to all targets at the same
+// time, every upload gets its own progress bar. The results are in
+// the order of the uploaders.
+func uploadImageToTargets(progressBar progress.ProgressBar, uploaders []namedUploader, imagePath string, opts *uploadOptions) []*uploadResult {
+	results := make([]*uploadResult, len(uploaders))
+	wraps := make([]func(io.Reader, uint64) io.Reader, len(uploaders))
+
+	st, err := os.Stat(imagePath)
 	if err != nil {
-		return fmt.Errorf("cannot stat upload: %v", err)
+		for i, nu := range uploaders {
+			results[i] = &uploadResult{Target: nu.name, Image: filepath.Base(imagePath), Error: err.Error(), err: err}
+		}
+		return results
+	}
+	var multi *multiUploadReporter
+	if reporter, ok := progressBar.(progress.UploadProgressReporter); ok {
+		multi = newMultiUploadReporter(reporter, len(uploaders))
+	}
+	var bars []*pb.ProgressBar
+	for i, nu := range uploaders {
+		if multi != nil {
+			reporter := multi.forUpload(i)
+			wraps[i] = func(r io.Reader, size uint64) io.Reader {
+				return newUploadProgressReader(r, size, reporter)
+			}
+			continue
+		}
+		bar := pb.New64(st.Size())
+		bar.Set(pb.Bytes, true)
+		bar.Set("prefix", nu.name+" ")
+		wraps[i] = func(r io.Reader, size uint64) io.Reader {
+			// a retry starts from the beginning
+			bar.SetCurrent(0)
+			return bar.NewProxyReader(r)
+		}
+		bars = append(bars, bar)
 	}
-	size := uint64(st.Size())
-	pbar := pb.New64(st.Size())
-	pbar.Set(pb.Bytes, true)
-	pbar.SetWriter(osStdout)
-	r := pbar.NewProxyReader(f)
-	pbar.Start()
-	defer pbar.Finish()
 
-	return uploader.UploadAndRegister(r, size, osStderr)
+	var pool *pb.Pool
+	if len(bars) > 0 {
+		pool = pb.NewPool(bars...)
+		pool.Output = osStdout
+		// the pool needs a terminal, without one the final
+		// state of the bars is printed when all are done
+		if err := pool.Start(); err != nil {
+			pool = nil
+		}
+	}
+	var wg sync.WaitGroup
+	for i, nu := range uploaders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = uploadWithRetries(nu, imagePath, opts, wraps[i])
+		}()
+	}
+	wg.Wait()
+	for _, bar := range bars {
+		bar.Finish()
+	}
+	if pool != nil {
+		_ = pool.Stop()
+	} else {
+		for _, bar := range bars {
+			fmt.Fprintln(osStdout, bar.String())
+		}
+	}
+	return results
+}
+
+// reportUploadResults prints the outcome of every upload and returns
+// an error if any of them failed
+func reportUploadResults(w io.Writer, imagePath string, results []*uploadResult) error {
+	fmt.Fprintf(w, "Upload summary for %s:\n", filepath.Base(imagePath))
+	var failed []string
+	for _, res := range results {
+		if res.err != nil {
+			fmt.Fprintf(w, "  %s: failed: %v\n", res.Target, res.err)
+			failed = append(failed, res.Target)
+			continue
+		}
+		if res.RemoteID != "" {
+			fmt.Fprintf(w, "  %s: ok (%s)\n", res.Target, res.RemoteID)
+			continue
+		}
+		fmt.Fprintf(w, "  %s: ok\n", res.Target)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("cannot upload %s to %d of %d targets: %s", filepath.Base(imagePath), len(failed), len(results), strings.Join(failed, ", "))
+	}
+	return nil
 }
 
 func uploaderCheckWithProgress(pbar progress.ProgressBar, uploader cloud.Uploader) error {
@@ -75,23 +481,34 @@ func uploaderCheckWithProgress(pbar progress.ProgressBar, uploader cloud.Uploade
 	return uploader.Check(pw)
 }
 
-func uploaderFor(cmd *cobra.Command, typeOrCloud string, targetArch string, bootMode *platform.BootMode) (cloud.Uploader, error) {
+// uploaderFor returns the uploader for the given image type or cloud,
+// the artifact metadata (if known) is used to tag the uploaded image
+// so that "cloud list" can find it
+func uploaderFor(cmd *cobra.Command, typeOrCloud string, targetArch string, bootMode *platform.BootMode, md *artifactMetadata, creds uploadCredentials) (cloud.Uploader, error) {
 	switch typeOrCloud {
 	case "ami", "generic-ami", "aws":
-		return uploaderForCmdAWS(cmd, targetArch, bootMode)
+		return uploaderForCmdAWS(cmd, targetArch, bootMode, md)
 	case "libvirt":
 		return uploaderForLibvirt(cmd, targetArch, bootMode)
 	case "openstack":
-		return uploaderForCmdOpenstack(cmd, targetArch, bootMode)
+		return uploaderForCmdOpenstack(cmd, targetArch, bootMode, md)
 	case "ibmcloud":
-		return uploaderForCmdIbmCloud(cmd, targetArch, bootMode)
+		return uploaderForCmdIbmCloud(cmd, targetArch, bootMode, creds)
+	case "vhd", "generic-vhd", "azure", "cloud-azure", "azure-cvm", "azure-rhui", "azure-eap7-rhui", "azure-sap-rhui", "azure-sapapps-rhui":
+		return uploaderForCmdAzure(cmd, targetArch, bootMode, creds)
+	case "gce", "gcp":
+		return uploaderForCmdGCP(cmd, targetArch, bootMode)
+	case "s3":
+		return uploaderForCmdS3(cmd, targetArch, bootMode, creds)
+	case "oci":
+		return uploaderForCmdOCI(cmd, targetArch, bootMode)
 	default:
 		return nil, fmt.Errorf("%w: %q", ErrUploadTypeUnsupported, typeOrCloud)
 	}
 
 }
 
-func uploaderForCmdAWS(cmd *cobra.Command, targetArchStr string, bootMode *platform.BootMode) (cloud.Uploader, error) {
+func uploaderForCmdAWS(cmd *cobra.Command, targetArchStr string, bootMode *platform.BootMode, md *artifactMetadata) (cloud.Uploader, error) {
 	amiName, err := cmd.Flags().GetString("aws-ami-name")
 	if err != nil {
 		return nil, err
@@ -123,12 +540,50 @@ func uploaderForCmdAWS(cmd *cobra.Command, targetArchStr string, bootMode *platf
 			Value: parts[1],
 		})
 	}
+	for _, tag := range cloudImageTags(targetArchStr, md) {
+		slicedTags = append(slicedTags, awscloud.AWSTag{
+			Name:  tag.name,
+			Value: tag.value,
+		})
+	}
+	copyToRegions, err := cmd.Flags().GetStringArray("aws-copy-to-region")
+	if err != nil {
+		return nil, err
+	}
+	shareWith, err := cmd.Flags().GetStringArray("aws-share-with-account")
+	if err != nil {
+		return nil, err
+	}
+	awsBootMode, err := cmd.Flags().GetString("aws-boot-mode")
+	if err != nil {
+		return nil, err
+	}
+	for i, copyTo := range copyToRegions {
+		if copyTo == region {
+			return nil, fmt.Errorf("cannot copy the AMI into the region it is registered in (%s)", region)
+		}
+		if slices.Index(copyToRegions, copyTo) != i {
+			return nil, fmt.Errorf("cannot use --aws-copy-to-region=%s more than once", copyTo)
+		}
+	}
+	for _, account := range shareWith {
+		if !awsAccountIDRe.MatchString(account) {
+			return nil, fmt.Errorf("invalid AWS account id %q (expected 12 digits)", account)
+		}
+	}
+	if awsBootMode != "" {
+		// the explicit boot mode wins over the one of the image
+		bm, err := awsBootModeFromString(awsBootMode)
+		if err != nil {
+			return nil, err
+		}
+		bootMode = &bm
+	}
 	if bootMode == nil {
-		// If unset, default to BOOT_HYBIRD which translated
-		// to "uefi-prefered" when registering the image.
-		// This should give us wide compatibility. Ideally
-		// we would introspect the image but we have no
-		// metadata there right now.
+		// If unset (e.g. an image without metadata), default
+		// to BOOT_HYBIRD which translated to "uefi-prefered"
+		// when registering the image. This should give us
+		// wide compatibility.
 		// XXX: move this into the "images" library itself?
 		bootModeHybrid := platform.BOOT_HYBRID
 		bootMode = &bootModeHybrid
@@ -163,7 +618,18 @@ func uploaderForCmdAWS(cmd *cobra.Command, targetArchStr string, bootMode *platf
 		Profile:    profile,
 	}
 
-	return awscloudNewUploader(region, bucketName, amiName, opts)
+	uploader, err := awscloudNewUploader(region, bucketName, amiName, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &awsAMIUploader{
+		Uploader:      uploader,
+		amiName:       amiName,
+		region:        region,
+		profile:       profile,
+		copyToRegions: copyToRegions,
+		shareWith:     shareWith,
+	}, nil
 }
 
 func uploaderForLibvirt(cmd *cobra.Command, targetArchStr string, bootMode *platform.BootMode) (cloud.Uploader, error) {
@@ -179,10 +645,88 @@ func uploaderForLibvirt(cmd *cobra.Command, targetArchStr string, bootMode *plat
 	if err != nil {
 		return nil, err
 	}
-	return libvirtNewUploader(connection, pool, volume)
+	uploader, err := libvirtNewUploader(connection, pool, volume)
+	if err != nil {
+		return nil, err
+	}
+	domain, err := libvirtDomainOptionsFromCmd(cmd, targetArchStr, bootMode)
+	if err != nil {
+		return nil, err
+	}
+	if domain != nil {
+		domain.Connection = connection
+		domain.Pool = pool
+		domain.Volume = volume
+		if domain.Name == "" {
+			domain.Name = volume
+		}
+	}
+	return &libvirtUploader{Uploader: uploader, connection: connection, pool: pool, volume: volume, domain: domain}, nil
 }
 
-func uploaderForCmdOpenstack(cmd *cobra.Command, targetArchStr string, bootMode *platform.BootMode) (cloud.Uploader, error) {
+// libvirtDomainOptionsFromCmd returns nil if no domain should be
+// defined for the uploaded volume
+func libvirtDomainOptionsFromCmd(cmd *cobra.Command, targetArchStr string, bootMode *platform.BootMode) (*libvirtDomainOptions, error) {
+	defineDomain, err := cmd.Flags().GetBool("libvirt-define-domain")
+	if err != nil {
+		return nil, err
+	}
+	start, err := cmd.Flags().GetBool("libvirt-start")
+	if err != nil {
+		return nil, err
+	}
+	// starting a domain needs one
+	if !defineDomain && !start {
+		return nil, nil
+	}
+	name, err := cmd.Flags().GetString("libvirt-domain")
+	if err != nil {
+		return nil, err
+	}
+	memoryStr, err := cmd.Flags().GetString("libvirt-memory")
+	if err != nil {
+		return nil, err
+	}
+	network, err := cmd.Flags().GetString("libvirt-network")
+	if err != nil {
+		return nil, err
+	}
+	startTimeout, err := cmd.Flags().GetDuration("libvirt-start-timeout")
+	if err != nil {
+		return nil, err
+	}
+	targetArch, err := arch.FromString(targetArchStr)
+	if err != nil {
+		return nil, err
+	}
+	var memoryMiB uint64
+	if memoryStr != "" {
+		memory, err := datasizes.Parse(memoryStr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse --libvirt-memory: %w", err)
+		}
+		memoryMiB = memory / datasizes.MiB
+		if memoryMiB == 0 {
+			return nil, fmt.Errorf("--libvirt-memory %q is less than 1 MiB", memoryStr)
+		}
+	}
+	if bootMode == nil {
+		// same default as for AWS, see uploaderForCmdAWS
+		hybrid := platform.BOOT_HYBRID
+		bootMode = &hybrid
+	}
+	return &libvirtDomainOptions{
+		Name:         name,
+		Arch:         targetArch,
+		BootMode:     *bootMode,
+		MemoryMiB:    memoryMiB,
+		Network:      network,
+		Start:        start,
+		StartTimeout: startTimeout,
+	}, nil
+}
+
+func uploaderForCmdOpenstack(cmd *cobra.Command, targetArchStr string, bootMode *platform.BootMode, md *artifactMetadata) (cloud.Uploader, error) {
 	image, err := cmd.Flags().GetString("openstack-image")
 	if err != nil {
 		return nil, err
@@ -199,10 +743,14 @@ func uploaderForCmdOpenstack(cmd *cobra.Command, targetArchStr string, bootMode
 		DiskFormat:      diskFormat,
 		ContainerFormat: containerFormat,
 	}
-	return openstackNewUploader(image, opts)
+	uploader, err := openstackNewUploader(image, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &openstackUploader{Uploader: uploader, imageName: image, diskFormat: diskFormat, tags: cloudImageTags(targetArchStr, md)}, nil
 }
 
-func uploaderForCmdIbmCloud(cmd *cobra.Command, targetArchStr string, bootMode *platform.BootMode) (cloud.Uploader, error) {
+func uploaderForCmdIbmCloud(cmd *cobra.Command, targetArchStr string, bootMode *platform.BootMode, creds uploadCredentials) (cloud.Uploader, error) {
 	bucketName, err := cmd.Flags().GetString("ibmcloud-bucket")
 	if err != nil {
 		return nil, err
@@ -215,11 +763,11 @@ func uploaderForCmdIbmCloud(cmd *cobra.Command, targetArchStr string, bootMode *
 	if err != nil {
 		return nil, err
 	}
-	apiKey := os.Getenv("IBMCLOUD_API_KEY")
+	apiKey := creds.getenv("IBMCLOUD_API_KEY")
 	if apiKey == "" {
 		return nil, fmt.Errorf("Please set your IBM Cloud API key as $IBMCLOUD_API_KEY")
 	}
-	crn := os.Getenv("IBMCLOUD_CRN")
+	crn := creds.getenv("IBMCLOUD_CRN")
 	if crn == "" {
 		return nil, fmt.Errorf("Please set your IBM Cloud Resource Name as $IBMCLOUD_CRN")
 	}
@@ -231,6 +779,178 @@ func uploaderForCmdIbmCloud(cmd *cobra.Command, targetArchStr string, bootMode *
 	return ibmNewUploader(region, bucketName, imageName, credentials)
 }
 
+func uploaderForCmdAzure(cmd *cobra.Command, targetArchStr string, bootMode *platform.BootMode, creds uploadCredentials) (cloud.Uploader, error) {
+	var missing []string
+	requiredArgs := []string{"azure-storage-account", "azure-storage-container", "azure-resource-group", "azure-image-name"}
+	for _, argName := range requiredArgs {
+		arg, err := cmd.Flags().GetString(argName)
+		if err != nil {
+			return nil, err
+		}
+		if arg == "" {
+			missing = append(missing, fmt.Sprintf("--%s", argName))
+		}
+	}
+	if len(missing) > 0 {
+		if len(missing) == len(requiredArgs) {
+			return nil, fmt.Errorf("%w: %q", ErrUploadConfigNotProvided, missing)
+		}
+		return nil, fmt.Errorf("%w: %q", ErrMissingUploadConfig, missing)
+	}
+	opts := &azureUploaderOptions{}
+	for flagName, val := range map[string]*string{
+		"azure-storage-account":   &opts.StorageAccount,
+		"azure-storage-container": &opts.StorageContainer,
+		"azure-storage-endpoint":  &opts.StorageEndpoint,
+		"azure-resource-group":    &opts.ResourceGroup,
+		"azure-image-name":        &opts.ImageName,
+		"azure-location":          &opts.Location,
+	} {
+		v, err := cmd.Flags().GetString(flagName)
+		if err != nil {
+			return nil, err
+		}
+		*val = v
+	}
+	// images that can boot with UEFI run on a generation 2 VM
+	opts.HyperVGen = azure.HyperVGenV1
+	if bootMode != nil && (*bootMode == platform.BOOT_UEFI || *bootMode == platform.BOOT_HYBRID) {
+		opts.HyperVGen = azure.HyperVGenV2
+	}
+
+	tenantID, err := cmd.Flags().GetString("azure-tenant-id")
+	if err != nil {
+		return nil, err
+	}
+	if tenantID == "" {
+		tenantID = creds.getenv("AZURE_TENANT_ID")
+	}
+	subscriptionID, err := cmd.Flags().GetString("azure-subscription-id")
+	if err != nil {
+		return nil, err
+	}
+	if subscriptionID == "" {
+		subscriptionID = creds.getenv("AZURE_SUBSCRIPTION_ID")
+	}
+	if tenantID == "" || subscriptionID == "" {
+		return nil, fmt.Errorf("Please set your Azure tenant and subscription via --azure-tenant-id/--azure-subscription-id or $AZURE_TENANT_ID/$AZURE_SUBSCRIPTION_ID")
+	}
+	credentials := azure.Credentials{
+		ClientID:     creds.getenv("AZURE_CLIENT_ID"),
+		ClientSecret: creds.getenv("AZURE_CLIENT_SECRET"),
+	}
+	if credentials.ClientID == "" || credentials.ClientSecret == "" {
+		return nil, fmt.Errorf("Please set your Azure service principal as $AZURE_CLIENT_ID and $AZURE_CLIENT_SECRET")
+	}
+	client, err := azureNewClient(credentials, tenantID, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	opts.SubscriptionID = subscriptionID
+	opts.StorageKey = creds.getenv("AZURE_STORAGE_KEY")
+	return newAzureUploader(client, opts), nil
+}
+
+func uploaderForCmdGCP(cmd *cobra.Command, targetArchStr string, bootMode *platform.BootMode) (cloud.Uploader, error) {
+	var missing []string
+	requiredArgs := []string{"gcp-project", "gcp-bucket", "gcp-image-name"}
+	for _, argName := range requiredArgs {
+		arg, err := cmd.Flags().GetString(argName)
+		if err != nil {
+			return nil, err
+		}
+		if arg == "" {
+			missing = append(missing, fmt.Sprintf("--%s", argName))
+		}
+	}
+	if len(missing) > 0 {
+		if len(missing) == len(requiredArgs) {
+			return nil, fmt.Errorf("%w: %q", ErrUploadConfigNotProvided, missing)
+		}
+		return nil, fmt.Errorf("%w: %q", ErrMissingUploadConfig, missing)
+	}
+	opts := &gcpUploaderOptions{}
+	for flagName, val := range map[string]*string{
+		"gcp-project":          &opts.Project,
+		"gcp-bucket":           &opts.Bucket,
+		"gcp-image-name":       &opts.ImageName,
+		"gcp-region":           &opts.Region,
+		"gcp-storage-endpoint": &opts.StorageEndpoint,
+		"gcp-compute-endpoint": &opts.ComputeEndpoint,
+	} {
+		v, err := cmd.Flags().GetString(flagName)
+		if err != nil {
+			return nil, err
+		}
+		*val = v
+	}
+	targetArch, err := arch.FromString(targetArchStr)
+	if err != nil {
+		return nil, err
+	}
+	opts.TargetArch = targetArch
+	opts.GuestOsFeatures = gcpGuestOsFeatures(bootMode)
+	return newGCPUploader(opts), nil
+}
+
+func uploaderForCmdS3(cmd *cobra.Command, targetArchStr string, bootMode *platform.BootMode, creds uploadCredentials) (cloud.Uploader, error) {
+	var missing []string
+	requiredArgs := []string{"s3-endpoint", "s3-bucket"}
+	for _, argName := range requiredArgs {
+		arg, err := cmd.Flags().GetString(argName)
+		if err != nil {
+			return nil, err
+		}
+		if arg == "" {
+			missing = append(missing, fmt.Sprintf("--%s", argName))
+		}
+	}
+	if len(missing) > 0 {
+		if len(missing) == len(requiredArgs) {
+			return nil, fmt.Errorf("%w: %q", ErrUploadConfigNotProvided, missing)
+		}
+		return nil, fmt.Errorf("%w: %q", ErrMissingUploadConfig, missing)
+	}
+	opts := &s3UploaderOptions{}
+	for flagName, val := range map[string]*string{
+		"s3-endpoint":   &opts.Endpoint,
+		"s3-region":     &opts.Region,
+		"s3-bucket":     &opts.Bucket,
+		"s3-key-prefix": &opts.KeyPrefix,
+		"s3-ca-cert":    &opts.CACert,
+	} {
+		v, err := cmd.Flags().GetString(flagName)
+		if err != nil {
+			return nil, err
+		}
+		*val = v
+	}
+	pathStyle, err := cmd.Flags().GetBool("s3-path-style")
+	if err != nil {
+		return nil, err
+	}
+	opts.PathStyle = pathStyle
+	// without credentials from an upload target the AWS SDK reads
+	// them from the environment or the shared configuration
+	if len(creds) > 0 {
+		opts.AccessKeyID = creds.getenv("AWS_ACCESS_KEY_ID")
+		opts.SecretAccessKey = creds.getenv("AWS_SECRET_ACCESS_KEY")
+		opts.SessionToken = creds.getenv("AWS_SESSION_TOKEN")
+	}
+	return newS3Uploader(opts)
+}
+
+func uploaderForCmdOCI(cmd *cobra.Command, targetArchStr string, bootMode *platform.BootMode) (cloud.Uploader, error) {
+	ref, err := cmd.Flags().GetString("ref")
+	if err != nil {
+		return nil, err
+	}
+	if ref == "" {
+		return nil, fmt.Errorf("%w: %q", ErrUploadConfigNotProvided, []string{"--ref"})
+	}
+	return newOCIUploader(ref, targetArchStr)
+}
+
 func detectArchFromImagePath(imagePath string) string {
 	// This detection is currently rather naive, we just look for
 	// the file name and try to infer from that. We could extend
@@ -254,11 +974,23 @@ func detectArchFromImagePath(imagePath string) string {
 func cmdUpload(cmd *cobra.Command, args []string) error {
 	imagePath := args[0]
 
-	uploadTo, err := cmd.Flags().GetString("to")
+	uploadTo, err := cmd.Flags().GetStringArray("to")
 	if err != nil {
 		return err
 	}
-	if uploadTo == "" {
+	target, err := uploadTargetFromCmd(cmd, "target")
+	if err != nil {
+		return err
+	}
+	if target != nil {
+		for _, to := range uploadTo {
+			if to != target.Type {
+				return fmt.Errorf("cannot use --to=%s with upload target %q of type %q", to, target.Name, target.Type)
+			}
+		}
+		uploadTo = []string{target.Type}
+	}
+	if len(uploadTo) == 0 {
 		return fmt.Errorf("missing --to parameter, try --to=aws")
 	}
 
@@ -266,6 +998,24 @@ func cmdUpload(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	// the metadata written by "build" is more reliable than
+	// guessing from the filename
+	md, err := readArtifactMetadata(imagePath)
+	if err != nil {
+		fmt.Fprintf(osStderr, "WARNING: ignoring image metadata: %v\n", err)
+	}
+	var bootMode *platform.BootMode
+	if md != nil && md.BootMode != "" {
+		bm, err := bootModeFromString(md.BootMode)
+		if err != nil {
+			return err
+		}
+		bootMode = &bm
+	}
+	if targetArch == "" && md != nil && md.Arch != "" {
+		targetArch = md.Arch
+		fmt.Fprintf(osStderr, "Note: using architecture %q based on image metadata (use --arch to override)\n", targetArch)
+	}
 	if targetArch == "" {
 		targetArch = detectArchFromImagePath(imagePath)
 		if targetArch != "" {
@@ -277,10 +1027,49 @@ func cmdUpload(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	uploader, err := uploaderFor(cmd, uploadTo, targetArch, nil)
+	var uploaders []namedUploader
+	for _, to := range uploadTo {
+		name := to
+		if target != nil {
+			name = target.Name
+		}
+		for _, nu := range uploaders {
+			if nu.name == name {
+				return fmt.Errorf("cannot use --to=%s more than once", to)
+			}
+		}
+		uploader, err := uploaderFor(cmd, to, targetArch, bootMode, md, target.credentials())
+		if err != nil && len(uploadTo) > 1 {
+			return fmt.Errorf("cannot upload to %s: %w", name, err)
+		}
+		if err != nil {
+			return err
+		}
+		uploaders = append(uploaders, namedUploader{name: name, uploader: uploader})
+	}
+	opts, err := uploadOptionsFromCmd(cmd)
 	if err != nil {
 		return err
 	}
+	resultPath, err := cmd.Flags().GetString("upload-result")
+	if err != nil {
+		return err
+	}
+	if len(uploaders) == 1 {
+		res := uploadImageWithProgress(nil, uploaders[0], imagePath, opts)
+		return errors.Join(res.err, writeUploadResults(resultPath, []*uploadResult{res}))
+	}
 
-	return uploadImageWithProgress(uploader, imagePath)
+	// check all targets first so that a misconfigured target does
+	// not leave partial uploads behind on the other targets
+	for _, nu := range uploaders {
+		if err := nu.uploader.Check(osStderr); err != nil {
+			return fmt.Errorf("cannot upload to %s: %w", nu.name, err)
+		}
+	}
+	results := uploadImageToTargets(nil, uploaders, imagePath, opts)
+	if err := writeUploadResults(resultPath, results); err != nil {
+		return err
+	}
+	return reportUploadResults(osStdout, imagePath, results)
 }
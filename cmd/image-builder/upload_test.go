@@ -2,19 +2,25 @@ package main_test
 
 import (
 	"bytes"
+	"crypto/md5"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/images"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/osbuild/images/pkg/arch"
 	"github.com/osbuild/images/pkg/cloud"
 	"github.com/osbuild/images/pkg/cloud/awscloud"
+	"github.com/osbuild/images/pkg/cloud/openstack"
 	"github.com/osbuild/images/pkg/platform"
+	testrepos "github.com/osbuild/images/test/data/repositories"
 
 	main "github.com/osbuild/image-builder-cli/cmd/image-builder"
 	"github.com/osbuild/image-builder-cli/internal/testutil"
@@ -23,9 +29,6 @@ import (
 func TestUploadWithAWSMock(t *testing.T) {
 	fakeDiskContent := "fake-raw-img"
 
-	var regionName, bucketName, amiName string
-	var uploadOpts *awscloud.UploaderOptions
-
 	for _, tc := range []struct {
 		fakeDiskName       string
 		targetArchArg      string
@@ -43,18 +46,11 @@ func TestUploadWithAWSMock(t *testing.T) {
 		err := os.WriteFile(fakeImageFilePath, []byte(fakeDiskContent), 0644)
 		assert.NoError(t, err)
 
-		var fa fakeAwsUploader
-		restore := main.MockAwscloudNewUploader(func(region string, bucket string, ami string, opts *awscloud.UploaderOptions) (cloud.Uploader, error) {
-			regionName = region
-			bucketName = bucket
-			amiName = ami
-			uploadOpts = opts
-			return &fa, nil
-		})
-		defer restore()
+		fa := fakeAwsUploader{amiID: "ami-fake"}
+		mockAWSUploads(t, &fa)
 
 		var fakeStdout, fakeStderr bytes.Buffer
-		restore = main.MockOsStdout(&fakeStdout)
+		restore := main.MockOsStdout(&fakeStdout)
 		defer restore()
 		restore = main.MockOsStderr(&fakeStderr)
 		defer restore()
@@ -73,13 +69,17 @@ func TestUploadWithAWSMock(t *testing.T) {
 		err = main.Run()
 		require.NoError(t, err)
 
-		assert.Equal(t, regionName, "aws-region-1")
-		assert.Equal(t, bucketName, "aws-bucket-2")
-		assert.Equal(t, amiName, "aws-ami-3")
+		assert.Equal(t, "aws-region-1", fa.region)
+		assert.Equal(t, "aws-bucket-2", fa.bucket)
+		assert.Equal(t, "aws-ami-3", fa.ami)
 		expectedBootMode := platform.BOOT_HYBRID
 		targetArch, err := arch.FromString(tc.expectedUploadArch)
 		assert.NoError(t, err)
-		assert.Equal(t, &awscloud.UploaderOptions{TargetArch: targetArch, BootMode: &expectedBootMode}, uploadOpts)
+		expectedTags := []awscloud.AWSTag{
+			{Name: "image-builder:created-by", Value: "image-builder"},
+			{Name: "image-builder:arch", Value: tc.expectedUploadArch},
+		}
+		assert.Equal(t, &awscloud.UploaderOptions{TargetArch: targetArch, BootMode: &expectedBootMode, Tags: expectedTags}, fa.opts)
 
 		assert.Equal(t, 0, fa.checkCalls)
 		assert.Equal(t, 1, fa.uploadAndRegisterCalls)
@@ -93,6 +93,55 @@ func TestUploadWithAWSMock(t *testing.T) {
 	}
 }
 
+func TestUploadUsesArtifactMetadata(t *testing.T) {
+	tmpdir := t.TempDir()
+	// the filename would suggest x86_64 but the metadata wins
+	fakeImageFilePath := filepath.Join(tmpdir, "centos-9-ami-x86_64.raw.xz")
+	err := os.WriteFile(fakeImageFilePath, []byte("fake-raw-img"), 0644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(tmpdir, "centos-9-ami-x86_64.json"), []byte(`{
+  "distro": "centos-9",
+  "arch": "aarch64",
+  "image-type": "ami",
+  "boot-mode": "uefi",
+  "filename": "centos-9-ami-x86_64.raw.xz"
+}`), 0644)
+	require.NoError(t, err)
+
+	fa := &fakeAwsUploader{amiID: "ami-fake"}
+	mockAWSUploads(t, fa)
+
+	var fakeStderr bytes.Buffer
+	restore := main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(&fakeStderr)
+	defer restore()
+
+	restore = main.MockOsArgs([]string{
+		"upload",
+		"--to=aws",
+		"--aws-region=aws-region-1",
+		"--aws-bucket=aws-bucket-2",
+		"--aws-ami-name=aws-ami-3",
+		fakeImageFilePath,
+	})
+	defer restore()
+
+	err = main.Run()
+	require.NoError(t, err)
+
+	expectedBootMode := platform.BOOT_UEFI
+	// the metadata is also used for the tags that "cloud list" shows
+	expectedTags := []awscloud.AWSTag{
+		{Name: "image-builder:created-by", Value: "image-builder"},
+		{Name: "image-builder:arch", Value: "aarch64"},
+		{Name: "image-builder:distro", Value: "centos-9"},
+		{Name: "image-builder:image-type", Value: "ami"},
+	}
+	assert.Equal(t, &awscloud.UploaderOptions{TargetArch: arch.ARCH_AARCH64, BootMode: &expectedBootMode, Tags: expectedTags}, fa.opts)
+	assert.Equal(t, `Note: using architecture "aarch64" based on image metadata (use --arch to override)`+"\n", fakeStderr.String())
+}
+
 func TestUploadCmdlineErrors(t *testing.T) {
 	var fakeStderr bytes.Buffer
 	restore := main.MockOsStderr(&fakeStderr)
@@ -138,24 +187,15 @@ func TestBuildAndUploadWithAWSMock(t *testing.T) {
 		t.Skip("no osbuild-depsolve-dnf binary found")
 	}
 
-	var regionName, bucketName, amiName string
-	var fa fakeAwsUploader
-	var uploadOpts *awscloud.UploaderOptions
-	restore := main.MockAwscloudNewUploader(func(region string, bucket string, ami string, opts *awscloud.UploaderOptions) (cloud.Uploader, error) {
-		regionName = region
-		bucketName = bucket
-		amiName = ami
-		uploadOpts = opts
-		return &fa, nil
-	})
-	defer restore()
+	fa := fakeAwsUploader{amiID: "ami-fake"}
+	mockAWSUploads(t, &fa)
 
 	outputDir := t.TempDir()
 	fakeOsbuildScript := makeFakeOsbuildScript()
 	testutil.MockCommand(t, "osbuild", fakeOsbuildScript)
 
 	var fakeStdout bytes.Buffer
-	restore = main.MockOsStdout(&fakeStdout)
+	restore := main.MockOsStdout(&fakeStdout)
 	defer restore()
 
 	restore = main.MockOsArgs([]string{
@@ -172,11 +212,11 @@ func TestBuildAndUploadWithAWSMock(t *testing.T) {
 	err := main.Run()
 	require.NoError(t, err)
 
-	assert.Equal(t, regionName, "aws-region-1")
-	assert.Equal(t, bucketName, "aws-bucket-2")
-	assert.Equal(t, amiName, "aws-ami-3")
+	assert.Equal(t, "aws-region-1", fa.region)
+	assert.Equal(t, "aws-bucket-2", fa.bucket)
+	assert.Equal(t, "aws-ami-3", fa.ami)
 	expectedBootMode := platform.BOOT_HYBRID
-	assert.Equal(t, &awscloud.UploaderOptions{BootMode: &expectedBootMode, TargetArch: arch.Current()}, uploadOpts)
+	assert.Equal(t, &awscloud.UploaderOptions{BootMode: &expectedBootMode, TargetArch: arch.Current()}, fa.opts)
 	assert.Equal(t, 1, fa.checkCalls)
 	assert.Equal(t, 1, fa.uploadAndRegisterCalls)
 	assert.Equal(t, "fake-img-raw\n", fa.uploadAndRegisterRead.String())
@@ -190,24 +230,15 @@ func TestBuildAndUploadFedoraWithAWSMock(t *testing.T) {
 		t.Skip("no osbuild-depsolve-dnf binary found")
 	}
 
-	var regionName, bucketName, amiName string
-	var fa fakeAwsUploader
-	var uploadOpts *awscloud.UploaderOptions
-	restore := main.MockAwscloudNewUploader(func(region string, bucket string, ami string, opts *awscloud.UploaderOptions) (cloud.Uploader, error) {
-		regionName = region
-		bucketName = bucket
-		amiName = ami
-		uploadOpts = opts
-		return &fa, nil
-	})
-	defer restore()
+	fa := fakeAwsUploader{amiID: "ami-fake"}
+	mockAWSUploads(t, &fa)
 
 	outputDir := t.TempDir()
 	fakeOsbuildScript := makeFakeOsbuildScript()
 	testutil.MockCommand(t, "osbuild", fakeOsbuildScript)
 
 	var fakeStdout bytes.Buffer
-	restore = main.MockOsStdout(&fakeStdout)
+	restore := main.MockOsStdout(&fakeStdout)
 	defer restore()
 
 	restore = main.MockOsArgs([]string{
@@ -224,11 +255,11 @@ func TestBuildAndUploadFedoraWithAWSMock(t *testing.T) {
 	err := main.Run()
 	require.NoError(t, err)
 
-	assert.Equal(t, regionName, "aws-region-1")
-	assert.Equal(t, bucketName, "aws-bucket-2")
-	assert.Equal(t, amiName, "aws-ami-3")
+	assert.Equal(t, "aws-region-1", fa.region)
+	assert.Equal(t, "aws-bucket-2", fa.bucket)
+	assert.Equal(t, "aws-ami-3", fa.ami)
 	expectedBootMode := platform.BOOT_HYBRID
-	assert.Equal(t, &awscloud.UploaderOptions{BootMode: &expectedBootMode, TargetArch: arch.Current()}, uploadOpts)
+	assert.Equal(t, &awscloud.UploaderOptions{BootMode: &expectedBootMode, TargetArch: arch.Current()}, fa.opts)
 	assert.Equal(t, 1, fa.checkCalls)
 	assert.Equal(t, 1, fa.uploadAndRegisterCalls)
 	assert.Equal(t, "fake-img-raw\n", fa.uploadAndRegisterRead.String())
@@ -297,3 +328,257 @@ func TestBuildAndUploadWithAWSPartialCmdlineErrors(t *testing.T) {
 	err := main.Run()
 	assert.EqualError(t, err, `missing upload configuration: ["--aws-ami-name" "--aws-bucket"]`)
 }
+
+func TestUploadToMultipleTargets(t *testing.T) {
+	fs, s3Args := mockS3(t)
+	imagePath := makeTestS3Image(t)
+
+	fa := fakeAwsUploader{
+		uploadAndRegisterErr: fmt.Errorf("injected aws error"),
+	}
+	mockAWSUploads(t, &fa)
+	var sleeps []time.Duration
+	restore := main.MockUploadRetrySleep(func(d time.Duration) { sleeps = append(sleeps, d) })
+	defer restore()
+
+	var fakeStdout bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+	cmdline := append([]string{
+		"upload",
+		"--to=aws",
+		"--aws-region=aws-region-1",
+		"--aws-bucket=aws-bucket-2",
+		"--aws-ami-name=aws-ami-3",
+	}, s3Args...)
+	restore = main.MockOsArgs(append(cmdline, imagePath))
+	defer restore()
+
+	// a failed upload does not stop the other ones
+	err := main.Run()
+	assert.EqualError(t, err, "cannot upload centos-9-minimal-raw-x86_64.raw to 1 of 2 targets: aws")
+	assert.Contains(t, fakeStdout.String(), "Upload summary for centos-9-minimal-raw-x86_64.raw:\n  aws: failed: injected aws error\n  s3: ok (s3://my-bucket/images/centos-9-minimal-raw-x86_64.raw)\n")
+	assert.Equal(t, 1, fa.checkCalls)
+	// a retry would import another snapshot, aws uploads are not retried
+	assert.Equal(t, 1, fa.uploadAndRegisterCalls)
+	assert.Equal(t, "0123456789", fa.uploadAndRegisterRead.String())
+	assert.Empty(t, sleeps)
+	assert.Equal(t, []byte("0123456789"), fs.objects["my-bucket/images/centos-9-minimal-raw-x86_64.raw"])
+}
+
+func TestUploadToMultipleTargetsErrors(t *testing.T) {
+	_, s3Args := mockS3(t)
+	imagePath := makeTestS3Image(t)
+
+	fa := fakeAwsUploader{
+		uploadAndRegisterErr: fmt.Errorf("upload should not be called"),
+	}
+	restore := main.MockAwscloudNewUploader(func(region string, bucket string, ami string, opts *awscloud.UploaderOptions) (cloud.Uploader, error) {
+		return &fa, nil
+	})
+	defer restore()
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+
+	awsArgs := []string{"--to=aws", "--aws-region=r", "--aws-bucket=b", "--aws-ami-name=a"}
+	for _, tc := range []struct {
+		cmdline     []string
+		expectedErr string
+	}{
+		{
+			append([]string{"--to=gcp"}, awsArgs...),
+			`cannot upload to gcp: missing all upload configuration: ["--gcp-project" "--gcp-bucket" "--gcp-image-name"]`,
+		}, {
+			append([]string{"--to=aws"}, awsArgs...),
+			`cannot use --to=aws more than once`,
+		}, {
+			append(append(awsArgs, s3Args...), "--s3-bucket=other-bucket"),
+			`cannot upload to s3: cannot access bucket "other-bucket"`,
+		},
+	} {
+		t.Run(strings.Join(tc.cmdline, ","), func(t *testing.T) {
+			restore := main.MockOsArgs(append(append([]string{"upload"}, tc.cmdline...), imagePath))
+			defer restore()
+
+			err := main.Run()
+			assert.ErrorContains(t, err, tc.expectedErr)
+		})
+	}
+	assert.Equal(t, 0, fa.uploadAndRegisterCalls)
+}
+
+func TestBuildAndUploadToMultipleTargets(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+	restore = main.MockOsbuildVersion(func() (string, error) { return "999", nil })
+	defer restore()
+	restore = main.MockManifestgenDepsolver(fakeDepsolve)
+	defer restore()
+	restore = main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+	fs, s3Args := mockS3(t)
+	testutil.MockCommand(t, "osbuild", makeFakeOsbuildScript())
+
+	fa := fakeAwsUploader{amiID: "ami-fake"}
+	fe := mockAWSUploads(t, &fa)
+
+	var fakeStdout bytes.Buffer
+	restore = main.MockOsStdout(&fakeStdout)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+	cmdline := append([]string{
+		"build",
+		"--output-dir", t.TempDir(),
+		"--cache", t.TempDir(),
+		"--to=aws",
+		"--aws-region=aws-region-1",
+		"--aws-bucket=aws-bucket-2",
+		"--aws-ami-name=aws-ami-3",
+	}, s3Args...)
+	restore = main.MockOsArgs(append(cmdline, "ami", "--distro=centos-9"))
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	assert.Contains(t, fakeStdout.String(), "  aws: ok (ami-fake)\n  s3: ok (s3://my-bucket/images/centos-9-ami-"+arch.Current().String()+".raw)\n")
+	assert.Equal(t, 1, fa.checkCalls)
+	assert.Equal(t, "fake-img-raw\n", fa.uploadAndRegisterRead.String())
+	assert.Equal(t, []byte("fake-img-raw\n"), fs.objects["my-bucket/images/centos-9-ami-"+arch.Current().String()+".raw"])
+
+	// all targets are checked before the build starts
+	fa = fakeAwsUploader{amiID: "ami-fake", ec2: fe}
+	restore = main.MockOsArgs(append(cmdline, "--s3-bucket=other-bucket", "ami", "--distro=centos-9"))
+	defer restore()
+	err = main.Run()
+	assert.ErrorContains(t, err, `cannot upload to s3: cannot access bucket "other-bucket"`)
+	assert.Equal(t, 0, fa.uploadAndRegisterCalls)
+}
+
+func TestBuildAndUploadMultipleImageTypesUploadFailure(t *testing.T) {
+	restore := main.MockSetupIsContainer(func() bool { return false })
+	defer restore()
+	restore = main.MockOsbuildVersion(func() (string, error) { return "999", nil })
+	defer restore()
+	restore = main.MockManifestgenDepsolver(fakeDepsolve)
+	defer restore()
+	restore = main.MockNewRepoRegistry(testrepos.New)
+	defer restore()
+	fs, s3Args := mockS3(t)
+	fs.badETag = true
+	// the fake osbuild does not know about the "vmdk" export
+	testutil.MockCommand(t, "osbuild", makeFakeOsbuildScript())
+
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+	restore = main.MockOsArgs(append(append([]string{
+		"build",
+		"--output-dir", t.TempDir(),
+		"--cache", t.TempDir(),
+		"--upload-retries=0",
+	}, s3Args...), "qcow2", "vmdk", "oci", "--distro=centos-9", "--arch=x86_64"))
+	defer restore()
+
+	err := main.Run()
+	// a failed upload does not stop the uploads of the other images
+	// and the build failures are still reported
+	assert.ErrorContains(t, err, "cannot build 1 of 3 images: centos-9-vmdk-x86_64\n")
+	assert.ErrorContains(t, err, `cannot verify upload: object "images/centos-9-qcow2-x86_64.qcow2"`)
+	assert.ErrorContains(t, err, `cannot verify upload: object "images/centos-9-oci-x86_64.qcow2"`)
+}
+
+func TestUploadOpenstackResult(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "disk.qcow2")
+	require.NoError(t, os.WriteFile(imagePath, []byte("fake-qcow2"), 0644))
+
+	var fa fakeAwsUploader
+	restore := main.MockOpenstackNewUploader(func(image string, opts *openstack.UploaderOptions) (cloud.Uploader, error) {
+		assert.Equal(t, "my-image", image)
+		return &fa, nil
+	})
+	defer restore()
+	fg := &fakeGlance{
+		images: []images.Image{
+			{ID: "1234-abcd", Name: "my-image", Checksum: fmt.Sprintf("%x", md5.Sum([]byte("fake-qcow2"))), SizeBytes: 10},
+		},
+	}
+	mockFakeGlance(t, fg)
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(io.Discard)
+	defer restore()
+	resultPath := filepath.Join(t.TempDir(), "result.json")
+	restore = main.MockOsArgs([]string{"upload", "--to=openstack", "--arch=x86_64", "--openstack-image=my-image", "--upload-result", resultPath, imagePath})
+	defer restore()
+
+	err := main.Run()
+	require.NoError(t, err)
+	content, err := os.ReadFile(resultPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `"remote_id": "1234-abcd",`)
+	assert.Contains(t, string(content), `"verified": true,`)
+	// the image is tagged for "cloud list"
+	assert.Equal(t, images.UpdateOpts{
+		images.ReplaceImageTags{NewTags: []string{"image-builder"}},
+		images.UpdateImageProperty{Op: images.AddOp, Name: "image-builder:arch", Value: "x86_64"},
+	}, fg.updates["1234-abcd"])
+
+	// a checksum mismatch fails the upload and is reported in the result
+	fg.images[0].Checksum = "0123"
+	restore = main.MockOsArgs([]string{"upload", "--to=openstack", "--arch=x86_64", "--openstack-image=my-image", "--upload-retries=0", "--upload-result", resultPath, imagePath})
+	defer restore()
+	err = main.Run()
+	expectedErr := fmt.Sprintf("cannot verify upload: image 1234-abcd has checksum 0123 instead of %x", md5.Sum([]byte("fake-qcow2")))
+	assert.EqualError(t, err, expectedErr)
+	content, err = os.ReadFile(resultPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), fmt.Sprintf(`"error": %q`, expectedErr))
+}
+
+func TestUploadOpenstackFailureDeletesImage(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "disk.qcow2")
+	require.NoError(t, os.WriteFile(imagePath, []byte("fake-qcow2"), 0644))
+
+	fa := &fakeAwsUploader{uploadAndRegisterErr: fmt.Errorf("injected upload error")}
+	restore := main.MockOpenstackNewUploader(func(image string, opts *openstack.UploaderOptions) (cloud.Uploader, error) {
+		return fa, nil
+	})
+	defer restore()
+	fg := &fakeGlance{
+		images: []images.Image{
+			{ID: "1234-abcd", Name: "my-image", Status: images.ImageStatusQueued},
+		},
+	}
+	mockFakeGlance(t, fg)
+	var sleeps []time.Duration
+	restore = main.MockUploadRetrySleep(func(d time.Duration) { sleeps = append(sleeps, d) })
+	defer restore()
+	var fakeStderr bytes.Buffer
+	restore = main.MockOsStdout(io.Discard)
+	defer restore()
+	restore = main.MockOsStderr(&fakeStderr)
+	defer restore()
+	restore = main.MockOsArgs([]string{"upload", "--to=openstack", "--arch=x86_64", "--openstack-image=my-image", imagePath})
+	defer restore()
+
+	// every attempt would create a new image, the upload is not retried
+	err := main.Run()
+	assert.EqualError(t, err, "injected upload error")
+	assert.Equal(t, 1, fa.uploadAndRegisterCalls)
+	assert.Empty(t, sleeps)
+	assert.Equal(t, []string{"1234-abcd"}, fg.deleted)
+	assert.Contains(t, fakeStderr.String(), "Deleted the incomplete image 1234-abcd\n")
+
+	// an active image with the same name is not deleted
+	fg.images[0].Status = images.ImageStatusActive
+	fg.deleted = nil
+	err = main.Run()
+	assert.EqualError(t, err, "injected upload error")
+	assert.Empty(t, fg.deleted)
+}
@@ -26,6 +26,22 @@ type versionDescription struct {
 	} `yaml:"image-builder" json:"image-builder"`
 }
 
+// used in tests
+var osbuildVersion = osbuild.OSBuildVersion
+
+// imagesVersion returns the version of the "images" library that is
+// used in this binary
+func imagesVersion() string {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range bi.Deps {
+			if dep.Path == "github.com/osbuild/images" {
+				return dep.Version
+			}
+		}
+	}
+	return "unknown"
+}
+
 func readVersionInfo() *versionDescription {
 	vd := &versionDescription{}
 
@@ -34,7 +50,7 @@ func readVersionInfo() *versionDescription {
 	// be defined by whatever is building this project.
 	vd.ImageBuilder.Commit = "unknown"
 	vd.ImageBuilder.Version = version
-	vd.ImageBuilder.Dependencies.Images = "unknown"
+	vd.ImageBuilder.Dependencies.Images = imagesVersion()
 	vd.ImageBuilder.Dependencies.OSBuild = "unknown"
 
 	if bi, ok := debug.ReadBuildInfo(); ok {
@@ -44,19 +60,13 @@ func readVersionInfo() *versionDescription {
 				vd.ImageBuilder.Commit = bs.Value
 			}
 		}
-
-		for _, dep := range bi.Deps {
-			if dep.Path == "github.com/osbuild/images" {
-				vd.ImageBuilder.Dependencies.Images = dep.Version
-			}
-		}
 	}
 
-	osbuildVersion, err := osbuild.OSBuildVersion()
+	osbuildVer, err := osbuildVersion()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to get osbuild version: %v\n", err)
 	}
-	vd.ImageBuilder.Dependencies.OSBuild = osbuildVersion
+	vd.ImageBuilder.Dependencies.OSBuild = osbuildVer
 
 	return vd
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/osbuild/images/pkg/datasizes"
+)
+
+const (
+	vhdFooterSize = 512
+	// azure needs the virtual size of a VHD to be a multiple of 1 MiB
+	vhdSizeAlignment = 1 * datasizes.MiB
+)
+
+var vhdCookie = []byte("conectix")
+
+// vhdEpoch is the start of the timestamps in a VHD footer
+var vhdEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// isVHDFooter returns true if the given (last 512 bytes of an image)
+// are the footer of a VHD
+func isVHDFooter(footer []byte) bool {
+	return len(footer) == vhdFooterSize && bytes.HasPrefix(footer, vhdCookie)
+}
+
+// vhdGeometry returns the CHS geometry of a disk with the given number
+// of sectors, as specified in the VHD specification
+func vhdGeometry(totalSectors uint64) (cylinders uint16, heads uint8, sectorsPerTrack uint8) {
+	totalSectors = min(totalSectors, 65535*16*255)
+
+	var spt, hds, cylinderTimesHeads uint64
+	if totalSectors >= 65535*16*63 {
+		spt = 255
+		hds = 16
+		cylinderTimesHeads = totalSectors / spt
+	} else {
+		spt = 17
+		cylinderTimesHeads = totalSectors / spt
+		hds = max((cylinderTimesHeads+1023)/1024, 4)
+		if cylinderTimesHeads >= hds*1024 || hds > 16 {
+			spt = 31
+			hds = 16
+			cylinderTimesHeads = totalSectors / spt
+		}
+		if cylinderTimesHeads >= hds*1024 {
+			spt = 63
+			hds = 16
+			cylinderTimesHeads = totalSectors / spt
+		}
+	}
+	return uint16(cylinderTimesHeads / hds), uint8(hds), uint8(spt)
+}
+
+// makeVHDFooter returns the footer of a fixed VHD with the given
+// virtual size
+func makeVHDFooter(size uint64, now time.Time) []byte {
+	footer := make([]byte, vhdFooterSize)
+	copy(footer[0:], vhdCookie)
+	// features: reserved bit, always set
+	binary.BigEndian.PutUint32(footer[8:], 2)
+	// file format version 1.0
+	binary.BigEndian.PutUint32(footer[12:], 0x00010000)
+	// data offset, fixed disks have no dynamic header
+	binary.BigEndian.PutUint64(footer[16:], 0xffffffffffffffff)
+	binary.BigEndian.PutUint32(footer[24:], uint32(now.Sub(vhdEpoch).Seconds()))
+	copy(footer[28:], "ibcl")
+	binary.BigEndian.PutUint32(footer[32:], 0x00010000)
+	copy(footer[36:], "Wi2k")
+	binary.BigEndian.PutUint64(footer[40:], size)
+	binary.BigEndian.PutUint64(footer[48:], size)
+	cylinders, heads, sectorsPerTrack := vhdGeometry(size / 512)
+	binary.BigEndian.PutUint16(footer[56:], cylinders)
+	footer[58] = heads
+	footer[59] = sectorsPerTrack
+	// disk type: fixed
+	binary.BigEndian.PutUint32(footer[60:], 2)
+	// a failing rand.Read leaves a zero id which is still valid
+	_, _ = rand.Read(footer[68:84])
+
+	var checksum uint32
+	for _, b := range footer {
+		checksum += uint32(b)
+	}
+	binary.BigEndian.PutUint32(footer[64:], ^checksum)
+	return footer
+}
+
+// newVHDReader returns the data of the raw disk r as a fixed VHD: the
+// disk is padded to the size alignment that azure needs and the footer
+// is appended
+func newVHDReader(r io.ReadCloser, size uint64) (io.ReadCloser, uint64) {
+	virtualSize := (size + vhdSizeAlignment - 1) / vhdSizeAlignment * vhdSizeAlignment
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		io.MultiReader(
+			r,
+			bytes.NewReader(make([]byte, virtualSize-size)),
+			bytes.NewReader(makeVHDFooter(virtualSize, time.Now())),
+		),
+		r,
+	}, virtualSize + vhdFooterSize
+}
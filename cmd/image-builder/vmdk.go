@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// vmdkSparseHeader is the header of a hosted sparse extent, see the
+// "Virtual Disk Format 5.0" specification by VMware
+type vmdkSparseHeader struct {
+	Magic              uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RgdOffset          uint64
+	GdOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  uint8
+	NonEndLineChar     uint8
+	DoubleEndLineChar1 uint8
+	DoubleEndLineChar2 uint8
+	CompressAlgorithm  uint16
+}
+
+const (
+	vmdkSectorSize = 512
+
+	vmdkFlagZeroedGTE   = 1 << 2
+	vmdkFlagCompressed  = 1 << 16
+	vmdkCompressDeflate = 1
+
+	// streamOptimized images write the grain directory after the
+	// grains, its offset is in the footer at the end of the file
+	vmdkGDAtEnd = 0xffffffffffffffff
+	// the footer is followed by its end-of-stream marker
+	vmdkFooterOffset = 2 * vmdkSectorSize
+
+	vmdkMaxGrainSize = 1 << 20
+)
+
+func readVMDKSparseHeader(r io.ReaderAt, offset int64) (*vmdkSparseHeader, error) {
+	var hdr vmdkSparseHeader
+	buf := make([]byte, binary.Size(hdr))
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return nil, fmt.Errorf("cannot read vmdk header: %w", err)
+	}
+	if _, err := binary.Decode(buf, binary.LittleEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("cannot read vmdk header: %w", err)
+	}
+	if !bytes.Equal(buf[:4], []byte("KDMV")) {
+		return nil, fmt.Errorf("invalid vmdk header at offset %d", offset)
+	}
+	return &hdr, nil
+}
+
+// newVMDKRawReader returns a reader for the raw disk of a vmdk image
+// with a single sparse extent (monolithicSparse or streamOptimized)
+func newVMDKRawReader(r io.ReaderAt, fileSize int64) (*rawImageReader, error) {
+	hdr, err := readVMDKSparseHeader(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.GdOffset == vmdkGDAtEnd {
+		if fileSize < vmdkFooterOffset+vmdkSectorSize {
+			return nil, fmt.Errorf("vmdk image is too short for a footer")
+		}
+		hdr, err = readVMDKSparseHeader(r, fileSize-vmdkFooterOffset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if hdr.GrainSize == 0 || hdr.GrainSize > vmdkMaxGrainSize || hdr.NumGTEsPerGT == 0 {
+		return nil, fmt.Errorf("invalid vmdk grain size %d or grain table size %d", hdr.GrainSize, hdr.NumGTEsPerGT)
+	}
+	if hdr.Flags&vmdkFlagCompressed != 0 && hdr.CompressAlgorithm != vmdkCompressDeflate {
+		return nil, fmt.Errorf("unsupported vmdk compression algorithm %d", hdr.CompressAlgorithm)
+	}
+
+	sectorsPerGT := hdr.GrainSize * uint64(hdr.NumGTEsPerGT)
+	gd, err := readLittleEndianTable(r, hdr.GdOffset*vmdkSectorSize, (hdr.Capacity+sectorsPerGT-1)/sectorsPerGT)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read vmdk grain directory: %w", err)
+	}
+	vr := &vmdkReader{r: r, hdr: hdr, gd: gd}
+	return &rawImageReader{
+		size:      hdr.Capacity * vmdkSectorSize,
+		blockSize: hdr.GrainSize * vmdkSectorSize,
+		readBlock: vr.readGrain,
+	}, nil
+}
+
+type vmdkReader struct {
+	r   io.ReaderAt
+	hdr *vmdkSparseHeader
+	gd  []uint32
+
+	// the last used grain table
+	gt       []uint32
+	gtOffset uint32
+}
+
+func (vr *vmdkReader) readGrain(idx uint64, buf []byte) error {
+	gtEntries := uint64(vr.hdr.NumGTEsPerGT)
+	gtOffset := vr.gd[idx/gtEntries]
+	if gtOffset == 0 {
+		// no grain table, all grains read as zeros
+		return nil
+	}
+	if vr.gt == nil || gtOffset != vr.gtOffset {
+		gt, err := readLittleEndianTable(vr.r, uint64(gtOffset)*vmdkSectorSize, gtEntries)
+		if err != nil {
+			return fmt.Errorf("cannot read vmdk grain table: %w", err)
+		}
+		vr.gt = gt
+		vr.gtOffset = gtOffset
+	}
+
+	// 0 is an unallocated grain and 1 can mark a grain of zeros
+	sector := vr.gt[idx%gtEntries]
+	if sector == 0 || (sector == 1 && vr.hdr.Flags&vmdkFlagZeroedGTE != 0) {
+		return nil
+	}
+	offset := int64(sector) * vmdkSectorSize
+	if vr.hdr.Flags&vmdkFlagCompressed == 0 {
+		if _, err := vr.r.ReadAt(buf, offset); err != nil {
+			return fmt.Errorf("cannot read vmdk grain %d: %w", idx, err)
+		}
+		return nil
+	}
+
+	// compressed grains start with the sector number (8 bytes) and the
+	// size of the compressed data (4 bytes)
+	marker := make([]byte, 12)
+	if _, err := vr.r.ReadAt(marker, offset); err != nil {
+		return fmt.Errorf("cannot read vmdk grain %d: %w", idx, err)
+	}
+	compressed := make([]byte, binary.LittleEndian.Uint32(marker[8:]))
+	if _, err := vr.r.ReadAt(compressed, offset+int64(len(marker))); err != nil {
+		return fmt.Errorf("cannot read vmdk grain %d: %w", idx, err)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return fmt.Errorf("cannot decompress vmdk grain %d: %w", idx, err)
+	}
+	defer zr.Close()
+	// the last grain can be shorter than the grain size
+	if _, err := io.ReadFull(zr, buf); err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("cannot decompress vmdk grain %d: %w", idx, err)
+	}
+	return nil
+}
+
+// readLittleEndianTable reads a table of n 32 bit little endian entries
+func readLittleEndianTable(r io.ReaderAt, offset, n uint64) ([]uint32, error) {
+	buf := make([]byte, n*4)
+	if _, err := r.ReadAt(buf, int64(offset)); err != nil {
+		return nil, err
+	}
+	table := make([]uint32, n)
+	for i := range table {
+		table[i] = binary.LittleEndian.Uint32(buf[i*4:])
+	}
+	return table, nil
+}
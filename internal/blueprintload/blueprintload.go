@@ -1,11 +1,14 @@
 package blueprintload
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
 
 	"github.com/BurntSushi/toml"
 
@@ -13,8 +16,8 @@ import (
 )
 
 // XXX: move this helper into images, share with bib
-func decodeToml(r io.Reader, what string) (*blueprint.Blueprint, error) {
-	dec := toml.NewDecoder(r)
+func decodeToml(data []byte, what string) (*blueprint.Blueprint, error) {
+	dec := toml.NewDecoder(bytes.NewReader(data))
 
 	var conf blueprint.Blueprint
 	metadata, err := dec.Decode(&conf)
@@ -28,12 +31,16 @@ func decodeToml(r io.Reader, what string) (*blueprint.Blueprint, error) {
 	return &conf, nil
 }
 
-func decodeJson(r io.Reader, what string) (*blueprint.Blueprint, error) {
-	dec := json.NewDecoder(r)
+func decodeJson(data []byte, what string) (*blueprint.Blueprint, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
 	dec.DisallowUnknownFields()
 
 	var conf blueprint.Blueprint
 	if err := dec.Decode(&conf); err != nil {
+		if offset, ok := jsonErrorOffset(err); ok {
+			line, column := lineColumn(data, offset)
+			err = fmt.Errorf("line %d, column %d: %w", line, column, err)
+		}
 		return nil, fmt.Errorf("cannot decode %q: %w", what, err)
 	}
 	if dec.More() {
@@ -42,29 +49,115 @@ func decodeJson(r io.Reader, what string) (*blueprint.Blueprint, error) {
 	return &conf, nil
 }
 
-func Load(path string) (*blueprint.Blueprint, error) {
-	var fp io.ReadCloser
+// jsonErrorOffset returns the offset in the input after which the
+// json decoding failed, if the error has one
+func jsonErrorOffset(err error) (int64, bool) {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return syntaxErr.Offset, true
+	case errors.As(err, &typeErr):
+		return typeErr.Offset, true
+	default:
+		return 0, false
+	}
+}
+
+// lineColumn returns the 1-based line and column of the last byte
+// before the given offset
+func lineColumn(data []byte, offset int64) (int, int) {
+	offset = min(max(offset-1, 0), int64(len(data)))
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+var (
+	tomlLineRe = regexp.MustCompile(`^(\[|[A-Za-z0-9_.\-"' ]+=)`)
+	yamlLineRe = regexp.MustCompile(`^(---|- |-$|[A-Za-z0-9_.\-"' ]+:(\s|$))`)
+)
+
+// detectFormat returns the format of a blueprint without a (known)
+// file extension, the first line that is not empty or a comment
+// decides
+func detectFormat(data []byte, what string) (string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		switch {
+		case line[0] == '{':
+			return "json", nil
+		case tomlLineRe.Match(line):
+			return "toml", nil
+		case yamlLineRe.Match(line):
+			return "yaml", nil
+		}
+		break
+	}
+	return "", fmt.Errorf("cannot detect the format of %q (please use .toml, .json or .yaml)", what)
+}
+
+// Load loads the blueprint at the given path ("-" is stdin), the
+// variables are substituted in the string values of the decoded
+// blueprint, nil vars means that the blueprint is used as it is (e.g.
+// with a "${PATH}" in a script), see Vars
+func Load(path string, vars *Vars) (*blueprint.Blueprint, error) {
+	var data []byte
 	var err error
 
 	switch path {
 	case "":
 		return &blueprint.Blueprint{}, nil
 	case "-":
-		fp = os.Stdin
+		data, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read blueprint from stdin: %w", err)
+		}
 	default:
-		fp, err = os.Open(path)
+		data, err = os.ReadFile(path)
 		if err != nil {
 			return nil, fmt.Errorf("cannot open blueprint file %q: %w", path, err)
 		}
-		defer fp.Close()
 	}
 
-	switch {
-	case path == "-", filepath.Ext(path) == ".json":
-		return decodeJson(fp, path)
-	case filepath.Ext(path) == ".toml":
-		return decodeToml(fp, path)
+	var format string
+	switch ext := filepath.Ext(path); {
+	case path == "-", ext == "":
+		format, err = detectFormat(data, path)
+		if err != nil {
+			return nil, err
+		}
+	case ext == ".json":
+		format = "json"
+	case ext == ".toml":
+		format = "toml"
+	case ext == ".yaml", ext == ".yml":
+		format = "yaml"
 	default:
-		return nil, fmt.Errorf("unsupported file extension for %q (please use .toml or .json)", path)
+		return nil, fmt.Errorf("unsupported file extension for %q (please use .toml, .json or .yaml)", path)
+	}
+
+	var bp *blueprint.Blueprint
+	switch format {
+	case "json":
+		bp, err = decodeJson(data, path)
+	case "toml":
+		bp, err = decodeToml(data, path)
+	default:
+		bp, err = decodeYaml(data, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if vars != nil {
+		if err := vars.substitute(bp, path); err != nil {
+			return nil, err
+		}
 	}
+	return bp, nil
 }
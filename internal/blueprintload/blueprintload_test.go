@@ -27,6 +27,12 @@ var testBlueprintTOML = `
 name = "alice"
 `
 
+var testBlueprintYAML = `
+customizations:
+  user:
+    - name: alice
+`
+
 var testBlueprintJSONunknownKeys = `
 {
   "birds": {"name": "robin"}
@@ -38,6 +44,13 @@ var testBlueprintTOMLunknownKeys = `
 name = "robin"
 `
 
+var testBlueprintYAMLunknownKeys = `
+customizations:
+  user:
+    - name: alice
+      nmae: bob
+`
+
 var expectedBlueprint = &blueprint.Blueprint{
 	Customizations: &blueprint.Customizations{
 		User: []blueprint.UserCustomization{
@@ -67,13 +80,23 @@ func TestBlueprintLoadJSON(t *testing.T) {
 		{"bp.json", testBlueprintJSON, expectedBlueprint, ""},
 		{"bp.toml", testBlueprintTOML, expectedBlueprint, ""},
 		{"bp.toml", "wrong-content", nil, `cannot decode ".*/bp.toml": toml: `},
-		{"bp.json", "wrong-content", nil, `cannot decode ".*/bp.json": invalid `},
-		{"bp", "wrong-content", nil, `unsupported file extension for "/.*/bp"`},
+		{"bp.json", "wrong-content", nil, `cannot decode ".*/bp.json": line 1, column 1: invalid `},
+		{"bp.txt", "wrong-content", nil, `unsupported file extension for "/.*/bp.txt" \(please use .toml, .json or .yaml\)`},
+		{"bp", "wrong-content", nil, `cannot detect the format of "/.*/bp" \(please use .toml, .json or .yaml\)`},
 		{"bp.toml", testBlueprintTOMLunknownKeys, nil, `cannot decode ".*/bp.toml": unknown keys found: \[birds birds.name\]`},
 		{"bp.json", testBlueprintJSONunknownKeys, nil, `cannot decode ".*/bp.json": json: unknown field "birds"`},
+		{"bp.yaml", testBlueprintYAML, expectedBlueprint, ""},
+		{"bp.yml", testBlueprintYAML, expectedBlueprint, ""},
+		{"bp.yaml", testBlueprintYAMLunknownKeys, nil, `cannot decode ".*/bp.yaml": line 5, column 7: unknown key "customizations.user\[0\].nmae"$`},
+		{"bp.yaml", "name: [", nil, `cannot decode ".*/bp.yaml": yaml: line 1: did not find expected node content`},
+		// the format of files without an extension is detected
+		{"bp", testBlueprintJSON, expectedBlueprint, ""},
+		{"bp", testBlueprintTOML, expectedBlueprint, ""},
+		{"bp", "# comment\n" + testBlueprintYAML, expectedBlueprint, ""},
+		{"bp", testBlueprintYAMLunknownKeys, nil, `cannot decode ".*/bp": line 5, column 7: unknown key`},
 	} {
 		blueprintPath := makeTestBlueprint(t, tc.fname, tc.content)
-		bp, err := blueprintload.Load(blueprintPath)
+		bp, err := blueprintload.Load(blueprintPath, nil)
 		if tc.expectedError == "" {
 			assert.NoError(t, err)
 			assert.Equal(t, tc.expectedBp, bp)
@@ -83,3 +106,270 @@ func TestBlueprintLoadJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestBlueprintLoadYAMLErrors(t *testing.T) {
+	for _, tc := range []struct {
+		content       string
+		expectedError string
+	}{
+		{"name: a\nname: b\n", `line 2, column 1: key "name" is already defined`},
+		{"packages: alice\n", `line 1, column 11: json: cannot unmarshal string into Go struct field Blueprint.packages of type \[\]blueprint.Package`},
+		{"name: a\n---\nname: b\n", `multiple configuration objects or extra data found in ".*/bp.yaml"`},
+		{"customizations:\n  hostname: [a]\n", `line 2, column 13: json: cannot unmarshal array into Go struct field Blueprint.customizations.hostname of type string`},
+	} {
+		blueprintPath := makeTestBlueprint(t, "bp.yaml", tc.content)
+		_, err := blueprintload.Load(blueprintPath, nil)
+		assert.Error(t, err)
+		assert.Regexp(t, tc.expectedError, err.Error())
+	}
+}
+
+func TestBlueprintLoadYAMLAnchorsAndStrings(t *testing.T) {
+	blueprintPath := makeTestBlueprint(t, "bp.yaml", `
+version: 1.0
+packages:
+  - &pkg
+    name: vim
+    version: "*"
+  - <<: *pkg
+    name: nano
+`)
+	bp, err := blueprintload.Load(blueprintPath, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &blueprint.Blueprint{
+		Version: "1.0",
+		Packages: []blueprint.Package{
+			{Name: "vim", Version: "*"},
+			{Name: "nano", Version: "*"},
+		},
+	}, bp)
+}
+
+func TestBlueprintLoadStdinDetectsFormat(t *testing.T) {
+	for _, content := range []string{testBlueprintJSON, testBlueprintTOML, testBlueprintYAML} {
+		stdinPath := makeTestBlueprint(t, "stdin", content)
+		f, err := os.Open(stdinPath)
+		assert.NoError(t, err)
+		defer f.Close()
+		oldStdin := os.Stdin
+		os.Stdin = f
+		defer func() { os.Stdin = oldStdin }()
+
+		bp, err := blueprintload.Load("-", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedBlueprint, bp)
+	}
+}
+
+func TestBlueprintLoadAllMerges(t *testing.T) {
+	base := makeTestBlueprint(t, "base.toml", `
+name = "base"
+version = "1.0.0"
+packages = [{ name = "vim" }, { name = "tmux", version = "*" }]
+
+[customizations]
+hostname = "base.example.com"
+
+[customizations.services]
+enabled = ["sshd"]
+
+[[customizations.user]]
+name = "alice"
+groups = ["wheel"]
+`)
+	overlay := makeTestBlueprint(t, "team.yaml", `
+version: 1.1.0
+packages:
+  - name: tmux
+    version: "*"
+  - name: nginx
+customizations:
+  services:
+    enabled: [nginx, sshd]
+  user:
+    - name: alice
+      groups: [wheel]
+    - name: bob
+  group:
+    - name: devs
+`)
+	bp, err := blueprintload.LoadAll([]string{base, overlay}, nil)
+	assert.NoError(t, err)
+	hostname := "base.example.com"
+	assert.Equal(t, &blueprint.Blueprint{
+		Name:    "base",
+		Version: "1.1.0",
+		Packages: []blueprint.Package{
+			{Name: "vim"},
+			{Name: "tmux", Version: "*"},
+			{Name: "nginx"},
+		},
+		Customizations: &blueprint.Customizations{
+			Hostname: &hostname,
+			Services: &blueprint.ServicesCustomization{
+				Enabled: []string{"sshd", "nginx"},
+			},
+			User: []blueprint.UserCustomization{
+				{Name: "alice", Groups: []string{"wheel"}},
+				{Name: "bob"},
+			},
+			Group: []blueprint.GroupCustomization{
+				{Name: "devs"},
+			},
+		},
+	}, bp)
+
+	// the layers are not modified
+	baseBp, err := blueprintload.Load(base, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sshd"}, baseBp.Customizations.Services.Enabled)
+}
+
+func TestBlueprintMergeOverridesPointers(t *testing.T) {
+	enabled, disabled := true, false
+	bp, err := blueprintload.Merge([]*blueprint.Blueprint{
+		{Customizations: &blueprint.Customizations{FIPS: &enabled}},
+		{Customizations: &blueprint.Customizations{FIPS: &disabled}},
+	}, []string{"a", "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, &disabled, bp.Customizations.FIPS)
+	assert.True(t, enabled)
+}
+
+func TestBlueprintLoadAllConflicts(t *testing.T) {
+	base := makeTestBlueprint(t, "base.json", `{"packages": [{"name": "vim", "version": "9.1"}], "customizations": {"user": [{"name": "alice", "uid": 1000}]}}`)
+
+	for _, tc := range []struct {
+		overlay       string
+		expectedError string
+	}{
+		{
+			`{"packages": [{"name": "vim", "version": "9.0"}]}`,
+			`cannot merge ".*/overlay.json": packages "vim" conflicts with an earlier blueprint`,
+		},
+		{
+			`{"customizations": {"user": [{"name": "alice", "uid": 1001}]}}`,
+			`cannot merge ".*/overlay.json": customizations.user "alice" conflicts with an earlier blueprint`,
+		},
+		{
+			`{"packages": [{"name": "vim"}], "birds": []}`,
+			`cannot decode ".*/overlay.json": json: unknown field "birds"`,
+		},
+	} {
+		overlay := makeTestBlueprint(t, "overlay.json", tc.overlay)
+		_, err := blueprintload.LoadAll([]string{base, overlay}, nil)
+		assert.Error(t, err)
+		assert.Regexp(t, tc.expectedError, err.Error())
+	}
+}
+
+func TestBlueprintLoadSubstitutesVars(t *testing.T) {
+	secretPath := makeTestBlueprint(t, "password", "s3cret\n")
+	varsPath := makeTestBlueprint(t, "prod.vars", `
+# production
+HOSTNAME=prod.example.com
+KEY="ssh-ed25519 AAAA"
+`)
+	t.Setenv("TEST_VIM_VERSION", "9.1")
+	blueprintPath := makeTestBlueprint(t, "bp.toml", `
+packages = [{ name = "vim", version = "${env:TEST_VIM_VERSION}" }]
+
+[customizations]
+hostname = "${HOSTNAME}"
+
+[[customizations.user]]
+name = "alice"
+key = "${KEY}"
+password = "${file:`+secretPath+`}"
+
+[[customizations.files]]
+path = "/etc/motd"
+data = "$${HOME} is not substituted, $HOME neither"
+`)
+
+	for _, tc := range []struct {
+		maskSecrets      bool
+		expectedPassword string
+	}{
+		{false, "s3cret"},
+		{true, blueprintload.SecretMask},
+	} {
+		vars := &blueprintload.Vars{MaskSecrets: tc.maskSecrets}
+		assert.NoError(t, vars.LoadFile(varsPath))
+		// later values override earlier ones
+		assert.NoError(t, vars.Set("KEY=ssh-ed25519 BBBB"))
+
+		bp, err := blueprintload.Load(blueprintPath, vars)
+		assert.NoError(t, err)
+		assert.Equal(t, []blueprint.Package{{Name: "vim", Version: "9.1"}}, bp.Packages)
+		assert.Equal(t, "prod.example.com", *bp.Customizations.Hostname)
+		assert.Equal(t, "ssh-ed25519 BBBB", *bp.Customizations.User[0].Key)
+		assert.Equal(t, tc.expectedPassword, *bp.Customizations.User[0].Password)
+		assert.Equal(t, "${HOME} is not substituted, $HOME neither", bp.Customizations.Files[0].Data)
+	}
+}
+
+func TestBlueprintLoadWithoutVars(t *testing.T) {
+	blueprintPath := makeTestBlueprint(t, "bp.toml", `
+[[customizations.files]]
+path = "/etc/profile.d/local.sh"
+data = "export PATH=${PATH}:/usr/local/sbin"
+`)
+	bp, err := blueprintload.Load(blueprintPath, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "export PATH=${PATH}:/usr/local/sbin", bp.Customizations.Files[0].Data)
+}
+
+func TestBlueprintLoadVarsOnlyInStringValues(t *testing.T) {
+	// the value must not be able to change the blueprint around it
+	value := "x\"\nname = \"injected\"\n# ${NAME}\n---\n\"}"
+	vars := &blueprintload.Vars{}
+	assert.NoError(t, vars.Set("VALUE="+value))
+
+	for _, tc := range []struct {
+		fname   string
+		content string
+	}{
+		{"bp.toml", `# ${UNDEFINED} in a comment is ignored
+[customizations]
+hostname = "${VALUE}"
+`},
+		{"bp.json", `{"customizations": {"hostname": "${VALUE}"}}`},
+		{"bp.yaml", `# ${UNDEFINED} in a comment is ignored
+customizations:
+  hostname: ${VALUE}
+`},
+	} {
+		t.Run(tc.fname, func(t *testing.T) {
+			bp, err := blueprintload.Load(makeTestBlueprint(t, tc.fname, tc.content), vars)
+			assert.NoError(t, err)
+			assert.Equal(t, "", bp.Name)
+			assert.Equal(t, value, *bp.Customizations.Hostname)
+		})
+	}
+}
+
+func TestBlueprintLoadVarsErrors(t *testing.T) {
+	blueprintPath := makeTestBlueprint(t, "bp.yaml", `
+name: ${NAME}
+version: ${env:TEST_UNDEFINED_VERSION}
+description: ${file:/nonexistent/secret}
+customizations:
+  hostname: ${host-name}
+  timezone:
+    timezone: ${TZ
+`)
+	_, err := blueprintload.Load(blueprintPath, &blueprintload.Vars{})
+	assert.EqualError(t, err, `cannot substitute the variables in "`+blueprintPath+`": `+
+		`name: undefined variable "NAME"; `+
+		`description: cannot read secret file: open /nonexistent/secret: no such file or directory; `+
+		`version: undefined environment variable "TEST_UNDEFINED_VERSION"; `+
+		`customizations.hostname: invalid variable reference "${host-name}"; `+
+		`customizations.timezone.timezone: unterminated variable reference "${TZ"`)
+
+	var vars blueprintload.Vars
+	assert.EqualError(t, vars.Set("NAME"), `cannot use blueprint variable "NAME", expected NAME=VALUE`)
+	assert.EqualError(t, vars.Set("MY-NAME=x"), `cannot use blueprint variable "MY-NAME=x": invalid variable name "MY-NAME"`)
+	varsPath := makeTestBlueprint(t, "bad.vars", "NAME=x\nHOSTNAME\n")
+	assert.EqualError(t, vars.LoadFile(varsPath), `cannot parse "`+varsPath+`": line 2: expected NAME=VALUE`)
+}
@@ -0,0 +1,198 @@
+package blueprintload
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/osbuild/blueprint/pkg/blueprint"
+)
+
+// identityFields are the (json) names of the fields that identify an
+// entry of a list, e.g. a package or user by its name or a file by its
+// path. Entries with the same identity must be equal in all layers.
+var identityFields = []string{"name", "path", "mountpoint", "id"}
+
+// LoadAll loads the blueprints at the given paths and merges them in
+// order, see Load and Merge
+func LoadAll(paths []string, vars *Vars) (*blueprint.Blueprint, error) {
+	switch len(paths) {
+	case 0:
+		return Load("", vars)
+	case 1:
+		return Load(paths[0], vars)
+	}
+
+	var bps []*blueprint.Blueprint
+	for _, path := range paths {
+		bp, err := Load(path, vars)
+		if err != nil {
+			return nil, err
+		}
+		bps = append(bps, bp)
+	}
+	return Merge(bps, paths)
+}
+
+// Merge deep-merges the blueprints in order into a new blueprint, the
+// names are used in errors. Lists (e.g. packages, users or groups) are
+// appended and de-duplicated. Values that are set in a later blueprint
+// override earlier ones, a value cannot be unset. Entries of lists
+// that have the same name (or path, mountpoint, id) but differ are a
+// conflict.
+func Merge(bps []*blueprint.Blueprint, names []string) (*blueprint.Blueprint, error) {
+	var merged blueprint.Blueprint
+	dst := reflect.ValueOf(&merged).Elem()
+	for i, bp := range bps {
+		if err := mergeValue(dst, reflect.ValueOf(bp).Elem(), ""); err != nil {
+			return nil, fmt.Errorf("cannot merge %q: %w", names[i], err)
+		}
+	}
+	return &merged, nil
+}
+
+func mergeValue(dst, src reflect.Value, path string) error {
+	switch src.Kind() {
+	case reflect.Pointer:
+		if src.IsNil() {
+			return nil
+		}
+		if elem := src.Type().Elem(); elem.Kind() != reflect.Struct || opaqueStruct(elem) {
+			// e.g. a *bool that is explicitly set to false
+			copied := reflect.New(elem)
+			copied.Elem().Set(src.Elem())
+			dst.Set(copied)
+			return nil
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.New(src.Type().Elem()))
+		}
+		return mergeValue(dst.Elem(), src.Elem(), path)
+	case reflect.Struct:
+		if opaqueStruct(src.Type()) {
+			break
+		}
+		t := src.Type()
+		for i := 0; i < t.NumField(); i++ {
+			fieldPath := path
+			if f := t.Field(i); !f.Anonymous || f.Tag.Get("json") != "" {
+				fieldPath = JoinPath(path, FieldName(f))
+			}
+			if err := mergeValue(dst.Field(i), src.Field(i), fieldPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice:
+		return mergeSlice(dst, src, path)
+	case reflect.Map:
+		if src.IsNil() {
+			return nil
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMap(src.Type()))
+		}
+		iter := src.MapRange()
+		for iter.Next() {
+			// map values cannot be modified in place
+			value := reflect.New(src.Type().Elem()).Elem()
+			if existing := dst.MapIndex(iter.Key()); existing.IsValid() {
+				value.Set(existing)
+			}
+			if err := mergeValue(value, iter.Value(), fmt.Sprintf("%s.%v", path, iter.Key())); err != nil {
+				return err
+			}
+			dst.SetMapIndex(iter.Key(), value)
+		}
+		return nil
+	}
+
+	if !src.IsZero() {
+		dst.Set(src)
+	}
+	return nil
+}
+
+// mergeSlice appends the entries of src that are not in dst yet
+func mergeSlice(dst, src reflect.Value, path string) error {
+	for i := 0; i < src.Len(); i++ {
+		entry := src.Index(i)
+		id, hasID := entryIdentity(entry)
+		found := false
+		for j := 0; j < dst.Len(); j++ {
+			existing := dst.Index(j)
+			if reflect.DeepEqual(existing.Interface(), entry.Interface()) {
+				found = true
+				break
+			}
+			if otherID, ok := entryIdentity(existing); hasID && ok && otherID == id {
+				return fmt.Errorf("%s %q conflicts with an earlier blueprint", path, id)
+			}
+		}
+		if found {
+			continue
+		}
+		// copy the entry so that merging later layers does not modify
+		// the blueprint it came from
+		copied := reflect.New(entry.Type()).Elem()
+		if err := mergeValue(copied, entry, path); err != nil {
+			return err
+		}
+		dst.Set(reflect.Append(dst, copied))
+	}
+	return nil
+}
+
+// entryIdentity returns the value of the identity field of a list
+// entry, if it has one
+func entryIdentity(v reflect.Value) (string, bool) {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return "", false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct || opaqueStruct(v.Type()) {
+		return "", false
+	}
+	for _, name := range identityFields {
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if FieldName(f) == name && f.Type.Kind() == reflect.String && v.Field(i).String() != "" {
+				return v.Field(i).String(), true
+			}
+		}
+	}
+	return "", false
+}
+
+// opaqueStruct returns true for structs that are merged as a whole
+// because their fields cannot be set one by one
+func opaqueStruct(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if !t.Field(i).IsExported() {
+			return true
+		}
+	}
+	return false
+}
+
+// FieldName returns the key of the given blueprint field in a
+// blueprint file, this is the json name (or the go name of fields
+// without one)
+func FieldName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return f.Name
+	}
+	return name
+}
+
+// JoinPath appends the given key to the key path of a blueprint
+// option, e.g. "customizations" and "user" to "customizations.user"
+func JoinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,224 @@
+package blueprintload
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/osbuild/blueprint/pkg/blueprint"
+)
+
+// SecretMask replaces the content of secret files when the secrets
+// are masked
+const SecretMask = "********"
+
+// Vars are the variables that are substituted in the string values of
+// the decoded blueprints, references in comments, keys or other values
+// are left alone:
+//
+//	${NAME}       a variable from Values (e.g. set via --blueprint-var)
+//	${env:NAME}   an environment variable
+//	${file:PATH}  the content of a (secret) file without the trailing newline
+//	$${           a literal "${"
+//
+// The values are not escaped or parsed, a value with quotes or
+// newlines (e.g. a PEM key) ends up in the string as it is. Every
+// reference must be defined, an undefined variable is an error.
+type Vars struct {
+	Values map[string]string
+
+	// MaskSecrets replaces the content of the files with SecretMask,
+	// e.g. to show a rendered blueprint
+	MaskSecrets bool
+}
+
+var (
+	varNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	varRefRe  = regexp.MustCompile(`\$\$\{|\$\{([^}\n]*)(\}?)`)
+)
+
+func (v *Vars) setValue(name, value string) error {
+	if !varNameRe.MatchString(name) {
+		return fmt.Errorf("invalid variable name %q", name)
+	}
+	if v.Values == nil {
+		v.Values = make(map[string]string)
+	}
+	v.Values[name] = value
+	return nil
+}
+
+// Set sets a variable from a NAME=VALUE assignment
+func (v *Vars) Set(assignment string) error {
+	name, value, ok := strings.Cut(assignment, "=")
+	if !ok {
+		return fmt.Errorf("cannot use blueprint variable %q, expected NAME=VALUE", assignment)
+	}
+	if err := v.setValue(name, value); err != nil {
+		return fmt.Errorf("cannot use blueprint variable %q: %w", assignment, err)
+	}
+	return nil
+}
+
+// LoadFile sets the variables from a file with NAME=VALUE lines, empty
+// lines and lines starting with "#" are ignored. Quotes around the
+// value are removed.
+func (v *Vars) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot open blueprint variables file %q: %w", path, err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("cannot parse %q: line %d: expected NAME=VALUE", path, lineNo)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if err := v.setValue(strings.TrimSpace(name), value); err != nil {
+			return fmt.Errorf("cannot parse %q: line %d: %w", path, lineNo, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// resolve returns the value of a reference (the part between "${"
+// and "}")
+func (v *Vars) resolve(ref string) (string, error) {
+	switch kind, arg, _ := strings.Cut(ref, ":"); {
+	case kind == "env" && varNameRe.MatchString(arg):
+		value, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", fmt.Errorf("undefined environment variable %q", arg)
+		}
+		return value, nil
+	case kind == "file" && arg != "":
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			return "", fmt.Errorf("cannot read secret file: %w", err)
+		}
+		if v.MaskSecrets {
+			return SecretMask, nil
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case varNameRe.MatchString(ref):
+		value, ok := v.Values[ref]
+		if !ok {
+			return "", fmt.Errorf("undefined variable %q", ref)
+		}
+		return value, nil
+	default:
+		return "", fmt.Errorf("invalid variable reference %q", "${"+ref+"}")
+	}
+}
+
+// substituteString replaces the variable references in a single
+// string, the problems are returned instead of an error so that all of
+// them can be reported at once
+func (v *Vars) substituteString(s string) (string, []string) {
+	var out strings.Builder
+	var problems []string
+	last := 0
+	for _, m := range varRefRe.FindAllStringSubmatchIndex(s, -1) {
+		out.WriteString(s[last:m[0]])
+		last = m[1]
+
+		match := s[m[0]:m[1]]
+		if match == "$${" {
+			out.WriteString("${")
+			continue
+		}
+		if m[4] == m[5] {
+			problems = append(problems, fmt.Sprintf("unterminated variable reference %q", match))
+			continue
+		}
+		value, err := v.resolve(s[m[2]:m[3]])
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		out.WriteString(value)
+	}
+	out.WriteString(s[last:])
+	return out.String(), problems
+}
+
+// substituteValue replaces the variable references in all strings of
+// the given value, path is the key path of the value in the blueprint
+// (e.g. "customizations.user[0].key") for the problems
+func (v *Vars) substituteValue(val reflect.Value, path string, problems *[]string) {
+	switch val.Kind() {
+	case reflect.String:
+		s, stringProblems := v.substituteString(val.String())
+		for _, problem := range stringProblems {
+			*problems = append(*problems, fmt.Sprintf("%s: %s", path, problem))
+		}
+		val.SetString(s)
+	case reflect.Pointer:
+		if !val.IsNil() {
+			v.substituteValue(val.Elem(), path, problems)
+		}
+	case reflect.Interface:
+		if val.IsNil() {
+			return
+		}
+		// the value of an interface cannot be changed in place
+		elem := reflect.New(val.Elem().Type()).Elem()
+		elem.Set(val.Elem())
+		v.substituteValue(elem, path, problems)
+		val.Set(elem)
+	case reflect.Struct:
+		t := val.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			switch {
+			case !f.IsExported():
+				continue
+			case f.Anonymous:
+				v.substituteValue(val.Field(i), path, problems)
+			default:
+				v.substituteValue(val.Field(i), JoinPath(path, FieldName(f)), problems)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < val.Len(); i++ {
+			v.substituteValue(val.Index(i), fmt.Sprintf("%s[%d]", path, i), problems)
+		}
+	case reflect.Map:
+		keys := val.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int {
+			return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+		})
+		for _, key := range keys {
+			// like for interfaces the value is changed in a copy
+			elem := reflect.New(val.Type().Elem()).Elem()
+			elem.Set(val.MapIndex(key))
+			v.substituteValue(elem, JoinPath(path, fmt.Sprint(key)), problems)
+			val.SetMapIndex(key, elem)
+		}
+	}
+}
+
+// substitute replaces the variable references in the string values of
+// the decoded blueprint, all problems are reported at once
+func (v *Vars) substitute(bp *blueprint.Blueprint, what string) error {
+	var problems []string
+	v.substituteValue(reflect.ValueOf(bp).Elem(), "", &problems)
+	if len(problems) > 0 {
+		return fmt.Errorf("cannot substitute the variables in %q: %s", what, strings.Join(problems, "; "))
+	}
+	return nil
+}
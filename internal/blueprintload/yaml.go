@@ -0,0 +1,284 @@
+package blueprintload
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+
+	"github.com/osbuild/blueprint/pkg/blueprint"
+)
+
+// decodeYaml decodes a YAML blueprint. The blueprint types only know
+// json and toml, so the YAML is converted to json and decoded like a
+// json blueprint. The conversion checks the keys against the blueprint
+// types to report unknown keys with their position.
+func decodeYaml(data []byte, what string) (*blueprint.Blueprint, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	var doc yaml.Node
+	if err := dec.Decode(&doc); err != nil {
+		if err == io.EOF {
+			return &blueprint.Blueprint{}, nil
+		}
+		return nil, fmt.Errorf("cannot decode %q: %w", what, err)
+	}
+	var extra yaml.Node
+	if err := dec.Decode(&extra); err != io.EOF {
+		return nil, fmt.Errorf("multiple configuration objects or extra data found in %q", what)
+	}
+
+	conv := &yamlConverter{}
+	if err := conv.convert(&doc, reflect.TypeOf(blueprint.Blueprint{}), ""); err != nil {
+		return nil, fmt.Errorf("cannot decode %q: %w", what, err)
+	}
+
+	jsonDec := json.NewDecoder(bytes.NewReader(conv.buf.Bytes()))
+	jsonDec.DisallowUnknownFields()
+	var conf blueprint.Blueprint
+	if err := jsonDec.Decode(&conf); err != nil {
+		if offset, ok := jsonErrorOffset(err); ok {
+			if node := conv.nodeBefore(offset); node != nil {
+				err = fmt.Errorf("line %d, column %d: %w", node.Line, node.Column, err)
+			}
+		}
+		return nil, fmt.Errorf("cannot decode %q: %w", what, err)
+	}
+	return &conf, nil
+}
+
+// yamlPosition is the YAML node of the json value that starts at the
+// given offset
+type yamlPosition struct {
+	offset int64
+	node   *yaml.Node
+}
+
+// yamlConverter writes the json for a YAML node tree
+type yamlConverter struct {
+	buf       bytes.Buffer
+	positions []yamlPosition
+}
+
+// nodeBefore returns the node of the last json value that starts
+// before the given offset
+func (c *yamlConverter) nodeBefore(offset int64) *yaml.Node {
+	i := sort.Search(len(c.positions), func(i int) bool {
+		return c.positions[i].offset >= offset
+	})
+	if i == 0 {
+		return nil
+	}
+	return c.positions[i-1].node
+}
+
+func yamlErrorf(node *yaml.Node, format string, a ...any) error {
+	return fmt.Errorf("line %d, column %d: %s", node.Line, node.Column, fmt.Sprintf(format, a...))
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// targetType returns the type to check the node against, types that
+// decode themselves are not checked (nil)
+func targetType(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() == reflect.Interface || reflect.PointerTo(t).Implements(jsonUnmarshalerType) {
+		return nil
+	}
+	return t
+}
+
+// convert writes the json for the node, t is the type that the json
+// will be decoded into (or nil) and path the key path for errors
+func (c *yamlConverter) convert(node *yaml.Node, t reflect.Type, path string) error {
+	t = targetType(t)
+	switch node.Kind {
+	case yaml.DocumentNode:
+		return c.convert(node.Content[0], t, path)
+	case yaml.AliasNode:
+		return c.convert(node.Alias, t, path)
+	}
+
+	c.positions = append(c.positions, yamlPosition{offset: int64(c.buf.Len()), node: node})
+	switch node.Kind {
+	case yaml.MappingNode:
+		return c.convertMapping(node, t, path)
+	case yaml.SequenceNode:
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		c.buf.WriteByte('[')
+		for i, item := range node.Content {
+			if i > 0 {
+				c.buf.WriteByte(',')
+			}
+			if err := c.convert(item, elem, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		c.buf.WriteByte(']')
+		return nil
+	default:
+		return c.convertScalar(node, t)
+	}
+}
+
+func (c *yamlConverter) convertScalar(node *yaml.Node, t reflect.Type) error {
+	var v any
+	switch {
+	case node.ShortTag() == "!!null":
+		v = nil
+	case node.ShortTag() == "!!str", node.ShortTag() == "!!timestamp", node.ShortTag() == "!!binary":
+		v = node.Value
+	case t != nil && (t.Kind() == reflect.String || reflect.PointerTo(t).Implements(textUnmarshalerType)):
+		// like the YAML decoder a string can be written without
+		// quotes even if it looks like a number (e.g. version: 1.0)
+		v = node.Value
+	default:
+		if err := node.Decode(&v); err != nil {
+			return yamlErrorf(node, "%v", err)
+		}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return yamlErrorf(node, "unsupported value %q", node.Value)
+	}
+	c.buf.Write(b)
+	return nil
+}
+
+// mappingPairs returns the key and value nodes of a mapping, the keys
+// merged with "<<" are only used if the mapping does not set them
+func mappingPairs(node *yaml.Node) ([][2]*yaml.Node, error) {
+	var pairs, merged [][2]*yaml.Node
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Kind != yaml.ScalarNode {
+			return nil, yamlErrorf(key, "keys must be strings")
+		}
+		if key.ShortTag() != "!!merge" {
+			pairs = append(pairs, [2]*yaml.Node{key, value})
+			continue
+		}
+		sources := []*yaml.Node{value}
+		if value.Kind == yaml.SequenceNode {
+			sources = value.Content
+		}
+		for _, src := range sources {
+			if src.Kind == yaml.AliasNode {
+				src = src.Alias
+			}
+			if src.Kind != yaml.MappingNode {
+				return nil, yamlErrorf(src, "only mappings can be merged")
+			}
+			srcPairs, err := mappingPairs(src)
+			if err != nil {
+				return nil, err
+			}
+			merged = append(merged, srcPairs...)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, pair := range pairs {
+		if seen[pair[0].Value] {
+			return nil, yamlErrorf(pair[0], "key %q is already defined", pair[0].Value)
+		}
+		seen[pair[0].Value] = true
+	}
+	for _, pair := range merged {
+		if !seen[pair[0].Value] {
+			pairs = append(pairs, pair)
+			seen[pair[0].Value] = true
+		}
+	}
+	return pairs, nil
+}
+
+func (c *yamlConverter) convertMapping(node *yaml.Node, t reflect.Type, path string) error {
+	pairs, err := mappingPairs(node)
+	if err != nil {
+		return err
+	}
+
+	var fields map[string]reflect.Type
+	if t != nil && t.Kind() == reflect.Struct {
+		fields = jsonFields(t)
+	}
+	c.buf.WriteByte('{')
+	for i, pair := range pairs {
+		key, value := pair[0], pair[1]
+		keyPath := key.Value
+		if path != "" {
+			keyPath = path + "." + key.Value
+		}
+
+		var valueType reflect.Type
+		switch {
+		case fields != nil:
+			ft, ok := fields[strings.ToLower(key.Value)]
+			if !ok {
+				return yamlErrorf(key, "unknown key %q", keyPath)
+			}
+			valueType = ft
+		case t != nil && t.Kind() == reflect.Map:
+			valueType = t.Elem()
+		}
+
+		if i > 0 {
+			c.buf.WriteByte(',')
+		}
+		b, err := json.Marshal(key.Value)
+		if err != nil {
+			return yamlErrorf(key, "unsupported key %q", key.Value)
+		}
+		c.buf.Write(b)
+		c.buf.WriteByte(':')
+		if err := c.convert(value, valueType, keyPath); err != nil {
+			return err
+		}
+	}
+	c.buf.WriteByte('}')
+	return nil
+}
+
+// jsonFields returns the types of the fields of a struct by their
+// (lower case) json name, json matches the names case-insensitively
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			if et := targetType(f.Type); et != nil && et.Kind() == reflect.Struct {
+				for k, v := range jsonFields(et) {
+					fields[k] = v
+				}
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+	return fields
+}
@@ -16,6 +16,13 @@ import (
 	"github.com/osbuild/images/pkg/osbuild"
 )
 
+// DefaultCacheMaxSize is the maximum size of the osbuild store that
+// is used if OSBuildOptions.CacheMaxSize is unset
+const DefaultCacheMaxSize = int64(20 * datasizes.GiB)
+
+// CacheMaxSizeUnlimited disables the size limit of the osbuild store
+const CacheMaxSizeUnlimited = int64(-1)
+
 type OSBuildOptions struct {
 	StoreDir  string
 	OutputDir string
@@ -44,7 +51,7 @@ func RunOSBuild(pb ProgressBar, manifest []byte, exports []string, opts *OSBuild
 	// checked with them we can remove the runOSBuildNoProgress() and
 	// just run with the new runOSBuildWithProgress() helper.
 	switch pb.(type) {
-	case *terminalProgressBar, *debugProgressBar:
+	case *terminalProgressBar, *debugProgressBar, *jsonProgressBar:
 		return runOSBuildWithProgress(pb, manifest, exports, opts)
 	default:
 		return runOSBuildNoProgress(pb, manifest, exports, opts)
@@ -52,9 +59,12 @@ func RunOSBuild(pb ProgressBar, manifest []byte, exports []string, opts *OSBuild
 }
 
 func newOsbuildCmd(manifest []byte, exports []string, opts *OSBuildOptions) *exec.Cmd {
-	cacheMaxSize := int64(20 * datasizes.GiB)
-	if opts.CacheMaxSize != 0 {
-		cacheMaxSize = opts.CacheMaxSize
+	cacheMaxSize := fmt.Sprintf("%v", DefaultCacheMaxSize)
+	switch {
+	case opts.CacheMaxSize == CacheMaxSizeUnlimited:
+		cacheMaxSize = "unlimited"
+	case opts.CacheMaxSize != 0:
+		cacheMaxSize = fmt.Sprintf("%v", opts.CacheMaxSize)
 	}
 	cmd := exec.Command(
 		osbuildCmd,
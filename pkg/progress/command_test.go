@@ -46,6 +46,29 @@ osbuild-stderr-output
 `)
 }
 
+func TestRunOSBuildWithJSONProgress(t *testing.T) {
+	var stdout bytes.Buffer
+	restore := progress.MockOsStdout(&stdout)
+	defer restore()
+
+	restore = progress.MockOsbuildCmd(makeFakeOsbuild(t, `
+>&3 echo '{"message": "osbuild-stage-message", "context": {"origin": "osbuild.monitor", "id": "1", "pipeline": {"name": "build"}}, "progress": {"total": 2, "done": 1}}'
+
+echo osbuild-stdout-output
+`))
+	defer restore()
+
+	var progressOut bytes.Buffer
+	pbar, err := progress.NewJSONProgressBar(&progressOut)
+	assert.NoError(t, err)
+	err = progress.RunOSBuild(pbar, []byte(`{"fake":"manifest"}`), nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "\x1e{\"type\":\"progress\",\"level\":0,\"message\":\"Pipeline build\",\"done\":1,\"total\":2}\n"+
+		"\x1e{\"type\":\"message\",\"message\":\"osbuild-stage-message\"}\n", progressOut.String())
+	// the raw osbuild output is not mixed into the json stream
+	assert.Equal(t, "", stdout.String())
+}
+
 func TestRunOSBuildWithProgressIncorrectJSON(t *testing.T) {
 	signalDeliveredMarkerPath := filepath.Join(t.TempDir(), "sigint-delivered")
 
@@ -144,19 +167,30 @@ osbuild-stderr-output
 }
 
 func TestRunOSBuildCacheMaxSize(t *testing.T) {
-	fakeOsbuildBinary := makeFakeOsbuild(t, `echo "$@" > "$0".cmdline`)
-	restore := progress.MockOsbuildCmd(fakeOsbuildBinary)
-	defer restore()
-
-	pbar, err := progress.New("debug")
-	assert.NoError(t, err)
-
-	osbuildOpts := &progress.OSBuildOptions{
-		CacheMaxSize: 77,
+	for _, tc := range []struct {
+		cacheMaxSize int64
+		expected     string
+	}{
+		{0, "--cache-max-size=21474836480"},
+		{77, "--cache-max-size=77"},
+		{progress.CacheMaxSizeUnlimited, "--cache-max-size=unlimited"},
+	} {
+		t.Run(tc.expected, func(t *testing.T) {
+			fakeOsbuildBinary := makeFakeOsbuild(t, `echo "$@" > "$0".cmdline`)
+			restore := progress.MockOsbuildCmd(fakeOsbuildBinary)
+			defer restore()
+
+			pbar, err := progress.New("debug")
+			assert.NoError(t, err)
+
+			osbuildOpts := &progress.OSBuildOptions{
+				CacheMaxSize: tc.cacheMaxSize,
+			}
+			err = progress.RunOSBuild(pbar, []byte(`{"fake":"manifest"}`), nil, osbuildOpts)
+			assert.NoError(t, err)
+			cmdline, err := os.ReadFile(fakeOsbuildBinary + ".cmdline")
+			assert.NoError(t, err)
+			assert.Contains(t, string(cmdline), tc.expected)
+		})
 	}
-	err = progress.RunOSBuild(pbar, []byte(`{"fake":"manifest"}`), nil, osbuildOpts)
-	assert.NoError(t, err)
-	cmdline, err := os.ReadFile(fakeOsbuildBinary + ".cmdline")
-	assert.NoError(t, err)
-	assert.Contains(t, string(cmdline), "--cache-max-size=77")
 }
@@ -2,6 +2,7 @@ package progress
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -98,6 +99,8 @@ func New(typ string) (ProgressBar, error) {
 		return NewTerminalProgressBar()
 	case "debug":
 		return NewDebugProgressBar()
+	case "json":
+		return NewJSONProgressBar(nil)
 	default:
 		return nil, fmt.Errorf("unknown progress type: %q", typ)
 	}
@@ -347,3 +350,87 @@ func (b *debugProgressBar) SetProgress(subLevel int, msg string, done int, total
 	fmt.Fprintf(b.w, "\n")
 	return nil
 }
+
+// UploadProgressReporter is implemented by progress bars that can
+// report the number of bytes uploaded
+type UploadProgressReporter interface {
+	SetUploadProgress(done uint64, total uint64)
+}
+
+// JSON progress record types, see doc/01-usage.md
+type jsonMessageRecord struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type jsonProgressRecord struct {
+	Type    string `json:"type"`
+	Level   int    `json:"level"`
+	Message string `json:"message"`
+	Done    int    `json:"done"`
+	Total   int    `json:"total"`
+}
+
+type jsonUploadRecord struct {
+	Type  string `json:"type"`
+	Done  uint64 `json:"done"`
+	Total uint64 `json:"total"`
+}
+
+type jsonProgressBar struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// NewJSONProgressBar creates a progressbar aimed at higher level tools
+// (like "podman bootc"). It writes all progress information as
+// RFC7464 JSON text sequences to the given writer (or stdout if the
+// writer is nil).
+func NewJSONProgressBar(w io.Writer) (ProgressBar, error) {
+	if w == nil {
+		w = osStdout()
+	}
+	b := &jsonProgressBar{w: w}
+	return b, nil
+}
+
+func (b *jsonProgressBar) writeRecord(rec any) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		// this can only happen on programming errors
+		log.Printf("WARNING: cannot marshal json progress: %v", err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Fprintf(b.w, "\x1e%s\n", data)
+}
+
+func (b *jsonProgressBar) SetPulseMsgf(msg string, args ...any) {
+	b.writeRecord(&jsonMessageRecord{Type: "pulse", Message: fmt.Sprintf(msg, args...)})
+}
+
+func (b *jsonProgressBar) SetMessagef(msg string, args ...any) {
+	b.writeRecord(&jsonMessageRecord{Type: "message", Message: fmt.Sprintf(msg, args...)})
+}
+
+func (b *jsonProgressBar) Start() {
+}
+
+func (b *jsonProgressBar) Write(p []byte) (n int, err error) {
+	b.writeRecord(&jsonMessageRecord{Type: "log", Message: string(p)})
+	return len(p), nil
+}
+
+func (b *jsonProgressBar) Stop() {
+}
+
+func (b *jsonProgressBar) SetProgress(subLevel int, msg string, done int, total int) error {
+	b.writeRecord(&jsonProgressRecord{Type: "progress", Level: subLevel, Message: msg, Done: done, Total: total})
+	return nil
+}
+
+func (b *jsonProgressBar) SetUploadProgress(done uint64, total uint64) {
+	b.writeRecord(&jsonUploadRecord{Type: "upload", Done: done, Total: total})
+}
@@ -20,6 +20,7 @@ func TestProgressNew(t *testing.T) {
 		{"term", &progress.TerminalProgressBar{}, ""},
 		{"debug", &progress.DebugProgressBar{}, ""},
 		{"verbose", &progress.VerboseProgressBar{}, ""},
+		{"json", &progress.JSONProgressBar{}, ""},
 		// unknown progress type
 		{"bad", nil, `unknown progress type: "bad"`},
 	} {
@@ -101,6 +102,51 @@ func TestDebugProgress(t *testing.T) {
 	buf.Reset()
 }
 
+func TestJSONProgress(t *testing.T) {
+	var buf bytes.Buffer
+
+	pbar, err := progress.NewJSONProgressBar(&buf)
+	assert.NoError(t, err)
+
+	pbar.Start()
+	assert.Equal(t, "", buf.String())
+
+	pbar.SetPulseMsgf("pulse-%s", "msg")
+	assert.Equal(t, "\x1e{\"type\":\"pulse\",\"message\":\"pulse-msg\"}\n", buf.String())
+	buf.Reset()
+
+	pbar.SetMessagef("some-message")
+	assert.Equal(t, "\x1e{\"type\":\"message\",\"message\":\"some-message\"}\n", buf.String())
+	buf.Reset()
+
+	err = pbar.SetProgress(1, "set-progress-msg", 0, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "\x1e{\"type\":\"progress\",\"level\":1,\"message\":\"set-progress-msg\",\"done\":0,\"total\":5}\n", buf.String())
+	buf.Reset()
+
+	pbar.(progress.UploadProgressReporter).SetUploadProgress(1024, 4096)
+	assert.Equal(t, "\x1e{\"type\":\"upload\",\"done\":1024,\"total\":4096}\n", buf.String())
+	buf.Reset()
+
+	pbar.Stop()
+	assert.Equal(t, "", buf.String())
+
+	_, err = pbar.Write([]byte("output\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "\x1e{\"type\":\"log\",\"message\":\"output\\n\"}\n", buf.String())
+}
+
+func TestJSONProgressDefaultsToStdout(t *testing.T) {
+	var buf bytes.Buffer
+	restore := progress.MockOsStdout(&buf)
+	defer restore()
+
+	pbar, err := progress.New("json")
+	assert.NoError(t, err)
+	pbar.SetMessagef("some-message")
+	assert.Equal(t, "\x1e{\"type\":\"message\",\"message\":\"some-message\"}\n", buf.String())
+}
+
 func TestTermProgress(t *testing.T) {
 	var buf bytes.Buffer
 	restore := progress.MockOsStderr(&buf)
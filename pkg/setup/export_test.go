@@ -1,3 +1,17 @@
 package setup
 
-var ValidateCanRunTargetArch = validateCanRunTargetArch
+func MockBinfmtMiscDir(dir string) (restore func()) {
+	saved := binfmtMiscDir
+	binfmtMiscDir = dir
+	return func() {
+		binfmtMiscDir = saved
+	}
+}
+
+func MockLoopControlPath(p string) (restore func()) {
+	saved := loopControlPath
+	loopControlPath = p
+	return func() {
+		loopControlPath = saved
+	}
+}
@@ -102,7 +102,7 @@ func Validate(targetArch string, inVm bool) error {
 	}
 
 	// Try to run the cross arch binary
-	if err := validateCanRunTargetArch(targetArch); err != nil {
+	if err := ValidateCanRunTargetArch(targetArch); err != nil {
 		return fmt.Errorf("cannot run binary in target arch: %w", err)
 	}
 
@@ -127,7 +127,9 @@ func ValidateHasContainerStorageMounted() error {
 	return nil
 }
 
-func validateCanRunTargetArch(targetArch string) error {
+// ValidateCanRunTargetArch checks that binaries of the given target
+// architecture (in GOARCH notation) can be run
+func ValidateCanRunTargetArch(targetArch string) error {
 	if targetArch == runtime.GOARCH || targetArch == "" {
 		return nil
 	}
@@ -151,6 +153,73 @@ func validateCanRunTargetArch(targetArch string) error {
 	return nil
 }
 
+var binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+
+// ValidateHasQemuUser checks that a qemu-user binfmt handler is
+// registered for the given (foreign) architecture, e.g. "aarch64"
+func ValidateHasQemuUser(targetArch string) error {
+	p := filepath.Join(binfmtMiscDir, "qemu-"+targetArch)
+	if _, err := os.Stat(p); err != nil {
+		return fmt.Errorf("cannot find binfmt handler %q, do you have 'qemu-user-static' installed?", p)
+	}
+	return nil
+}
+
+var loopControlPath = "/dev/loop-control"
+
+// ValidateHasLoopDevices checks that loop devices can be allocated,
+// they are needed to build disk images
+func ValidateHasLoopDevices() error {
+	if _, err := os.Stat(loopControlPath); err != nil {
+		return fmt.Errorf("cannot find loop devices: %w", err)
+	}
+	return nil
+}
+
+// ValidateStoreWritable checks that the osbuild store can be written
+// (or created), the store itself is not modified.
+func ValidateStoreWritable(storePath string) error {
+	p := storePath
+	for {
+		if _, err := os.Stat(p); err == nil {
+			break
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			break
+		}
+		p = parent
+	}
+	if err := unix.Access(p, unix.W_OK); err != nil {
+		return fmt.Errorf("cannot write to %q: %w", p, err)
+	}
+	return nil
+}
+
+var selinuxEnforceFile = "/sys/fs/selinux/enforce"
+
+// SELinuxEnforcing returns true if SELinux is in enforcing mode
+func SELinuxEnforcing() bool {
+	b, err := os.ReadFile(selinuxEnforceFile)
+	return err == nil && strings.TrimSpace(string(b)) == "1"
+}
+
+// ValidateOsbuildSELinuxLabel checks that osbuild is labeled so that
+// it can transition to install_t, without this it cannot set SELinux
+// labels in the image that are unknown to the host.
+func ValidateOsbuildSELinuxLabel(osbuildPath string) error {
+	buf := make([]byte, 256)
+	n, err := unix.Getxattr(osbuildPath, "security.selinux", buf)
+	if err != nil {
+		return fmt.Errorf("cannot read SELinux label of %q: %w", osbuildPath, err)
+	}
+	label := strings.TrimRight(string(buf[:n]), "\x00")
+	if !strings.Contains(label, ":osbuild_exec_t:") && !strings.Contains(label, ":install_exec_t:") {
+		return fmt.Errorf("%s has the SELinux label %q instead of osbuild_exec_t", osbuildPath, label)
+	}
+	return nil
+}
+
 func ValidateHasContainerTags(imgref string) error {
 	extraOpts := []string{}
 	if isRootless, _ := podmanutil.IsRootless(); isRootless {
@@ -115,3 +115,43 @@ echo '%s'
 		}
 	}
 }
+
+func TestValidateHasQemuUser(t *testing.T) {
+	binfmtDir := t.TempDir()
+	restore := setup.MockBinfmtMiscDir(binfmtDir)
+	defer restore()
+
+	err := setup.ValidateHasQemuUser("aarch64")
+	assert.EqualError(t, err, fmt.Sprintf(`cannot find binfmt handler "%s/qemu-aarch64", do you have 'qemu-user-static' installed?`, binfmtDir))
+
+	err = os.WriteFile(filepath.Join(binfmtDir, "qemu-aarch64"), []byte("enabled\n"), 0644)
+	assert.NoError(t, err)
+	assert.NoError(t, setup.ValidateHasQemuUser("aarch64"))
+}
+
+func TestValidateHasLoopDevices(t *testing.T) {
+	loopControl := filepath.Join(t.TempDir(), "loop-control")
+	restore := setup.MockLoopControlPath(loopControl)
+	defer restore()
+
+	err := setup.ValidateHasLoopDevices()
+	assert.ErrorContains(t, err, "cannot find loop devices: ")
+
+	assert.NoError(t, os.WriteFile(loopControl, nil, 0644))
+	assert.NoError(t, setup.ValidateHasLoopDevices())
+}
+
+func TestValidateStoreWritable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write everywhere")
+	}
+	tmpdir := t.TempDir()
+
+	// a store that does not exist yet is created in the parent
+	assert.NoError(t, setup.ValidateStoreWritable(filepath.Join(tmpdir, "not/yet/there")))
+
+	readOnly := filepath.Join(tmpdir, "ro")
+	assert.NoError(t, os.Mkdir(readOnly, 0555))
+	err := setup.ValidateStoreWritable(filepath.Join(readOnly, "store"))
+	assert.EqualError(t, err, fmt.Sprintf(`cannot write to %q: permission denied`, readOnly))
+}